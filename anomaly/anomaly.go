@@ -0,0 +1,324 @@
+package anomaly
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+)
+
+type Method string
+
+const (
+	MethodZScore   Method = "zscore"
+	MethodEWMA     Method = "ewma"
+	MethodSeasonal Method = "seasonal"
+)
+
+type Config struct {
+	WindowSize        int
+	MinSamples        int
+	ZScoreThreshold   float64
+	EWMALambda        float64
+	EWMALimit         float64
+	SeasonalPeriod    time.Duration
+	SeasonalBuckets   int
+	SeasonalThreshold float64
+}
+
+func NewConfig(envVars *config.EnvVars) Config {
+	return Config{
+		WindowSize:        envVars.Anomaly.WindowSize,
+		MinSamples:        envVars.Anomaly.MinSamples,
+		ZScoreThreshold:   envVars.Anomaly.ZScoreThreshold,
+		EWMALambda:        envVars.Anomaly.EWMALambda,
+		EWMALimit:         envVars.Anomaly.EWMALimit,
+		SeasonalPeriod:    envVars.Anomaly.SeasonalPeriod,
+		SeasonalBuckets:   envVars.Anomaly.SeasonalBuckets,
+		SeasonalThreshold: envVars.Anomaly.SeasonalThreshold,
+	}
+}
+
+type Anomaly struct {
+	Method    Method
+	Timestamp time.Time
+	Value     float64
+	Expected  float64
+	Lower     float64
+	Upper     float64
+	Score     float64
+}
+
+// SeriesKey identifies a measurement series the same way it's tagged in InfluxDB.
+type SeriesKey struct {
+	SensorID    string
+	Measurement string
+	Unit        string
+}
+
+// runningStats keeps a mean and variance using Welford's online algorithm.
+type runningStats struct {
+	count int
+	mean  float64
+	m2    float64
+}
+
+func (r *runningStats) add(value float64) {
+	r.count++
+	delta := value - r.mean
+	r.mean += delta / float64(r.count)
+	r.m2 += delta * (value - r.mean)
+}
+
+func (r *runningStats) stdDev() float64 {
+	if r.count < 2 {
+		return 0
+	}
+	return math.Sqrt(r.m2 / float64(r.count-1))
+}
+
+// Detector holds the state needed to evaluate a single series, one point at a time, in
+// chronological order.
+type Detector struct {
+	cfg Config
+
+	window     []float64
+	windowNext int
+
+	ewma        float64
+	ewmaStarted bool
+
+	seasonal []runningStats
+}
+
+func NewDetector(cfg Config) *Detector {
+	d := &Detector{
+		cfg:    cfg,
+		window: make([]float64, 0, cfg.WindowSize),
+	}
+	if cfg.SeasonalPeriod > 0 && cfg.SeasonalBuckets > 0 {
+		d.seasonal = make([]runningStats, cfg.SeasonalBuckets)
+	}
+	return d
+}
+
+// Observe evaluates the value against the state accumulated so far and then adds it to that
+// state. It returns one anomaly for each method that flagged the value.
+func (d *Detector) Observe(timestamp time.Time, value float64) []Anomaly {
+	var anomalies []Anomaly
+
+	mean, stdDev := d.windowStats()
+	warm := len(d.window) >= d.cfg.MinSamples && stdDev > 0
+
+	if warm && d.cfg.ZScoreThreshold > 0 {
+		score := (value - mean) / stdDev
+		if math.Abs(score) > d.cfg.ZScoreThreshold {
+			anomalies = append(anomalies, Anomaly{
+				Method:    MethodZScore,
+				Timestamp: timestamp,
+				Value:     value,
+				Expected:  mean,
+				Lower:     mean - d.cfg.ZScoreThreshold*stdDev,
+				Upper:     mean + d.cfg.ZScoreThreshold*stdDev,
+				Score:     score,
+			})
+		}
+	}
+
+	if d.cfg.EWMALambda > 0 {
+		if !d.ewmaStarted {
+			d.ewma = value
+			d.ewmaStarted = true
+		} else {
+			d.ewma = d.cfg.EWMALambda*value + (1-d.cfg.EWMALambda)*d.ewma
+		}
+
+		if warm && d.cfg.EWMALimit > 0 {
+			// Asymptotic control limits of an EWMA chart centered on the rolling window baseline
+			sigma := stdDev * math.Sqrt(d.cfg.EWMALambda/(2-d.cfg.EWMALambda))
+			lower := mean - d.cfg.EWMALimit*sigma
+			upper := mean + d.cfg.EWMALimit*sigma
+			if d.ewma < lower || d.ewma > upper {
+				anomalies = append(anomalies, Anomaly{
+					Method:    MethodEWMA,
+					Timestamp: timestamp,
+					Value:     value,
+					Expected:  mean,
+					Lower:     lower,
+					Upper:     upper,
+					Score:     (d.ewma - mean) / sigma,
+				})
+			}
+		}
+	}
+
+	if d.seasonal != nil {
+		bucket := &d.seasonal[d.seasonalBucket(timestamp)]
+		bucketStdDev := bucket.stdDev()
+		if bucket.count >= d.cfg.MinSamples && bucketStdDev > 0 && d.cfg.SeasonalThreshold > 0 {
+			score := (value - bucket.mean) / bucketStdDev
+			if math.Abs(score) > d.cfg.SeasonalThreshold {
+				anomalies = append(anomalies, Anomaly{
+					Method:    MethodSeasonal,
+					Timestamp: timestamp,
+					Value:     value,
+					Expected:  bucket.mean,
+					Lower:     bucket.mean - d.cfg.SeasonalThreshold*bucketStdDev,
+					Upper:     bucket.mean + d.cfg.SeasonalThreshold*bucketStdDev,
+					Score:     score,
+				})
+			}
+		}
+		bucket.add(value)
+	}
+
+	d.pushWindow(value)
+
+	return anomalies
+}
+
+func (d *Detector) windowStats() (float64, float64) {
+	var stats runningStats
+	for _, v := range d.window {
+		stats.add(v)
+	}
+	return stats.mean, stats.stdDev()
+}
+
+func (d *Detector) pushWindow(value float64) {
+	if d.cfg.WindowSize <= 0 {
+		return
+	}
+	if len(d.window) < d.cfg.WindowSize {
+		d.window = append(d.window, value)
+		return
+	}
+	d.window[d.windowNext] = value
+	d.windowNext = (d.windowNext + 1) % d.cfg.WindowSize
+}
+
+// seasonalBucket returns the bucket of the time within the period, taking the offset modulo the
+// period rounding down so the times before 1970 fall in a bucket as well. The bucket is computed
+// in floating point, as the offset times the number of buckets can overflow for long periods.
+func (d *Detector) seasonalBucket(timestamp time.Time) int {
+	period := int64(d.cfg.SeasonalPeriod)
+	offset := timestamp.UnixNano() % period
+	if offset < 0 {
+		offset += period
+	}
+	bucket := int(float64(offset) / float64(period) * float64(d.cfg.SeasonalBuckets))
+	return min(bucket, d.cfg.SeasonalBuckets-1)
+}
+
+// sweepInterval is how often the monitor drops the detectors of the series no longer observed
+const sweepInterval = time.Minute
+
+// Monitor keeps one Detector per series so anomalies can be flagged as measurements are written.
+// The detectors of the series not observed for the idle timeout are dropped, and so is the one
+// observed the longest ago when there are too many series, so the series written once don't stay
+// in memory.
+type Monitor struct {
+	cfg         Config
+	idleTimeout time.Duration
+	maxSeries   int
+	mu          sync.Mutex
+	detectors   map[SeriesKey]*monitoredSeries
+}
+
+type monitoredSeries struct {
+	detector     *Detector
+	lastObserved time.Time
+}
+
+func NewMonitor(envVars *config.EnvVars) *Monitor {
+	return newMonitor(NewConfig(envVars), envVars.Anomaly.IdleTimeout, envVars.Anomaly.MaxSeries)
+}
+
+func newMonitor(cfg Config, idleTimeout time.Duration, maxSeries int) *Monitor {
+	return &Monitor{
+		cfg:         cfg,
+		idleTimeout: idleTimeout,
+		maxSeries:   maxSeries,
+		detectors:   map[SeriesKey]*monitoredSeries{},
+	}
+}
+
+func (m *Monitor) Config() Config {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cfg
+}
+
+// SetThresholds changes the thresholds of the monitor and of the detectors it already has, which
+// keep their state.
+func (m *Monitor) SetThresholds(zScoreThreshold, ewmaLimit, seasonalThreshold float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cfg.ZScoreThreshold = zScoreThreshold
+	m.cfg.EWMALimit = ewmaLimit
+	m.cfg.SeasonalThreshold = seasonalThreshold
+	for _, series := range m.detectors {
+		series.detector.cfg = m.cfg
+	}
+}
+
+func (m *Monitor) Observe(key SeriesKey, timestamp time.Time, value float64) []Anomaly {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series, ok := m.detectors[key]
+	if !ok {
+		if len(m.detectors) >= m.maxSeries {
+			m.dropLeastRecent()
+		}
+		series = &monitoredSeries{detector: NewDetector(m.cfg)}
+		m.detectors[key] = series
+	}
+	series.lastObserved = time.Now()
+
+	return series.detector.Observe(timestamp, value)
+}
+
+// dropLeastRecent drops the detector of the series observed the longest ago. The caller holds the
+// mutex.
+func (m *Monitor) dropLeastRecent() {
+	var oldest *SeriesKey
+	for key, series := range m.detectors {
+		if oldest == nil || series.lastObserved.Before(m.detectors[*oldest].lastObserved) {
+			oldest = &key
+		}
+	}
+	if oldest != nil {
+		delete(m.detectors, *oldest)
+	}
+}
+
+// Sweep drops the detectors of the series not observed for the idle timeout.
+func (m *Monitor) Sweep(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, series := range m.detectors {
+		if now.Sub(series.lastObserved) > m.idleTimeout {
+			delete(m.detectors, key)
+		}
+	}
+}
+
+// Run sweeps the detectors periodically until the context is done.
+func (m *Monitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			m.Sweep(now)
+		}
+	}
+}
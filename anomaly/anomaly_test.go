@@ -0,0 +1,194 @@
+package anomaly
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig() Config {
+	return Config{
+		WindowSize:        20,
+		MinSamples:        10,
+		ZScoreThreshold:   3,
+		EWMALambda:        0.2,
+		EWMALimit:         3,
+		SeasonalPeriod:    24 * time.Hour,
+		SeasonalBuckets:   24,
+		SeasonalThreshold: 3,
+	}
+}
+
+func methods(anomalies []Anomaly) []Method {
+	result := []Method{}
+	for _, a := range anomalies {
+		result = append(result, a.Method)
+	}
+	return result
+}
+
+func TestDetector(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when a series is stable, it should not flag anything", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		detector := NewDetector(testConfig())
+		start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 100; i++ {
+			value := 20 + float64(i%3)*0.1
+			is.Empty(detector.Observe(start.Add(time.Duration(i)*time.Minute), value))
+		}
+	})
+
+	t.Run("when a spike follows a stable series, it should be flagged by the rolling z-score", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		detector := NewDetector(testConfig())
+		start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 30; i++ {
+			detector.Observe(start.Add(time.Duration(i)*time.Minute), 20+float64(i%3)*0.1)
+		}
+
+		anomalies := detector.Observe(start.Add(30*time.Minute), 35)
+		is.Contains(methods(anomalies), MethodZScore)
+		is.Equal(35.0, anomalies[0].Value)
+	})
+
+	t.Run("when a series drifts slowly, it should be flagged by the EWMA control limits", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		cfg := testConfig()
+		cfg.ZScoreThreshold = 0
+		cfg.SeasonalBuckets = 0
+		detector := NewDetector(cfg)
+		start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 30; i++ {
+			detector.Observe(start.Add(time.Duration(i)*time.Minute), 20+float64(i%2)*0.2)
+		}
+
+		var flagged []Method
+		for i := 30; i < 40; i++ {
+			flagged = append(flagged, methods(detector.Observe(start.Add(time.Duration(i)*time.Minute), 20.6))...)
+		}
+		is.Contains(flagged, MethodEWMA)
+	})
+
+	t.Run("when a value is unusual for its time of day, it should be flagged by the seasonal baseline", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		cfg := testConfig()
+		cfg.ZScoreThreshold = 0
+		cfg.EWMALambda = 0
+		detector := NewDetector(cfg)
+		start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+		for day := 0; day < 15; day++ {
+			for hour := 0; hour < 24; hour++ {
+				// Warm at noon, cold at midnight
+				value := 10 + float64(12-abs(hour-12)) + float64(day%2)*0.5
+				is.Empty(detector.Observe(start.Add(time.Duration(day*24+hour)*time.Hour), value))
+			}
+		}
+
+		midnight := start.Add(15 * 24 * time.Hour)
+		is.Equal([]Method{MethodSeasonal}, methods(detector.Observe(midnight, 22)))
+	})
+}
+
+func TestSeasonalBucket(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when a timestamp is before 1970, it should fall in the bucket of its time of day", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		detector := NewDetector(testConfig())
+		is.Equal(23, detector.seasonalBucket(time.Date(1969, 12, 31, 23, 30, 0, 0, time.UTC)))
+		is.Equal(0, detector.seasonalBucket(time.Date(1900, 1, 1, 0, 0, 0, 1, time.UTC)))
+		is.Equal(5, detector.seasonalBucket(time.Date(1969, 6, 1, 5, 59, 59, 0, time.UTC)))
+		is.NotPanics(func() { detector.Observe(time.Unix(-1, 0), 20) })
+	})
+
+	t.Run("when the period is long, it should not overflow", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		cfg := testConfig()
+		cfg.SeasonalPeriod = 100 * 365 * 24 * time.Hour
+		cfg.SeasonalBuckets = 1000
+		detector := NewDetector(cfg)
+		bucket := detector.seasonalBucket(time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC))
+		is.GreaterOrEqual(bucket, 0)
+		is.Less(bucket, 1000)
+	})
+}
+
+func TestMonitor(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when two series are observed, it should keep their state apart", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		monitor := newMonitor(testConfig(), time.Hour, 100)
+		stable := SeriesKey{SensorID: "a", Measurement: "temperature", Unit: "celsius"}
+		other := SeriesKey{SensorID: "b", Measurement: "temperature", Unit: "celsius"}
+
+		start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 30; i++ {
+			monitor.Observe(stable, start.Add(time.Duration(i)*time.Minute), 20+float64(i%3)*0.1)
+		}
+
+		is.Empty(monitor.Observe(other, start.Add(30*time.Minute), 35))
+		is.NotEmpty(monitor.Observe(stable, start.Add(30*time.Minute), 35))
+	})
+
+	t.Run("when the thresholds are raised, it should apply them to the series already observed", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		monitor := newMonitor(testConfig(), time.Hour, 100)
+		key := SeriesKey{SensorID: "a", Measurement: "temperature", Unit: "celsius"}
+
+		start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 30; i++ {
+			monitor.Observe(key, start.Add(time.Duration(i)*time.Minute), 20+float64(i%3)*0.1)
+		}
+
+		monitor.SetThresholds(1000, 1000, 1000)
+		is.Equal(1000.0, monitor.Config().ZScoreThreshold)
+		is.Empty(monitor.Observe(key, start.Add(30*time.Minute), 35))
+	})
+
+	t.Run("when series are no longer observed or there are too many, it should drop the least recent ones", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		monitor := newMonitor(testConfig(), time.Hour, 2)
+		start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+		first := SeriesKey{SensorID: "a", Measurement: "temperature", Unit: "celsius"}
+		second := SeriesKey{SensorID: "b", Measurement: "temperature", Unit: "celsius"}
+		third := SeriesKey{SensorID: "c", Measurement: "temperature", Unit: "celsius"}
+		monitor.Observe(first, start, 20)
+		monitor.Observe(second, start, 20)
+		monitor.detectors[first].lastObserved = time.Now().Add(-time.Minute)
+		monitor.Observe(third, start, 20)
+		is.Len(monitor.detectors, 2)
+		is.NotContains(monitor.detectors, first)
+
+		monitor.Sweep(time.Now().Add(2 * time.Hour))
+		is.Empty(monitor.detectors)
+	})
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
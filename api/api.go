@@ -3,33 +3,124 @@ package api
 import (
 	"github.com/gofiber/contrib/fiberzerolog"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/golobby/container/v3"
 	"github.com/rs/zerolog"
+	"github.com/zignd/pingthings-collaborative-technical-interview/anomaly"
+	"github.com/zignd/pingthings-collaborative-technical-interview/channel"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/dedup"
+	"github.com/zignd/pingthings-collaborative-technical-interview/health"
+	"github.com/zignd/pingthings-collaborative-technical-interview/importer"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ingest"
+	"github.com/zignd/pingthings-collaborative-technical-interview/metrics"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ratelimit"
+	"github.com/zignd/pingthings-collaborative-technical-interview/replication"
 	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
 )
 
 func SetupServer(cont *container.Container) (*fiber.App, error) {
 	app := fiber.New(fiber.Config{
 		DisableStartupMessage: true,
+		StreamRequestBody:     true,
 	})
 
 	err := cont.Call(func(
 		logger zerolog.Logger,
-		sensorsRepository *repository.SensorsRepository,
-		measurementRepository *repository.MeasurementRepository,
+		sensorsRepository repository.SensorsRepository,
+		measurementRepository repository.MeasurementRepository,
+		anomaliesRepository repository.AnomaliesRepository,
+		anomalyMonitor *anomaly.Monitor,
+		channelsRepository repository.ChannelsRepository,
+		resolver *channel.Resolver,
+		importsRepository repository.ImportsRepository,
+		measurementsImporter *importer.Importer,
+		pipeline *ingest.Pipeline,
+		deduplicator *dedup.Deduplicator,
+		idempotencyRepository repository.IdempotencyRepository,
+		assetsRepository repository.AssetsRepository,
+		geofencesRepository repository.GeofencesRepository,
+		tracksRepository repository.TracksRepository,
+		checker *health.Checker,
+		envVars *config.EnvVars,
+		configLoader *config.Loader,
+		limiter *ratelimit.Limiter,
+		replicator *replication.Replicator,
+		applier *replication.Applier,
 	) {
+		// Registered before the middlewares, the probes are neither traced, measured nor logged
+		app.Get("/healthz", GetLiveness())
+		app.Get("/readyz", GetReadiness(checker))
+
+		app.Use(Tracing())
+
+		app.Use(Metrics())
+
 		app.Use(fiberzerolog.New(fiberzerolog.Config{
 			Logger:   &logger,
 			Messages: []string{"server side error", "client side error", "success"},
 		}))
 
-		app.Post("/sensors", PostSensor(sensorsRepository))
-		app.Get("/sensors/nearest", GetNearestSensor(sensorsRepository))
-		app.Get("/sensors/name/:name", GetSensorByName(sensorsRepository))
-		app.Get("/sensors/:id", GetSensorByID(sensorsRepository))
-		app.Put("/sensors/:id", PutSensor(sensorsRepository))
-		app.Post("/sensors/:id/measurements", PostMeasurement(sensorsRepository, measurementRepository))
-		app.Get("/sensors/:id/measurements/summary", GetMeasurementSummary(sensorsRepository, measurementRepository))
+		app.Use(Actor())
+
+		ingestLimit := RateLimit(limiter, ratelimit.ClassIngest)
+		queryLimit := RateLimit(limiter, ratelimit.ClassQuery)
+		writeLimit := RateLimit(limiter, ratelimit.ClassWrite)
+		rawQuery := QueryGuardrails(envVars.Query.Timeout, envVars.Query.MaxRawRange, hintAggregate)
+		aggregateQuery := QueryGuardrails(envVars.Query.Timeout, envVars.Query.MaxAggregateRange, hintNarrowRange)
+		summaryQuery := QueryGuardrails(envVars.Query.Timeout, envVars.Query.MaxSummaryRange, hintNarrowRange)
+		exportQuery := QueryGuardrails(envVars.Query.ExportTimeout, envVars.Query.MaxExportRange, hintNarrowRange)
+
+		app.Get("/metrics", adaptor.HTTPHandler(metrics.Handler()))
+		app.Get("/config", GetConfig(configLoader, envVars.API.AdminToken))
+
+		app.Post("/sensors", writeLimit, PostSensor(sensorsRepository))
+		app.Get("/sensors", queryLimit, GetSensors(sensorsRepository))
+		app.Get("/sensors/nearest", queryLimit, GetNearestSensor(sensorsRepository))
+		app.Get("/sensors/name/:name", queryLimit, GetSensorByName(sensorsRepository))
+		app.Get("/sensors/:id", queryLimit, GetSensorByID(sensorsRepository))
+		app.Put("/sensors/:id", writeLimit, PutSensor(sensorsRepository))
+		app.Patch("/sensors/:id", writeLimit, PatchSensor(sensorsRepository))
+		app.Put("/sensors/:id/tags/:tag", writeLimit, PutSensorTag(sensorsRepository))
+		app.Delete("/sensors/:id/tags/:tag", writeLimit, DeleteSensorTag(sensorsRepository))
+		app.Get("/sensors/:id/history", queryLimit, GetSensorHistory(sensorsRepository))
+		app.Get("/sensors/:id/location", queryLimit, GetSensorLocation(sensorsRepository))
+		app.Post("/sensors/:id/location", ingestLimit, PostSensorLocation(sensorsRepository, tracksRepository))
+		app.Get("/sensors/:id/track", queryLimit, GetSensorTrack(sensorsRepository, tracksRepository))
+		app.Get("/sensors/:id/geofence-events", queryLimit, GetSensorGeofenceEvents(sensorsRepository, geofencesRepository))
+		app.Post("/sensors/:id/measurements", ingestLimit, Idempotent(idempotencyRepository, true), PostMeasurement(sensorsRepository, pipeline, deduplicator, anomalyMonitor, anomaliesRepository))
+		app.Get("/sensors/:id/measurements", queryLimit, rawQuery, GetMeasurements(sensorsRepository, resolver))
+		app.Get("/sensors/:id/measurements/aggregate", queryLimit, aggregateQuery, GetAggregatedMeasurements(sensorsRepository, resolver))
+		app.Get("/sensors/:id/measurements/export", queryLimit, exportQuery, ExportSensorMeasurements(sensorsRepository, measurementRepository))
+		app.Get("/sensors/:id/measurements/summary", queryLimit, summaryQuery, GetMeasurementSummary(sensorsRepository, resolver))
+		app.Get("/measurements", queryLimit, rawQuery, GetMeasurementsByLabels(measurementRepository))
+		app.Get("/measurements/heatmap", queryLimit, aggregateQuery, GetHeatmap(sensorsRepository, measurementRepository))
+		app.Get("/measurements/export", queryLimit, exportQuery, ExportTaggedMeasurements(sensorsRepository, measurementRepository))
+		app.Post("/geofences", writeLimit, PostGeofence(geofencesRepository))
+		app.Get("/geofences", queryLimit, GetGeofences(geofencesRepository))
+		app.Get("/geofences/:id", queryLimit, GetGeofence(geofencesRepository))
+		app.Delete("/geofences/:id", writeLimit, DeleteGeofence(geofencesRepository))
+		app.Get("/geofences/:id/events", queryLimit, GetGeofenceEvents(geofencesRepository))
+		app.Post("/assets", writeLimit, PostAsset(assetsRepository))
+		app.Get("/assets", queryLimit, GetAssets(assetsRepository))
+		app.Get("/assets/:id", queryLimit, GetAsset(assetsRepository))
+		app.Put("/assets/:id", writeLimit, PutAsset(assetsRepository))
+		app.Delete("/assets/:id", writeLimit, DeleteAsset(assetsRepository))
+		app.Get("/assets/:id/sensors", queryLimit, GetAssetSensors(assetsRepository))
+		app.Put("/assets/:id/sensors/:sensorID", writeLimit, PutAssetSensor(assetsRepository))
+		app.Delete("/assets/:id/sensors/:sensorID", writeLimit, DeleteAssetSensor(assetsRepository))
+		app.Get("/assets/:id/measurements/summary", queryLimit, summaryQuery, GetAssetMeasurementSummary(assetsRepository, measurementRepository))
+		app.Get("/assets/:id/measurements/export", queryLimit, exportQuery, ExportAssetMeasurements(assetsRepository, measurementRepository))
+		app.Post("/measurements/import", ingestLimit, Idempotent(idempotencyRepository, false), PostImport(measurementsImporter))
+		app.Get("/ingest/stats", queryLimit, GetIngestStats(pipeline))
+		app.Post(replication.BatchesPath, ingestLimit, PostReplicationBatch(applier, envVars.Replication.Token, envVars.Replication.MaxBatchBytes))
+		app.Get("/replication/stats", queryLimit, GetReplicationStats(replicator, envVars.API.AdminToken, envVars.Replication.Token))
+		app.Get("/measurements/import/:importID", queryLimit, GetImport(importsRepository))
+		app.Get("/sensors/:id/anomalies", queryLimit, GetAnomalies(sensorsRepository, anomaliesRepository))
+		app.Post("/sensors/:id/anomalies/detect", queryLimit, rawQuery, DetectAnomalies(sensorsRepository, measurementRepository, anomalyMonitor, anomaliesRepository))
+		app.Post("/sensors/:id/channels", writeLimit, PostChannel(sensorsRepository, channelsRepository, resolver))
+		app.Get("/sensors/:id/channels", queryLimit, GetChannels(channelsRepository))
+		app.Delete("/sensors/:id/channels/:channelID", writeLimit, DeleteChannel(channelsRepository))
 	})
 	if err != nil {
 		return nil, err
@@ -1,21 +1,36 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-faker/faker/v4"
 	"github.com/golobby/container/v3"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/anomaly"
+	"github.com/zignd/pingthings-collaborative-technical-interview/channel"
 	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/dedup"
+	"github.com/zignd/pingthings-collaborative-technical-interview/health"
+	"github.com/zignd/pingthings-collaborative-technical-interview/importer"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ingest"
+	"github.com/zignd/pingthings-collaborative-technical-interview/internal/testutil"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ratelimit"
+	"github.com/zignd/pingthings-collaborative-technical-interview/replication"
 	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -36,7 +51,10 @@ func configureLogger(envVars *config.EnvVars) zerolog.Logger {
 func setupContainer() (*container.Container, error) {
 	cont := container.New()
 
-	if err := cont.Singleton(config.Get); err != nil {
+	if err := cont.Singleton(func() (*config.Loader, error) { return config.NewLoader(nil) }); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(func(loader *config.Loader) *config.EnvVars { return loader.Current() }); err != nil {
 		return nil, err
 	}
 	if err := cont.Singleton(configureLogger); err != nil {
@@ -45,12 +63,63 @@ func setupContainer() (*container.Container, error) {
 	if err := cont.Singleton(buildMongoClient); err != nil {
 		return nil, err
 	}
-	if err := cont.Singleton(repository.NewSensorsRepository); err != nil {
+	if err := cont.Singleton(repository.NewMongoSensorsRepository); err != nil {
 		return nil, err
 	}
 	if err := cont.Singleton(repository.NewMeasurementRepository); err != nil {
 		return nil, err
 	}
+	if err := cont.Singleton(replication.NewReplicator); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(replication.NewApplier); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(repository.NewMongoAnomaliesRepository); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(anomaly.NewMonitor); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(repository.NewMongoChannelsRepository); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(channel.NewResolver); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(repository.NewMongoImportsRepository); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(ingest.NewPipeline); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(dedup.NewDeduplicator); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(repository.NewMongoIdempotencyRepository); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(repository.NewMongoAssetsRepository); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(repository.NewMongoGeofencesRepository); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(repository.NewMongoTracksRepository); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(health.NewChecker); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(ratelimit.NewStore); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(ratelimit.NewLimiter); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(importer.NewImporter); err != nil {
+		return nil, err
+	}
 
 	return &cont, nil
 }
@@ -72,7 +141,7 @@ func TestAPI(t *testing.T) {
 		ctx := context.Background()
 
 		body := Sensor{
-			Name: faker.Word(),
+			Name: testutil.UniqueSensorName(),
 			Location: Location{
 				Longitude: faker.Longitude(),
 				Latitude:  faker.Latitude(),
@@ -97,7 +166,7 @@ func TestAPI(t *testing.T) {
 		ctx := context.Background()
 
 		body := Sensor{
-			Name: faker.Word(),
+			Name: testutil.UniqueSensorName(),
 			Location: Location{
 				Longitude: faker.Longitude(),
 				Latitude:  faker.Latitude(),
@@ -164,4 +233,449 @@ func TestAPI(t *testing.T) {
 		}
 		is.Equal(expectedResBody, resBody)
 	})
+
+	t.Run("when a channel expression uses a variable without an input, it should return a bad request", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		ctx := context.Background()
+
+		sensorBody := Sensor{
+			Name: testutil.UniqueSensorName(),
+			Location: Location{
+				Longitude: faker.Longitude(),
+				Latitude:  faker.Latitude(),
+			},
+			Tags: []string{faker.Word()},
+		}
+		bodyBytes, err := json.Marshal(sensorBody)
+		is.Nil(err)
+
+		req := httptest.NewRequestWithContext(ctx, "POST", "/sensors", bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := app.Test(req)
+		is.Nil(err)
+		is.Equal(http.StatusCreated, res.StatusCode)
+
+		var createdSensor Sensor
+		is.Nil(json.NewDecoder(res.Body).Decode(&createdSensor))
+
+		channelBody := Channel{
+			Name:       "dew_point",
+			Unit:       "celsius",
+			Expression: "dewpoint(temperature, humidity)",
+			Inputs: []ChannelInput{
+				{Variable: "temperature", SensorID: createdSensor.ID, Measurement: "temperature", Unit: "celsius"},
+			},
+			Alignment: "1m",
+		}
+		bodyBytes, err = json.Marshal(channelBody)
+		is.Nil(err)
+
+		req = httptest.NewRequestWithContext(ctx, "POST", fmt.Sprintf("/sensors/%s/channels", createdSensor.ID), bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err = app.Test(req)
+		is.Nil(err)
+		is.Equal(http.StatusBadRequest, res.StatusCode)
+
+		resBody := map[string]interface{}{}
+		json.NewDecoder(res.Body).Decode(&resBody)
+		is.Equal("variable humidity of the expression has no input", resBody["error"])
+	})
+	t.Run("when a measurement is posted again with the same idempotency key, it should replay the first response", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		ctx := context.Background()
+
+		sensorBody := Sensor{
+			Name: testutil.UniqueSensorName(),
+			Location: Location{
+				Longitude: faker.Longitude(),
+				Latitude:  faker.Latitude(),
+			},
+			Tags: []string{faker.Word()},
+		}
+		bodyBytes, err := json.Marshal(sensorBody)
+		is.Nil(err)
+
+		req := httptest.NewRequestWithContext(ctx, "POST", "/sensors", bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := app.Test(req)
+		is.Nil(err)
+		is.Equal(http.StatusCreated, res.StatusCode)
+
+		var createdSensor Sensor
+		is.Nil(json.NewDecoder(res.Body).Decode(&createdSensor))
+
+		measurementBody := Measurement{
+			Name:  "temperature",
+			Unit:  "celsius",
+			Value: 21.5,
+		}
+		bodyBytes, err = json.Marshal(measurementBody)
+		is.Nil(err)
+
+		idempotencyKey := faker.UUIDHyphenated()
+		var responses []Measurement
+		for range 2 {
+			req = httptest.NewRequestWithContext(ctx, "POST", fmt.Sprintf("/sensors/%s/measurements", createdSensor.ID), bytes.NewBuffer(bodyBytes))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+
+			res, err = app.Test(req)
+			is.Nil(err)
+			is.Equal(http.StatusAccepted, res.StatusCode)
+
+			var measurement Measurement
+			is.Nil(json.NewDecoder(res.Body).Decode(&measurement))
+			responses = append(responses, measurement)
+		}
+
+		is.Equal("true", res.Header.Get("Idempotency-Replayed"))
+		is.Equal(responses[0], responses[1])
+	})
+	t.Run("when a sensor is registered again with its external ID, it should get the existing sensor", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		ctx := context.Background()
+
+		body := Sensor{
+			ExternalID: faker.UUIDHyphenated(),
+			Name:       testutil.UniqueSensorName(),
+			Location: Location{
+				Longitude: faker.Longitude(),
+				Latitude:  faker.Latitude(),
+			},
+			Tags: []string{faker.Word()},
+		}
+		bodyBytes, err := json.Marshal(body)
+		is.Nil(err)
+
+		var sensors []Sensor
+		for _, expectedStatus := range []int{http.StatusCreated, http.StatusOK} {
+			req := httptest.NewRequestWithContext(ctx, "POST", "/sensors", bytes.NewBuffer(bodyBytes))
+			req.Header.Set("Content-Type", "application/json")
+
+			res, err := app.Test(req)
+			is.Nil(err)
+			is.Equal(expectedStatus, res.StatusCode)
+
+			var sensor Sensor
+			is.Nil(json.NewDecoder(res.Body).Decode(&sensor))
+			sensors = append(sensors, sensor)
+		}
+		is.Equal(sensors[0].ID, sensors[1].ID)
+
+		// Same name, no external ID
+		body.ExternalID = ""
+		bodyBytes, err = json.Marshal(body)
+		is.Nil(err)
+
+		req := httptest.NewRequestWithContext(ctx, "POST", "/sensors", bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := app.Test(req)
+		is.Nil(err)
+		is.Equal(http.StatusConflict, res.StatusCode)
+	})
+
+	t.Run("when raw measurements are queried over a range longer than the maximum, it should reject it before querying", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		ctx := context.Background()
+
+		query := url.Values{
+			"measurement": {"temperature"},
+			"unit":        {"celsius"},
+			"start":       {"2000-01-01T00:00:00Z"},
+			"end":         {"2024-01-01T00:00:00Z"},
+		}
+		req := httptest.NewRequestWithContext(ctx, "GET", "/sensors/000000000000000000000000/measurements?"+query.Encode(), nil)
+
+		res, err := app.Test(req)
+		is.Nil(err)
+		is.Equal(http.StatusBadRequest, res.StatusCode)
+
+		var body map[string]string
+		is.Nil(json.NewDecoder(res.Body).Decode(&body))
+		is.Contains(body["error"], "use the aggregate endpoint instead")
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	app, _ := embeddedServer(t, "-rate_limit.query_burst=3", "-rate_limit.query_rate=0.001")
+
+	t.Run("when a client exceeds its query budget sending a new API key every time, it should return 429 with the rate limit headers", func(t *testing.T) {
+		is := require.New(t)
+
+		var res *http.Response
+		for i := 0; i <= 3; i++ {
+			req := httptest.NewRequest("GET", "/sensors", nil)
+			req.Header.Set("X-API-Key", faker.UUIDDigit())
+
+			var err error
+			res, err = app.Test(req, -1)
+			is.Nil(err)
+			if i < 3 {
+				is.Equal(http.StatusOK, res.StatusCode)
+			}
+		}
+		is.Equal(http.StatusTooManyRequests, res.StatusCode)
+		is.Equal("3", res.Header.Get("RateLimit-Limit"))
+		is.Equal("0", res.Header.Get("RateLimit-Remaining"))
+		is.NotEmpty(res.Header.Get("Retry-After"))
+	})
+
+	t.Run("when a client exceeds its query budget on the stats, it should return 429", func(t *testing.T) {
+		is := require.New(t)
+
+		for _, path := range []string{"/ingest/stats", "/replication/stats"} {
+			app, _ := embeddedServer(t, "-rate_limit.query_burst=3", "-rate_limit.query_rate=0.001", "-api.admin_token=admin-secret")
+			var res *http.Response
+			for i := 0; i <= 3; i++ {
+				req := httptest.NewRequest("GET", path, nil)
+				req.Header.Set("Authorization", "Bearer admin-secret")
+
+				var err error
+				res, err = app.Test(req, -1)
+				is.Nil(err)
+				if i < 3 {
+					is.Equal(http.StatusOK, res.StatusCode, path)
+				}
+			}
+			is.Equal(http.StatusTooManyRequests, res.StatusCode, path)
+		}
+	})
+}
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+	is := require.New(t)
+
+	app, _ := embeddedServer(t, "-query.max_export_range=24h")
+
+	res := request(t, app, "POST", "/sensors", Sensor{
+		Name:     testutil.UniqueSensorName(),
+		Location: Location{Longitude: 1, Latitude: 2},
+		Tags:     []string{"export"},
+	})
+	is.Equal(http.StatusCreated, res.StatusCode)
+	var sensor Sensor
+	is.Nil(json.NewDecoder(res.Body).Decode(&sensor))
+
+	at := time.Now().UTC().Truncate(time.Second)
+	res = request(t, app, "POST", fmt.Sprintf("/sensors/%s/measurements", sensor.ID), Measurement{
+		Name:      "temperature",
+		Unit:      "celsius",
+		Value:     21.5,
+		Timestamp: at,
+	})
+	is.Equal(http.StatusAccepted, res.StatusCode)
+
+	t.Run("when the time range is longer than the export range, it should return 400", func(t *testing.T) {
+		is := require.New(t)
+
+		res := request(t, app, "GET", fmt.Sprintf("/sensors/%s/measurements/export?start=%s&end=%s",
+			sensor.ID, at.Add(-48*time.Hour).Format(time.RFC3339), at.Format(time.RFC3339)), nil)
+		is.Equal(http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("when the time range is within the export range, it should stream the measurements", func(t *testing.T) {
+		is := require.New(t)
+
+		path := fmt.Sprintf("/sensors/%s/measurements/export?start=%s&end=%s",
+			sensor.ID, at.Add(-time.Hour).Format(time.RFC3339), at.Add(time.Minute).Format(time.RFC3339))
+		is.Eventually(func() bool {
+			res := request(t, app, "GET", path, nil)
+			body, err := io.ReadAll(res.Body)
+			return err == nil && res.StatusCode == http.StatusOK && strings.Contains(string(body), "21.5")
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("when a write to the client fails, it should cancel the export", func(t *testing.T) {
+		is := require.New(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream := &exportStream{writer: bufio.NewWriterSize(failingWriter{}, 16), cancel: cancel}
+
+		_, err := stream.Write([]byte("2024-01-01T00:00:00Z,"))
+		is.ErrorIs(err, io.ErrClosedPipe)
+		is.ErrorIs(ctx.Err(), context.Canceled)
+		is.ErrorIs(stream.flushEvery(0), io.ErrClosedPipe)
+	})
+}
+
+func TestChannels(t *testing.T) {
+	t.Parallel()
+	is := require.New(t)
+
+	app, _ := embeddedServer(t)
+
+	res := request(t, app, "POST", "/sensors", Sensor{
+		Name:     testutil.UniqueSensorName(),
+		Location: Location{Longitude: 1, Latitude: 2},
+		Tags:     []string{"channels"},
+	})
+	is.Equal(http.StatusCreated, res.StatusCode)
+	var sensor Sensor
+	is.Nil(json.NewDecoder(res.Body).Decode(&sensor))
+
+	channelsPath := fmt.Sprintf("/sensors/%s/channels", sensor.ID)
+	res = request(t, app, "POST", channelsPath, Channel{
+		Name:       "fahrenheit",
+		Unit:       "fahrenheit",
+		Expression: "celsius * 1.8 + 32",
+		Inputs: []ChannelInput{
+			{Variable: "celsius", SensorID: sensor.ID, Measurement: "temperature", Unit: "celsius"},
+		},
+		Alignment: "1m",
+	})
+	is.Equal(http.StatusCreated, res.StatusCode)
+
+	t.Run("when an input sensor ID isn't a valid ID, it should return 400", func(t *testing.T) {
+		is := require.New(t)
+
+		res := request(t, app, "POST", channelsPath, Channel{
+			Name:       "kelvin",
+			Unit:       "kelvin",
+			Expression: "celsius + 273.15",
+			Inputs: []ChannelInput{
+				{Variable: "celsius", SensorID: "not-an-id", Measurement: "temperature", Unit: "celsius"},
+			},
+			Alignment: "1m",
+		})
+		is.Equal(http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("when an input is another channel, it should return 400", func(t *testing.T) {
+		is := require.New(t)
+
+		res := request(t, app, "POST", channelsPath, Channel{
+			Name:       "rankine",
+			Unit:       "rankine",
+			Expression: "fahrenheit + 459.67",
+			Inputs: []ChannelInput{
+				{Variable: "fahrenheit", SensorID: sensor.ID, Measurement: "fahrenheit", Unit: "fahrenheit"},
+			},
+			Alignment: "1m",
+		})
+		is.Equal(http.StatusBadRequest, res.StatusCode)
+
+		resBody := map[string]any{}
+		is.Nil(json.NewDecoder(res.Body).Decode(&resBody))
+		is.Contains(resBody["error"], "the inputs of a channel must be physical series")
+	})
+
+	t.Run("when the aggregate function is unsupported, it should return 400", func(t *testing.T) {
+		is := require.New(t)
+
+		at := time.Now().UTC()
+		res := request(t, app, "GET", fmt.Sprintf("/sensors/%s/measurements/aggregate?measurement=fahrenheit&unit=fahrenheit&start=%s&end=%s&every=1m&fn=mode",
+			sensor.ID, at.Add(-time.Hour).Format(time.RFC3339), at.Format(time.RFC3339)), nil)
+		is.Equal(http.StatusBadRequest, res.StatusCode)
+	})
+}
+
+func TestUnknownSensor(t *testing.T) {
+	t.Parallel()
+
+	app, _ := embeddedServer(t)
+
+	end := time.Now().UTC()
+	timeRange := fmt.Sprintf("start=%s&end=%s", end.Add(-time.Hour).Format(time.RFC3339), end.Format(time.RFC3339))
+	routes := []struct {
+		method string
+		path   string
+		query  string
+		body   any
+	}{
+		{"GET", "/sensors/%s", "", nil},
+		{"PATCH", "/sensors/%s", "", map[string]any{"name": "renamed"}},
+		{"GET", "/sensors/%s/history", "", nil},
+		{"GET", "/sensors/%s/location", "", nil},
+		{"GET", "/sensors/%s/measurements", "measurement=temperature&unit=celsius&" + timeRange, nil},
+		{"GET", "/sensors/%s/measurements/aggregate", "measurement=temperature&unit=celsius&every=1m&" + timeRange, nil},
+		{"GET", "/sensors/%s/measurements/summary", "measurement=temperature&unit=celsius&" + timeRange, nil},
+		{"POST", "/sensors/%s/measurements", "", Measurement{Name: "temperature", Unit: "celsius", Value: 21.5}},
+		{"GET", "/sensors/%s/anomalies", timeRange, nil},
+		{"POST", "/sensors/%s/anomalies/detect", "measurement=temperature&unit=celsius&" + timeRange, nil},
+		{"GET", "/sensors/%s/measurements/export", timeRange, nil},
+		{"POST", "/sensors/%s/channels", "", Channel{
+			Name:       "fahrenheit",
+			Unit:       "fahrenheit",
+			Expression: "celsius * 1.8 + 32",
+			Inputs: []ChannelInput{
+				{Variable: "celsius", SensorID: primitive.NewObjectID().Hex(), Measurement: "temperature", Unit: "celsius"},
+			},
+			Alignment: "1m",
+		}},
+	}
+
+	for _, id := range []string{primitive.NewObjectID().Hex(), "not-an-id"} {
+		for _, route := range routes {
+			path := fmt.Sprintf(route.path, id)
+			t.Run(fmt.Sprintf("when %s %s is requested, it should return 404", route.method, path), func(t *testing.T) {
+				is := require.New(t)
+
+				res := request(t, app, route.method, path+"?"+route.query, route.body)
+				is.Equal(http.StatusNotFound, res.StatusCode)
+			})
+		}
+	}
+
+	t.Run("when a sensor is requested by an unknown name, it should return 404", func(t *testing.T) {
+		is := require.New(t)
+
+		res := request(t, app, "GET", "/sensors/name/"+testutil.UniqueSensorName(), nil)
+		is.Equal(http.StatusNotFound, res.StatusCode)
+	})
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestConfig(t *testing.T) {
+	t.Parallel()
+
+	app, _ := embeddedServer(t, "-api.admin_token=admin-secret")
+
+	t.Run("when the admin token is missing or wrong, it should return 401", func(t *testing.T) {
+		is := require.New(t)
+
+		res := request(t, app, "GET", "/config", nil)
+		is.Equal(http.StatusUnauthorized, res.StatusCode)
+
+		req := httptest.NewRequest("GET", "/config", nil)
+		req.Header.Set("Authorization", "Bearer "+replicationToken)
+		res, err := app.Test(req, -1)
+		is.Nil(err)
+		is.Equal(http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("when the admin token is given, it should return the configuration with the secrets redacted", func(t *testing.T) {
+		is := require.New(t)
+
+		req := httptest.NewRequest("GET", "/config", nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		res, err := app.Test(req, -1)
+		is.Nil(err)
+		is.Equal(http.StatusOK, res.StatusCode)
+
+		var dump map[string]config.Setting
+		is.Nil(json.NewDecoder(res.Body).Decode(&dump))
+		is.Equal("REDACTED", dump["api.admin_token"].Value)
+		is.Equal("embedded", dump["storage.backend"].Value)
+	})
 }
@@ -2,15 +2,23 @@ package api
 
 import (
 	"context"
+	"errors"
+	"slices"
+	"strings"
 	"time"
 
 	validator "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/zignd/pingthings-collaborative-technical-interview/anomaly"
+	"github.com/zignd/pingthings-collaborative-technical-interview/channel"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
 	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Location struct {
-	Longitude float64 `json:"longitude"`
-	Latitude  float64 `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Latitude  float64  `json:"latitude"`
+	Altitude  *float64 `json:"altitude,omitempty"` // Meters above sea level
 }
 
 func (l Location) ValidateWithContext(ctx context.Context) error {
@@ -22,41 +30,353 @@ func (l Location) ValidateWithContext(ctx context.Context) error {
 	return validator.ValidateStructWithContext(ctx, &l, fieldRules...)
 }
 
+type SensorHardware struct {
+	Manufacturer    string `json:"manufacturer,omitempty"`
+	Model           string `json:"model,omitempty"`
+	SerialNumber    string `json:"serial_number,omitempty"`
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+}
+
+func (h SensorHardware) ValidateWithContext(ctx context.Context) error {
+	fieldRules := []*validator.FieldRules{
+		validator.Field(&h.Manufacturer, validator.Length(0, 255)),
+		validator.Field(&h.Model, validator.Length(0, 255)),
+		validator.Field(&h.SerialNumber, validator.Length(0, 255)),
+		validator.Field(&h.FirmwareVersion, validator.Length(0, 255)),
+	}
+
+	return validator.ValidateStructWithContext(ctx, &h, fieldRules...)
+}
+
 type Sensor struct {
-	ID       string   `json:"id,omitempty"`
-	Name     string   `json:"name"`
-	Location Location `json:"location"`
-	Tags     []string `json:"tags"`
+	ID          string            `json:"id,omitempty"`
+	ExternalID  string            `json:"external_id,omitempty"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Location    Location          `json:"location"`
+	Tags        []string          `json:"tags"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Hardware    *SensorHardware   `json:"hardware,omitempty"`
+	InstalledAt *time.Time        `json:"installed_at,omitempty"`
+	AssetID     string            `json:"asset_id,omitempty"` // Read only, changed by attaching the sensor to an asset
+	Version     int               `json:"version"`
 }
 
 func (s Sensor) ValidateWithContext(ctx context.Context) error {
 	fieldRules := []*validator.FieldRules{
+		validator.Field(&s.ExternalID, validator.Length(0, 255)),
 		validator.Field(&s.Name, validator.Required),
+		validator.Field(&s.Description, validator.Length(0, 1024)),
 		validator.Field(&s.Location, validator.Required),
 		validator.Field(&s.Tags, validator.Required, validator.Length(1, 0)),
+		validator.Field(&s.Labels, validator.By(func(value interface{}) error {
+			return label.Validate(value.(map[string]string))
+		})),
+		validator.Field(&s.Hardware),
 	}
 
 	return validator.ValidateStructWithContext(ctx, &s, fieldRules...)
 }
 
+func mapAPISensorToDBSensor(apiSensor *Sensor) *repository.Sensor {
+	sensor := &repository.Sensor{
+		ExternalID:  apiSensor.ExternalID,
+		Name:        apiSensor.Name,
+		Description: apiSensor.Description,
+		Location: repository.GeoJSONPoint{
+			Type:        "Point",
+			Coordinates: []float64{apiSensor.Location.Longitude, apiSensor.Location.Latitude},
+		},
+		Altitude:    apiSensor.Location.Altitude,
+		Tags:        apiSensor.Tags,
+		Labels:      apiSensor.Labels,
+		InstalledAt: apiSensor.InstalledAt,
+	}
+	if apiSensor.Hardware != nil && *apiSensor.Hardware != (SensorHardware{}) {
+		sensor.Hardware = (*repository.SensorHardware)(apiSensor.Hardware)
+	}
+	return sensor
+}
+
 func mapDBSensorToAPISensor(dbSensor *repository.Sensor) *Sensor {
+	location := mapGeoJSONPointToLocation(dbSensor.Location)
+	location.Altitude = dbSensor.Altitude
+
+	var assetID string
+	if dbSensor.AssetID != nil {
+		assetID = dbSensor.AssetID.Hex()
+	}
+
 	return &Sensor{
-		ID:   dbSensor.ID.Hex(),
-		Name: dbSensor.Name,
-		Location: Location{
-			Longitude: dbSensor.Location.Coordinates[0],
-			Latitude:  dbSensor.Location.Coordinates[1],
+		ID:          dbSensor.ID.Hex(),
+		ExternalID:  dbSensor.ExternalID,
+		Name:        dbSensor.Name,
+		Description: dbSensor.Description,
+		Location:    location,
+		Tags:        dbSensor.Tags,
+		Labels:      dbSensor.Labels,
+		Hardware:    (*SensorHardware)(dbSensor.Hardware),
+		InstalledAt: dbSensor.InstalledAt,
+		AssetID:     assetID,
+		Version:     dbSensor.Version,
+	}
+}
+
+func mapDBSensorsToAPISensors(dbSensors []*repository.Sensor) []*Sensor {
+	sensors := make([]*Sensor, 0, len(dbSensors))
+	for _, s := range dbSensors {
+		sensors = append(sensors, mapDBSensorToAPISensor(s))
+	}
+	return sensors
+}
+
+func mapGeoJSONPointToLocation(point repository.GeoJSONPoint) Location {
+	return Location{
+		Longitude: point.Coordinates[0],
+		Latitude:  point.Coordinates[1],
+	}
+}
+
+type Asset struct {
+	ID          string `json:"id,omitempty"`
+	ParentID    string `json:"parent_id,omitempty"`
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+func (a Asset) ValidateWithContext(ctx context.Context) error {
+	kinds := make([]interface{}, 0, len(repository.AssetKinds))
+	for _, kind := range repository.AssetKinds {
+		kinds = append(kinds, string(kind))
+	}
+
+	fieldRules := []*validator.FieldRules{
+		validator.Field(&a.ParentID, validator.By(func(value interface{}) error {
+			if value.(string) == "" {
+				return nil
+			}
+			if _, err := primitive.ObjectIDFromHex(value.(string)); err != nil {
+				return errors.New("must be a valid asset ID")
+			}
+			return nil
+		})),
+		validator.Field(&a.Kind, validator.Required, validator.In(kinds...)),
+		validator.Field(&a.Name, validator.Required, validator.Length(1, 255)),
+		validator.Field(&a.Description, validator.Length(0, 1024)),
+	}
+
+	return validator.ValidateStructWithContext(ctx, &a, fieldRules...)
+}
+
+// mapAPIAssetToDBAsset expects the asset to have been validated.
+func mapAPIAssetToDBAsset(apiAsset *Asset) *repository.Asset {
+	asset := &repository.Asset{
+		Kind:        repository.AssetKind(apiAsset.Kind),
+		Name:        strings.TrimSpace(apiAsset.Name),
+		Description: apiAsset.Description,
+	}
+	if apiAsset.ParentID != "" {
+		parentID, _ := primitive.ObjectIDFromHex(apiAsset.ParentID)
+		asset.ParentID = &parentID
+	}
+	return asset
+}
+
+func mapDBAssetToAPIAsset(dbAsset *repository.Asset) *Asset {
+	asset := &Asset{
+		ID:          dbAsset.ID.Hex(),
+		Kind:        string(dbAsset.Kind),
+		Name:        dbAsset.Name,
+		Description: dbAsset.Description,
+	}
+	if dbAsset.ParentID != nil {
+		asset.ParentID = dbAsset.ParentID.Hex()
+	}
+	return asset
+}
+
+func mapDBAssetsToAPIAssets(dbAssets []*repository.Asset) []*Asset {
+	assets := make([]*Asset, 0, len(dbAssets))
+	for _, a := range dbAssets {
+		assets = append(assets, mapDBAssetToAPIAsset(a))
+	}
+	return assets
+}
+
+type SensorState struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Location    Location          `json:"location"`
+	Tags        []string          `json:"tags"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Hardware    *SensorHardware   `json:"hardware,omitempty"`
+	InstalledAt *time.Time        `json:"installed_at,omitempty"`
+	AssetID     string            `json:"asset_id,omitempty"`
+}
+
+type SensorRevision struct {
+	Version   int          `json:"version"`
+	Action    string       `json:"action"`
+	Actor     string       `json:"actor"`
+	Timestamp time.Time    `json:"timestamp"`
+	Changed   []string     `json:"changed"`
+	Before    *SensorState `json:"before,omitempty"`
+	After     SensorState  `json:"after"`
+}
+
+func mapDBSensorStateToAPISensorState(state repository.SensorState) SensorState {
+	location := mapGeoJSONPointToLocation(state.Location)
+	location.Altitude = state.Altitude
+	var assetID string
+	if state.AssetID != nil {
+		assetID = state.AssetID.Hex()
+	}
+
+	return SensorState{
+		Name:        state.Name,
+		Description: state.Description,
+		Location:    location,
+		Tags:        state.Tags,
+		Labels:      state.Labels,
+		Hardware:    (*SensorHardware)(state.Hardware),
+		InstalledAt: state.InstalledAt,
+		AssetID:     assetID,
+	}
+}
+
+func mapDBSensorRevisionsToAPISensorRevisions(dbRevisions []*repository.SensorRevision) []*SensorRevision {
+	revisions := make([]*SensorRevision, 0, len(dbRevisions))
+	for _, r := range dbRevisions {
+		revision := &SensorRevision{
+			Version:   r.Version,
+			Action:    r.Action,
+			Actor:     r.Actor,
+			Timestamp: r.Timestamp,
+			Changed:   r.Changed,
+			After:     mapDBSensorStateToAPISensorState(r.After),
+		}
+		if r.Before != nil {
+			before := mapDBSensorStateToAPISensorState(*r.Before)
+			revision.Before = &before
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions
+}
+
+type TrackPoint struct {
+	Location
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (p TrackPoint) ValidateWithContext(ctx context.Context) error {
+	return p.Location.ValidateWithContext(ctx)
+}
+
+func mapDBTrackPointsToAPITrackPoints(dbPoints []*repository.TrackPoint) []*TrackPoint {
+	points := make([]*TrackPoint, 0, len(dbPoints))
+	for _, p := range dbPoints {
+		location := mapGeoJSONPointToLocation(p.Location)
+		location.Altitude = p.Altitude
+		points = append(points, &TrackPoint{
+			Location:  location,
+			Timestamp: p.Timestamp,
+		})
+	}
+	return points
+}
+
+type Geofence struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+	// Area holds the rings of a GeoJSON polygon: the boundary first, then the holes, each one a
+	// closed list of longitude, latitude pairs
+	Area [][][]float64 `json:"area"`
+}
+
+func (g Geofence) ValidateWithContext(ctx context.Context) error {
+	fieldRules := []*validator.FieldRules{
+		validator.Field(&g.Name, validator.Required, validator.Length(1, 255)),
+		validator.Field(&g.Area, validator.Required, validator.By(func(value interface{}) error {
+			for _, ring := range value.([][][]float64) {
+				if len(ring) < 4 {
+					return errors.New("each ring must have at least 4 positions")
+				}
+				for _, position := range ring {
+					if len(position) != 2 || position[0] < -180 || position[0] > 180 || position[1] < -90 || position[1] > 90 {
+						return errors.New("each position must be a valid longitude, latitude pair")
+					}
+				}
+				if !slices.Equal(ring[0], ring[len(ring)-1]) {
+					return errors.New("each ring must end where it starts")
+				}
+			}
+			return nil
+		})),
+	}
+
+	return validator.ValidateStructWithContext(ctx, &g, fieldRules...)
+}
+
+func mapAPIGeofenceToDBGeofence(apiGeofence *Geofence) *repository.Geofence {
+	return &repository.Geofence{
+		Name: apiGeofence.Name,
+		Area: repository.GeoJSONPolygon{
+			Type:        "Polygon",
+			Coordinates: apiGeofence.Area,
 		},
-		Tags: dbSensor.Tags,
 	}
 }
 
+func mapDBGeofenceToAPIGeofence(dbGeofence *repository.Geofence) *Geofence {
+	return &Geofence{
+		ID:   dbGeofence.ID.Hex(),
+		Name: dbGeofence.Name,
+		Area: dbGeofence.Area.Coordinates,
+	}
+}
+
+func mapDBGeofencesToAPIGeofences(dbGeofences []*repository.Geofence) []*Geofence {
+	geofences := make([]*Geofence, 0, len(dbGeofences))
+	for _, g := range dbGeofences {
+		geofences = append(geofences, mapDBGeofenceToAPIGeofence(g))
+	}
+	return geofences
+}
+
+type GeofenceEvent struct {
+	SensorID     string    `json:"sensor_id"`
+	GeofenceID   string    `json:"geofence_id"`
+	GeofenceName string    `json:"geofence_name"`
+	Type         string    `json:"type"`
+	Timestamp    time.Time `json:"timestamp"`
+	Location     Location  `json:"location"`
+}
+
+func mapDBGeofenceEventsToAPIGeofenceEvents(dbEvents []*repository.GeofenceEvent) []*GeofenceEvent {
+	events := make([]*GeofenceEvent, 0, len(dbEvents))
+	for _, e := range dbEvents {
+		events = append(events, &GeofenceEvent{
+			SensorID:     e.SensorID.Hex(),
+			GeofenceID:   e.GeofenceID.Hex(),
+			GeofenceName: e.GeofenceName,
+			Type:         e.Type,
+			Timestamp:    e.Timestamp,
+			Location:     mapGeoJSONPointToLocation(e.Location),
+		})
+	}
+	return events
+}
+
 type Measurement struct {
-	Name      string    `json:"name"`
-	SensorID  string    `json:"sensor_id"`
-	Unit      string    `json:"unit"`
-	Value     float64   `json:"value"`
-	Timestamp time.Time `json:"timestamp"`
+	MessageID string            `json:"message_id,omitempty"`
+	Name      string            `json:"name"`
+	SensorID  string            `json:"sensor_id"`
+	Unit      string            `json:"unit"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	Labels    map[string]string `json:"labels,omitempty"` // Set from the sensor, never by the client
 }
 
 func (m Measurement) ValidateWithContext(ctx context.Context) error {
@@ -64,6 +384,13 @@ func (m Measurement) ValidateWithContext(ctx context.Context) error {
 		validator.Field(&m.Name, validator.Required),
 		validator.Field(&m.Unit, validator.Required),
 		validator.Field(&m.Value, validator.Required),
+		validator.Field(&m.Timestamp, validator.By(func(value interface{}) error {
+			timestamp := value.(time.Time)
+			if timestamp.IsZero() {
+				return nil
+			}
+			return repository.CheckTimestamp(timestamp)
+		})),
 	}
 
 	return validator.ValidateStructWithContext(ctx, &m, fieldRules...)
@@ -78,3 +405,169 @@ func mapAPIMeasurementToDBMeasurement(apiMeasurement *Measurement) *repository.M
 		Timestamp: apiMeasurement.Timestamp,
 	}
 }
+
+type Anomaly struct {
+	SensorID    string    `json:"sensor_id"`
+	Measurement string    `json:"measurement"`
+	Unit        string    `json:"unit"`
+	Method      string    `json:"method"`
+	Timestamp   time.Time `json:"timestamp"`
+	Value       float64   `json:"value"`
+	Expected    float64   `json:"expected"`
+	Lower       float64   `json:"lower"`
+	Upper       float64   `json:"upper"`
+	Score       float64   `json:"score"`
+}
+
+func mapDetectedAnomaliesToDBAnomalies(key anomaly.SeriesKey, detected []anomaly.Anomaly) []*repository.Anomaly {
+	detectedAt := time.Now()
+	dbAnomalies := make([]*repository.Anomaly, 0, len(detected))
+	for _, a := range detected {
+		dbAnomalies = append(dbAnomalies, &repository.Anomaly{
+			SensorID:    key.SensorID,
+			Measurement: key.Measurement,
+			Unit:        key.Unit,
+			Method:      string(a.Method),
+			Timestamp:   a.Timestamp,
+			Value:       a.Value,
+			Expected:    a.Expected,
+			Lower:       a.Lower,
+			Upper:       a.Upper,
+			Score:       a.Score,
+			DetectedAt:  detectedAt,
+		})
+	}
+	return dbAnomalies
+}
+
+func mapDBAnomaliesToAPIAnomalies(dbAnomalies []*repository.Anomaly) []*Anomaly {
+	anomalies := make([]*Anomaly, 0, len(dbAnomalies))
+	for _, a := range dbAnomalies {
+		anomalies = append(anomalies, &Anomaly{
+			SensorID:    a.SensorID,
+			Measurement: a.Measurement,
+			Unit:        a.Unit,
+			Method:      a.Method,
+			Timestamp:   a.Timestamp,
+			Value:       a.Value,
+			Expected:    a.Expected,
+			Lower:       a.Lower,
+			Upper:       a.Upper,
+			Score:       a.Score,
+		})
+	}
+	return anomalies
+}
+
+func mapDBMeasurementsToAPIMeasurements(dbMeasurements []*repository.Measurement) []*Measurement {
+	measurements := make([]*Measurement, 0, len(dbMeasurements))
+	for _, m := range dbMeasurements {
+		measurements = append(measurements, &Measurement{
+			Name:      m.Name,
+			SensorID:  m.SensorID,
+			Unit:      m.Unit,
+			Value:     m.Value,
+			Timestamp: m.Timestamp,
+			Labels:    m.Labels,
+		})
+	}
+	return measurements
+}
+
+type ChannelInput struct {
+	Variable    string `json:"variable"`
+	SensorID    string `json:"sensor_id"`
+	Measurement string `json:"measurement"`
+	Unit        string `json:"unit"`
+}
+
+func (i ChannelInput) ValidateWithContext(ctx context.Context) error {
+	fieldRules := []*validator.FieldRules{
+		validator.Field(&i.Variable, validator.Required),
+		validator.Field(&i.SensorID, validator.Required),
+		validator.Field(&i.Measurement, validator.Required),
+		validator.Field(&i.Unit, validator.Required),
+	}
+
+	return validator.ValidateStructWithContext(ctx, &i, fieldRules...)
+}
+
+type Channel struct {
+	ID         string         `json:"id,omitempty"`
+	SensorID   string         `json:"sensor_id"`
+	Name       string         `json:"name"`
+	Unit       string         `json:"unit"`
+	Expression string         `json:"expression"`
+	Inputs     []ChannelInput `json:"inputs"`
+	Alignment  string         `json:"alignment"`
+}
+
+func (ch Channel) ValidateWithContext(ctx context.Context) error {
+	fieldRules := []*validator.FieldRules{
+		validator.Field(&ch.Name, validator.Required),
+		validator.Field(&ch.Unit, validator.Required),
+		validator.Field(&ch.Expression, validator.Required, validator.By(func(value interface{}) error {
+			_, err := channel.ParseExpression(value.(string))
+			return err
+		})),
+		validator.Field(&ch.Inputs, validator.Required, validator.Length(1, 0)),
+		validator.Field(&ch.Alignment, validator.Required, validator.By(func(value interface{}) error {
+			alignment, err := time.ParseDuration(value.(string))
+			if err != nil {
+				return errors.New("must be a valid duration")
+			}
+			if alignment <= 0 {
+				return errors.New("must be positive")
+			}
+			return nil
+		})),
+	}
+
+	return validator.ValidateStructWithContext(ctx, &ch, fieldRules...)
+}
+
+func mapAPIChannelToDBChannel(apiChannel *Channel) *repository.Channel {
+	// The alignment is validated beforehand
+	alignment, _ := time.ParseDuration(apiChannel.Alignment)
+
+	inputs := make([]repository.ChannelInput, 0, len(apiChannel.Inputs))
+	for _, input := range apiChannel.Inputs {
+		inputs = append(inputs, repository.ChannelInput{
+			Variable:    input.Variable,
+			SensorID:    input.SensorID,
+			Measurement: input.Measurement,
+			Unit:        input.Unit,
+		})
+	}
+
+	return &repository.Channel{
+		SensorID:   apiChannel.SensorID,
+		Name:       apiChannel.Name,
+		Unit:       apiChannel.Unit,
+		Expression: apiChannel.Expression,
+		Inputs:     inputs,
+		Alignment:  alignment,
+	}
+}
+
+func mapDBChannelToAPIChannel(dbChannel *repository.Channel) *Channel {
+	inputs := make([]ChannelInput, 0, len(dbChannel.Inputs))
+	for _, input := range dbChannel.Inputs {
+		inputs = append(inputs, ChannelInput{
+			Variable:    input.Variable,
+			SensorID:    input.SensorID,
+			Measurement: input.Measurement,
+			Unit:        input.Unit,
+		})
+	}
+
+	return &Channel{
+		ID:         dbChannel.ID.Hex(),
+		SensorID:   dbChannel.SensorID,
+		Name:       dbChannel.Name,
+		Unit:       dbChannel.Unit,
+		Expression: dbChannel.Expression,
+		Inputs:     inputs,
+		Alignment:  dbChannel.Alignment.String(),
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/channel"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+const (
+	hintAggregate   = "use the aggregate endpoint instead"
+	hintNarrowRange = "narrow the time range instead"
+)
+
+// QueryGuardrails rejects the time ranges longer than maxRange before the handler queries them,
+// telling the client what to do instead with hint, and bounds the queries of the handler with the
+// timeout. Missing or invalid ranges are left for the handler to report. The streamed exports run
+// after their handler returns, so they carry the deadline over to the stream themselves.
+func QueryGuardrails(timeout, maxRange time.Duration, hint string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Query("start") != "" || c.Query("end") != "" {
+			startTime, endTime, err := parseTimeRange(c)
+			if err == nil && endTime.Sub(startTime) > maxRange {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": fmt.Sprintf("the time range can't be longer than %s, %s", formatRange(maxRange), hint),
+				})
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+		c.SetUserContext(ctx)
+		return c.Next()
+	}
+}
+
+// queryFailed answers a failed query. The queries that matched too many points or timed out are
+// the client's to change, so they're told how rather than getting a 500.
+func queryFailed(c *fiber.Ctx, err error, message string) error {
+	var tooManyPoints *repository.TooManyPointsError
+	var partitionTooLarge *repository.PartitionTooLargeError
+	switch {
+	case errors.As(err, &tooManyPoints):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": fmt.Sprintf("the query matches more than %d points, %s", tooManyPoints.Max, hintAggregate),
+		})
+	case errors.As(err, &partitionTooLarge):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": fmt.Sprintf("a partition of the time range matches more than %d points, narrow the sensors or the measurement", partitionTooLarge.Max),
+		})
+	case errors.Is(err, channel.ErrVirtualInput):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "the channel has another channel as input, which isn't supported",
+		})
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(c.UserContext().Err(), context.DeadlineExceeded):
+		log.Warn().Err(err).Msg("query timed out")
+		return c.Status(fiber.StatusGatewayTimeout).JSON(fiber.Map{
+			"error": "the query timed out, narrow the time range or " + hintAggregate,
+		})
+	}
+
+	log.Error().Err(err).Msg(message)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+	})
+}
+
+// formatRange formats whole days as such, since durations only go up to hours.
+func formatRange(d time.Duration) string {
+	const day = 24 * time.Hour
+	if d >= day && d%day == 0 {
+		return fmt.Sprintf("%d days", d/day)
+	}
+	return d.String()
+}
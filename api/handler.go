@@ -1,15 +1,24 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/anomaly"
+	"github.com/zignd/pingthings-collaborative-technical-interview/channel"
+	"github.com/zignd/pingthings-collaborative-technical-interview/dedup"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ingest"
 	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func PostSensor(sensorsRepository *repository.SensorsRepository) func(c *fiber.Ctx) error {
+func PostSensor(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		var sensor Sensor
 		if err := c.BodyParser(&sensor); err != nil {
@@ -29,30 +38,38 @@ func PostSensor(sensorsRepository *repository.SensorsRepository) func(c *fiber.C
 			})
 		}
 
-		dbSensor := &repository.Sensor{
-			Name: sensor.Name,
-			Location: repository.GeoJSONPoint{
-				Type:        "Point",
-				Coordinates: []float64{sensor.Location.Longitude, sensor.Location.Latitude},
-			},
-			Tags: sensor.Tags,
-		}
+		dbSensor := mapAPISensorToDBSensor(&sensor)
 
-		if err := sensorsRepository.CreateSensor(ctx, dbSensor); err != nil {
+		created, err := sensorsRepository.RegisterSensor(ctx, dbSensor)
+		if errors.Is(err, repository.ErrNameTaken) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if err != nil {
 			log.Error().Err(err).Msg("failed to create sensor")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "failed to create sensor",
 			})
 		}
 
-		c.Status(fiber.StatusCreated)
+		setETag(c, dbSensor)
+		// A sensor registered again with its external ID gets the existing sensor back
+		if created {
+			c.Status(fiber.StatusCreated)
+		}
 		return c.JSON(mapDBSensorToAPISensor(dbSensor))
 	}
 }
 
-func GetSensorByID(sensorsRepository *repository.SensorsRepository) func(c *fiber.Ctx) error {
+func GetSensorByID(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		dbSensor, err := sensorsRepository.GetSensorByID(c.UserContext(), c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("failed to get sensor")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -60,13 +77,19 @@ func GetSensorByID(sensorsRepository *repository.SensorsRepository) func(c *fibe
 			})
 		}
 
+		setETag(c, dbSensor)
 		return c.JSON(mapDBSensorToAPISensor(dbSensor))
 	}
 }
 
-func GetSensorByName(sensorsRepository *repository.SensorsRepository) func(c *fiber.Ctx) error {
+func GetSensorByName(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		dbSensor, err := sensorsRepository.GetSensorByName(c.UserContext(), c.Params("name"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("failed to get sensor")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -74,11 +97,12 @@ func GetSensorByName(sensorsRepository *repository.SensorsRepository) func(c *fi
 			})
 		}
 
+		setETag(c, dbSensor)
 		return c.JSON(mapDBSensorToAPISensor(dbSensor))
 	}
 }
 
-func GetNearestSensor(sensorsRepository *repository.SensorsRepository) func(c *fiber.Ctx) error {
+func GetNearestSensor(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		latitude := c.Query("latitude")
 		float64Latitude, err := strconv.ParseFloat(latitude, 64)
@@ -125,8 +149,15 @@ func GetNearestSensor(sensorsRepository *repository.SensorsRepository) func(c *f
 	}
 }
 
-func PutSensor(sensorsRepository *repository.SensorsRepository) func(c *fiber.Ctx) error {
+func PutSensor(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
+		expectedVersion, err := parseIfMatch(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
 		var sensor Sensor
 		if err := c.BodyParser(&sensor); err != nil {
 			log.Warn().Err(err).Msg("invalid request body")
@@ -136,7 +167,7 @@ func PutSensor(sensorsRepository *repository.SensorsRepository) func(c *fiber.Ct
 		}
 
 		ctx := c.UserContext()
-		err := sensor.ValidateWithContext(ctx)
+		err = sensor.ValidateWithContext(ctx)
 		if err != nil {
 			log.Warn().Err(err).Msg("invalid sensor")
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -145,27 +176,31 @@ func PutSensor(sensorsRepository *repository.SensorsRepository) func(c *fiber.Ct
 			})
 		}
 
-		dbSensor := &repository.Sensor{
-			Name: sensor.Name,
-			Location: repository.GeoJSONPoint{
-				Type:        "Point",
-				Coordinates: []float64{sensor.Location.Longitude, sensor.Location.Latitude},
-			},
-			Tags: sensor.Tags,
-		}
-
-		if err := sensorsRepository.UpdateSensor(ctx, c.Params("id"), dbSensor); err != nil {
+		dbSensor := mapAPISensorToDBSensor(&sensor)
+
+		if err := sensorsRepository.UpdateSensor(ctx, c.Params("id"), dbSensor, expectedVersion); err != nil {
+			if errors.Is(err, repository.ErrVersionConflict) {
+				return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			if errors.Is(err, repository.ErrNameTaken) {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
 			log.Error().Err(err).Msg("failed to update sensor")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "failed to update sensor",
 			})
 		}
 
+		setETag(c, dbSensor)
 		return c.JSON(mapDBSensorToAPISensor(dbSensor))
 	}
 }
 
-func PostMeasurement(sensorsRepository *repository.SensorsRepository, measurementRepository *repository.MeasurementRepository) func(c *fiber.Ctx) error {
+func PostMeasurement(sensorsRepository repository.SensorsRepository, pipeline *ingest.Pipeline, deduplicator *dedup.Deduplicator, anomalyMonitor *anomaly.Monitor, anomaliesRepository repository.AnomaliesRepository) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		var measurement Measurement
 		if err := c.BodyParser(&measurement); err != nil {
@@ -186,50 +221,145 @@ func PostMeasurement(sensorsRepository *repository.SensorsRepository, measuremen
 		}
 
 		sensor, err := sensorsRepository.GetSensorByID(ctx, c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("failed to get sensor")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "failed to get sensor",
 			})
 		}
-		if sensor == nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "sensor not found",
-			})
-		}
 
 		dbMeasurement := mapAPIMeasurementToDBMeasurement(&measurement)
 		dbMeasurement.SensorID = sensor.ID.Hex()
+		dbMeasurement.Labels = sensor.Labels
+		if dbMeasurement.Timestamp.IsZero() {
+			dbMeasurement.Timestamp = time.Now()
+		}
 
-		if err := measurementRepository.CreateMeasurement(ctx, dbMeasurement); err != nil {
-			log.Error().Err(err).Msg("failed to create measurement")
+		admitted, err := deduplicator.Admit(ctx, dbMeasurement)
+		if errors.Is(err, dedup.ErrDuplicate) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to check for duplicate measurements")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to create measurement",
+				"error": "failed to check for duplicate measurements",
+			})
+		}
+		if !admitted {
+			// Kept the measurement that was already there, nothing is written
+			measurement.SensorID = dbMeasurement.SensorID
+			measurement.Timestamp = dbMeasurement.Timestamp
+			measurement.Labels = dbMeasurement.Labels
+			return c.JSON(measurement)
+		}
+
+		if err := pipeline.Enqueue(dbMeasurement); err != nil {
+			log.Warn().Err(err).Msg("failed to enqueue measurement")
+			deduplicator.Forget(dbMeasurement)
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(max(1, int(pipeline.RetryAfter().Seconds()))))
+			status := fiber.StatusServiceUnavailable
+			if errors.Is(err, ingest.ErrQueueFull) {
+				status = fiber.StatusTooManyRequests
+			}
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
 			})
 		}
 
 		measurement.SensorID = dbMeasurement.SensorID
 		measurement.Timestamp = dbMeasurement.Timestamp
+		measurement.Labels = dbMeasurement.Labels
 
-		c.Status(fiber.StatusCreated)
+		seriesKey := anomaly.SeriesKey{
+			SensorID:    dbMeasurement.SensorID,
+			Measurement: dbMeasurement.Name,
+			Unit:        dbMeasurement.Unit,
+		}
+		if detected := anomalyMonitor.Observe(seriesKey, dbMeasurement.Timestamp, dbMeasurement.Value); len(detected) > 0 {
+			// The measurement is already accepted, so failing to record the anomaly shouldn't fail the request
+			if err := anomaliesRepository.SaveAnomalies(ctx, mapDetectedAnomaliesToDBAnomalies(seriesKey, detected)); err != nil {
+				log.Error().Err(err).Msg("failed to save anomalies")
+			}
+		}
+
+		c.Status(fiber.StatusAccepted)
 		return c.JSON(measurement)
 	}
 }
 
-func GetMeasurementSummary(sensorsRepository *repository.SensorsRepository, measurementRepository *repository.MeasurementRepository) func(c *fiber.Ctx) error {
+func GetIngestStats(pipeline *ingest.Pipeline) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(pipeline.Stats())
+	}
+}
+
+func GetMeasurements(sensorsRepository repository.SensorsRepository, resolver *channel.Resolver) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		sensor, err := sensorsRepository.GetSensorByID(c.UserContext(), c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("failed to get sensor")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "failed to get sensor",
 			})
 		}
-		if sensor == nil {
+
+		measurement := c.Query("measurement")
+		if measurement == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "measurement query parameter is required",
+			})
+		}
+
+		unit := c.Query("unit")
+		if unit == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "unit query parameter is required",
+			})
+		}
+
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		measurements, err := resolver.GetMeasurements(c.UserContext(), sensor.ID.Hex(), measurement, unit, startTime, endTime)
+		if err != nil {
+			return queryFailed(c, err, "failed to get measurements")
+		}
+
+		return c.JSON(mapDBMeasurementsToAPIMeasurements(measurements))
+	}
+}
+
+func GetAggregatedMeasurements(sensorsRepository repository.SensorsRepository, resolver *channel.Resolver) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		sensor, err := sensorsRepository.GetSensorByID(c.UserContext(), c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"error": "sensor not found",
 			})
 		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor",
+			})
+		}
 
 		measurement := c.Query("measurement")
 		if measurement == "" {
@@ -245,37 +375,78 @@ func GetMeasurementSummary(sensorsRepository *repository.SensorsRepository, meas
 			})
 		}
 
-		start := c.Query("start")
-		end := c.Query("end")
-		if start == "" || end == "" {
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "start and end query parameters are required",
+				"error": err.Error(),
 			})
 		}
 
-		startTime, err := time.Parse(time.RFC3339, start)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to parse start query parameter")
+		every, err := time.ParseDuration(c.Query("every"))
+		if err != nil || every <= 0 {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "failed to parse start query parameter",
+				"error": "every query parameter must be a positive duration",
 			})
 		}
 
-		endTime, err := time.Parse(time.RFC3339, end)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to parse end query parameter")
+		fn := c.Query("fn", "mean")
+		measurements, err := resolver.GetAggregatedMeasurements(c.UserContext(), sensor.ID.Hex(), measurement, unit, startTime, endTime, every, fn)
+		var unsupportedFunction *channel.UnsupportedFunctionError
+		if errors.As(err, &unsupportedFunction) {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "failed to parse end query parameter",
+				"error": fmt.Sprintf("fn query parameter must be one of %s", strings.Join(channel.AggregateFunctions, ", ")),
 			})
 		}
+		if err != nil {
+			return queryFailed(c, err, "failed to get aggregated measurements")
+		}
+
+		return c.JSON(mapDBMeasurementsToAPIMeasurements(measurements))
+	}
+}
 
-		summary, err := measurementRepository.GetMeasurementSummary(c.UserContext(), sensor.ID.Hex(), measurement, unit, startTime, endTime)
+func GetMeasurementSummary(sensorsRepository repository.SensorsRepository, resolver *channel.Resolver) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		sensor, err := sensorsRepository.GetSensorByID(c.UserContext(), c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
 		if err != nil {
-			log.Error().Err(err).Msg("failed to get measurement summary")
+			log.Error().Err(err).Msg("failed to get sensor")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to get measurement summary",
+				"error": "failed to get sensor",
 			})
 		}
+
+		measurement := c.Query("measurement")
+		if measurement == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "measurement query parameter is required",
+			})
+		}
+
+		unit := c.Query("unit")
+		if unit == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "unit query parameter is required",
+			})
+		}
+
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		summary, err := resolver.GetMeasurementSummary(c.UserContext(), sensor.ID.Hex(), measurement, unit, startTime, endTime)
+		if err != nil {
+			return queryFailed(c, err, "failed to get measurement summary")
+		}
 		if summary.Count == 0 {
 			return c.JSON(fiber.Map{
 				"message": "no measurements found for the specified time range",
@@ -285,3 +456,29 @@ func GetMeasurementSummary(sensorsRepository *repository.SensorsRepository, meas
 		return c.JSON(summary)
 	}
 }
+
+// parseTimeRange parses the start and end query parameters. The error message is meant to be
+// returned to the client.
+func parseTimeRange(c *fiber.Ctx) (time.Time, time.Time, error) {
+	start := c.Query("start")
+	end := c.Query("end")
+	if start == "" || end == "" {
+		return time.Time{}, time.Time{}, errors.New("start and end query parameters are required")
+	}
+
+	startTime, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("failed to parse start query parameter")
+	}
+
+	endTime, err := time.Parse(time.RFC3339, end)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("failed to parse end query parameter")
+	}
+
+	if !endTime.After(startTime) {
+		return time.Time{}, time.Time{}, errors.New("end must be after start")
+	}
+
+	return startTime, endTime, nil
+}
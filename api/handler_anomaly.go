@@ -0,0 +1,116 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/anomaly"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func GetAnomalies(sensorsRepository repository.SensorsRepository, anomaliesRepository repository.AnomaliesRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		sensor, err := sensorsRepository.GetSensorByID(ctx, c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor",
+			})
+		}
+
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		dbAnomalies, err := anomaliesRepository.GetAnomalies(ctx, sensor.ID.Hex(), c.Query("measurement"), c.Query("unit"), startTime, endTime)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get anomalies")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get anomalies",
+			})
+		}
+
+		return c.JSON(mapDBAnomaliesToAPIAnomalies(dbAnomalies))
+	}
+}
+
+// DetectAnomalies runs the detectors over a historical range of a series and stores whatever
+// they flag alongside the anomalies found on write.
+func DetectAnomalies(sensorsRepository repository.SensorsRepository, measurementRepository repository.MeasurementRepository, anomalyMonitor *anomaly.Monitor, anomaliesRepository repository.AnomaliesRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		sensor, err := sensorsRepository.GetSensorByID(ctx, c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor",
+			})
+		}
+
+		measurement := c.Query("measurement")
+		if measurement == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "measurement query parameter is required",
+			})
+		}
+
+		unit := c.Query("unit")
+		if unit == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "unit query parameter is required",
+			})
+		}
+
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		measurements, err := measurementRepository.GetMeasurements(ctx, sensor.ID.Hex(), measurement, unit, startTime, endTime)
+		if err != nil {
+			return queryFailed(c, err, "failed to get measurements")
+		}
+
+		seriesKey := anomaly.SeriesKey{
+			SensorID:    sensor.ID.Hex(),
+			Measurement: measurement,
+			Unit:        unit,
+		}
+		detector := anomaly.NewDetector(anomalyMonitor.Config())
+		var detected []anomaly.Anomaly
+		for _, m := range measurements {
+			detected = append(detected, detector.Observe(m.Timestamp, m.Value)...)
+		}
+
+		dbAnomalies := mapDetectedAnomaliesToDBAnomalies(seriesKey, detected)
+		if err := anomaliesRepository.SaveAnomalies(ctx, dbAnomalies); err != nil {
+			log.Error().Err(err).Msg("failed to save anomalies")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to save anomalies",
+			})
+		}
+
+		return c.JSON(mapDBAnomaliesToAPIAnomalies(dbAnomalies))
+	}
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// findAsset gets the asset of the id route parameter. When it returns no asset, the response was
+// already sent and the error is the one of sending it.
+func findAsset(c *fiber.Ctx, assetsRepository repository.AssetsRepository) (*repository.Asset, error) {
+	asset, err := assetsRepository.GetAsset(c.UserContext(), c.Params("id"))
+	if err != nil && !errors.Is(err, primitive.ErrInvalidHex) {
+		log.Error().Err(err).Msg("failed to get asset")
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to get asset",
+		})
+	}
+	if asset == nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "asset not found",
+		})
+	}
+	return asset, nil
+}
+
+func PostAsset(assetsRepository repository.AssetsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var asset Asset
+		if err := c.BodyParser(&asset); err != nil {
+			log.Warn().Err(err).Msg("invalid request body")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+
+		if err := asset.ValidateWithContext(c.UserContext()); err != nil {
+			log.Warn().Err(err).Msg("invalid asset")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid asset",
+				"details": err,
+			})
+		}
+
+		dbAsset := mapAPIAssetToDBAsset(&asset)
+		err := assetsRepository.CreateAsset(c.UserContext(), dbAsset)
+		switch {
+		case errors.Is(err, repository.ErrInvalidAssetParent):
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "a site can't have a parent, a building must be under a site and a room under a building",
+			})
+		case errors.Is(err, repository.ErrAssetNameTaken):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		case err != nil:
+			log.Error().Err(err).Msg("failed to create asset")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to create asset",
+			})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(mapDBAssetToAPIAsset(dbAsset))
+	}
+}
+
+// GetAssets lists the children of the asset of the parent_id query parameter, or the sites
+// without it.
+func GetAssets(assetsRepository repository.AssetsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		assets, err := assetsRepository.GetAssets(c.UserContext(), c.Query("parent_id"))
+		if errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "parent_id query parameter must be a valid asset ID",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get assets")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get assets",
+			})
+		}
+
+		return c.JSON(mapDBAssetsToAPIAssets(assets))
+	}
+}
+
+func GetAsset(assetsRepository repository.AssetsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		asset, err := findAsset(c, assetsRepository)
+		if asset == nil {
+			return err
+		}
+
+		return c.JSON(mapDBAssetToAPIAsset(asset))
+	}
+}
+
+// PutAsset renames the asset and replaces its description, the kind and the parent can't be
+// changed.
+func PutAsset(assetsRepository repository.AssetsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		current, err := findAsset(c, assetsRepository)
+		if current == nil {
+			return err
+		}
+
+		var asset Asset
+		if err := c.BodyParser(&asset); err != nil {
+			log.Warn().Err(err).Msg("invalid request body")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+		asset.Kind = string(current.Kind)
+		asset.ParentID = ""
+
+		if err := asset.ValidateWithContext(c.UserContext()); err != nil {
+			log.Warn().Err(err).Msg("invalid asset")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid asset",
+				"details": err,
+			})
+		}
+
+		dbAsset := mapAPIAssetToDBAsset(&asset)
+		err = assetsRepository.UpdateAsset(c.UserContext(), current.ID.Hex(), dbAsset)
+		switch {
+		case errors.Is(err, repository.ErrAssetNameTaken):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "asset not found",
+			})
+		case err != nil:
+			log.Error().Err(err).Msg("failed to update asset")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to update asset",
+			})
+		}
+
+		return c.JSON(mapDBAssetToAPIAsset(dbAsset))
+	}
+}
+
+func DeleteAsset(assetsRepository repository.AssetsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		deleted, err := assetsRepository.DeleteAsset(c.UserContext(), c.Params("id"))
+		switch {
+		case errors.Is(err, primitive.ErrInvalidHex):
+			deleted = false
+		case errors.Is(err, repository.ErrAssetNotEmpty):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		case err != nil:
+			log.Error().Err(err).Msg("failed to delete asset")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to delete asset",
+			})
+		}
+		if !deleted {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "asset not found",
+			})
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// PutAssetSensor attaches the sensor to the asset, moving it out of the asset it was attached to.
+func PutAssetSensor(assetsRepository repository.AssetsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		asset, err := findAsset(c, assetsRepository)
+		if asset == nil {
+			return err
+		}
+
+		attached, err := assetsRepository.AttachSensor(c.UserContext(), asset, c.Params("sensorID"))
+		if err != nil && !errors.Is(err, primitive.ErrInvalidHex) {
+			log.Error().Err(err).Msg("failed to attach sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to attach sensor",
+			})
+		}
+		if !attached {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func DeleteAssetSensor(assetsRepository repository.AssetsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		asset, err := findAsset(c, assetsRepository)
+		if asset == nil {
+			return err
+		}
+
+		detached, err := assetsRepository.DetachSensor(c.UserContext(), asset, c.Params("sensorID"))
+		if err != nil && !errors.Is(err, primitive.ErrInvalidHex) {
+			log.Error().Err(err).Msg("failed to detach sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to detach sensor",
+			})
+		}
+		if !detached {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not attached to the asset",
+			})
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// GetAssetSensors lists the sensors attached to the asset or to any asset under it.
+func GetAssetSensors(assetsRepository repository.AssetsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		asset, err := findAsset(c, assetsRepository)
+		if asset == nil {
+			return err
+		}
+
+		sensors, err := assetsRepository.GetAssetSensors(c.UserContext(), asset)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get asset sensors")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get asset sensors",
+			})
+		}
+
+		return c.JSON(mapDBSensorsToAPISensors(sensors))
+	}
+}
+
+// GetAssetMeasurementSummary summarizes the series of every sensor under the asset as if they
+// were a single series.
+func GetAssetMeasurementSummary(assetsRepository repository.AssetsRepository, measurementRepository repository.MeasurementRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		asset, err := findAsset(c, assetsRepository)
+		if asset == nil {
+			return err
+		}
+
+		measurement := c.Query("measurement")
+		if measurement == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "measurement query parameter is required",
+			})
+		}
+
+		unit := c.Query("unit")
+		if unit == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "unit query parameter is required",
+			})
+		}
+
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		sensors, err := assetsRepository.GetAssetSensors(c.UserContext(), asset)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get asset sensors")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get asset sensors",
+			})
+		}
+		sensorIDs := make([]string, 0, len(sensors))
+		for _, sensor := range sensors {
+			sensorIDs = append(sensorIDs, sensor.ID.Hex())
+		}
+
+		summary, err := measurementRepository.GetSensorsMeasurementSummary(c.UserContext(), sensorIDs, measurement, unit, startTime, endTime)
+		if err != nil {
+			return queryFailed(c, err, "failed to get measurement summary")
+		}
+		if summary.Count == 0 {
+			return c.JSON(fiber.Map{
+				"message": "no measurements found for the specified time range",
+			})
+		}
+
+		return c.JSON(summary)
+	}
+}
+
+// ExportAssetMeasurements exports the measurements of every sensor under the asset.
+func ExportAssetMeasurements(assetsRepository repository.AssetsRepository, measurementRepository repository.MeasurementRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		asset, err := findAsset(c, assetsRepository)
+		if asset == nil {
+			return err
+		}
+
+		sensors, err := assetsRepository.GetAssetSensors(c.UserContext(), asset)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get asset sensors")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get asset sensors",
+			})
+		}
+		if len(sensors) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "no sensor attached under the asset",
+			})
+		}
+
+		return exportMeasurements(c, measurementRepository, sensors)
+	}
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/channel"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func PostChannel(sensorsRepository repository.SensorsRepository, channelsRepository repository.ChannelsRepository, resolver *channel.Resolver) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var ch Channel
+		if err := c.BodyParser(&ch); err != nil {
+			log.Warn().Err(err).Msg("invalid request body")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+
+		ctx := c.UserContext()
+		if err := ch.ValidateWithContext(ctx); err != nil {
+			log.Warn().Err(err).Msg("invalid channel")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid channel",
+				"details": err,
+			})
+		}
+
+		sensor, err := sensorsRepository.GetSensorByID(ctx, c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor",
+			})
+		}
+
+		// The expression was already parsed by the validation
+		expression, _ := channel.ParseExpression(ch.Expression)
+		inputs := map[string]bool{}
+		for _, input := range ch.Inputs {
+			inputs[input.Variable] = true
+
+			if _, err := sensorsRepository.GetSensorByID(ctx, input.SensorID); err != nil {
+				if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+						"error": fmt.Sprintf("sensor %s of input %s not found", input.SensorID, input.Variable),
+					})
+				}
+				log.Error().Err(err).Msg("failed to get input sensor")
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "failed to get input sensor",
+				})
+			}
+		}
+		for _, variable := range expression.Variables() {
+			if !inputs[variable] {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": fmt.Sprintf("variable %s of the expression has no input", variable),
+				})
+			}
+		}
+
+		dbChannel := mapAPIChannelToDBChannel(&ch)
+		if err := resolver.ValidateInputs(ctx, dbChannel.Inputs); err != nil {
+			if errors.Is(err, channel.ErrVirtualInput) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			log.Error().Err(err).Msg("failed to validate the channel inputs")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to validate the channel inputs",
+			})
+		}
+
+		dbChannel.SensorID = sensor.ID.Hex()
+
+		if err := channelsRepository.CreateChannel(ctx, dbChannel); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "a channel with the same name and unit already exists for this sensor",
+				})
+			}
+			log.Error().Err(err).Msg("failed to create channel")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to create channel",
+			})
+		}
+
+		c.Status(fiber.StatusCreated)
+		return c.JSON(mapDBChannelToAPIChannel(dbChannel))
+	}
+}
+
+func GetChannels(channelsRepository repository.ChannelsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		dbChannels, err := channelsRepository.GetChannels(c.UserContext(), c.Params("id"))
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get channels")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get channels",
+			})
+		}
+
+		channels := make([]*Channel, 0, len(dbChannels))
+		for _, dbChannel := range dbChannels {
+			channels = append(channels, mapDBChannelToAPIChannel(dbChannel))
+		}
+
+		return c.JSON(channels)
+	}
+}
+
+func DeleteChannel(channelsRepository repository.ChannelsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		deleted, err := channelsRepository.DeleteChannel(c.UserContext(), c.Params("id"), c.Params("channelID"))
+		if err != nil {
+			log.Error().Err(err).Msg("failed to delete channel")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to delete channel",
+			})
+		}
+		if !deleted {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "channel not found",
+			})
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"crypto/subtle"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+)
+
+// GetConfig dumps the current configuration for debugging, with the source of each setting and
+// the secrets redacted. The rest of the configuration still tells a lot about the deployment, so
+// only the holders of the admin token can read it, and none can when there's no token.
+func GetConfig(loader *config.Loader, token string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if !bearerToken(c, token) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "missing or invalid admin token",
+			})
+		}
+
+		return c.JSON(loader.Dump())
+	}
+}
+
+// bearerToken tells whether the request carries the token as a bearer token, never when the
+// token is empty.
+func bearerToken(c *fiber.Ctx, token string) bool {
+	authorization := []byte(c.Get(fiber.HeaderAuthorization))
+	return token != "" && subtle.ConstantTimeCompare(authorization, []byte("Bearer "+token)) == 1
+}
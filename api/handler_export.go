@@ -0,0 +1,197 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/export"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func ExportSensorMeasurements(sensorsRepository repository.SensorsRepository, measurementRepository repository.MeasurementRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		sensor, err := sensorsRepository.GetSensorByID(c.UserContext(), c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor",
+			})
+		}
+
+		return exportMeasurements(c, measurementRepository, []*repository.Sensor{sensor})
+	}
+}
+
+func ExportTaggedMeasurements(sensorsRepository repository.SensorsRepository, measurementRepository repository.MeasurementRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		tag := c.Query("tag")
+		if tag == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "tag query parameter is required",
+			})
+		}
+
+		sensors, err := sensorsRepository.GetSensorsByTag(c.UserContext(), tag)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensors")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensors",
+			})
+		}
+		if len(sensors) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "no sensor found with the specified tag",
+			})
+		}
+
+		return exportMeasurements(c, measurementRepository, sensors)
+	}
+}
+
+// exportMeasurements streams the measurements of the sensors in the requested format. Once the
+// response starts being written its status can't change anymore, so failures from that point on
+// are only logged and the response is cut short.
+func exportMeasurements(c *fiber.Ctx, measurementRepository repository.MeasurementRepository, sensors []*repository.Sensor) error {
+	format, err := export.ParseFormat(c.Query("format", string(export.FormatCSV)))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "format query parameter must be one of csv, ndjson or parquet",
+		})
+	}
+
+	startTime, endTime, err := parseTimeRange(c)
+	if err != nil {
+		log.Warn().Err(err).Msg("invalid time range")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	measurement := c.Query("measurement")
+	unit := c.Query("unit")
+
+	sensorsByID := make(map[string]*repository.Sensor, len(sensors))
+	sensorIDs := make([]string, 0, len(sensors))
+	for _, sensor := range sensors {
+		sensorsByID[sensor.ID.Hex()] = sensor
+		sensorIDs = append(sensorIDs, sensor.ID.Hex())
+	}
+
+	c.Set(fiber.HeaderContentType, format.ContentType())
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="measurements-%s.%s"`, time.Now().UTC().Format("20060102T150405Z"), format))
+
+	// The body stream writer runs after the handler returns, when the request context can't be
+	// used anymore, only its span and the deadline of the export are kept
+	spanContext := trace.SpanContextFromContext(c.UserContext())
+	deadline, hasDeadline := c.UserContext().Deadline()
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithCancel(trace.ContextWithSpanContext(context.Background(), spanContext))
+		defer cancel()
+		if hasDeadline {
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+
+		// The query is cancelled as soon as a write fails, which is also how a closed connection
+		// shows, so a client going away doesn't leave the export running
+		stream := &exportStream{writer: w, cancel: cancel, flushedAt: time.Now()}
+		writer, err := export.NewWriter(format, stream)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to start export")
+			return
+		}
+
+		err = measurementRepository.StreamMeasurements(ctx, sensorIDs, measurement, unit, startTime, endTime, func(m *repository.Measurement) error {
+			sensor := sensorsByID[m.SensorID]
+			err := writer.Write(&export.Row{
+				Timestamp:   m.Timestamp,
+				SensorID:    m.SensorID,
+				SensorName:  sensor.Name,
+				SensorTags:  sensor.Tags,
+				Longitude:   sensor.Location.Coordinates[0],
+				Latitude:    sensor.Location.Coordinates[1],
+				Measurement: m.Name,
+				Unit:        m.Unit,
+				Value:       m.Value,
+			})
+			if err != nil {
+				return err
+			}
+			return stream.flushEvery(exportFlushInterval)
+		})
+		if err != nil {
+			if stream.err != nil {
+				log.Warn().Err(stream.err).Msg("export cut short by the client")
+				return
+			}
+			log.Error().Err(err).Msg("failed to export measurements")
+			return
+		}
+
+		if err := writer.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to finish export")
+			return
+		}
+		if err := w.Flush(); err != nil {
+			log.Error().Err(err).Msg("failed to flush export")
+		}
+	})
+
+	return nil
+}
+
+// exportFlushInterval is how often the rows written are sent to the client, which is also how
+// soon a closed connection is noticed while rows keep coming.
+const exportFlushInterval = time.Second
+
+// exportStream writes an export to the response, cancelling it once a write fails.
+type exportStream struct {
+	writer    *bufio.Writer
+	cancel    context.CancelFunc
+	flushedAt time.Time
+	err       error
+}
+
+func (s *exportStream) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	if err != nil {
+		s.fail(err)
+	}
+	return n, err
+}
+
+// flushEvery sends the rows buffered so far once the interval has passed since the last time.
+func (s *exportStream) flushEvery(interval time.Duration) error {
+	if s.err != nil {
+		return s.err
+	}
+	if time.Since(s.flushedAt) < interval {
+		return nil
+	}
+	s.flushedAt = time.Now()
+	if err := s.writer.Flush(); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (s *exportStream) fail(err error) {
+	if s.err == nil {
+		s.err = err
+		s.cancel()
+	}
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PostSensorLocation records a position of a mobile sensor, moving the sensor there, and returns
+// the geofences it entered and exited.
+func PostSensorLocation(sensorsRepository repository.SensorsRepository, tracksRepository repository.TracksRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var point TrackPoint
+		if err := c.BodyParser(&point); err != nil {
+			log.Warn().Err(err).Msg("invalid request body")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+
+		ctx := c.UserContext()
+		if err := point.ValidateWithContext(ctx); err != nil {
+			log.Warn().Err(err).Msg("invalid location")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid location",
+				"details": err,
+			})
+		}
+
+		sensor, err := sensorsRepository.GetSensorByID(ctx, c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor",
+			})
+		}
+
+		if point.Timestamp.IsZero() {
+			point.Timestamp = time.Now()
+		}
+		events, err := tracksRepository.RecordLocation(ctx, &repository.TrackPoint{
+			SensorID:  sensor.ID,
+			Timestamp: point.Timestamp,
+			Location: repository.GeoJSONPoint{
+				Type:        "Point",
+				Coordinates: []float64{point.Longitude, point.Latitude},
+			},
+			Altitude: point.Altitude,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("failed to record location")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to record location",
+			})
+		}
+
+		for _, event := range events {
+			log.Info().
+				Str("sensor_id", event.SensorID.Hex()).
+				Str("geofence_id", event.GeofenceID.Hex()).
+				Str("type", event.Type).
+				Msg("sensor crossed a geofence")
+		}
+
+		return c.JSON(fiber.Map{
+			"location": point,
+			"events":   mapDBGeofenceEventsToAPIGeofenceEvents(events),
+		})
+	}
+}
+
+func GetSensorTrack(sensorsRepository repository.SensorsRepository, tracksRepository repository.TracksRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		sensor, err := sensorsRepository.GetSensorByID(c.UserContext(), c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor",
+			})
+		}
+
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		points, err := tracksRepository.GetTrack(c.UserContext(), sensor.ID, startTime, endTime)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get track")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get track",
+			})
+		}
+
+		return c.JSON(mapDBTrackPointsToAPITrackPoints(points))
+	}
+}
+
+func GetSensorGeofenceEvents(sensorsRepository repository.SensorsRepository, geofencesRepository repository.GeofencesRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		sensor, err := sensorsRepository.GetSensorByID(c.UserContext(), c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor",
+			})
+		}
+
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		events, err := geofencesRepository.GetSensorEvents(c.UserContext(), sensor.ID, startTime, endTime)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get geofence events")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get geofence events",
+			})
+		}
+
+		return c.JSON(mapDBGeofenceEventsToAPIGeofenceEvents(events))
+	}
+}
+
+func PostGeofence(geofencesRepository repository.GeofencesRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var geofence Geofence
+		if err := c.BodyParser(&geofence); err != nil {
+			log.Warn().Err(err).Msg("invalid request body")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+
+		if err := geofence.ValidateWithContext(c.UserContext()); err != nil {
+			log.Warn().Err(err).Msg("invalid geofence")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid geofence",
+				"details": err,
+			})
+		}
+
+		dbGeofence := mapAPIGeofenceToDBGeofence(&geofence)
+		err := geofencesRepository.CreateGeofence(c.UserContext(), dbGeofence)
+		switch {
+		case errors.Is(err, repository.ErrInvalidGeofenceArea):
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		case mongo.IsDuplicateKeyError(err):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "a geofence with the same name already exists",
+			})
+		case err != nil:
+			log.Error().Err(err).Msg("failed to create geofence")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to create geofence",
+			})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(mapDBGeofenceToAPIGeofence(dbGeofence))
+	}
+}
+
+func GetGeofences(geofencesRepository repository.GeofencesRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		geofences, err := geofencesRepository.GetGeofences(c.UserContext())
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get geofences")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get geofences",
+			})
+		}
+
+		return c.JSON(mapDBGeofencesToAPIGeofences(geofences))
+	}
+}
+
+func GetGeofence(geofencesRepository repository.GeofencesRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		geofence, err := geofencesRepository.GetGeofence(c.UserContext(), c.Params("id"))
+		if err != nil && !errors.Is(err, primitive.ErrInvalidHex) {
+			log.Error().Err(err).Msg("failed to get geofence")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get geofence",
+			})
+		}
+		if geofence == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "geofence not found",
+			})
+		}
+
+		return c.JSON(mapDBGeofenceToAPIGeofence(geofence))
+	}
+}
+
+// DeleteGeofence deletes the geofence, its events are kept.
+func DeleteGeofence(geofencesRepository repository.GeofencesRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		deleted, err := geofencesRepository.DeleteGeofence(c.UserContext(), c.Params("id"))
+		if err != nil && !errors.Is(err, primitive.ErrInvalidHex) {
+			log.Error().Err(err).Msg("failed to delete geofence")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to delete geofence",
+			})
+		}
+		if !deleted {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "geofence not found",
+			})
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func GetGeofenceEvents(geofencesRepository repository.GeofencesRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		geofenceID, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "geofence not found",
+			})
+		}
+
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		// Events of deleted geofences are kept, so they're returned regardless of the geofence
+		events, err := geofencesRepository.GetGeofenceEvents(c.UserContext(), geofenceID, startTime, endTime)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get geofence events")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get geofence events",
+			})
+		}
+
+		return c.JSON(mapDBGeofenceEventsToAPIGeofenceEvents(events))
+	}
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/zignd/pingthings-collaborative-technical-interview/health"
+)
+
+// GetLiveness answers as long as the server can serve requests, whatever the state of its
+// dependencies.
+func GetLiveness() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"status": "ok",
+		})
+	}
+}
+
+// GetReadiness pings the dependencies and returns 503 Service Unavailable unless they're all up
+// and the server finished starting.
+func GetReadiness(checker *health.Checker) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		report := checker.Check(c.UserContext())
+		if report.Status != health.StatusReady {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(report)
+		}
+		return c.JSON(report)
+	}
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/heatmap"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+const (
+	defaultHeatmapResolution = 50
+	maxHeatmapResolution     = 500
+	// defaultHeatmapWindow is the time range of the heatmap when start and end aren't given
+	defaultHeatmapWindow = 24 * time.Hour
+)
+
+var heatmapFunctions = []string{"last", "mean", "median", "min", "max"}
+
+// GetHeatmap interpolates the values of the sensors within the bbox over a grid, each sensor
+// contributing the value of its series reduced with the fn query parameter.
+func GetHeatmap(sensorsRepository repository.SensorsRepository, measurementRepository repository.MeasurementRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		measurement := c.Query("measurement")
+		if measurement == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "measurement query parameter is required",
+			})
+		}
+
+		unit := c.Query("unit")
+		if unit == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "unit query parameter is required",
+			})
+		}
+
+		if c.Query("bbox") == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "bbox query parameter is required",
+			})
+		}
+		bbox, err := heatmap.ParseBBox(c.Query("bbox"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		resolution := defaultHeatmapResolution
+		if c.Query("resolution") != "" {
+			resolution, err = strconv.Atoi(c.Query("resolution"))
+		}
+		if err != nil || resolution < 1 || resolution > maxHeatmapResolution {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "resolution query parameter must be between 1 and " + strconv.Itoa(maxHeatmapResolution),
+			})
+		}
+
+		method, err := heatmap.ParseMethod(c.Query("method", string(heatmap.MethodIDW)))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		power := 2.0
+		if c.Query("power") != "" {
+			power, err = strconv.ParseFloat(c.Query("power"), 64)
+		}
+		if err != nil || power <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "power query parameter must be a positive number",
+			})
+		}
+
+		fn := c.Query("fn", "last")
+		if !slices.Contains(heatmapFunctions, fn) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "fn query parameter must be one of last, mean, median, min and max",
+			})
+		}
+
+		format := c.Query("format", "grid")
+		if format != "grid" && format != "geojson" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "format query parameter must be grid or geojson",
+			})
+		}
+
+		endTime := time.Now()
+		startTime := endTime.Add(-defaultHeatmapWindow)
+		if c.Query("start") != "" || c.Query("end") != "" {
+			if startTime, endTime, err = parseTimeRange(c); err != nil {
+				log.Warn().Err(err).Msg("invalid time range")
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+		}
+
+		ctx := c.UserContext()
+		sensors, err := sensorsRepository.GetSensorsWithin(ctx, bbox.MinLongitude, bbox.MinLatitude, bbox.MaxLongitude, bbox.MaxLatitude)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensors")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensors",
+			})
+		}
+		sensorIDs := make([]string, 0, len(sensors))
+		for _, sensor := range sensors {
+			sensorIDs = append(sensorIDs, sensor.ID.Hex())
+		}
+
+		values, err := measurementRepository.GetSensorValues(ctx, sensorIDs, measurement, unit, startTime, endTime, fn)
+		if err != nil {
+			return queryFailed(c, err, "failed to get sensor values")
+		}
+
+		samples := make([]heatmap.Sample, 0, len(values))
+		for _, sensor := range sensors {
+			value, ok := values[sensor.ID.Hex()]
+			if !ok || len(sensor.Location.Coordinates) != 2 {
+				continue
+			}
+			samples = append(samples, heatmap.Sample{
+				Longitude: sensor.Location.Coordinates[0],
+				Latitude:  sensor.Location.Coordinates[1],
+				Value:     value,
+			})
+		}
+
+		grid, err := heatmap.Interpolate(ctx, samples, bbox, heatmap.Options{
+			Method:     method,
+			Resolution: resolution,
+			Power:      power,
+		})
+		switch {
+		case errors.Is(err, heatmap.ErrNoSamples):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "no sensor within the bbox has measurements for the specified time range",
+			})
+		case errors.Is(err, heatmap.ErrTooFewSamples), errors.Is(err, heatmap.ErrSingularVariogram):
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		case errors.Is(err, heatmap.ErrTooManySamples):
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": err.Error() + ", narrow the bbox or use idw",
+			})
+		case errors.Is(err, heatmap.ErrTooManyCells):
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": err.Error() + ", lower the resolution",
+			})
+		case err != nil:
+			return queryFailed(c, err, "failed to interpolate heatmap")
+		}
+
+		if format == "geojson" {
+			return c.JSON(mapGridToGeoJSON(grid))
+		}
+		return c.JSON(fiber.Map{
+			"method":  method,
+			"samples": len(samples),
+			"grid":    grid,
+		})
+	}
+}
+
+// mapGridToGeoJSON maps each cell of the grid to a polygon feature with its value.
+func mapGridToGeoJSON(grid *heatmap.Grid) fiber.Map {
+	features := make([]fiber.Map, 0, grid.Rows*grid.Columns)
+	for row := range grid.Rows {
+		for column := range grid.Columns {
+			west, south, east, north := grid.CellBounds(row, column)
+			features = append(features, fiber.Map{
+				"type": "Feature",
+				"geometry": repository.GeoJSONPolygon{
+					Type: "Polygon",
+					Coordinates: [][][]float64{{
+						{west, south}, {east, south}, {east, north}, {west, north}, {west, south},
+					}},
+				},
+				"properties": fiber.Map{
+					"row":    row,
+					"column": column,
+					"value":  grid.Values[row][column],
+				},
+			})
+		}
+	}
+	return fiber.Map{
+		"type":     "FeatureCollection",
+		"features": features,
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const headerActor = "X-Actor"
+
+// Actor records the X-Actor header in the request context as the author of the sensor revisions
+// the request produces.
+func Actor() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if actor := c.Get(headerActor); actor != "" {
+			c.SetUserContext(repository.WithActor(c.UserContext(), actor))
+		}
+		return c.Next()
+	}
+}
+
+func GetSensorHistory(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		sensor, err := sensorsRepository.GetSensorByID(ctx, c.Params("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor",
+			})
+		}
+
+		revisions, err := sensorsRepository.GetSensorHistory(ctx, sensor.ID.Hex())
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor history")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor history",
+			})
+		}
+
+		return c.JSON(mapDBSensorRevisionsToAPISensorRevisions(revisions))
+	}
+}
+
+// GetSensorLocation returns where the sensor was at the time of the at query parameter, so
+// measurements taken before it was relocated can be placed where they were taken. It defaults to
+// the current location.
+func GetSensorLocation(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		at := time.Now()
+		if value := c.Query("at"); value != "" {
+			var err error
+			at, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "failed to parse at query parameter",
+				})
+			}
+		}
+
+		state, err := sensorsRepository.GetSensorStateAt(c.UserContext(), c.Params("id"), at)
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "sensor not found",
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensor location")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensor location",
+			})
+		}
+		if state == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "the sensor didn't exist at that time",
+			})
+		}
+
+		return c.JSON(mapGeoJSONPointToLocation(state.Location))
+	}
+}
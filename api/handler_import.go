@@ -0,0 +1,81 @@
+package api
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/importer"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ImportReport struct {
+	*repository.Import
+	SkippedRows int `json:"skipped_rows"`
+}
+
+// PostImport imports the measurements of a CSV or NDJSON body. Sending the same file again with
+// the import_id of an interrupted import resumes it.
+func PostImport(measurementsImporter *importer.Importer) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		format, err := importer.ParseFormat(c.Query("format", string(importer.FormatCSV)))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "format query parameter must be one of csv or ndjson",
+			})
+		}
+
+		importID := c.Query("import_id")
+		if importID == "" {
+			importID = primitive.NewObjectID().Hex()
+		}
+
+		// Large bodies are streamed instead of being read into memory up front
+		var body io.Reader = c.Context().RequestBodyStream()
+		if body == nil {
+			body = bytes.NewReader(c.Body())
+		}
+
+		reader, err := importer.NewReader(format, body)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid import file")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":     "invalid import file",
+				"details":   err.Error(),
+				"import_id": importID,
+			})
+		}
+
+		imp, skippedRows, err := measurementsImporter.Import(c.UserContext(), importID, reader)
+		if err != nil {
+			log.Error().Err(err).Str("import_id", importID).Msg("failed to import measurements")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":     "failed to import measurements, retry with the same import_id to resume",
+				"import_id": importID,
+			})
+		}
+
+		return c.JSON(ImportReport{Import: imp, SkippedRows: skippedRows})
+	}
+}
+
+func GetImport(importsRepository repository.ImportsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		imp, err := importsRepository.GetImport(c.UserContext(), c.Params("importID"))
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get import")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get import",
+			})
+		}
+		if imp == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "import not found",
+			})
+		}
+
+		return c.JSON(imp)
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+// GetSensors lists the sensors, narrowed down by the label selector of the labels query
+// parameter when there's one.
+func GetSensors(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		selector, err := label.ParseSelector(c.Query("labels"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		sensors, err := sensorsRepository.GetSensors(c.UserContext(), selector)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get sensors")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to get sensors",
+			})
+		}
+
+		return c.JSON(mapDBSensorsToAPISensors(sensors))
+	}
+}
+
+// GetMeasurementsByLabels returns the measurements written with labels meeting the selector of
+// the labels query parameter, across sensors.
+func GetMeasurementsByLabels(measurementRepository repository.MeasurementRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		selector, err := label.ParseSelector(c.Query("labels"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if len(selector) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "labels query parameter is required",
+			})
+		}
+
+		startTime, endTime, err := parseTimeRange(c)
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid time range")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		measurements, err := measurementRepository.GetMeasurementsByLabels(c.UserContext(), selector, c.Query("measurement"), c.Query("unit"), startTime, endTime)
+		if err != nil {
+			return queryFailed(c, err, "failed to get measurements")
+		}
+
+		return c.JSON(mapDBMeasurementsToAPIMeasurements(measurements))
+	}
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/replication"
+)
+
+// PostReplicationBatch applies a batch shipped by a server replicating to this one, gzip
+// compressed or not. The batch is acknowledged once it was applied, so a failure has the source
+// send it again. Only the servers sharing the replication token can send batches, and none can
+// when this server has no token.
+func PostReplicationBatch(applier *replication.Applier, token string, maxBytes int64) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if !bearerToken(c, token) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "missing or invalid replication token",
+			})
+		}
+
+		// The raw body is decompressed here rather than by Body, which has no limit on the size
+		// of what it decompresses
+		var body io.Reader = c.Context().RequestBodyStream()
+		if body == nil {
+			body = bytes.NewReader(c.Request().Body())
+		}
+		switch encoding := c.Get(fiber.HeaderContentEncoding); encoding {
+		case "", "identity":
+		case "gzip":
+			reader, err := gzip.NewReader(body)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "invalid gzip body",
+				})
+			}
+			defer reader.Close()
+			body = reader
+		default:
+			return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+				"error": "Content-Encoding must be gzip or identity",
+			})
+		}
+
+		var batch replication.Batch
+		limited := &io.LimitedReader{R: body, N: maxBytes + 1}
+		if err := json.NewDecoder(limited).Decode(&batch); err != nil {
+			if limited.N <= 0 {
+				return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+					"error": "the replication batch is too large, lower REPLICATION__BATCH_SIZE",
+				})
+			}
+			log.Warn().Err(err).Msg("invalid replication batch")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid replication batch",
+			})
+		}
+		if batch.Source == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "the replication batch must have a source",
+			})
+		}
+
+		result, err := applier.Apply(c.UserContext(), &batch)
+		if err != nil {
+			log.Error().Err(err).Str("source", batch.Source).Msg("failed to apply replication batch")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to apply replication batch",
+			})
+		}
+
+		return c.JSON(result)
+	}
+}
+
+// GetReplicationStats requires either the admin token or the replication token, as the stats tell
+// where upstream is and how far behind it this server is.
+func GetReplicationStats(replicator *replication.Replicator, adminToken, replicationToken string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if !bearerToken(c, adminToken) && !bearerToken(c, replicationToken) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "missing or invalid admin or replication token",
+			})
+		}
+
+		return c.JSON(replicator.Stats())
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxPatchAttempts is how many times a patch without If-Match is applied again when another
+// update gets in between reading the sensor and writing the patched one.
+const maxPatchAttempts = 3
+
+func setETag(c *fiber.Ctx, sensor *repository.Sensor) {
+	c.Set(fiber.HeaderETag, strconv.Quote(strconv.Itoa(sensor.Version)))
+}
+
+// parseIfMatch returns the sensor version of the If-Match header, or repository.AnyVersion when
+// the header is missing or "*".
+func parseIfMatch(c *fiber.Ctx) (int, error) {
+	value := strings.TrimPrefix(strings.TrimSpace(c.Get(fiber.HeaderIfMatch)), "W/")
+	if value == "" || value == "*" {
+		return repository.AnyVersion, nil
+	}
+
+	version, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || version < 0 {
+		return 0, errors.New("the If-Match header must be the ETag of the sensor")
+	}
+	return version, nil
+}
+
+// PatchSensor applies a JSON Merge Patch (RFC 7396) to the sensor.
+func PatchSensor(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		expectedVersion, err := parseIfMatch(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		ctx := c.UserContext()
+		for attempt := 1; ; attempt++ {
+			current, err := sensorsRepository.GetSensorByID(ctx, c.Params("id"))
+			if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "sensor not found",
+				})
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("failed to get sensor")
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "failed to get sensor",
+				})
+			}
+			if expectedVersion != repository.AnyVersion && current.Version != expectedVersion {
+				return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+					"error": repository.ErrVersionConflict.Error(),
+				})
+			}
+
+			var sensor Sensor
+			if err := applyMergePatch(mapDBSensorToAPISensor(current), c.Body(), &sensor); err != nil {
+				log.Warn().Err(err).Msg("invalid merge patch")
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "invalid merge patch",
+				})
+			}
+
+			if err := sensor.ValidateWithContext(ctx); err != nil {
+				log.Warn().Err(err).Msg("invalid sensor")
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error":   "invalid sensor",
+					"details": err,
+				})
+			}
+
+			dbSensor := mapAPISensorToDBSensor(&sensor)
+			err = sensorsRepository.UpdateSensor(ctx, current.ID.Hex(), dbSensor, current.Version)
+			if errors.Is(err, repository.ErrVersionConflict) {
+				if expectedVersion == repository.AnyVersion && attempt < maxPatchAttempts {
+					continue
+				}
+				return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			if errors.Is(err, repository.ErrNameTaken) {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("failed to update sensor")
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "failed to update sensor",
+				})
+			}
+
+			setETag(c, dbSensor)
+			return c.JSON(mapDBSensorToAPISensor(dbSensor))
+		}
+	}
+}
+
+func PutSensorTag(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		expectedVersion, err := parseIfMatch(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		dbSensor, err := sensorsRepository.AddSensorTag(c.UserContext(), c.Params("id"), c.Params("tag"), expectedVersion)
+		if errors.Is(err, repository.ErrVersionConflict) {
+			return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to add sensor tag")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to add sensor tag",
+			})
+		}
+
+		setETag(c, dbSensor)
+		return c.JSON(mapDBSensorToAPISensor(dbSensor))
+	}
+}
+
+func DeleteSensorTag(sensorsRepository repository.SensorsRepository) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		expectedVersion, err := parseIfMatch(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		dbSensor, err := sensorsRepository.RemoveSensorTag(c.UserContext(), c.Params("id"), c.Params("tag"), expectedVersion)
+		switch {
+		case errors.Is(err, repository.ErrVersionConflict):
+			return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		case errors.Is(err, repository.ErrLastTag):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		case err != nil:
+			log.Error().Err(err).Msg("failed to remove sensor tag")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to remove sensor tag",
+			})
+		}
+
+		setETag(c, dbSensor)
+		return c.JSON(mapDBSensorToAPISensor(dbSensor))
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+const (
+	headerIdempotencyKey      = "Idempotency-Key"
+	headerIdempotencyReplayed = "Idempotency-Replayed"
+	maxIdempotencyKeyLength   = 255
+)
+
+// Idempotent replays the response of the first request for the requests repeating its
+// Idempotency-Key header. With readBody, the message_id of a JSON body is used when the header is
+// missing, and the body is part of what has to match for a request to be a repeat; it's off for
+// routes streaming their body.
+func Idempotent(idempotencyRepository repository.IdempotencyRepository, readBody bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(headerIdempotencyKey)
+		if key == "" && readBody {
+			var body struct {
+				MessageID string `json:"message_id"`
+			}
+			// An invalid body is left for the handler to report
+			_ = json.Unmarshal(c.Body(), &body)
+			key = body.MessageID
+		}
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "the idempotency key can't be longer than 255 characters",
+			})
+		}
+
+		// Keys are scoped to the route, so the same key sent to two sensors doesn't collide
+		scopedKey := c.Method() + " " + c.Path() + " " + key
+		hash := sha256.New()
+		hash.Write([]byte(c.Method() + " " + c.OriginalURL() + "\n"))
+		if readBody {
+			hash.Write(c.Body())
+		}
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		ctx := c.UserContext()
+		record, err := idempotencyRepository.Reserve(ctx, scopedKey, fingerprint)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to reserve idempotency key")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to reserve idempotency key",
+			})
+		}
+		if record != nil {
+			if record.Fingerprint != fingerprint {
+				return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+					"error": "the idempotency key was already used for a different request",
+				})
+			}
+			if record.Status == repository.IdempotencyStatusPending {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "a request with the same idempotency key is still being processed",
+				})
+			}
+
+			c.Set(headerIdempotencyReplayed, "true")
+			c.Set(fiber.HeaderContentType, record.ContentType)
+			return c.Status(record.StatusCode).Send(record.Body)
+		}
+
+		if err := c.Next(); err != nil {
+			releaseIdempotencyKey(c, idempotencyRepository, scopedKey)
+			return err
+		}
+
+		// Failures that are worth retrying aren't remembered, so the retry is processed again
+		status := c.Response().StatusCode()
+		if status >= fiber.StatusInternalServerError || status == fiber.StatusTooManyRequests {
+			releaseIdempotencyKey(c, idempotencyRepository, scopedKey)
+			return nil
+		}
+
+		contentType := string(c.Response().Header.ContentType())
+		if err := idempotencyRepository.Complete(ctx, scopedKey, status, contentType, bytes.Clone(c.Response().Body())); err != nil {
+			log.Error().Err(err).Msg("failed to save idempotent response")
+		}
+		return nil
+	}
+}
+
+func releaseIdempotencyKey(c *fiber.Ctx, idempotencyRepository repository.IdempotencyRepository, key string) {
+	if err := idempotencyRepository.Release(c.UserContext(), key); err != nil {
+		log.Error().Err(err).Msg("failed to release idempotency key")
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+)
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396) to the JSON representation of original,
+// decoding the result into out.
+func applyMergePatch(original interface{}, patch []byte, out interface{}) error {
+	originalBytes, err := json.Marshal(original)
+	if err != nil {
+		return err
+	}
+
+	var target, patchValue interface{}
+	if err := json.Unmarshal(originalBytes, &target); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(patch, &patchValue); err != nil {
+		return err
+	}
+
+	patchedBytes, err := json.Marshal(mergePatch(target, patchValue))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(patchedBytes, out)
+}
+
+// mergePatch is the MergePatch function of RFC 7396: objects are merged member by member, null
+// removes a member and anything else replaces the target.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatch(t *testing.T) {
+	t.Parallel()
+
+	// Examples from the appendix of RFC 7396
+	cases := []struct {
+		target   string
+		patch    string
+		expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, c := range cases {
+		t.Run("when "+c.patch+" is applied to "+c.target+", it should result in "+c.expected, func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			var target, patch interface{}
+			is.Nil(json.Unmarshal([]byte(c.target), &target))
+			is.Nil(json.Unmarshal([]byte(c.patch), &patch))
+
+			result, err := json.Marshal(mergePatch(target, patch))
+			is.Nil(err)
+			is.JSONEq(c.expected, string(result))
+		})
+	}
+
+	t.Run("when a sensor is patched, it should only change the patched fields", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		original := &Sensor{
+			Name:     "farm",
+			Location: Location{Longitude: 10, Latitude: 20},
+			Tags:     []string{"tag1"},
+		}
+
+		var patched Sensor
+		is.Nil(applyMergePatch(original, []byte(`{"location":{"latitude":30},"tags":["tag2","tag3"]}`), &patched))
+		is.Equal("farm", patched.Name)
+		is.Equal(Location{Longitude: 10, Latitude: 30}, patched.Location)
+		is.Equal([]string{"tag2", "tag3"}, patched.Tags)
+	})
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zignd/pingthings-collaborative-technical-interview/metrics"
+)
+
+// Metrics records the duration of the requests by the route they matched. Requests matching no
+// route are recorded under the route of the middleware, "/".
+func Metrics() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		metrics.ObserveHTTPRequest(c.Method(), c.Route().Path, responseStatus(c, err), start)
+		return err
+	}
+}
+
+// responseStatus is the status the response will have. Errors returned by the handlers only
+// become a status in the error handler, after the middlewares.
+func responseStatus(c *fiber.Ctx, err error) int {
+	if err == nil {
+		return c.Response().StatusCode()
+	}
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr.Code
+	}
+	return fiber.StatusInternalServerError
+}
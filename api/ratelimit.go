@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ratelimit"
+)
+
+const (
+	headerAPIKey             = "X-API-Key"
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+)
+
+// RateLimit takes a token from the budgets of the class for the client and, on the ingest routes
+// of a sensor, for the sensor, answering 429 Too Many Requests when one of them is used up. The
+// client is its IP, and its X-API-Key header too when it's a configured key. The request goes
+// through when the store fails, rate limiting being a protection rather than a requirement.
+func RateLimit(limiter *ratelimit.Limiter, class ratelimit.Class) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !limiter.Limits().Enabled {
+			return c.Next()
+		}
+
+		client := ratelimit.Client{IP: c.IP(), APIKey: c.Get(headerAPIKey)}
+		result, err := limiter.Allow(c.UserContext(), class, client, c.Params("id"))
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to check rate limit")
+			return c.Next()
+		}
+
+		c.Set(headerRateLimitLimit, strconv.Itoa(result.Limit))
+		c.Set(headerRateLimitRemaining, strconv.Itoa(result.Remaining))
+		c.Set(headerRateLimitReset, strconv.Itoa(ceilSeconds(result.Reset)))
+		if !result.Allowed {
+			retryAfter := ceilSeconds(result.RetryAfter)
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": fmt.Sprintf("rate limit exceeded, retry in %d seconds", retryAfter),
+			})
+		}
+		return c.Next()
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
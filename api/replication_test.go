@@ -0,0 +1,326 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golobby/container/v3"
+	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/dependency"
+	"github.com/zignd/pingthings-collaborative-technical-interview/replication"
+)
+
+const replicationToken = "replication-secret"
+
+// embeddedServer builds and starts a server in embedded mode keeping everything in directories
+// of its own, the app being left to the caller to serve or test.
+func embeddedServer(t *testing.T, args ...string) (*fiber.App, *container.Container) {
+	is := require.New(t)
+
+	cont, err := dependency.SetupContainer(append([]string{
+		"-api.address=127.0.0.1:0",
+		"-storage.backend=embedded",
+		"-embedded.dir=" + t.TempDir(),
+		"-ingest.spool_dir=" + t.TempDir(),
+		"-ingest.flush_interval=10ms",
+		"-replication.token=" + replicationToken,
+	}, args...))
+	is.Nil(err)
+	app, err := SetupServer(cont)
+	is.Nil(err)
+
+	var lifecycle *dependency.Lifecycle
+	is.Nil(cont.Resolve(&lifecycle))
+	is.Nil(lifecycle.Start(context.Background()))
+	t.Cleanup(func() {
+		lifecycle.Stop(context.Background())
+	})
+	return app, cont
+}
+
+// serve serves the app on the address, once its previous listener was closed.
+func serve(t *testing.T, app *fiber.App, address string) {
+	is := require.New(t)
+
+	listener, err := net.Listen("tcp", address)
+	is.Nil(err)
+	go app.Listener(listener)
+	t.Cleanup(func() {
+		app.Shutdown()
+	})
+}
+
+func request(t *testing.T, app *fiber.App, method, target string, body any) *http.Response {
+	is := require.New(t)
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		is.Nil(err)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := app.Test(req, -1)
+	is.Nil(err)
+	return res
+}
+
+func replicationStats(t *testing.T, app *fiber.App) replication.Stats {
+	var stats replication.Stats
+	req := httptest.NewRequest("GET", "/replication/stats", nil)
+	req.Header.Set("Authorization", "Bearer "+replicationToken)
+	res, err := app.Test(req, -1)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Nil(t, json.NewDecoder(res.Body).Decode(&stats))
+	return stats
+}
+
+func TestReplication(t *testing.T) {
+	is := require.New(t)
+
+	upstreamApp, upstreamCont := embeddedServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.Nil(err)
+	upstreamAddress := listener.Addr().String()
+	go upstreamApp.Listener(listener)
+
+	edgeApp, _ := embeddedServer(t,
+		"-replication.upstream_url=http://"+upstreamAddress,
+		"-replication.source=edge",
+		"-replication.dir="+t.TempDir(),
+		"-replication.interval=20ms",
+		"-replication.max_backoff=100ms",
+	)
+
+	res := request(t, edgeApp, "POST", "/sensors", Sensor{
+		Name:     "boiler",
+		Location: Location{Longitude: 1, Latitude: 2},
+		Tags:     []string{"heat"},
+	})
+	is.Equal(http.StatusCreated, res.StatusCode)
+	var sensor Sensor
+	is.Nil(json.NewDecoder(res.Body).Decode(&sensor))
+	at := time.Now().UTC().Truncate(time.Millisecond)
+	res = request(t, edgeApp, "POST", fmt.Sprintf("/sensors/%s/measurements", sensor.ID), Measurement{
+		Name:      "temperature",
+		Unit:      "celsius",
+		Value:     80,
+		Timestamp: at,
+	})
+	is.Equal(http.StatusAccepted, res.StatusCode)
+
+	measurementsPath := fmt.Sprintf("/sensors/%s/measurements?measurement=temperature&unit=celsius&start=%s&end=%s",
+		sensor.ID, at.Add(-time.Minute).Format(time.RFC3339), at.Add(time.Minute).Format(time.RFC3339))
+	upstreamMeasurements := func() []Measurement {
+		var measurements []Measurement
+		res := request(t, upstreamApp, "GET", measurementsPath, nil)
+		if res.StatusCode != http.StatusOK {
+			return nil
+		}
+		is.Nil(json.NewDecoder(res.Body).Decode(&measurements))
+		return measurements
+	}
+
+	t.Run("when the edge writes a sensor and its measurements, it should replicate them upstream with the same sensor ID", func(t *testing.T) {
+		is := require.New(t)
+
+		is.Eventually(func() bool { return len(upstreamMeasurements()) == 1 }, 5*time.Second, 20*time.Millisecond)
+		res := request(t, upstreamApp, "GET", "/sensors/"+sensor.ID, nil)
+		is.Equal(http.StatusOK, res.StatusCode)
+		var replicated Sensor
+		is.Nil(json.NewDecoder(res.Body).Decode(&replicated))
+		is.Equal("boiler", replicated.Name)
+		is.Equal(80.0, upstreamMeasurements()[0].Value)
+	})
+
+	t.Run("when the edge moves a sensor, it should replicate the move", func(t *testing.T) {
+		is := require.New(t)
+
+		res := request(t, edgeApp, "POST", fmt.Sprintf("/sensors/%s/location", sensor.ID), TrackPoint{
+			Location: Location{Longitude: 5, Latitude: 6},
+		})
+		is.Equal(http.StatusOK, res.StatusCode)
+
+		is.Eventually(func() bool {
+			var replicated Sensor
+			res := request(t, upstreamApp, "GET", "/sensors/"+sensor.ID, nil)
+			is.Nil(json.NewDecoder(res.Body).Decode(&replicated))
+			return replicated.Location.Longitude == 5 && replicated.Location.Latitude == 6
+		}, 5*time.Second, 20*time.Millisecond)
+
+		for _, id := range []string{"000000000000000000000000", "not-an-id"} {
+			res := request(t, edgeApp, "POST", fmt.Sprintf("/sensors/%s/location", id), TrackPoint{
+				Location: Location{Longitude: 5, Latitude: 6},
+			})
+			is.Equal(http.StatusNotFound, res.StatusCode)
+		}
+	})
+
+	t.Run("when a batch comes without the replication token, it should be rejected", func(t *testing.T) {
+		is := require.New(t)
+
+		batch := replication.Batch{Source: "intruder", Entries: []replication.Entry{}}
+		res := request(t, upstreamApp, "POST", replication.BatchesPath, batch)
+		is.Equal(http.StatusUnauthorized, res.StatusCode)
+
+		data, err := json.Marshal(batch)
+		is.Nil(err)
+		req := httptest.NewRequest("POST", replication.BatchesPath, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer not-the-token")
+		res, err = upstreamApp.Test(req, -1)
+		is.Nil(err)
+		is.Equal(http.StatusUnauthorized, res.StatusCode)
+
+		res = request(t, upstreamApp, "GET", "/replication/stats", nil)
+		is.Equal(http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("when a batch has invalid measurements, it should reject them one by one and write the others", func(t *testing.T) {
+		is := require.New(t)
+
+		batch := replication.Batch{Source: "edge", Entries: []replication.Entry{{
+			Seq: 1,
+			Measurements: []replication.MeasurementRecord{
+				{Name: "temperature", SensorID: sensor.ID, Unit: "celsius", Value: 81, Timestamp: at.Add(time.Second)},
+				{Name: "temperature", SensorID: sensor.ID, Unit: "celsius", Value: 82, Timestamp: time.Unix(-1, 0).UTC()},
+				{Name: "temperature", SensorID: sensor.ID, Unit: "celsius", Value: 83, Timestamp: at.Add(2 * time.Second), Labels: map[string]string{"rollup": "hourly"}},
+			},
+		}}}
+		data, err := json.Marshal(batch)
+		is.Nil(err)
+		req := httptest.NewRequest("POST", replication.BatchesPath, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+replicationToken)
+		res, err := upstreamApp.Test(req, -1)
+		is.Nil(err)
+		is.Equal(http.StatusOK, res.StatusCode)
+
+		var result replication.BatchResult
+		is.Nil(json.NewDecoder(res.Body).Decode(&result))
+		is.Equal(1, result.Measurements)
+		is.Len(result.RejectedMeasurements, 2)
+		is.Equal(1, result.RejectedMeasurements[0].Index)
+		is.Contains(result.RejectedMeasurements[0].Error, "timestamp")
+		is.Equal(2, result.RejectedMeasurements[1].Index)
+		is.Contains(result.RejectedMeasurements[1].Error, "reserved")
+	})
+
+	t.Run("when upstream is down, it should keep the changes and merge them once it's back, keeping the fields edited upstream since", func(t *testing.T) {
+		is := require.New(t)
+
+		is.Nil(upstreamApp.Shutdown())
+		res := request(t, edgeApp, "PUT", "/sensors/"+sensor.ID, Sensor{
+			Name:     "boiler at the edge",
+			Location: Location{Longitude: 1, Latitude: 2},
+			Tags:     []string{"heat", "edge"},
+		})
+		is.Equal(http.StatusOK, res.StatusCode)
+		res = request(t, edgeApp, "POST", fmt.Sprintf("/sensors/%s/measurements", sensor.ID), Measurement{
+			Name:      "temperature",
+			Unit:      "celsius",
+			Value:     81,
+			Timestamp: at.Add(time.Second),
+		})
+		is.Equal(http.StatusAccepted, res.StatusCode)
+		is.Eventually(func() bool {
+			stats := replicationStats(t, edgeApp)
+			return stats.Pending == 2 && stats.Failures > 0
+		}, 5*time.Second, 20*time.Millisecond)
+
+		// Renamed upstream after the edge change, while the edge can't reach it
+		time.Sleep(time.Millisecond)
+		restartedApp, err := SetupServer(upstreamCont)
+		is.Nil(err)
+		res = request(t, restartedApp, "PUT", "/sensors/"+sensor.ID, Sensor{
+			Name:     "boiler upstream",
+			Location: Location{Longitude: 1, Latitude: 2},
+			Tags:     []string{"heat"},
+		})
+		is.Equal(http.StatusOK, res.StatusCode)
+		serve(t, restartedApp, upstreamAddress)
+
+		is.Eventually(func() bool { return replicationStats(t, edgeApp).Pending == 0 }, 5*time.Second, 20*time.Millisecond)
+		res = request(t, restartedApp, "GET", "/sensors/"+sensor.ID, nil)
+		var replicated Sensor
+		is.Nil(json.NewDecoder(res.Body).Decode(&replicated))
+		is.Equal("boiler upstream", replicated.Name)
+		is.Equal([]string{"heat", "edge"}, replicated.Tags)
+		is.Len(upstreamMeasurements(), 2)
+	})
+
+	t.Run("when a compressed batch is larger than the maximum once decompressed, it should be rejected", func(t *testing.T) {
+		is := require.New(t)
+
+		app, _ := embeddedServer(t, "-replication.max_batch_bytes=1024")
+		var body bytes.Buffer
+		writer := gzip.NewWriter(&body)
+		_, err := writer.Write([]byte(`{"source":"edge","entries":[` + string(bytes.Repeat([]byte(`{"seq":1},`), 1000)) + `{"seq":1}]}`))
+		is.Nil(err)
+		is.Nil(writer.Close())
+
+		req := httptest.NewRequest("POST", replication.BatchesPath, &body)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Authorization", "Bearer "+replicationToken)
+		res, err := app.Test(req, -1)
+		is.Nil(err)
+		is.Equal(http.StatusRequestEntityTooLarge, res.StatusCode)
+	})
+
+	t.Run("when the journal drops the creation of a sensor, it should record the sensor again", func(t *testing.T) {
+		is := require.New(t)
+
+		// Upstream is only served once the edge dropped entries
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		is.Nil(err)
+		address := listener.Addr().String()
+		is.Nil(listener.Close())
+
+		edgeApp, _ := embeddedServer(t,
+			"-replication.upstream_url=http://"+address,
+			"-replication.dir="+t.TempDir(),
+			"-replication.max_bytes=1024",
+			"-replication.segment_bytes=256",
+			"-replication.interval=20ms",
+			"-replication.max_backoff=100ms",
+		)
+		res := request(t, edgeApp, "POST", "/sensors", Sensor{
+			Name:     "pump",
+			Location: Location{Longitude: 3, Latitude: 4},
+			Tags:     []string{"water"},
+		})
+		is.Equal(http.StatusCreated, res.StatusCode)
+		var pump Sensor
+		is.Nil(json.NewDecoder(res.Body).Decode(&pump))
+		for i := range 20 {
+			res := request(t, edgeApp, "POST", fmt.Sprintf("/sensors/%s/measurements", pump.ID), Measurement{
+				Name:      "pressure",
+				Unit:      "bar",
+				Value:     float64(i + 1),
+				Timestamp: at.Add(time.Duration(i) * time.Second),
+			})
+			is.Equal(http.StatusAccepted, res.StatusCode)
+		}
+		is.Eventually(func() bool { return replicationStats(t, edgeApp).Dropped > 0 }, 5*time.Second, 20*time.Millisecond)
+
+		upstreamApp, _ := embeddedServer(t)
+		serve(t, upstreamApp, address)
+		is.Eventually(func() bool {
+			return request(t, upstreamApp, "GET", "/sensors/"+pump.ID, nil).StatusCode == http.StatusOK
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+}
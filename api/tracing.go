@@ -0,0 +1,63 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/zignd/pingthings-collaborative-technical-interview/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestHeaderCarrier reads the trace context from the request headers.
+type requestHeaderCarrier struct {
+	c *fiber.Ctx
+}
+
+func (r requestHeaderCarrier) Get(key string) string {
+	return r.c.Get(key)
+}
+
+func (r requestHeaderCarrier) Set(key, value string) {
+	r.c.Request().Header.Set(key, value)
+}
+
+func (r requestHeaderCarrier) Keys() []string {
+	var keys []string
+	r.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// Tracing wraps each request in a span, continuing the trace of the client when the request has a
+// traceparent header. The span goes down to the repositories through the user context.
+func Tracing() fiber.Handler {
+	tracer := tracing.Tracer()
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), requestHeaderCarrier{c: c})
+		ctx, span := tracer.Start(ctx, c.Method(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Method()),
+				attribute.String("url.path", c.Path()),
+			),
+		)
+		defer span.End()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+
+		// The route is only known once it was matched
+		status := responseStatus(c, err)
+		span.SetName(c.Method() + " " + c.Route().Path)
+		span.SetAttributes(
+			attribute.String("http.route", c.Route().Path),
+			attribute.Int("http.response.status_code", status),
+		)
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, "")
+		}
+		return err
+	}
+}
@@ -0,0 +1,110 @@
+package channel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+func TestExpression(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when an expression is parsed, it should respect the operator precedence", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		expression, err := ParseExpression("a - b * 2 ^ 2 / -c")
+		is.Nil(err)
+		is.Equal([]string{"a", "b", "c"}, expression.Variables())
+
+		value, err := expression.Evaluate(map[string]float64{"a": 1, "b": 3, "c": 4})
+		is.Nil(err)
+		is.Equal(4.0, value)
+	})
+
+	t.Run("when the dew point is computed, it should match the Magnus formula", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		expression, err := ParseExpression("dewpoint(temperature, humidity)")
+		is.Nil(err)
+
+		value, err := expression.Evaluate(map[string]float64{"temperature": 25, "humidity": 60})
+		is.Nil(err)
+		is.InDelta(16.69, value, 0.01)
+	})
+
+	t.Run("when an expression is malformed, it should return an error", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		for _, src := range []string{"", "a +", "(a", "a b", "unknown(a)", "pow(a)", "a $ b", "1..2"} {
+			_, err := ParseExpression(src)
+			is.Error(err, src)
+		}
+	})
+
+	t.Run("when a variable has no value, it should return an error", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		expression, err := ParseExpression("a - b")
+		is.Nil(err)
+
+		_, err = expression.Evaluate(map[string]float64{"a": 1})
+		is.ErrorContains(err, `missing value for variable "b"`)
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	measurements := []*repository.Measurement{}
+	for i, value := range []float64{1, 2, 3, 10, 20} {
+		measurements = append(measurements, &repository.Measurement{
+			Name:      "delta",
+			Unit:      "celsius",
+			Value:     value,
+			Timestamp: start.Add(time.Duration(i*20) * time.Minute),
+		})
+	}
+
+	t.Run("when measurements are aggregated, it should stamp each window with its end", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		aggregated, err := Aggregate(measurements, time.Hour, "mean")
+		is.Nil(err)
+		is.Len(aggregated, 2)
+		is.Equal(2.0, aggregated[0].Value)
+		is.Equal(start.Add(time.Hour), aggregated[0].Timestamp)
+		is.Equal(15.0, aggregated[1].Value)
+		is.Equal(start.Add(2*time.Hour), aggregated[1].Timestamp)
+	})
+
+	t.Run("when the aggregate function is unknown, it should return an error", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		_, err := Aggregate(measurements, time.Hour, "mode")
+		var unsupportedFunction *UnsupportedFunctionError
+		is.ErrorAs(err, &unsupportedFunction)
+		is.Equal("mode", unsupportedFunction.Fn)
+	})
+
+	t.Run("when measurements are summarized, it should compute every statistic", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		summary := Summarize(measurements, "celsius")
+		is.Equal(1.0, summary.MinValue)
+		is.Equal(20.0, summary.MaxValue)
+		is.Equal(3.0, summary.MedianValue)
+		is.Equal(7.2, summary.MeanValue)
+		is.Equal(5, summary.Count)
+		is.Equal("celsius", summary.Unit)
+	})
+}
@@ -0,0 +1,337 @@
+package channel
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode"
+)
+
+// Expression is a parsed arithmetic expression over named variables, such as
+// "dewpoint(temperature, humidity)" or "a - b".
+type Expression struct {
+	root      node
+	variables []string
+}
+
+type function struct {
+	arity int
+	call  func(args []float64) float64
+}
+
+var functions = map[string]function{
+	"abs":   {1, func(args []float64) float64 { return math.Abs(args[0]) }},
+	"sqrt":  {1, func(args []float64) float64 { return math.Sqrt(args[0]) }},
+	"exp":   {1, func(args []float64) float64 { return math.Exp(args[0]) }},
+	"ln":    {1, func(args []float64) float64 { return math.Log(args[0]) }},
+	"log10": {1, func(args []float64) float64 { return math.Log10(args[0]) }},
+	"pow":   {2, func(args []float64) float64 { return math.Pow(args[0], args[1]) }},
+	"min":   {2, func(args []float64) float64 { return math.Min(args[0], args[1]) }},
+	"max":   {2, func(args []float64) float64 { return math.Max(args[0], args[1]) }},
+	// dewpoint takes a temperature in celsius and a relative humidity in percent and uses the
+	// Magnus formula
+	"dewpoint": {2, func(args []float64) float64 {
+		const a, b = 17.62, 243.12
+		gamma := math.Log(args[1]/100) + a*args[0]/(b+args[0])
+		return b * gamma / (a - gamma)
+	}},
+}
+
+func ParseExpression(src string) (*Expression, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, variables: map[string]struct{}{}}
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.tokens[p.pos].text, p.tokens[p.pos].pos)
+	}
+
+	variables := make([]string, 0, len(p.variables))
+	for v := range p.variables {
+		variables = append(variables, v)
+	}
+	sort.Strings(variables)
+
+	return &Expression{root: root, variables: variables}, nil
+}
+
+// Variables returns the names referenced by the expression, sorted.
+func (e *Expression) Variables() []string {
+	return e.variables
+}
+
+func (e *Expression) Evaluate(vars map[string]float64) (float64, error) {
+	return e.root.eval(vars)
+}
+
+type node interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+type variableNode string
+
+func (n variableNode) eval(vars map[string]float64) (float64, error) {
+	value, ok := vars[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("missing value for variable %q", string(n))
+	}
+	return value, nil
+}
+
+type negateNode struct {
+	operand node
+}
+
+func (n negateNode) eval(vars map[string]float64) (float64, error) {
+	value, err := n.operand.eval(vars)
+	return -value, err
+}
+
+type binaryNode struct {
+	op          byte
+	left, right node
+}
+
+func (n binaryNode) eval(vars map[string]float64) (float64, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	case '/':
+		return left / right, nil
+	case '^':
+		return math.Pow(left, right), nil
+	default:
+		return 0, fmt.Errorf("unexpected operator %q", n.op)
+	}
+}
+
+type callNode struct {
+	fn   function
+	args []node
+}
+
+func (n callNode) eval(vars map[string]float64) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+	return n.fn.call(args), nil
+}
+
+type token struct {
+	text string
+	pos  int
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				for i < len(src) && unicode.IsDigit(rune(src[i])) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{text: src[start:i], pos: start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(src) && (unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i])) || src[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{text: src[start:i], pos: start})
+		case c == '+' || c == '-' || c == '*' || c == '/' || c == '^' || c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, token{text: string(c), pos: i})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens    []token
+	pos       int
+	variables map[string]struct{}
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+func (p *parser) expect(text string) error {
+	if p.peek() != text {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("expected %q at the end of the expression", text)
+		}
+		return fmt.Errorf("expected %q at position %d", text, p.tokens[p.pos].pos)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) parseSum() (node, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.peek()[0]
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseProduct() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.peek()[0]
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.peek() == "-" {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negateNode{operand: operand}, nil
+	}
+	return p.parsePower()
+}
+
+func (p *parser) parsePower() (node, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == "^" {
+		p.pos++
+		// Right associative, so 2^3^2 is 2^(3^2)
+		exponent, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return binaryNode{op: '^', left: base, right: exponent}, nil
+	}
+	return base, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of the expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	c := rune(tok.text[0])
+	switch {
+	case tok.text == "(":
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	case unicode.IsDigit(c) || c == '.':
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return numberNode(value), nil
+	case unicode.IsLetter(c) || c == '_':
+		if p.peek() != "(" {
+			p.variables[tok.text] = struct{}{}
+			return variableNode(tok.text), nil
+		}
+
+		fn, ok := functions[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %q at position %d", tok.text, tok.pos)
+		}
+		p.pos++
+		var args []node
+		for p.peek() != ")" {
+			if len(args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		p.pos++
+		if len(args) != fn.arity {
+			return nil, fmt.Errorf("function %q takes %d arguments but got %d", tok.text, fn.arity, len(args))
+		}
+		return callNode{fn: fn, args: args}, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+}
@@ -0,0 +1,286 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+// ErrVirtualInput is returned for a channel having a virtual series as input, since channels
+// are only computed from physical series.
+var ErrVirtualInput = errors.New("the inputs of a channel must be physical series")
+
+// AggregateFunctions are the functions both physical and virtual series can be aggregated with.
+var AggregateFunctions = []string{"mean", "median", "min", "max", "sum", "count", "first", "last"}
+
+// UnsupportedFunctionError is returned when aggregating with a function outside of
+// AggregateFunctions.
+type UnsupportedFunctionError struct {
+	Fn string
+}
+
+func (e *UnsupportedFunctionError) Error() string {
+	return fmt.Sprintf("unsupported aggregate function: %s", e.Fn)
+}
+
+// Resolver answers measurement queries for both physical and virtual series. Physical series are
+// passed through to the MeasurementRepository, while virtual ones are evaluated on the fly from
+// the series of their inputs.
+type Resolver struct {
+	measurementRepository repository.MeasurementRepository
+	channelsRepository    repository.ChannelsRepository
+}
+
+func NewResolver(measurementRepository repository.MeasurementRepository, channelsRepository repository.ChannelsRepository) *Resolver {
+	return &Resolver{
+		measurementRepository: measurementRepository,
+		channelsRepository:    channelsRepository,
+	}
+}
+
+func (r *Resolver) GetMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) ([]*repository.Measurement, error) {
+	channel, err := r.channelsRepository.GetChannel(ctx, sensorID, measurement, unit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", err)
+	}
+	if channel == nil {
+		return r.measurementRepository.GetMeasurements(ctx, sensorID, measurement, unit, start, end)
+	}
+
+	return r.evaluate(ctx, channel, start, end)
+}
+
+func (r *Resolver) GetAggregatedMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time, every time.Duration, fn string) ([]*repository.Measurement, error) {
+	if _, ok := aggregateFunctions[fn]; !ok {
+		return nil, &UnsupportedFunctionError{Fn: fn}
+	}
+
+	channel, err := r.channelsRepository.GetChannel(ctx, sensorID, measurement, unit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", err)
+	}
+	if channel == nil {
+		return r.measurementRepository.GetAggregatedMeasurements(ctx, sensorID, measurement, unit, start, end, every, fn)
+	}
+
+	measurements, err := r.evaluate(ctx, channel, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return Aggregate(measurements, every, fn)
+}
+
+func (r *Resolver) GetMeasurementSummary(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (*repository.MeasurementSummary, error) {
+	channel, err := r.channelsRepository.GetChannel(ctx, sensorID, measurement, unit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", err)
+	}
+	if channel == nil {
+		return r.measurementRepository.GetMeasurementSummary(ctx, sensorID, measurement, unit, start, end)
+	}
+
+	measurements, err := r.evaluate(ctx, channel, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return Summarize(measurements, unit), nil
+}
+
+// ValidateInputs checks that none of the inputs is itself a virtual series, returning
+// ErrVirtualInput otherwise.
+func (r *Resolver) ValidateInputs(ctx context.Context, inputs []repository.ChannelInput) error {
+	for _, input := range inputs {
+		channel, err := r.channelsRepository.GetChannel(ctx, input.SensorID, input.Measurement, input.Unit)
+		if err != nil {
+			return fmt.Errorf("failed to get the channel of input %s: %w", input.Variable, err)
+		}
+		if channel != nil {
+			return fmt.Errorf("input %s is the channel %s: %w", input.Variable, channel.ID.Hex(), ErrVirtualInput)
+		}
+	}
+	return nil
+}
+
+// evaluate averages every input over the channel alignment window and applies the expression to
+// the windows where all the inputs have a value.
+func (r *Resolver) evaluate(ctx context.Context, channel *repository.Channel, start, end time.Time) ([]*repository.Measurement, error) {
+	expression, err := ParseExpression(channel.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the expression of channel %s: %w", channel.ID.Hex(), err)
+	}
+	// A channel may have been defined over one of the inputs after this one was created
+	if err := r.ValidateInputs(ctx, channel.Inputs); err != nil {
+		return nil, err
+	}
+
+	windows := map[int64]map[string]float64{}
+	for _, input := range channel.Inputs {
+		inputMeasurements, err := r.measurementRepository.GetAggregatedMeasurements(ctx, input.SensorID, input.Measurement, input.Unit, start, end, channel.Alignment, "mean")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the measurements of input %s: %w", input.Variable, err)
+		}
+
+		for _, m := range inputMeasurements {
+			key := m.Timestamp.UnixNano()
+			if windows[key] == nil {
+				windows[key] = map[string]float64{}
+			}
+			windows[key][input.Variable] = m.Value
+		}
+	}
+
+	keys := make([]int64, 0, len(windows))
+	for key, vars := range windows {
+		if len(vars) == len(channel.Inputs) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	measurements := make([]*repository.Measurement, 0, len(keys))
+	for _, key := range keys {
+		value, err := expression.Evaluate(windows[key])
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate the expression of channel %s: %w", channel.ID.Hex(), err)
+		}
+		// Out of domain inputs, such as a division by zero, don't produce a point
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+
+		measurements = append(measurements, &repository.Measurement{
+			Name:      channel.Name,
+			SensorID:  channel.SensorID,
+			Unit:      channel.Unit,
+			Value:     value,
+			Timestamp: time.Unix(0, key).UTC(),
+		})
+	}
+
+	return measurements, nil
+}
+
+var aggregateFunctions = map[string]func(values []float64) float64{
+	"mean": func(values []float64) float64 {
+		return sum(values) / float64(len(values))
+	},
+	"median": median,
+	"min": func(values []float64) float64 {
+		result := values[0]
+		for _, v := range values[1:] {
+			result = math.Min(result, v)
+		}
+		return result
+	},
+	"max": func(values []float64) float64 {
+		result := values[0]
+		for _, v := range values[1:] {
+			result = math.Max(result, v)
+		}
+		return result
+	},
+	"sum": sum,
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+	"first": func(values []float64) float64 {
+		return values[0]
+	},
+	"last": func(values []float64) float64 {
+		return values[len(values)-1]
+	},
+}
+
+// Aggregate windows the measurements by every, aligned to the Unix epoch and stamped with the end
+// of the window like Flux's aggregateWindow does, and aggregates each window with fn.
+func Aggregate(measurements []*repository.Measurement, every time.Duration, fn string) ([]*repository.Measurement, error) {
+	aggregate, ok := aggregateFunctions[fn]
+	if !ok {
+		return nil, &UnsupportedFunctionError{Fn: fn}
+	}
+	if every <= 0 {
+		return nil, fmt.Errorf("invalid aggregate window: %s", every)
+	}
+
+	aggregated := []*repository.Measurement{}
+	var window []float64
+	var windowStop time.Time
+	flush := func(last *repository.Measurement) {
+		if len(window) == 0 {
+			return
+		}
+		aggregated = append(aggregated, &repository.Measurement{
+			Name:      last.Name,
+			SensorID:  last.SensorID,
+			Unit:      last.Unit,
+			Value:     aggregate(window),
+			Timestamp: windowStop,
+		})
+		window = window[:0]
+	}
+
+	for i, m := range measurements {
+		offset := time.Duration(m.Timestamp.UnixNano() % int64(every))
+		if offset < 0 {
+			offset += every
+		}
+		stop := m.Timestamp.Add(every - offset)
+		if !stop.Equal(windowStop) {
+			if i > 0 {
+				flush(measurements[i-1])
+			}
+			windowStop = stop
+		}
+		window = append(window, m.Value)
+	}
+	if len(measurements) > 0 {
+		flush(measurements[len(measurements)-1])
+	}
+
+	return aggregated, nil
+}
+
+func Summarize(measurements []*repository.Measurement, unit string) *repository.MeasurementSummary {
+	summary := &repository.MeasurementSummary{
+		Unit:  unit,
+		Count: len(measurements),
+	}
+	if len(measurements) == 0 {
+		return summary
+	}
+
+	values := make([]float64, len(measurements))
+	for i, m := range measurements {
+		values[i] = m.Value
+	}
+
+	summary.MinValue = aggregateFunctions["min"](values)
+	summary.MaxValue = aggregateFunctions["max"](values)
+	summary.MeanValue = aggregateFunctions["mean"](values)
+	summary.MedianValue = median(values)
+
+	return summary
+}
+
+func sum(values []float64) float64 {
+	var result float64
+	for _, v := range values {
+		result += v
+	}
+	return result
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
 	"time"
 
+	"github.com/Netflix/go-env"
 	"github.com/go-faker/faker/v4"
 	"github.com/go-resty/resty/v2"
+	"github.com/joho/godotenv"
 	"github.com/zignd/pingthings-collaborative-technical-interview/api"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 const (
@@ -15,18 +25,44 @@ const (
 )
 
 func main() {
-	sensorName := faker.Word()
+	// Registering with the same external ID on every boot gets the same sensor back
+	hostname, err := os.Hostname()
+	if err != nil {
+		panic(fmt.Errorf("failed to get hostname: %w", err))
+	}
+	externalID := fmt.Sprintf("fake-temperature-sensor-%s", hostname)
 
+	// Only the tracing settings are read, the rest of the configuration is the API's
+	_ = godotenv.Load()
+	var tracingConfig config.Tracing
+	if _, err := env.UnmarshalFromEnviron(&tracingConfig); err != nil {
+		panic(fmt.Errorf("failed to read tracing settings: %w", err))
+	}
+	tracingProvider, err := tracing.Setup("fake-temperature-sensor", tracingConfig)
+	if err != nil {
+		panic(fmt.Errorf("failed to set up tracing: %w", err))
+	}
+	defer tracingProvider.Shutdown(context.Background())
+
+	// Every request is a trace of its own, continued by the API through the traceparent header
+	tracer := tracing.Tracer()
 	httpClient := resty.New().
-		SetBaseURL(APIAddress)
+		SetBaseURL(APIAddress).
+		OnBeforeRequest(func(_ *resty.Client, req *resty.Request) error {
+			otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+			return nil
+		})
 
-	fmt.Println("Creating sensor...")
+	fmt.Println("Registering sensor...")
 
+	ctx, span := tracer.Start(context.Background(), "register sensor")
 	var sensor api.Sensor
 	resp, err := httpClient.R().
+		SetContext(ctx).
 		SetResult(&sensor).
 		SetBody(api.Sensor{
-			Name: sensorName,
+			ExternalID: externalID,
+			Name:       externalID,
 			Location: api.Location{
 				Longitude: faker.Longitude(),
 				Latitude:  faker.Latitude(),
@@ -34,14 +70,15 @@ func main() {
 			Tags: []string{faker.Word(), faker.Word()},
 		}).
 		Post("/sensors")
+	span.End()
 	if err != nil {
-		panic(fmt.Errorf("failed to create sensor: %w", err))
+		panic(fmt.Errorf("failed to register sensor: %w", err))
 	}
 	if resp.IsError() {
 		panic(fmt.Errorf("error returned by the API: %s", resp.Status()))
 	}
 
-	fmt.Printf("Sensor created: %+v\n", sensor)
+	fmt.Printf("Sensor registered: %+v\n", sensor)
 
 	for {
 		fmt.Println("Posting measurements...")
@@ -49,8 +86,10 @@ func main() {
 		// Generate a random temperature between 15 and 45 degrees Celsius
 		randomTemperature := 15 + rand.Float64()*(45-15)
 
+		ctx, span := tracer.Start(context.Background(), "post measurement")
 		var measurement api.Measurement
 		resp, err := httpClient.R().
+			SetContext(ctx).
 			SetResult(&measurement).
 			SetBody(api.Measurement{
 				Name:     "temperature",
@@ -59,9 +98,16 @@ func main() {
 				Unit:     "Celsius",
 			}).
 			Post(fmt.Sprintf("/sensors/%s/measurements", sensor.ID))
+		span.End()
 		if err != nil {
 			panic(fmt.Errorf("failed to post measurement: %w", err))
 		}
+		if resp.StatusCode() == http.StatusTooManyRequests || resp.StatusCode() == http.StatusServiceUnavailable {
+			retryAfter, _ := strconv.Atoi(resp.Header().Get("Retry-After"))
+			fmt.Printf("API is busy, retrying in %ds...\n", retryAfter)
+			time.Sleep(time.Duration(retryAfter) * time.Second)
+			continue
+		}
 		if resp.IsError() {
 			panic(fmt.Errorf("error returned by the API: %s", resp.Status()))
 		}
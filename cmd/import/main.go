@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/zignd/pingthings-collaborative-technical-interview/api"
+)
+
+func main() {
+	apiAddress := flag.String("api", "http://localhost:3000", "address of the API")
+	filePath := flag.String("file", "", "CSV or NDJSON file to import")
+	format := flag.String("format", "", "csv or ndjson, detected from the file extension by default")
+	importID := flag.String("import-id", "", "ID of the import, derived from the file contents by default so running again resumes it")
+	reportPath := flag.String("report", "", "CSV file the rows that failed are written to")
+	flag.Parse()
+
+	if *filePath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(*filePath)) {
+		case ".ndjson", ".jsonl":
+			*format = "ndjson"
+		default:
+			*format = "csv"
+		}
+	}
+
+	if *importID == "" {
+		id, err := hashFile(*filePath)
+		if err != nil {
+			panic(fmt.Errorf("failed to hash the file: %w", err))
+		}
+		*importID = id
+	}
+
+	file, err := os.Open(*filePath)
+	if err != nil {
+		panic(fmt.Errorf("failed to open the file: %w", err))
+	}
+	defer file.Close()
+
+	fmt.Printf("Importing %s as %s with import ID %s...\n", *filePath, *format, *importID)
+
+	var report api.ImportReport
+	resp, err := resty.New().
+		SetBaseURL(*apiAddress).
+		R().
+		SetQueryParam("format", *format).
+		SetQueryParam("import_id", *importID).
+		SetHeader("Content-Type", "application/octet-stream").
+		SetBody(file).
+		SetResult(&report).
+		Post("/measurements/import")
+	if err != nil {
+		panic(fmt.Errorf("failed to import: %w", err))
+	}
+	if resp.IsError() {
+		panic(fmt.Errorf("error returned by the API: %s: %s", resp.Status(), resp.String()))
+	}
+
+	fmt.Printf("Import %s: %d rows imported, %d failed, %d skipped as already imported\n",
+		report.Status, report.ImportedRows, report.FailedRows, report.SkippedRows)
+	if report.ErrorsTruncated {
+		fmt.Printf("Only the first %d errors were kept\n", len(report.Errors))
+	}
+
+	if len(report.Errors) == 0 {
+		return
+	}
+
+	var out io.Writer = os.Stdout
+	if *reportPath != "" {
+		reportFile, err := os.Create(*reportPath)
+		if err != nil {
+			panic(fmt.Errorf("failed to create the report: %w", err))
+		}
+		defer reportFile.Close()
+		out = reportFile
+	}
+
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"row", "error"})
+	for _, rowErr := range report.Errors {
+		writer.Write([]string{strconv.Itoa(rowErr.Row), rowErr.Error})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		panic(fmt.Errorf("failed to write the report: %w", err))
+	}
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32], nil
+}
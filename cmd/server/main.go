@@ -1,28 +1,172 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/rs/zerolog/log"
 	"github.com/zignd/pingthings-collaborative-technical-interview/api"
 	"github.com/zignd/pingthings-collaborative-technical-interview/config"
 	"github.com/zignd/pingthings-collaborative-technical-interview/dependency"
+	"github.com/zignd/pingthings-collaborative-technical-interview/health"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ingest"
+	"github.com/zignd/pingthings-collaborative-technical-interview/metrics"
+	"github.com/zignd/pingthings-collaborative-technical-interview/replication"
 )
 
 func main() {
-	cont, err := dependency.SetupContainer()
+	cont, err := dependency.SetupContainer(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to setup DI")
 	}
 
+	var loader *config.Loader
+	if err := cont.Resolve(&loader); err != nil {
+		log.Fatal().Err(err).Msg("failed to resolve config.Loader")
+	}
+
 	var envVars *config.EnvVars
 	if err := cont.Resolve(&envVars); err != nil {
 		log.Fatal().Err(err).Msg("failed to resolve config.EnvVars")
 	}
 
+	var lifecycle *dependency.Lifecycle
+	if err := cont.Resolve(&lifecycle); err != nil {
+		log.Fatal().Err(err).Msg("failed to resolve dependency.Lifecycle")
+	}
+
 	app, err := api.SetupServer(cont)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to build app")
 	}
 
-	log.Info().Msgf("starting server at %s", envVars.API.Address)
-	app.Listen(envVars.API.Address)
+	var pipeline *ingest.Pipeline
+	if err := cont.Resolve(&pipeline); err != nil {
+		log.Fatal().Err(err).Msg("failed to resolve ingest.Pipeline")
+	}
+	if err := metrics.Registry.Register(pipeline.Collector()); err != nil {
+		log.Fatal().Err(err).Msg("failed to register the ingest metrics")
+	}
+
+	var replicator *replication.Replicator
+	if err := cont.Resolve(&replicator); err != nil {
+		log.Fatal().Err(err).Msg("failed to resolve replication.Replicator")
+	}
+	if replicator.Enabled() {
+		if err := metrics.Registry.Register(replicator.Collector()); err != nil {
+			log.Fatal().Err(err).Msg("failed to register the replication metrics")
+		}
+	}
+
+	var checker *health.Checker
+	if err := cont.Resolve(&checker); err != nil {
+		log.Fatal().Err(err).Msg("failed to resolve health.Checker")
+	}
+
+	lifecycle.Append(dependency.Background("config reload", func(ctx context.Context) error {
+		reloadOnHangup(ctx, loader)
+		return nil
+	}))
+
+	// The server is the last component started, so it's the first stopped: it stops accepting
+	// connections and waits for the requests in flight before anything they use is stopped
+	serveErr := make(chan error, 1)
+	lifecycle.Append(dependency.Hook{
+		Name: "http server",
+		Start: func(context.Context) error {
+			listener, err := net.Listen("tcp", envVars.API.Address)
+			if err != nil {
+				return err
+			}
+			log.Info().Msgf("starting server at %s", envVars.API.Address)
+			go func() {
+				serveErr <- app.Listener(listener)
+			}()
+			return nil
+		},
+		Stop: app.ShutdownWithContext,
+	})
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	exitCode := 0
+	if err := lifecycle.Start(signalCtx); err != nil {
+		log.Error().Err(err).Msg("failed to start")
+		exitCode = 1
+	} else {
+		exitCode = waitForShutdown(signalCtx, envVars, checker, serveErr)
+	}
+
+	log.Info().Msg("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), envVars.API.ShutdownTimeout)
+	defer cancel()
+	if err := lifecycle.Stop(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("failed to shut down cleanly")
+		exitCode = 1
+	}
+	os.Exit(exitCode)
+}
+
+// waitForShutdown waits for the server to be ready and then for a signal, or for the server to
+// stop on its own. It returns the exit code of the process.
+func waitForShutdown(signalCtx context.Context, envVars *config.EnvVars, checker *health.Checker, serveErr <-chan error) int {
+	// The server listens meanwhile, so the liveness probe passes while the readiness one doesn't
+	readyErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(signalCtx, envVars.Health.StartupTimeout)
+		defer cancel()
+		readyErr <- checker.WaitReady(ctx)
+	}()
+
+	for {
+		select {
+		case <-signalCtx.Done():
+			return 0
+		case err := <-serveErr:
+			log.Error().Err(err).Msg("server stopped")
+			return 1
+		case err := <-readyErr:
+			if err != nil {
+				if signalCtx.Err() != nil {
+					return 0
+				}
+				log.Error().Err(err).Msg("dependencies unavailable")
+				return 1
+			}
+			log.Info().Msg("server ready")
+		}
+	}
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP until the context is done.
+func reloadOnHangup(ctx context.Context, loader *config.Loader) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			result, err := loader.Reload()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to reload the configuration, keeping the current one")
+				continue
+			}
+			if len(result.Ignored) > 0 {
+				log.Warn().Strs("settings", result.Ignored).Msg("configuration changes that need a restart were ignored")
+			}
+			log.Info().Strs("settings", result.Applied).Msg("configuration reloaded")
+		}
+	}
 }
@@ -1,32 +1,166 @@
 package config
 
 import (
-	"github.com/Netflix/go-env"
-	"github.com/joho/godotenv"
+	"time"
 )
 
+// EnvVars is the configuration of the server. Its settings are loaded by Loader, which reads the
+// env tags for their environment variables, defaults and whether they're required, the secret tag
+// for the ones redacted from dumps and the reload tag for the ones that can change while running.
 type EnvVars struct {
 	API struct {
-		Address string `env:"API__ADDRESS,required=true"`
+		Address         string        `env:"API__ADDRESS,required=true"`
+		ShutdownTimeout time.Duration `env:"API__SHUTDOWN_TIMEOUT,default=30s"`
+		// AdminToken is the bearer token of GET /config, which is disabled without one
+		AdminToken string `env:"API__ADMIN_TOKEN" secret:"true"`
 	}
 	MongoDB struct {
-		URI      string `env:"MONGODB__URI,required=true"`
-		Database string `env:"MONGODB__DATABASE,required=true"`
+		URI      string `env:"MONGODB__URI" secret:"password"`
+		Database string `env:"MONGODB__DATABASE"`
+	}
+	Storage struct {
+		// Backend is where the measurements are kept, one of influxdb, timescaledb and embedded. The
+		// settings of the backend are required, the ones of the other backends ignored. The embedded
+		// backend also keeps the sensors, in place of MongoDB, so it needs no external service.
+		Backend string `env:"STORAGE__BACKEND,default=influxdb"`
 	}
 	InfluxDB struct {
-		ServerURL string `env:"INFLUXDB__SERVER_URL,required=true"`
-		Org       string `env:"INFLUXDB__ORG,required=true"`
-		Bucket    string `env:"INFLUXDB__BUCKET,required=true"`
-		Token     string `env:"INFLUXDB__TOKEN,required=true"`
+		ServerURL    string `env:"INFLUXDB__SERVER_URL"`
+		Org          string `env:"INFLUXDB__ORG"`
+		Bucket       string `env:"INFLUXDB__BUCKET"`
+		Token        string `env:"INFLUXDB__TOKEN" secret:"true"`
+		RollupBucket string `env:"INFLUXDB__ROLLUP_BUCKET"`
+	}
+	TimescaleDB struct {
+		URL      string `env:"TIMESCALEDB__URL" secret:"password"`
+		MaxConns int    `env:"TIMESCALEDB__MAX_CONNS,default=10"`
+	}
+	Embedded struct {
+		Dir string `env:"EMBEDDED__DIR,default=data"`
+		// The measurements are kept in a file per partition, the partitions past the retention
+		// being removed, unless it's 0
+		Partition time.Duration `env:"EMBEDDED__PARTITION,default=24h"`
+		Retention time.Duration `env:"EMBEDDED__RETENTION,default=720h"`
+		// The queries read a partition at a time, failing on one with more matching points
+		MaxPartitionPoints int `env:"EMBEDDED__MAX_PARTITION_POINTS,default=1000000"`
+	}
+	Sensors struct {
+		CaseInsensitiveNames bool `env:"SENSORS__CASE_INSENSITIVE_NAMES"`
+	}
+	Rollup struct {
+		Interval       time.Duration `env:"ROLLUP__INTERVAL,default=5m"`
+		RawRetention   time.Duration `env:"ROLLUP__RAW_RETENTION,default=720h"`
+		RawMaxRange    time.Duration `env:"ROLLUP__RAW_MAX_RANGE,default=168h"`
+		HourlyMaxRange time.Duration `env:"ROLLUP__HOURLY_MAX_RANGE,default=2160h"`
+	}
+	Ingest struct {
+		QueueSize         int           `env:"INGEST__QUEUE_SIZE,default=10000"`
+		BatchSize         int           `env:"INGEST__BATCH_SIZE,default=500"`
+		FlushInterval     time.Duration `env:"INGEST__FLUSH_INTERVAL,default=1s"`
+		SpoolDir          string        `env:"INGEST__SPOOL_DIR,default=spool"`
+		SpoolMaxBytes     int64         `env:"INGEST__SPOOL_MAX_BYTES,default=1073741824"`
+		SpoolSegmentBytes int64         `env:"INGEST__SPOOL_SEGMENT_BYTES,default=4194304"`
+		ReplayInterval    time.Duration `env:"INGEST__REPLAY_INTERVAL,default=10s"`
+		RetryAfter        time.Duration `env:"INGEST__RETRY_AFTER,default=5s"`
+	}
+	Idempotency struct {
+		Window         time.Duration `env:"IDEMPOTENCY__WINDOW,default=24h"`
+		PendingTimeout time.Duration `env:"IDEMPOTENCY__PENDING_TIMEOUT,default=10m"`
+	}
+	Dedup struct {
+		Policy string        `env:"DEDUP__POLICY,default=keep_last"`
+		Window time.Duration `env:"DEDUP__WINDOW,default=1m"`
+	}
+	Import struct {
+		BatchSize int `env:"IMPORT__BATCH_SIZE,default=5000"`
+		MaxErrors int `env:"IMPORT__MAX_ERRORS,default=1000"`
+	}
+	Anomaly struct {
+		WindowSize        int           `env:"ANOMALY__WINDOW_SIZE,default=60"`
+		MinSamples        int           `env:"ANOMALY__MIN_SAMPLES,default=10"`
+		ZScoreThreshold   float64       `env:"ANOMALY__ZSCORE_THRESHOLD,default=3" reload:"true"`
+		EWMALambda        float64       `env:"ANOMALY__EWMA_LAMBDA,default=0.2"`
+		EWMALimit         float64       `env:"ANOMALY__EWMA_LIMIT,default=3" reload:"true"`
+		SeasonalPeriod    time.Duration `env:"ANOMALY__SEASONAL_PERIOD,default=24h"`
+		SeasonalBuckets   int           `env:"ANOMALY__SEASONAL_BUCKETS,default=24"`
+		SeasonalThreshold float64       `env:"ANOMALY__SEASONAL_THRESHOLD,default=3" reload:"true"`
+		// The series not observed for IdleTimeout lose their state, and so does the one observed the
+		// longest ago beyond MaxSeries
+		IdleTimeout time.Duration `env:"ANOMALY__IDLE_TIMEOUT,default=168h"`
+		MaxSeries   int           `env:"ANOMALY__MAX_SERIES,default=100000"`
+	}
+	Replication struct {
+		// UpstreamURL is the server the sensor changes and the measurements are shipped to, such as
+		// http://cloud:3000, replication being disabled without it
+		UpstreamURL string `env:"REPLICATION__UPSTREAM_URL"`
+		// Source names this server upstream, its host name when empty
+		Source string `env:"REPLICATION__SOURCE"`
+		// Token is the secret shared by the servers replicating to each other, sent with the
+		// batches and required to accept them. Without it the server accepts no batches
+		Token         string        `env:"REPLICATION__TOKEN" secret:"true"`
+		Dir           string        `env:"REPLICATION__DIR,default=replication"`
+		MaxBytes      int64         `env:"REPLICATION__MAX_BYTES,default=1073741824"`
+		SegmentBytes  int64         `env:"REPLICATION__SEGMENT_BYTES,default=4194304"`
+		BatchSize     int           `env:"REPLICATION__BATCH_SIZE,default=5000"`
+		MaxBatchBytes int64         `env:"REPLICATION__MAX_BATCH_BYTES,default=67108864"` // Of the batches accepted, once decompressed
+		Interval      time.Duration `env:"REPLICATION__INTERVAL,default=5s"`
+		MaxBackoff    time.Duration `env:"REPLICATION__MAX_BACKOFF,default=5m"`
+		Timeout       time.Duration `env:"REPLICATION__TIMEOUT,default=30s"`
+	}
+	Health struct {
+		CheckTimeout   time.Duration `env:"HEALTH__CHECK_TIMEOUT,default=2s"`
+		StartupTimeout time.Duration `env:"HEALTH__STARTUP_TIMEOUT,default=5m"`
+	}
+	Query struct {
+		Timeout time.Duration `env:"QUERY__TIMEOUT,default=30s"`
+		// The longest time ranges by kind of query
+		MaxRawRange       time.Duration `env:"QUERY__MAX_RAW_RANGE,default=168h"`
+		MaxAggregateRange time.Duration `env:"QUERY__MAX_AGGREGATE_RANGE,default=8760h"`
+		MaxSummaryRange   time.Duration `env:"QUERY__MAX_SUMMARY_RANGE,default=87600h"`
+		MaxExportRange    time.Duration `env:"QUERY__MAX_EXPORT_RANGE,default=2160h"`
+		// ExportTimeout bounds an export, streamed for longer than a query is given
+		ExportTimeout time.Duration `env:"QUERY__EXPORT_TIMEOUT,default=10m"`
+		// MaxPoints is the most points a raw query returns
+		MaxPoints int `env:"QUERY__MAX_POINTS,default=100000"`
+	}
+	RateLimit struct {
+		Enabled bool `env:"RATE_LIMIT__ENABLED,default=true" reload:"true"`
+		// Store is where the buckets are kept, only memory for now
+		Store       string  `env:"RATE_LIMIT__STORE,default=memory"`
+		IngestRate  float64 `env:"RATE_LIMIT__INGEST_RATE,default=100" reload:"true"`
+		IngestBurst int     `env:"RATE_LIMIT__INGEST_BURST,default=200" reload:"true"`
+		QueryRate   float64 `env:"RATE_LIMIT__QUERY_RATE,default=20" reload:"true"`
+		QueryBurst  int     `env:"RATE_LIMIT__QUERY_BURST,default=50" reload:"true"`
+		WriteRate   float64 `env:"RATE_LIMIT__WRITE_RATE,default=10" reload:"true"`
+		WriteBurst  int     `env:"RATE_LIMIT__WRITE_BURST,default=20" reload:"true"`
+		SensorRate  float64 `env:"RATE_LIMIT__SENSOR_RATE,default=10" reload:"true"`
+		SensorBurst int     `env:"RATE_LIMIT__SENSOR_BURST,default=50" reload:"true"`
+		// APIKeys are the comma separated keys whose clients share a budget wherever they are
+		APIKeys string `env:"RATE_LIMIT__API_KEYS" secret:"true" reload:"true"`
+	}
+	Tracing Tracing
+	Log     struct {
+		Level string `env:"LOG__LEVEL,default=info" reload:"true"`
 	}
 	DevMode bool `env:"DEV_MODE"`
 }
 
+// Tracing is shared with the clients of the API, such as the fake sensor, so they can load it on
+// its own.
+type Tracing struct {
+	// Exporter is one of none, otlp, stdout and file
+	Exporter     string  `env:"TRACING__EXPORTER,default=none"`
+	OTLPEndpoint string  `env:"TRACING__OTLP_ENDPOINT,default=localhost:4318"`
+	OTLPInsecure bool    `env:"TRACING__OTLP_INSECURE"`
+	File         string  `env:"TRACING__FILE,default=traces.jsonl"`
+	SampleRatio  float64 `env:"TRACING__SAMPLE_RATIO,default=1"`
+}
+
+// Get loads the configuration without command line flags.
 func Get() (*EnvVars, error) {
-	_ = godotenv.Load()
-	var envVars EnvVars
-	if _, err := env.UnmarshalFromEnviron(&envVars); err != nil {
+	loader, err := NewLoader(nil)
+	if err != nil {
 		return nil, err
 	}
-	return &envVars, nil
+	return loader.Current(), nil
 }
@@ -0,0 +1,477 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of the settings, from the lowest precedence to the highest.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceDotEnv  = "dotenv"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+const redacted = "REDACTED"
+
+// ValidationError lists every problem found in the configuration, not only the first one.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// setting is a field of EnvVars. Its key, used in the config files and the command line flags, is
+// its environment variable in lower case with dots for double underscores, so INGEST__BATCH_SIZE
+// is ingest.batch_size.
+type setting struct {
+	env        string
+	key        string
+	value      string
+	hasDefault bool
+	required   bool
+	// secret is "true" to redact the whole value in dumps and "password" to only redact the
+	// password of a URL
+	secret     string
+	reloadable bool
+	index      []int
+	kind       reflect.Kind
+	duration   bool
+}
+
+var settings = collectSettings(reflect.TypeOf(EnvVars{}), nil)
+
+func collectSettings(t reflect.Type, index []int) []setting {
+	var result []setting
+	for i := range t.NumField() {
+		field := t.Field(i)
+		fieldIndex := append(slices.Clone(index), i)
+
+		tag := field.Tag.Get("env")
+		if tag == "" {
+			if field.Type.Kind() == reflect.Struct {
+				result = append(result, collectSettings(field.Type, fieldIndex)...)
+			}
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		s := setting{
+			env:        options[0],
+			key:        strings.ToLower(strings.ReplaceAll(options[0], "__", ".")),
+			secret:     field.Tag.Get("secret"),
+			reloadable: field.Tag.Get("reload") == "true",
+			index:      fieldIndex,
+			kind:       field.Type.Kind(),
+			duration:   field.Type == reflect.TypeOf(time.Duration(0)),
+		}
+		for _, option := range options[1:] {
+			switch {
+			case option == "required=true":
+				s.required = true
+			case strings.HasPrefix(option, "default="):
+				s.value = strings.TrimPrefix(option, "default=")
+				s.hasDefault = true
+			}
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// ReloadResult lists the settings whose changes were applied and the ones whose changes were
+// ignored because they need a restart.
+type ReloadResult struct {
+	Applied []string
+	Ignored []string
+}
+
+// Setting is the value of a setting in a dump, along with the layer it came from.
+type Setting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Loader loads the configuration from its layers, from the lowest precedence to the highest: the
+// defaults, the config file, the .env file, the environment and the command line flags. It keeps
+// the configuration loaded last and can load it again, applying the changes of the settings
+// tagged with reload.
+type Loader struct {
+	args []string
+
+	mu          sync.Mutex
+	current     *EnvVars
+	sources     map[string]string
+	subscribers []func(*EnvVars)
+}
+
+// NewLoader loads the configuration, args being the command line arguments without the program
+// name.
+func NewLoader(args []string) (*Loader, error) {
+	l := &Loader{args: args}
+	envVars, sources, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.current = envVars
+	l.sources = sources
+	return l, nil
+}
+
+// Current returns the configuration as of the last reload. Components read at construction the
+// configuration given by the container, which isn't updated, and subscribe to the reloads for the
+// settings they can change while running.
+func (l *Loader) Current() *EnvVars {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current
+}
+
+// OnReload calls fn with the new configuration after every reload that changed a setting.
+func (l *Loader) OnReload(fn func(*EnvVars)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers = append(l.subscribers, fn)
+}
+
+// Reload loads the configuration again and applies the changes of the reloadable settings. When
+// the new configuration is invalid, nothing is applied.
+func (l *Loader) Reload() (ReloadResult, error) {
+	next, sources, err := l.load()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	l.mu.Lock()
+	// A new configuration rather than changing the current one, which may be read meanwhile
+	updated := *l.current
+	updatedValue := reflect.ValueOf(&updated).Elem()
+	nextValue := reflect.ValueOf(next).Elem()
+	var result ReloadResult
+	for _, s := range settings {
+		field := updatedValue.FieldByIndex(s.index)
+		value := nextValue.FieldByIndex(s.index)
+		if field.Equal(value) {
+			continue
+		}
+		if !s.reloadable {
+			result.Ignored = append(result.Ignored, s.key)
+			continue
+		}
+		field.Set(value)
+		l.sources[s.key] = sources[s.key]
+		result.Applied = append(result.Applied, s.key)
+	}
+	l.current = &updated
+	subscribers := slices.Clone(l.subscribers)
+	l.mu.Unlock()
+
+	if len(result.Applied) > 0 {
+		for _, fn := range subscribers {
+			fn(&updated)
+		}
+	}
+	return result, nil
+}
+
+// Dump returns the current value and source of every setting, with the secrets redacted.
+func (l *Loader) Dump() map[string]Setting {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	root := reflect.ValueOf(l.current).Elem()
+	dump := make(map[string]Setting, len(settings))
+	for _, s := range settings {
+		value := fmt.Sprint(root.FieldByIndex(s.index).Interface())
+		if value != "" {
+			switch s.secret {
+			case "true":
+				value = redacted
+			case "password":
+				value = redactPassword(value)
+			}
+		}
+		dump[s.key] = Setting{Value: value, Source: l.sources[s.key]}
+	}
+	return dump
+}
+
+// secretParams are the words naming the query parameters of a URL holding secrets, such as the
+// password and sslpassword of PostgreSQL or the AWS_SESSION_TOKEN properties of MongoDB.
+var secretParams = []string{"password", "token", "secret", "key", "auth"}
+
+// redactPassword redacts the password of a URL and the values of its query parameters holding
+// secrets, or the whole value when it isn't a URL, such as a PostgreSQL key/value string.
+func redactPassword(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+
+	query := u.Query()
+	for name, values := range query {
+		lower := strings.ToLower(name)
+		if slices.ContainsFunc(secretParams, func(word string) bool { return strings.Contains(lower, word) }) {
+			for i := range values {
+				values[i] = redacted
+			}
+		}
+	}
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+func (l *Loader) load() (*EnvVars, map[string]string, error) {
+	flags, configFile, err := parseFlags(l.args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+
+	values := map[string]string{}
+	sources := map[string]string{}
+	apply := func(source string, layer map[string]string) {
+		for key, value := range layer {
+			values[key] = value
+			sources[key] = source
+		}
+	}
+
+	var problems []string
+	if configFile != "" {
+		layer, err := readFile(configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		for key := range layer {
+			if !slices.ContainsFunc(settings, func(s setting) bool { return s.key == key }) {
+				problems = append(problems, fmt.Sprintf("%s: unknown setting in %s", key, configFile))
+			}
+		}
+		apply(SourceFile, layer)
+	}
+
+	dotEnv, err := godotenv.Read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to read .env: %w", err)
+	}
+	apply(SourceDotEnv, byKey(dotEnv))
+
+	environment := map[string]string{}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			environment[s.env] = value
+		}
+	}
+	apply(SourceEnv, byKey(environment))
+	apply(SourceFlag, flags)
+
+	envVars := &EnvVars{}
+	root := reflect.ValueOf(envVars).Elem()
+	for _, s := range settings {
+		// An empty value is the same as an unset one, as with the environment variables
+		value := values[s.key]
+		if value == "" {
+			sources[s.key] = SourceDefault
+			if s.required && !s.hasDefault {
+				problems = append(problems, fmt.Sprintf("%s (%s): is required", s.key, s.env))
+				continue
+			}
+			if !s.hasDefault {
+				continue
+			}
+			value = s.value
+		}
+
+		field := root.FieldByIndex(s.index)
+		if err := setValue(s, field, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s): %s", s.key, s.env, err))
+			continue
+		}
+		if err := validateSetting(s.key, field.Interface()); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s): %s", s.key, s.env, err))
+		}
+	}
+	for _, key := range backendSettings[envVars.Storage.Backend] {
+		if values[key] == "" {
+			s := settings[slices.IndexFunc(settings, func(s setting) bool { return s.key == key })]
+			problems = append(problems, fmt.Sprintf("%s (%s): is required by the %s storage backend", s.key, s.env, envVars.Storage.Backend))
+		}
+	}
+	if values["replication.upstream_url"] != "" && values["replication.token"] == "" {
+		problems = append(problems, "replication.token (REPLICATION__TOKEN): is required to replicate upstream")
+	}
+	if len(problems) > 0 {
+		return nil, nil, &ValidationError{Problems: problems}
+	}
+
+	return envVars, sources, nil
+}
+
+// byKey keeps the known environment variables, by the key of their setting.
+func byKey(environment map[string]string) map[string]string {
+	layer := map[string]string{}
+	for _, s := range settings {
+		if value, ok := environment[s.env]; ok {
+			layer[s.key] = value
+		}
+	}
+	return layer
+}
+
+func setValue(s setting, field reflect.Value, value string) error {
+	switch {
+	case s.duration:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 30s or 5m, got %q", value)
+		}
+		field.SetInt(int64(duration))
+	case s.kind == reflect.String:
+		field.SetString(value)
+	case s.kind == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be true or false, got %q", value)
+		}
+		field.SetBool(b)
+	case s.kind == reflect.Int || s.kind == reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be an integer, got %q", value)
+		}
+		field.SetInt(i)
+	case s.kind == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number, got %q", value)
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.kind)
+	}
+	return nil
+}
+
+// readFile reads a YAML or TOML config file, whose sections are the part of the keys before the
+// dots.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	tree := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q, it must be .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	layer := map[string]string{}
+	if err := flatten("", tree, layer); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return layer, nil
+}
+
+func flatten(prefix string, tree map[string]any, layer map[string]string) error {
+	for name, value := range tree {
+		key := strings.ToLower(name)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		switch v := value.(type) {
+		case map[string]any:
+			if err := flatten(key, v, layer); err != nil {
+				return err
+			}
+		case string:
+			layer[key] = v
+		case float64:
+			layer[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case int, int64, bool:
+			layer[key] = fmt.Sprint(v)
+		default:
+			return fmt.Errorf("%s: must be a single value", key)
+		}
+	}
+	return nil
+}
+
+// flagValue records the flags that were set, so unset ones don't override the other layers.
+type flagValue struct {
+	key    string
+	layer  map[string]string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	return ""
+}
+
+func (f *flagValue) Set(value string) error {
+	f.layer[f.key] = value
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// parseFlags returns the settings set by the flags and the config file.
+func parseFlags(args []string) (map[string]string, string, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := fs.String("config", "", "YAML or TOML file to read the settings from, also set by CONFIG_FILE")
+	layer := map[string]string{}
+	for _, s := range settings {
+		usage := s.env
+		switch {
+		case s.required:
+			usage += ", required"
+		case s.hasDefault:
+			usage += ", default " + s.value
+		}
+		if s.reloadable {
+			usage += ", reloaded on SIGHUP"
+		}
+		fs.Var(&flagValue{key: s.key, layer: layer, isBool: s.kind == reflect.Bool}, s.key, usage)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, "", err
+	}
+	return layer, *configFile, nil
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	validator "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/rs/zerolog"
+)
+
+var (
+	positiveDuration = validator.By(func(value interface{}) error {
+		if value.(time.Duration) <= 0 {
+			return errors.New("must be a positive duration")
+		}
+		return nil
+	})
+	nonNegativeDuration = validator.By(func(value interface{}) error {
+		if value.(time.Duration) < 0 {
+			return errors.New("must not be negative")
+		}
+		return nil
+	})
+	serverURL = validator.By(func(value interface{}) error {
+		u, err := url.Parse(value.(string))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("must be a URL such as http://localhost:8086")
+		}
+		return nil
+	})
+	mongoURI = validator.By(func(value interface{}) error {
+		u, err := url.Parse(value.(string))
+		if err != nil || (u.Scheme != "mongodb" && u.Scheme != "mongodb+srv") {
+			return errors.New("must be a URI such as mongodb://localhost:27017")
+		}
+		return nil
+	})
+	postgresURL = validator.By(func(value interface{}) error {
+		u, err := url.Parse(value.(string))
+		if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+			return errors.New("must be a URL such as postgres://localhost:5432/sensors")
+		}
+		return nil
+	})
+	logLevel = validator.By(func(value interface{}) error {
+		if _, err := zerolog.ParseLevel(value.(string)); err != nil {
+			return errors.New("must be one of trace, debug, info, warn, error, fatal, panic, disabled")
+		}
+		return nil
+	})
+)
+
+// atLeast and atMost, unlike the rules of ozzo-validation, also validate zero values, which are
+// meaningful for numbers.
+func atLeast(min float64) validator.Rule {
+	return validator.By(func(value interface{}) error {
+		if number(value) < min {
+			return fmt.Errorf("must be no less than %v", min)
+		}
+		return nil
+	})
+}
+
+func atMost(max float64) validator.Rule {
+	return validator.By(func(value interface{}) error {
+		if number(value) > max {
+			return fmt.Errorf("must be no greater than %v", max)
+		}
+		return nil
+	})
+}
+
+func positive() validator.Rule {
+	return validator.By(func(value interface{}) error {
+		if number(value) <= 0 {
+			return errors.New("must be greater than 0")
+		}
+		return nil
+	})
+}
+
+func number(value interface{}) float64 {
+	v := reflect.ValueOf(value)
+	if v.CanInt() {
+		return float64(v.Int())
+	}
+	return v.Float()
+}
+
+func oneOf(values ...string) validator.Rule {
+	return validator.By(func(value interface{}) error {
+		if !slices.Contains(values, value.(string)) {
+			return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+		}
+		return nil
+	})
+}
+
+// rules validates the settings by key, once they were parsed. The ones without rules accept any
+// value of their type.
+var rules = map[string][]validator.Rule{
+	"api.shutdown_timeout":          {positiveDuration},
+	"mongodb.uri":                   {mongoURI},
+	"storage.backend":               {oneOf("influxdb", "timescaledb", "embedded")},
+	"influxdb.server_url":           {serverURL},
+	"timescaledb.url":               {postgresURL},
+	"timescaledb.max_conns":         {atLeast(1)},
+	"embedded.partition":            {positiveDuration},
+	"embedded.retention":            {nonNegativeDuration},
+	"embedded.max_partition_points": {atLeast(1)},
+	"rollup.interval":               {positiveDuration},
+	"rollup.raw_retention":          {nonNegativeDuration},
+	"rollup.raw_max_range":          {positiveDuration},
+	"rollup.hourly_max_range":       {positiveDuration},
+	"ingest.queue_size":             {atLeast(1)},
+	"ingest.batch_size":             {atLeast(1)},
+	"ingest.flush_interval":         {positiveDuration},
+	"ingest.spool_max_bytes":        {atLeast(0)},
+	"ingest.spool_segment_bytes":    {atLeast(1)},
+	"ingest.replay_interval":        {positiveDuration},
+	"ingest.retry_after":            {positiveDuration},
+	"idempotency.window":            {positiveDuration},
+	"idempotency.pending_timeout":   {positiveDuration},
+	"dedup.policy":                  {oneOf("keep_first", "keep_last", "reject")},
+	"dedup.window":                  {nonNegativeDuration},
+	"import.batch_size":             {atLeast(1)},
+	"import.max_errors":             {atLeast(0)},
+	"anomaly.window_size":           {atLeast(1)},
+	"anomaly.min_samples":           {atLeast(1)},
+	"anomaly.zscore_threshold":      {atLeast(0)},
+	"anomaly.ewma_lambda":           {atLeast(0), atMost(1)},
+	"anomaly.ewma_limit":            {atLeast(0)},
+	"anomaly.seasonal_period":       {positiveDuration},
+	"anomaly.seasonal_buckets":      {atLeast(1)},
+	"anomaly.seasonal_threshold":    {atLeast(0)},
+	"anomaly.idle_timeout":          {positiveDuration},
+	"anomaly.max_series":            {atLeast(1)},
+	"replication.upstream_url":      {serverURL},
+	"replication.max_bytes":         {atLeast(1)},
+	"replication.segment_bytes":     {atLeast(1)},
+	"replication.batch_size":        {atLeast(1)},
+	"replication.max_batch_bytes":   {atLeast(1)},
+	"replication.interval":          {positiveDuration},
+	"replication.max_backoff":       {positiveDuration},
+	"replication.timeout":           {positiveDuration},
+	"health.check_timeout":          {positiveDuration},
+	"health.startup_timeout":        {positiveDuration},
+	"query.timeout":                 {positiveDuration},
+	"query.max_raw_range":           {positiveDuration},
+	"query.max_aggregate_range":     {positiveDuration},
+	"query.max_summary_range":       {positiveDuration},
+	"query.max_export_range":        {positiveDuration},
+	"query.export_timeout":          {positiveDuration},
+	"query.max_points":              {atLeast(1)},
+	"rate_limit.store":              {oneOf("memory")},
+	"rate_limit.ingest_rate":        {positive()},
+	"rate_limit.ingest_burst":       {atLeast(1)},
+	"rate_limit.query_rate":         {positive()},
+	"rate_limit.query_burst":        {atLeast(1)},
+	"rate_limit.write_rate":         {positive()},
+	"rate_limit.write_burst":        {atLeast(1)},
+	"rate_limit.sensor_rate":        {positive()},
+	"rate_limit.sensor_burst":       {atLeast(1)},
+	"tracing.exporter":              {oneOf("none", "otlp", "stdout", "file")},
+	"tracing.sample_ratio":          {atLeast(0), atMost(1)},
+	"log.level":                     {logLevel},
+}
+
+func validateSetting(key string, value interface{}) error {
+	return validator.Validate(value, rules[key]...)
+}
+
+// backendSettings are the settings required by each storage backend, which can't be tagged as
+// required since the other backends don't need them. MongoDB is needed by every backend but the
+// embedded one, whose settings all have defaults.
+var backendSettings = map[string][]string{
+	"influxdb":    {"mongodb.uri", "mongodb.database", "influxdb.server_url", "influxdb.org", "influxdb.bucket", "influxdb.token"},
+	"timescaledb": {"mongodb.uri", "mongodb.database", "timescaledb.url"},
+}
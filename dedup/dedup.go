@@ -0,0 +1,227 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ingest"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+var ErrDuplicate = errors.New("a measurement with the same timestamp already exists in the series")
+
+// Policy decides what happens to a measurement whose series already has a point at its timestamp.
+type Policy string
+
+const (
+	// PolicyKeepFirst drops the duplicate, keeping the point already stored.
+	PolicyKeepFirst Policy = "keep_first"
+	// PolicyKeepLast writes the duplicate over the stored point, which is what InfluxDB does anyway.
+	PolicyKeepLast Policy = "keep_last"
+	// PolicyReject refuses the duplicate as an error.
+	PolicyReject Policy = "reject"
+)
+
+func ParsePolicy(value string) (Policy, error) {
+	switch policy := Policy(value); policy {
+	case PolicyKeepFirst, PolicyKeepLast, PolicyReject:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported duplicate policy: %s", value)
+	}
+}
+
+type timestampReader interface {
+	GetMeasurementTimestamps(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) ([]time.Time, error)
+}
+
+// backlog tells whether measurements are waiting in the ingest spool, which is the case for as
+// long as InfluxDB is unavailable and until the spool was replayed.
+type backlog interface {
+	Spooling() bool
+}
+
+type seriesKey struct {
+	sensorID    string
+	measurement string
+	unit        string
+}
+
+type pointKey struct {
+	seriesKey
+	timestamp int64
+}
+
+func newPointKey(m *repository.Measurement) pointKey {
+	return pointKey{
+		seriesKey: seriesKey{sensorID: m.SensorID, measurement: m.Name, unit: m.Unit},
+		timestamp: m.Timestamp.UnixNano(),
+	}
+}
+
+// Deduplicator finds measurements whose series already has a point at the same timestamp. Points
+// are looked up in InfluxDB, and the measurements admitted within the window are also remembered,
+// since they may still be waiting in the ingest queue. They are kept past the window while the
+// ingest spool isn't empty, since spooled measurements only reach InfluxDB once it's replayed.
+type Deduplicator struct {
+	reader  timestampReader
+	backlog backlog
+	policy  Policy
+	window  time.Duration
+
+	mu         sync.Mutex
+	recent     map[pointKey]time.Time
+	lastPruned time.Time
+}
+
+func NewDeduplicator(envVars *config.EnvVars, measurementRepository repository.MeasurementRepository, pipeline *ingest.Pipeline) (*Deduplicator, error) {
+	policy, err := ParsePolicy(envVars.Dedup.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDeduplicator(measurementRepository, pipeline, policy, envVars.Dedup.Window), nil
+}
+
+func newDeduplicator(reader timestampReader, backlog backlog, policy Policy, window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		reader:  reader,
+		backlog: backlog,
+		policy:  policy,
+		window:  window,
+		recent:  map[pointKey]time.Time{},
+	}
+}
+
+func (d *Deduplicator) Policy() Policy {
+	return d.policy
+}
+
+// Admit tells whether a measurement should be written. A duplicate returns false under
+// PolicyKeepFirst and ErrDuplicate under PolicyReject. Admitted measurements are remembered, so
+// Forget must be called if they end up not being written.
+func (d *Deduplicator) Admit(ctx context.Context, measurement *repository.Measurement) (bool, error) {
+	if d.policy == PolicyKeepLast {
+		return true, nil
+	}
+
+	key := newPointKey(measurement)
+	now := time.Now()
+
+	// Claiming the key before going to InfluxDB keeps concurrent retries from both being admitted
+	d.mu.Lock()
+	d.prune(now)
+	_, seen := d.recent[key]
+	if !seen {
+		d.recent[key] = now
+	}
+	d.mu.Unlock()
+
+	duplicate := seen
+	if !duplicate {
+		timestamps, err := d.reader.GetMeasurementTimestamps(ctx, measurement.SensorID, measurement.Name, measurement.Unit, measurement.Timestamp, measurement.Timestamp.Add(time.Nanosecond))
+		if err != nil {
+			d.Forget(measurement)
+			return false, err
+		}
+		if len(timestamps) > 0 {
+			duplicate = true
+			d.Forget(measurement)
+		}
+	}
+
+	if !duplicate {
+		return true, nil
+	}
+	if d.policy == PolicyReject {
+		return false, ErrDuplicate
+	}
+	return false, nil
+}
+
+// Forget releases measurements that were admitted but couldn't be written.
+func (d *Deduplicator) Forget(measurements ...*repository.Measurement) {
+	if d.policy == PolicyKeepLast {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, measurement := range measurements {
+		delete(d.recent, newPointKey(measurement))
+	}
+}
+
+// Filter returns the indexes of the measurements of a batch that are duplicates, either of points
+// already stored, of recently admitted measurements or of an earlier measurement of the same
+// batch. The batch isn't remembered, it's meant for callers writing it right away. Under
+// PolicyKeepLast nothing is a duplicate.
+func (d *Deduplicator) Filter(ctx context.Context, measurements []*repository.Measurement) ([]int, error) {
+	if d.policy == PolicyKeepLast || len(measurements) == 0 {
+		return nil, nil
+	}
+
+	type timeRange struct{ start, end time.Time }
+	ranges := map[seriesKey]*timeRange{}
+	for _, measurement := range measurements {
+		key := newPointKey(measurement).seriesKey
+		r, ok := ranges[key]
+		if !ok {
+			ranges[key] = &timeRange{start: measurement.Timestamp, end: measurement.Timestamp}
+			continue
+		}
+		if measurement.Timestamp.Before(r.start) {
+			r.start = measurement.Timestamp
+		}
+		if measurement.Timestamp.After(r.end) {
+			r.end = measurement.Timestamp
+		}
+	}
+
+	existing := map[pointKey]struct{}{}
+	for key, r := range ranges {
+		timestamps, err := d.reader.GetMeasurementTimestamps(ctx, key.sensorID, key.measurement, key.unit, r.start, r.end.Add(time.Nanosecond))
+		if err != nil {
+			return nil, err
+		}
+		for _, timestamp := range timestamps {
+			existing[pointKey{seriesKey: key, timestamp: timestamp.UnixNano()}] = struct{}{}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(time.Now())
+
+	var duplicates []int
+	for i, measurement := range measurements {
+		key := newPointKey(measurement)
+		_, stored := existing[key]
+		_, admitted := d.recent[key]
+		if stored || admitted {
+			duplicates = append(duplicates, i)
+			continue
+		}
+		existing[key] = struct{}{}
+	}
+
+	return duplicates, nil
+}
+
+// prune drops the measurements admitted before the window, at most once per window, unless some
+// may still be waiting in the spool. It must be called with the mutex held.
+func (d *Deduplicator) prune(now time.Time) {
+	if now.Sub(d.lastPruned) < d.window || d.backlog.Spooling() {
+		return
+	}
+	for key, admittedAt := range d.recent {
+		if now.Sub(admittedAt) > d.window {
+			delete(d.recent, key)
+		}
+	}
+	d.lastPruned = now
+}
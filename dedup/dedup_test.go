@@ -0,0 +1,152 @@
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+type fakeReader struct {
+	timestamps map[string][]time.Time
+	queries    int
+}
+
+func (f *fakeReader) GetMeasurementTimestamps(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) ([]time.Time, error) {
+	f.queries++
+	var timestamps []time.Time
+	for _, timestamp := range f.timestamps[sensorID] {
+		if !timestamp.Before(start) && timestamp.Before(end) {
+			timestamps = append(timestamps, timestamp)
+		}
+	}
+	return timestamps, nil
+}
+
+type fakeBacklog struct {
+	spooling bool
+}
+
+func (f *fakeBacklog) Spooling() bool {
+	return f.spooling
+}
+
+func newMeasurement(sensorID string, timestamp time.Time) *repository.Measurement {
+	return &repository.Measurement{
+		Name:      "temperature",
+		SensorID:  sensorID,
+		Unit:      "celsius",
+		Value:     20,
+		Timestamp: timestamp,
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	t.Parallel()
+
+	stored := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("when a measurement is already stored, it should apply the policy", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		reader := &fakeReader{timestamps: map[string][]time.Time{"a": {stored}}}
+		ctx := context.Background()
+
+		admitted, err := newDeduplicator(reader, &fakeBacklog{}, PolicyKeepFirst, time.Minute).Admit(ctx, newMeasurement("a", stored))
+		is.Nil(err)
+		is.False(admitted)
+
+		_, err = newDeduplicator(reader, &fakeBacklog{}, PolicyReject, time.Minute).Admit(ctx, newMeasurement("a", stored))
+		is.ErrorIs(err, ErrDuplicate)
+
+		admitted, err = newDeduplicator(reader, &fakeBacklog{}, PolicyKeepLast, time.Minute).Admit(ctx, newMeasurement("a", stored))
+		is.Nil(err)
+		is.True(admitted)
+	})
+
+	t.Run("when a measurement is admitted twice before being written, it should be a duplicate until forgotten", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		deduplicator := newDeduplicator(&fakeReader{}, &fakeBacklog{}, PolicyKeepFirst, time.Minute)
+		ctx := context.Background()
+		measurement := newMeasurement("a", stored.Add(time.Second))
+
+		admitted, err := deduplicator.Admit(ctx, measurement)
+		is.Nil(err)
+		is.True(admitted)
+
+		admitted, err = deduplicator.Admit(ctx, measurement)
+		is.Nil(err)
+		is.False(admitted)
+
+		deduplicator.Forget(measurement)
+		admitted, err = deduplicator.Admit(ctx, measurement)
+		is.Nil(err)
+		is.True(admitted)
+	})
+
+	t.Run("when measurements are waiting in the spool, it should remember them past the window", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		backlog := &fakeBacklog{spooling: true}
+		deduplicator := newDeduplicator(&fakeReader{}, backlog, PolicyKeepFirst, time.Nanosecond)
+		ctx := context.Background()
+		measurement := newMeasurement("a", stored.Add(2*time.Second))
+
+		admitted, err := deduplicator.Admit(ctx, measurement)
+		is.Nil(err)
+		is.True(admitted)
+		time.Sleep(time.Millisecond)
+
+		admitted, err = deduplicator.Admit(ctx, measurement)
+		is.Nil(err)
+		is.False(admitted)
+
+		// Once replayed, the point would be found in InfluxDB
+		backlog.spooling = false
+		time.Sleep(time.Millisecond)
+		admitted, err = deduplicator.Admit(ctx, measurement)
+		is.Nil(err)
+		is.True(admitted)
+	})
+
+	t.Run("when a batch has duplicates, it should return their indexes querying each series once", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		reader := &fakeReader{timestamps: map[string][]time.Time{"a": {stored}}}
+		deduplicator := newDeduplicator(reader, &fakeBacklog{}, PolicyReject, time.Minute)
+
+		duplicates, err := deduplicator.Filter(context.Background(), []*repository.Measurement{
+			newMeasurement("a", stored.Add(-time.Hour)),
+			newMeasurement("a", stored),
+			newMeasurement("b", stored),
+			newMeasurement("b", stored),
+			newMeasurement("a", stored.Add(time.Hour)),
+		})
+		is.Nil(err)
+		is.Equal([]int{1, 3}, duplicates)
+		is.Equal(2, reader.queries)
+	})
+
+	t.Run("when the policy is keep_last, it should never look for duplicates", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		reader := &fakeReader{timestamps: map[string][]time.Time{"a": {stored}}}
+		deduplicator := newDeduplicator(reader, &fakeBacklog{}, PolicyKeepLast, time.Minute)
+
+		duplicates, err := deduplicator.Filter(context.Background(), []*repository.Measurement{
+			newMeasurement("a", stored),
+			newMeasurement("a", stored),
+		})
+		is.Nil(err)
+		is.Empty(duplicates)
+		is.Zero(reader.queries)
+	})
+}
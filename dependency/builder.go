@@ -8,21 +8,48 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/health"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 func configureLogger(envVars *config.EnvVars) zerolog.Logger {
 	if envVars.DevMode {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
+	setLogLevel(envVars.Log.Level)
 
 	return log.Logger
 }
 
+// setLogLevel sets the level of every logger, the level having been validated with the
+// configuration.
+func setLogLevel(level string) {
+	if parsed, err := zerolog.ParseLevel(level); err == nil {
+		zerolog.SetGlobalLevel(parsed)
+	}
+}
+
 func buildMongoClient(envVars *config.EnvVars) (*mongo.Client, error) {
 	ctx := context.Background()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(envVars.MongoDB.URI))
+	opts := options.Client().
+		ApplyURI(envVars.MongoDB.URI).
+		SetMonitor(otelmongo.NewMonitor())
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+
+	// Connect doesn't wait for the server, which may still be starting along with the service
+	ctx, cancel := context.WithTimeout(ctx, envVars.Health.StartupTimeout)
+	defer cancel()
+	err = health.Retry(ctx, "mongodb", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, envVars.Health.CheckTimeout)
+		defer cancel()
+		return client.Ping(ctx, readpref.Primary())
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
 	}
@@ -1,29 +1,248 @@
 package dependency
 
 import (
+	"context"
+
 	"github.com/golobby/container/v3"
+	"github.com/zignd/pingthings-collaborative-technical-interview/anomaly"
+	"github.com/zignd/pingthings-collaborative-technical-interview/channel"
 	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/dedup"
+	"github.com/zignd/pingthings-collaborative-technical-interview/health"
+	"github.com/zignd/pingthings-collaborative-technical-interview/importer"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ingest"
+	"github.com/zignd/pingthings-collaborative-technical-interview/ratelimit"
+	"github.com/zignd/pingthings-collaborative-technical-interview/replication"
 	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"github.com/zignd/pingthings-collaborative-technical-interview/rollup"
+	"github.com/zignd/pingthings-collaborative-technical-interview/tracing"
 )
 
-func SetupContainer() (*container.Container, error) {
+// SetupContainer builds the components of the server, args being its command line arguments
+// without the program name.
+func SetupContainer(args []string) (*container.Container, error) {
 	cont := container.New()
 
-	if err := cont.Singleton(config.Get); err != nil {
+	if err := cont.Singleton(func() (*config.Loader, error) { return config.NewLoader(args) }); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(func(loader *config.Loader) *config.EnvVars { return loader.Current() }); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(NewLifecycle); err != nil {
 		return nil, err
 	}
 	if err := cont.Singleton(configureLogger); err != nil {
 		return nil, err
 	}
-	if err := cont.Singleton(buildMongoClient); err != nil {
+	// Set up before the clients, so they get the tracer provider
+	if err := cont.Singleton(tracing.NewProvider); err != nil {
+		return nil, err
+	}
+
+	// Everything but the measurements is kept in MongoDB, or in the embedded store in the embedded
+	// mode, which runs without any external service
+	var envVars *config.EnvVars
+	if err := cont.Resolve(&envVars); err != nil {
 		return nil, err
 	}
-	if err := cont.Singleton(repository.NewSensorsRepository); err != nil {
+	registerRepositories := registerMongoRepositories
+	if envVars.Storage.Backend == repository.StorageEmbedded {
+		registerRepositories = registerEmbeddedRepositories
+	}
+	if err := registerRepositories(cont); err != nil {
 		return nil, err
 	}
 	if err := cont.Singleton(repository.NewMeasurementRepository); err != nil {
 		return nil, err
 	}
+	if err := cont.Singleton(replication.NewReplicator); err != nil {
+		return nil, err
+	}
+	if err := recordForReplication(cont); err != nil {
+		return nil, err
+	}
+	// Built once the sensors repository records for replication, the tracks moving the sensors
+	// through it
+	newTracksRepository := any(repository.NewMongoTracksRepository)
+	if envVars.Storage.Backend == repository.StorageEmbedded {
+		newTracksRepository = repository.NewEmbeddedTracksRepository
+	}
+	if err := cont.Singleton(newTracksRepository); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(replication.NewApplier); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(anomaly.NewMonitor); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(channel.NewResolver); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(ingest.NewPipeline); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(dedup.NewDeduplicator); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(health.NewChecker); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(ratelimit.NewStore); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(ratelimit.NewLimiter); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(importer.NewImporter); err != nil {
+		return nil, err
+	}
+	if err := cont.Singleton(rollup.NewRoller); err != nil {
+		return nil, err
+	}
+	if err := cont.Call(registerHooks); err != nil {
+		return nil, err
+	}
+	if err := cont.Call(subscribeToReloads); err != nil {
+		return nil, err
+	}
 
 	return &cont, nil
 }
+
+func registerMongoRepositories(cont container.Container) error {
+	for _, constructor := range []any{
+		buildMongoClient,
+		repository.NewMongoSensorsRepository,
+		repository.NewMongoAnomaliesRepository,
+		repository.NewMongoChannelsRepository,
+		repository.NewMongoImportsRepository,
+		repository.NewMongoIdempotencyRepository,
+		repository.NewMongoAssetsRepository,
+		repository.NewMongoGeofencesRepository,
+		repository.NewMongoRollupCheckpointsRepository,
+	} {
+		if err := cont.Singleton(constructor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerEmbeddedRepositories(cont container.Container) error {
+	for _, constructor := range []any{
+		repository.NewEmbeddedStore,
+		repository.NewEmbeddedSensorsRepository,
+		repository.NewEmbeddedAnomaliesRepository,
+		repository.NewEmbeddedChannelsRepository,
+		repository.NewEmbeddedImportsRepository,
+		repository.NewEmbeddedIdempotencyRepository,
+		repository.NewEmbeddedAssetsRepository,
+		repository.NewEmbeddedGeofencesRepository,
+		repository.NewEmbeddedRollupCheckpointsRepository,
+	} {
+		if err := cont.Singleton(constructor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordForReplication replaces the sensors and measurement repositories with the ones recording
+// what's written through them for replication, when it's enabled, before the components writing
+// to them are built.
+func recordForReplication(cont container.Container) error {
+	var replicator *replication.Replicator
+	if err := cont.Resolve(&replicator); err != nil {
+		return err
+	}
+	if !replicator.Enabled() {
+		return nil
+	}
+
+	var sensorsRepository repository.SensorsRepository
+	if err := cont.Resolve(&sensorsRepository); err != nil {
+		return err
+	}
+	var measurementRepository repository.MeasurementRepository
+	if err := cont.Resolve(&measurementRepository); err != nil {
+		return err
+	}
+	sensorsRepository = replicator.RecordSensors(sensorsRepository)
+	measurementRepository = replicator.RecordMeasurements(measurementRepository)
+
+	if err := cont.Singleton(func() repository.SensorsRepository { return sensorsRepository }); err != nil {
+		return err
+	}
+	return cont.Singleton(func() repository.MeasurementRepository { return measurementRepository })
+}
+
+// registerHooks appends the hooks of the components in dependency order, so they're stopped in
+// the reverse one: the rollups and the pipeline before the replication journal, which records
+// what they write, then the storage backend, and all of them before MongoDB, or the embedded
+// store, which is shared by the repositories and closed along with the sensors repository.
+func registerHooks(
+	envVars *config.EnvVars,
+	lifecycle *Lifecycle,
+	tracingProvider *tracing.Provider,
+	sensorsRepository repository.SensorsRepository,
+	measurementRepository repository.MeasurementRepository,
+	pipeline *ingest.Pipeline,
+	roller *rollup.Roller,
+	rateLimitStore ratelimit.Store,
+	idempotencyRepository repository.IdempotencyRepository,
+	replicator *replication.Replicator,
+	monitor *anomaly.Monitor,
+) {
+	lifecycle.Append(Hook{
+		Name: "tracing",
+		Stop: tracingProvider.Shutdown,
+	})
+	lifecycle.Append(Hook{
+		Name: repository.MetadataStore(envVars.Storage.Backend),
+		Stop: func(context.Context) error { return sensorsRepository.Close() },
+	})
+	lifecycle.Append(Hook{
+		Name: envVars.Storage.Backend,
+		Stop: func(context.Context) error { return measurementRepository.Close() },
+	})
+	if replicator.Enabled() {
+		lifecycle.Append(Hook{
+			Name: "replication journal",
+			Stop: func(context.Context) error { return replicator.Close() },
+		})
+	}
+	lifecycle.Append(Hook{
+		Name: "ingest pipeline",
+		Start: func(context.Context) error {
+			go pipeline.Run(context.Background())
+			return nil
+		},
+		// Waits for the queued measurements to be written or spooled
+		Stop: pipeline.Close,
+	})
+	if roller.Enabled() {
+		lifecycle.Append(Background("rollups", roller.Run))
+	}
+	lifecycle.Append(Background("anomaly detector sweeper", monitor.Run))
+	if memoryStore, ok := rateLimitStore.(*ratelimit.MemoryStore); ok {
+		lifecycle.Append(Background("rate limit sweeper", memoryStore.Run))
+	}
+	if embeddedIdempotency, ok := idempotencyRepository.(*repository.EmbeddedIdempotencyRepository); ok {
+		lifecycle.Append(Background("idempotency key sweeper", embeddedIdempotency.Run))
+	}
+	if replicator.Enabled() {
+		lifecycle.Append(Background("replication", replicator.Run))
+	}
+}
+
+// subscribeToReloads applies the reloadable settings to the components using them, the other
+// components only read the configuration they were built with.
+func subscribeToReloads(loader *config.Loader, monitor *anomaly.Monitor, limiter *ratelimit.Limiter) {
+	loader.OnReload(func(envVars *config.EnvVars) {
+		setLogLevel(envVars.Log.Level)
+		monitor.SetThresholds(envVars.Anomaly.ZScoreThreshold, envVars.Anomaly.EWMALimit, envVars.Anomaly.SeasonalThreshold)
+		limiter.SetLimits(ratelimit.NewLimits(envVars))
+	})
+}
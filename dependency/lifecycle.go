@@ -0,0 +1,104 @@
+package dependency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Hook starts and stops a component, either function may be nil. Start must not block, long
+// running work goes to a goroutine that Stop ends.
+type Hook struct {
+	Name  string
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+// Lifecycle starts the components in the order their hooks were appended and stops them in the
+// reverse order, so each component stops before the ones it depends on.
+type Lifecycle struct {
+	mu      sync.Mutex
+	hooks   []Hook
+	started int
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{}
+}
+
+func (l *Lifecycle) Append(hook Hook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, hook)
+}
+
+// Start runs the start hooks not run yet, stopping at the first failure. The components started
+// until then are still stopped by Stop.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ; l.started < len(l.hooks); l.started++ {
+		hook := l.hooks[l.started]
+		if hook.Start == nil {
+			continue
+		}
+		if err := hook.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start %s: %w", hook.Name, err)
+		}
+		log.Info().Str("component", hook.Name).Msg("started")
+	}
+	return nil
+}
+
+// Stop runs the stop hooks of the started components, the last started first. A failing hook
+// doesn't keep the next ones from running, all the errors are returned together.
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var errs []error
+	for ; l.started > 0; l.started-- {
+		hook := l.hooks[l.started-1]
+		if hook.Stop == nil {
+			continue
+		}
+		if err := hook.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop %s: %w", hook.Name, err))
+			continue
+		}
+		log.Info().Str("component", hook.Name).Msg("stopped")
+	}
+	return errors.Join(errs...)
+}
+
+// Background is the hook of a component running until its context is cancelled, stopping it by
+// cancelling the context and waiting for run to return.
+func Background(name string, run func(ctx context.Context) error) Hook {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	return Hook{
+		Name: name,
+		Start: func(context.Context) error {
+			go func() {
+				defer close(done)
+				if err := run(ctx); err != nil {
+					log.Error().Err(err).Str("component", name).Msg("stopped unexpectedly")
+				}
+			}()
+			return nil
+		},
+		Stop: func(stopCtx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-stopCtx.Done():
+				return stopCtx.Err()
+			}
+		},
+	}
+}
@@ -0,0 +1,124 @@
+package dependency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func recordingHook(name string, events *[]string) Hook {
+	return Hook{
+		Name: name,
+		Start: func(context.Context) error {
+			*events = append(*events, "start "+name)
+			return nil
+		},
+		Stop: func(context.Context) error {
+			*events = append(*events, "stop "+name)
+			return nil
+		},
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when the components are stopped, it should stop them in the reverse order they were started", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		var events []string
+		lifecycle := NewLifecycle()
+		lifecycle.Append(recordingHook("mongodb", &events))
+		lifecycle.Append(Hook{Name: "no hooks"})
+		lifecycle.Append(recordingHook("pipeline", &events))
+		lifecycle.Append(recordingHook("server", &events))
+
+		is.Nil(lifecycle.Start(context.Background()))
+		is.Nil(lifecycle.Stop(context.Background()))
+		is.Equal([]string{
+			"start mongodb", "start pipeline", "start server",
+			"stop server", "stop pipeline", "stop mongodb",
+		}, events)
+	})
+
+	t.Run("when a component fails to start, it should only stop the ones started before it", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		var events []string
+		lifecycle := NewLifecycle()
+		lifecycle.Append(recordingHook("mongodb", &events))
+		lifecycle.Append(Hook{
+			Name:  "server",
+			Start: func(context.Context) error { return errors.New("address already in use") },
+			Stop: func(context.Context) error {
+				events = append(events, "stop server")
+				return nil
+			},
+		})
+		lifecycle.Append(recordingHook("rollups", &events))
+
+		is.ErrorContains(lifecycle.Start(context.Background()), "failed to start server: address already in use")
+		is.Nil(lifecycle.Stop(context.Background()))
+		is.Equal([]string{"start mongodb", "stop mongodb"}, events)
+	})
+
+	t.Run("when a component fails to stop, it should still stop the next ones and return every error", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		var events []string
+		lifecycle := NewLifecycle()
+		lifecycle.Append(recordingHook("mongodb", &events))
+		lifecycle.Append(Hook{
+			Name: "pipeline",
+			Stop: func(ctx context.Context) error { return context.DeadlineExceeded },
+		})
+
+		is.Nil(lifecycle.Start(context.Background()))
+		err := lifecycle.Stop(context.Background())
+		is.ErrorIs(err, context.DeadlineExceeded)
+		is.ErrorContains(err, "failed to stop pipeline")
+		is.Equal([]string{"start mongodb", "stop mongodb"}, events)
+	})
+
+	t.Run("when a background component is stopped, it should cancel it and wait for it to return", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		returned := make(chan struct{})
+		lifecycle := NewLifecycle()
+		lifecycle.Append(Background("rollups", func(ctx context.Context) error {
+			<-ctx.Done()
+			close(returned)
+			return nil
+		}))
+
+		is.Nil(lifecycle.Start(context.Background()))
+		is.Nil(lifecycle.Stop(context.Background()))
+		select {
+		case <-returned:
+		default:
+			is.Fail("the background component was still running")
+		}
+	})
+
+	t.Run("when a background component doesn't return before the deadline, it should stop waiting", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		lifecycle := NewLifecycle()
+		lifecycle.Append(Background("stuck", func(ctx context.Context) error {
+			select {}
+		}))
+
+		is.Nil(lifecycle.Start(context.Background()))
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		is.ErrorIs(lifecycle.Stop(ctx), context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,136 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+type Format string
+
+const (
+	FormatCSV     Format = "csv"
+	FormatNDJSON  Format = "ndjson"
+	FormatParquet Format = "parquet"
+)
+
+// Rows written to parquet are flushed as a row group every rowGroupSize rows, which bounds how
+// much of an export is held in memory.
+const rowGroupSize = 10_000
+
+func ParseFormat(value string) (Format, error) {
+	switch format := Format(value); format {
+	case FormatCSV, FormatNDJSON, FormatParquet:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported format: %s", value)
+	}
+}
+
+func (f Format) ContentType() string {
+	switch f {
+	case FormatCSV:
+		return "text/csv"
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/vnd.apache.parquet"
+	}
+}
+
+// Row is a measurement along with the metadata of its sensor.
+type Row struct {
+	Timestamp   time.Time `json:"timestamp" parquet:"timestamp,timestamp(millisecond)"`
+	SensorID    string    `json:"sensor_id" parquet:"sensor_id,dict"`
+	SensorName  string    `json:"sensor_name" parquet:"sensor_name,dict"`
+	SensorTags  []string  `json:"sensor_tags" parquet:"sensor_tags,list"`
+	Longitude   float64   `json:"longitude" parquet:"longitude"`
+	Latitude    float64   `json:"latitude" parquet:"latitude"`
+	Measurement string    `json:"measurement" parquet:"measurement,dict"`
+	Unit        string    `json:"unit" parquet:"unit,dict"`
+	Value       float64   `json:"value" parquet:"value"`
+}
+
+// Writer encodes rows one at a time. Close must be called to write whatever is still buffered
+// and, for parquet, the file footer.
+type Writer interface {
+	Write(row *Row) error
+	Close() error
+}
+
+func NewWriter(format Format, w io.Writer) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(w)
+	case FormatNDJSON:
+		return &ndjsonWriter{encoder: json.NewEncoder(w)}, nil
+	case FormatParquet:
+		return &parquetWriter{writer: parquet.NewGenericWriter[Row](w, parquet.MaxRowsPerRowGroup(rowGroupSize))}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+var csvHeader = []string{"timestamp", "sensor_id", "sensor_name", "sensor_tags", "longitude", "latitude", "measurement", "unit", "value"}
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return nil, err
+	}
+	return &csvWriter{writer: writer}, nil
+}
+
+func (c *csvWriter) Write(row *Row) error {
+	return c.writer.Write([]string{
+		row.Timestamp.Format(time.RFC3339Nano),
+		row.SensorID,
+		row.SensorName,
+		strings.Join(row.SensorTags, "|"),
+		strconv.FormatFloat(row.Longitude, 'f', -1, 64),
+		strconv.FormatFloat(row.Latitude, 'f', -1, 64),
+		row.Measurement,
+		row.Unit,
+		strconv.FormatFloat(row.Value, 'f', -1, 64),
+	})
+}
+
+func (c *csvWriter) Close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(row *Row) error {
+	return n.encoder.Encode(row)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+type parquetWriter struct {
+	writer *parquet.GenericWriter[Row]
+}
+
+func (p *parquetWriter) Write(row *Row) error {
+	_, err := p.writer.Write([]Row{*row})
+	return err
+}
+
+func (p *parquetWriter) Close() error {
+	return p.writer.Close()
+}
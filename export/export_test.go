@@ -0,0 +1,80 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/require"
+)
+
+func testRows() []*Row {
+	timestamp := time.Date(2024, 10, 22, 15, 0, 0, 0, time.UTC)
+	return []*Row{
+		{Timestamp: timestamp, SensorID: "6717bedc52536d1a81f9fca7", SensorName: "farm-1", SensorTags: []string{"tag1", "tag2"}, Longitude: -25.4, Latitude: -49.2, Measurement: "temperature", Unit: "celsius", Value: 16.4},
+		{Timestamp: timestamp.Add(time.Second), SensorID: "6717bedc52536d1a81f9fca7", SensorName: "farm-1", SensorTags: []string{"tag1", "tag2"}, Longitude: -25.4, Latitude: -49.2, Measurement: "temperature", Unit: "celsius", Value: 16.5},
+	}
+}
+
+func writeAll(t *testing.T, format Format) []byte {
+	is := require.New(t)
+
+	var buf bytes.Buffer
+	writer, err := NewWriter(format, &buf)
+	is.Nil(err)
+	for _, row := range testRows() {
+		is.Nil(writer.Write(row))
+	}
+	is.Nil(writer.Close())
+
+	return buf.Bytes()
+}
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when rows are exported as CSV, it should write a header followed by one line per row", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		expected := "timestamp,sensor_id,sensor_name,sensor_tags,longitude,latitude,measurement,unit,value\n" +
+			"2024-10-22T15:00:00Z,6717bedc52536d1a81f9fca7,farm-1,tag1|tag2,-25.4,-49.2,temperature,celsius,16.4\n" +
+			"2024-10-22T15:00:01Z,6717bedc52536d1a81f9fca7,farm-1,tag1|tag2,-25.4,-49.2,temperature,celsius,16.5\n"
+		is.Equal(expected, string(writeAll(t, FormatCSV)))
+	})
+
+	t.Run("when rows are exported as NDJSON, it should write one JSON object per line", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		lines := bytes.Split(bytes.TrimSpace(writeAll(t, FormatNDJSON)), []byte("\n"))
+		is.Len(lines, 2)
+
+		var row Row
+		is.Nil(json.Unmarshal(lines[1], &row))
+		is.Equal(*testRows()[1], row)
+	})
+
+	t.Run("when rows are exported as parquet, it should be readable back", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		data := writeAll(t, FormatParquet)
+		rows, err := parquet.Read[Row](bytes.NewReader(data), int64(len(data)))
+		is.Nil(err)
+		is.Len(rows, 2)
+		is.Equal(testRows()[0].SensorTags, rows[0].SensorTags)
+		is.Equal(16.5, rows[1].Value)
+		is.True(testRows()[1].Timestamp.Equal(rows[1].Timestamp))
+	})
+
+	t.Run("when the format is unknown, it should return an error", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		_, err := ParseFormat("xlsx")
+		is.ErrorContains(err, "unsupported format: xlsx")
+	})
+}
@@ -0,0 +1,141 @@
+// Package health checks the dependencies of the service, telling whether it's ready to serve.
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+const (
+	StatusUp       = "up"
+	StatusDown     = "down"
+	StatusReady    = "ready"
+	StatusNotReady = "not_ready"
+	// StatusStarting is the status until the dependencies were first seen up
+	StatusStarting = "starting"
+)
+
+const (
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+)
+
+// Check returns an error when the dependency isn't available.
+type Check func(ctx context.Context) error
+
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// Checker checks the dependencies on demand. It doesn't report ready before WaitReady saw all of
+// them up, and after that only while they're all up.
+type Checker struct {
+	checks  map[string]Check
+	timeout time.Duration
+	started atomic.Bool
+}
+
+func NewChecker(envVars *config.EnvVars, sensorsRepository repository.SensorsRepository, measurementRepository repository.MeasurementRepository) *Checker {
+	return newChecker(envVars.Health.CheckTimeout, map[string]Check{
+		repository.MetadataStore(envVars.Storage.Backend): sensorsRepository.Ping,
+		envVars.Storage.Backend:                           measurementRepository.Ping,
+	})
+}
+
+func newChecker(timeout time.Duration, checks map[string]Check) *Checker {
+	return &Checker{checks: checks, timeout: timeout}
+}
+
+// Check runs every check at the same time, each within the timeout.
+func (c *Checker) Check(ctx context.Context) Report {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	report := Report{Status: StatusReady, Dependencies: make(map[string]DependencyStatus, len(c.checks))}
+	for name, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status := c.run(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Dependencies[name] = status
+			if status.Status != StatusUp {
+				report.Status = StatusNotReady
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !c.started.Load() {
+		report.Status = StatusStarting
+	}
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, check Check) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	status := DependencyStatus{Status: StatusUp, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		status.Status = StatusDown
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// WaitReady checks the dependencies with backoff until they're all up, from then on the checker
+// can report ready. It gives up when the context is done.
+func (c *Checker) WaitReady(ctx context.Context) error {
+	err := Retry(ctx, "dependencies", func(ctx context.Context) error {
+		report := c.Check(ctx)
+		for name, dependency := range report.Dependencies {
+			if dependency.Status != StatusUp {
+				return fmt.Errorf("%s is down: %s", name, dependency.Error)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.started.Store(true)
+	return nil
+}
+
+// Retry calls fn until it succeeds, doubling the wait between the attempts up to a maximum. It
+// returns the last error of fn when the context is done first.
+func Retry(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("retry_in", backoff).Msgf("waiting for %s", name)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for %s: %w", name, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
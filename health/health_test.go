@@ -0,0 +1,119 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func up(ctx context.Context) error {
+	return nil
+}
+
+func down(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func hanging(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestChecker(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when the checker didn't wait for the dependencies, it should report starting", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		checker := newChecker(time.Second, map[string]Check{"mongodb": up})
+
+		report := checker.Check(context.Background())
+		is.Equal(StatusStarting, report.Status)
+		is.Equal(StatusUp, report.Dependencies["mongodb"].Status)
+	})
+
+	t.Run("when every dependency is up after starting, it should report ready", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		checker := newChecker(time.Second, map[string]Check{"mongodb": up, "influxdb": up})
+		is.Nil(checker.WaitReady(context.Background()))
+
+		report := checker.Check(context.Background())
+		is.Equal(StatusReady, report.Status)
+		is.Len(report.Dependencies, 2)
+	})
+
+	t.Run("when a dependency goes down after starting, it should report it and not ready", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		mongoUp := true
+		checker := newChecker(time.Second, map[string]Check{
+			"mongodb": func(ctx context.Context) error {
+				if mongoUp {
+					return nil
+				}
+				return down(ctx)
+			},
+			"influxdb": up,
+		})
+		is.Nil(checker.WaitReady(context.Background()))
+		mongoUp = false
+
+		report := checker.Check(context.Background())
+		is.Equal(StatusNotReady, report.Status)
+		is.Equal(StatusDown, report.Dependencies["mongodb"].Status)
+		is.Equal("connection refused", report.Dependencies["mongodb"].Error)
+		is.Equal(StatusUp, report.Dependencies["influxdb"].Status)
+	})
+
+	t.Run("when a dependency doesn't answer, it should report it down once the timeout is over", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		checker := newChecker(50*time.Millisecond, map[string]Check{"influxdb": hanging})
+
+		start := time.Now()
+		report := checker.Check(context.Background())
+		is.Less(time.Since(start), time.Second)
+		is.Equal(StatusDown, report.Dependencies["influxdb"].Status)
+		is.Equal(context.DeadlineExceeded.Error(), report.Dependencies["influxdb"].Error)
+	})
+
+	t.Run("when a dependency never comes up, it should give up waiting once the context is done", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		checker := newChecker(time.Second, map[string]Check{"mongodb": up, "influxdb": down})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		is.ErrorContains(checker.WaitReady(ctx), "influxdb is down")
+		is.Equal(StatusStarting, checker.Check(context.Background()).Status)
+	})
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when the function fails at first, it should call it again until it succeeds", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		attempts := 0
+		err := Retry(context.Background(), "test", func(ctx context.Context) error {
+			attempts++
+			if attempts < 2 {
+				return errors.New("not yet")
+			}
+			return nil
+		})
+		is.Nil(err)
+		is.Equal(2, attempts)
+	})
+}
@@ -0,0 +1,445 @@
+package heatmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type Method string
+
+const (
+	MethodIDW     Method = "idw"
+	MethodKriging Method = "kriging"
+)
+
+func ParseMethod(s string) (Method, error) {
+	switch Method(s) {
+	case MethodIDW, MethodKriging:
+		return Method(s), nil
+	default:
+		return "", fmt.Errorf("unsupported interpolation method: %s", s)
+	}
+}
+
+var (
+	ErrNoSamples         = errors.New("there are no samples to interpolate")
+	ErrTooFewSamples     = errors.New("kriging needs samples at 3 or more locations")
+	ErrSingularVariogram = errors.New("the samples can't be kriged, their variogram is singular")
+	ErrTooManySamples    = fmt.Errorf("kriging takes samples at %d locations at most", MaxKrigingSamples)
+	ErrTooManyCells      = fmt.Errorf("the grid can't have more than %d cells", MaxCells)
+)
+
+// The cost of kriging grows with the square of the samples for every cell, and with their cube to
+// set it up, so both are bounded.
+const (
+	MaxKrigingSamples = 250
+	MaxCells          = 250000
+)
+
+const earthRadius = 6371008.8 // Meters
+
+// BBox is a bounding box in degrees.
+type BBox struct {
+	MinLongitude float64 `json:"min_longitude"`
+	MinLatitude  float64 `json:"min_latitude"`
+	MaxLongitude float64 `json:"max_longitude"`
+	MaxLatitude  float64 `json:"max_latitude"`
+}
+
+// ParseBBox parses a bounding box in the min longitude, min latitude, max longitude, max latitude
+// order of GeoJSON.
+func ParseBBox(s string) (BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, errors.New("bbox must be min longitude, min latitude, max longitude and max latitude separated by commas")
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		// NaN would pass the range checks below, comparing false to everything
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return BBox{}, fmt.Errorf("invalid bbox coordinate %q", part)
+		}
+		values[i] = value
+	}
+
+	bbox := BBox{MinLongitude: values[0], MinLatitude: values[1], MaxLongitude: values[2], MaxLatitude: values[3]}
+	if bbox.MinLongitude < -180 || bbox.MaxLongitude > 180 || bbox.MinLatitude < -90 || bbox.MaxLatitude > 90 {
+		return BBox{}, errors.New("bbox must be within valid longitudes and latitudes")
+	}
+	if bbox.MinLongitude >= bbox.MaxLongitude || bbox.MinLatitude >= bbox.MaxLatitude {
+		return BBox{}, errors.New("bbox minimums must be lower than its maximums")
+	}
+	return bbox, nil
+}
+
+// Sample is a value measured at a location.
+type Sample struct {
+	Longitude float64
+	Latitude  float64
+	Value     float64
+}
+
+// Grid is an interpolated field over a bounding box, split in cells of the same size in degrees.
+// Values are indexed by row and then by column, the first row being the northernmost and the
+// first column the westernmost, and each one is the estimate at the center of its cell.
+type Grid struct {
+	BBox    BBox        `json:"bbox"`
+	Columns int         `json:"columns"`
+	Rows    int         `json:"rows"`
+	Values  [][]float64 `json:"values"`
+}
+
+// CellBounds returns the west, south, east and north edges of a cell.
+func (g *Grid) CellBounds(row, column int) (float64, float64, float64, float64) {
+	width := (g.BBox.MaxLongitude - g.BBox.MinLongitude) / float64(g.Columns)
+	height := (g.BBox.MaxLatitude - g.BBox.MinLatitude) / float64(g.Rows)
+	west := g.BBox.MinLongitude + float64(column)*width
+	north := g.BBox.MaxLatitude - float64(row)*height
+	return west, north - height, west + width, north
+}
+
+type Options struct {
+	Method Method
+	// Resolution is the number of cells along the longer side of the bounding box, the shorter
+	// side getting as many cells as needed for them to be roughly square on the ground
+	Resolution int
+	// Power of the distance in inverse distance weighting
+	Power float64
+}
+
+// Interpolate estimates the field over the bounding box from the samples, stopping with the error
+// of the context once it's done.
+func Interpolate(ctx context.Context, samples []Sample, bbox BBox, options Options) (*Grid, error) {
+	samples = mergeColocated(samples)
+	if len(samples) == 0 {
+		return nil, ErrNoSamples
+	}
+
+	columns, rows := gridSize(bbox, options.Resolution)
+	if columns*rows > MaxCells {
+		return nil, ErrTooManyCells
+	}
+
+	var estimate func(longitude, latitude float64) float64
+	switch options.Method {
+	case MethodIDW:
+		estimate = newIDW(samples, options.Power)
+	case MethodKriging:
+		if len(samples) > MaxKrigingSamples {
+			return nil, ErrTooManySamples
+		}
+		var err error
+		if estimate, err = newKriging(samples); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported interpolation method: %s", options.Method)
+	}
+
+	grid := &Grid{BBox: bbox, Columns: columns, Rows: rows, Values: make([][]float64, rows)}
+	for row := range rows {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		grid.Values[row] = make([]float64, columns)
+		for column := range columns {
+			west, south, east, north := grid.CellBounds(row, column)
+			grid.Values[row][column] = estimate((west+east)/2, (south+north)/2)
+		}
+	}
+	return grid, nil
+}
+
+func gridSize(bbox BBox, resolution int) (int, int) {
+	resolution = max(resolution, 1)
+	middleLatitude := (bbox.MinLatitude + bbox.MaxLatitude) / 2
+	width := distance(bbox.MinLongitude, middleLatitude, bbox.MaxLongitude, middleLatitude)
+	height := distance(bbox.MinLongitude, bbox.MinLatitude, bbox.MinLongitude, bbox.MaxLatitude)
+
+	cellSize := max(width, height) / float64(resolution)
+	columns := max(int(math.Round(width/cellSize)), 1)
+	rows := max(int(math.Round(height/cellSize)), 1)
+	return columns, rows
+}
+
+// mergeColocated averages the samples at the same location, which would otherwise make kriging
+// singular and inverse distance weighting pick one of them.
+func mergeColocated(samples []Sample) []Sample {
+	type location struct{ longitude, latitude float64 }
+	sums := map[location]float64{}
+	counts := map[location]int{}
+	order := []location{}
+	for _, sample := range samples {
+		key := location{sample.Longitude, sample.Latitude}
+		if counts[key] == 0 {
+			order = append(order, key)
+		}
+		sums[key] += sample.Value
+		counts[key]++
+	}
+
+	merged := make([]Sample, 0, len(order))
+	for _, key := range order {
+		merged = append(merged, Sample{Longitude: key.longitude, Latitude: key.latitude, Value: sums[key] / float64(counts[key])})
+	}
+	return merged
+}
+
+// distance is the great-circle distance in meters.
+func distance(longitude1, latitude1, longitude2, latitude2 float64) float64 {
+	lat1 := latitude1 * math.Pi / 180
+	lat2 := latitude2 * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (longitude2 - longitude1) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func newIDW(samples []Sample, power float64) func(longitude, latitude float64) float64 {
+	if power <= 0 {
+		power = 2
+	}
+
+	return func(longitude, latitude float64) float64 {
+		var weightedSum, weights float64
+		for _, sample := range samples {
+			d := distance(longitude, latitude, sample.Longitude, sample.Latitude)
+			if d < 1e-6 {
+				return sample.Value
+			}
+			weight := 1 / math.Pow(d, power)
+			weightedSum += weight * sample.Value
+			weights += weight
+		}
+		return weightedSum / weights
+	}
+}
+
+// variogram is an exponential variogram model, reaching 95% of its sill at the range.
+type variogram struct {
+	nugget      float64
+	partialSill float64
+	rng         float64
+}
+
+func (v variogram) at(h float64) float64 {
+	if h == 0 {
+		return 0
+	}
+	return v.nugget + v.partialSill*(1-math.Exp(-3*h/v.rng))
+}
+
+// newKriging sets up ordinary kriging with a variogram fitted to the samples.
+func newKriging(samples []Sample) (func(longitude, latitude float64) float64, error) {
+	n := len(samples)
+	if n < 3 {
+		return nil, ErrTooFewSamples
+	}
+
+	distances := make([][]float64, n)
+	for i := range samples {
+		distances[i] = make([]float64, n)
+		for j := range i {
+			d := distance(samples[i].Longitude, samples[i].Latitude, samples[j].Longitude, samples[j].Latitude)
+			distances[i][j], distances[j][i] = d, d
+		}
+	}
+
+	model, ok := fitVariogram(samples, distances)
+	if !ok {
+		// Every sample has the same value
+		value := samples[0].Value
+		return func(float64, float64) float64 { return value }, nil
+	}
+
+	// The system is the same for every cell, only its right hand side changes
+	system := make([][]float64, n+1)
+	for i := range n + 1 {
+		system[i] = make([]float64, n+1)
+		for j := range n + 1 {
+			switch {
+			case i == n && j == n:
+				system[i][j] = 0
+			case i == n || j == n:
+				system[i][j] = 1
+			default:
+				system[i][j] = model.at(distances[i][j])
+			}
+		}
+	}
+	lu, err := decomposeLU(system)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(longitude, latitude float64) float64 {
+		b := make([]float64, n+1)
+		for i, sample := range samples {
+			b[i] = model.at(distance(longitude, latitude, sample.Longitude, sample.Latitude))
+		}
+		b[n] = 1
+
+		weights := lu.solve(b)
+		var estimate float64
+		for i, sample := range samples {
+			estimate += weights[i] * sample.Value
+		}
+		return estimate
+	}, nil
+}
+
+// fitVariogram fits the model to the empirical semivariances of the sample pairs, binned by
+// distance up to half the largest one, by weighted least squares. It returns false when the
+// samples don't vary.
+func fitVariogram(samples []Sample, distances [][]float64) (variogram, bool) {
+	const bins = 10
+
+	var maxDistance, mean, variance float64
+	for i := range samples {
+		mean += samples[i].Value
+		for j := range i {
+			maxDistance = math.Max(maxDistance, distances[i][j])
+		}
+	}
+	mean /= float64(len(samples))
+	for _, sample := range samples {
+		variance += (sample.Value - mean) * (sample.Value - mean)
+	}
+	variance /= float64(len(samples))
+	if variance == 0 {
+		return variogram{}, false
+	}
+
+	cutoff := maxDistance / 2
+	var lags, semivariances, counts [bins]float64
+	for i := range samples {
+		for j := range i {
+			h := distances[i][j]
+			if h > cutoff {
+				continue
+			}
+			bin := min(int(h/cutoff*bins), bins-1)
+			lags[bin] += h
+			semivariances[bin] += (samples[i].Value - samples[j].Value) * (samples[i].Value - samples[j].Value) / 2
+			counts[bin]++
+		}
+	}
+
+	best := variogram{partialSill: variance, rng: cutoff}
+	bestError := math.Inf(1)
+	for k := 1; k <= 20; k++ {
+		rng := maxDistance * float64(k) / 20
+		// γ = nugget + partialSill * f(h) is linear in the nugget and the partial sill
+		var sw, sf, sff, sg, sfg float64
+		for bin := range bins {
+			if counts[bin] == 0 {
+				continue
+			}
+			w := counts[bin]
+			f := 1 - math.Exp(-3*(lags[bin]/counts[bin])/rng)
+			g := semivariances[bin] / counts[bin]
+			sw += w
+			sf += w * f
+			sff += w * f * f
+			sg += w * g
+			sfg += w * f * g
+		}
+		if sw == 0 {
+			break
+		}
+
+		// A negative nugget or a single lag leaves the partial sill alone to explain the semivariance
+		nugget, partialSill := -1.0, 0.0
+		if determinant := sw*sff - sf*sf; determinant > 1e-12 {
+			nugget = (sff*sg - sf*sfg) / determinant
+			partialSill = (sw*sfg - sf*sg) / determinant
+		}
+		if nugget < 0 {
+			nugget, partialSill = 0, sfg/sff
+		}
+		if partialSill <= 0 {
+			continue
+		}
+
+		model := variogram{nugget: nugget, partialSill: partialSill, rng: rng}
+		var sse float64
+		for bin := range bins {
+			if counts[bin] == 0 {
+				continue
+			}
+			residual := model.at(lags[bin]/counts[bin]) - semivariances[bin]/counts[bin]
+			sse += counts[bin] * residual * residual
+		}
+		if sse < bestError {
+			best, bestError = model, sse
+		}
+	}
+
+	return best, true
+}
+
+// lu is the LU decomposition of a square matrix with partial pivoting.
+type lu struct {
+	matrix      [][]float64
+	permutation []int
+}
+
+func decomposeLU(a [][]float64) (*lu, error) {
+	n := len(a)
+	matrix := make([][]float64, n)
+	for i := range a {
+		matrix[i] = append([]float64(nil), a[i]...)
+	}
+	permutation := make([]int, n)
+	for i := range permutation {
+		permutation[i] = i
+	}
+
+	for k := range n {
+		pivot := k
+		for i := k + 1; i < n; i++ {
+			if math.Abs(matrix[i][k]) > math.Abs(matrix[pivot][k]) {
+				pivot = i
+			}
+		}
+		if math.Abs(matrix[pivot][k]) < 1e-12 {
+			return nil, ErrSingularVariogram
+		}
+		matrix[k], matrix[pivot] = matrix[pivot], matrix[k]
+		permutation[k], permutation[pivot] = permutation[pivot], permutation[k]
+
+		for i := k + 1; i < n; i++ {
+			matrix[i][k] /= matrix[k][k]
+			for j := k + 1; j < n; j++ {
+				matrix[i][j] -= matrix[i][k] * matrix[k][j]
+			}
+		}
+	}
+
+	return &lu{matrix: matrix, permutation: permutation}, nil
+}
+
+func (l *lu) solve(b []float64) []float64 {
+	n := len(b)
+	x := make([]float64, n)
+	for i := range n {
+		x[i] = b[l.permutation[i]]
+		for j := range i {
+			x[i] -= l.matrix[i][j] * x[j]
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := i + 1; j < n; j++ {
+			x[i] -= l.matrix[i][j] * x[j]
+		}
+		x[i] /= l.matrix[i][i]
+	}
+	return x
+}
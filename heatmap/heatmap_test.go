@@ -0,0 +1,112 @@
+package heatmap
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var farm = BBox{MinLongitude: -47.01, MinLatitude: -22.01, MaxLongitude: -47.00, MaxLatitude: -22.00}
+
+func TestParseBBox(t *testing.T) {
+	t.Parallel()
+	is := require.New(t)
+
+	bbox, err := ParseBBox("-47.01,-22.01,-47.00,-22.00")
+	is.Nil(err)
+	is.Equal(farm, bbox)
+
+	for _, s := range []string{"-47.01,-22.01,-47.00", "-47.00,-22.01,-47.01,-22.00", "a,b,c,d", "-181,0,0,1", "NaN,0,1,1", "0,-Inf,1,1", "0,0,+Inf,1"} {
+		_, err := ParseBBox(s)
+		is.Error(err, s)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	t.Parallel()
+
+	// A field growing from west to east, sampled at the corners and the center
+	samples := []Sample{
+		{Longitude: -47.01, Latitude: -22.01, Value: 10},
+		{Longitude: -47.01, Latitude: -22.00, Value: 10},
+		{Longitude: -47.00, Latitude: -22.01, Value: 20},
+		{Longitude: -47.00, Latitude: -22.00, Value: 20},
+		{Longitude: -47.005, Latitude: -22.005, Value: 15},
+	}
+
+	for _, method := range []Method{MethodIDW, MethodKriging} {
+		t.Run("when the samples grow from west to east, it should estimate a field doing the same with "+string(method), func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			grid, err := Interpolate(context.Background(), samples, farm, Options{Method: method, Resolution: 10})
+			is.Nil(err)
+			// A degree of longitude is shorter than one of latitude away from the equator
+			is.Equal(9, grid.Columns)
+			is.Equal(10, grid.Rows)
+
+			for _, row := range grid.Values {
+				is.Less(row[0], row[len(row)-1])
+				for _, value := range row {
+					is.False(math.IsNaN(value))
+					is.GreaterOrEqual(value, 10.0-1e-6)
+					is.LessOrEqual(value, 20.0+1e-6)
+				}
+			}
+			is.InDelta(15, grid.Values[4][4], 1.5)
+		})
+	}
+
+	t.Run("when the bounding box is wider than tall, it should keep the cells roughly square", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		wide := BBox{MinLongitude: -47.02, MinLatitude: -22.01, MaxLongitude: -47.00, MaxLatitude: -22.00}
+		grid, err := Interpolate(context.Background(), samples, wide, Options{Method: MethodIDW, Resolution: 20})
+		is.Nil(err)
+		is.Equal(20, grid.Columns)
+		is.Equal(11, grid.Rows)
+	})
+
+	t.Run("when samples are colocated or all equal, it should still krige", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		grid, err := Interpolate(context.Background(), []Sample{
+			{Longitude: -47.01, Latitude: -22.01, Value: 12},
+			{Longitude: -47.01, Latitude: -22.01, Value: 12},
+			{Longitude: -47.00, Latitude: -22.00, Value: 12},
+			{Longitude: -47.00, Latitude: -22.01, Value: 12},
+		}, farm, Options{Method: MethodKriging, Resolution: 4})
+		is.Nil(err)
+		is.InDelta(12, grid.Values[2][1], 1e-9)
+
+		_, err = Interpolate(context.Background(), samples[:2], farm, Options{Method: MethodKriging, Resolution: 4})
+		is.ErrorIs(err, ErrTooFewSamples)
+
+		_, err = Interpolate(context.Background(), nil, farm, Options{Method: MethodIDW, Resolution: 4})
+		is.ErrorIs(err, ErrNoSamples)
+	})
+
+	t.Run("when there are too many samples to krige or the context is done, it should stop", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		many := make([]Sample, 0, MaxKrigingSamples+1)
+		for i := range MaxKrigingSamples + 1 {
+			many = append(many, Sample{Longitude: -47.01 + float64(i)*1e-5, Latitude: -22.01, Value: float64(i)})
+		}
+		_, err := Interpolate(context.Background(), many, farm, Options{Method: MethodKriging, Resolution: 4})
+		is.ErrorIs(err, ErrTooManySamples)
+
+		_, err = Interpolate(context.Background(), samples, farm, Options{Method: MethodIDW, Resolution: 1000})
+		is.ErrorIs(err, ErrTooManyCells)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = Interpolate(ctx, samples, farm, Options{Method: MethodIDW, Resolution: 4})
+		is.ErrorIs(err, context.Canceled)
+	})
+}
@@ -0,0 +1,239 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/dedup"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type Importer struct {
+	sensorsRepository     repository.SensorsRepository
+	measurementRepository repository.MeasurementRepository
+	importsRepository     repository.ImportsRepository
+	deduplicator          *dedup.Deduplicator
+	batchSize             int
+	maxErrors             int
+}
+
+func NewImporter(envVars *config.EnvVars, sensorsRepository repository.SensorsRepository, measurementRepository repository.MeasurementRepository, importsRepository repository.ImportsRepository, deduplicator *dedup.Deduplicator) *Importer {
+	return &Importer{
+		sensorsRepository:     sensorsRepository,
+		measurementRepository: measurementRepository,
+		importsRepository:     importsRepository,
+		deduplicator:          deduplicator,
+		batchSize:             envVars.Import.BatchSize,
+		maxErrors:             envVars.Import.MaxErrors,
+	}
+}
+
+// Import reads every row of the reader, writing the valid ones in batches and recording why the
+// others failed. Progress is saved after each batch, so importing the same file again with the
+// same ID skips the rows that were already committed. It returns the import along with the
+// number of rows skipped that way.
+func (i *Importer) Import(ctx context.Context, importID string, reader Reader) (*repository.Import, int, error) {
+	imp, err := i.importsRepository.GetImport(ctx, importID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get import: %w", err)
+	}
+	if imp == nil {
+		imp = &repository.Import{
+			ID:        importID,
+			Errors:    []repository.ImportRowError{},
+			StartedAt: time.Now(),
+		}
+	}
+	imp.Status = repository.ImportStatusRunning
+	skippedRows := imp.CommittedRows
+
+	resolver := &sensorResolver{sensorsRepository: i.sensorsRepository, sensors: map[string]*repository.Sensor{}, failures: map[string]error{}}
+	batch := make([]*repository.Measurement, 0, i.batchSize)
+	batchRows := make([]int, 0, i.batchSize)
+	var pendingErrors []repository.ImportRowError
+
+	commit := func(row int) error {
+		duplicates, err := i.deduplicator.Filter(ctx, batch)
+		if err != nil {
+			return fmt.Errorf("failed to check for duplicate measurements: %w", err)
+		}
+		if len(duplicates) > 0 {
+			batch = i.dropDuplicates(batch, batchRows, duplicates, &pendingErrors)
+			if i.deduplicator.Policy() == dedup.PolicyKeepFirst {
+				imp.DuplicateRows += len(duplicates)
+			}
+		}
+
+		if len(batch) > 0 {
+			if err := i.measurementRepository.CreateMeasurements(ctx, batch); err != nil {
+				return err
+			}
+		}
+
+		imp.CommittedRows = max(imp.CommittedRows, row)
+		imp.ImportedRows += len(batch)
+		imp.FailedRows += len(pendingErrors)
+		for _, rowErr := range pendingErrors {
+			if len(imp.Errors) >= i.maxErrors {
+				imp.ErrorsTruncated = true
+				break
+			}
+			imp.Errors = append(imp.Errors, rowErr)
+		}
+		if err := i.importsRepository.SaveImport(ctx, imp); err != nil {
+			return fmt.Errorf("failed to save import progress: %w", err)
+		}
+
+		batch = batch[:0]
+		batchRows = batchRows[:0]
+		pendingErrors = pendingErrors[:0]
+		return nil
+	}
+
+	row := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		var rowErr *RowError
+		if err != nil && !errors.As(err, &rowErr) {
+			return nil, 0, abort(commit, row, fmt.Errorf("failed to read row %d: %w", row+1, err))
+		}
+
+		row++
+		if row <= skippedRows {
+			continue
+		}
+
+		if rowErr == nil {
+			var measurement *repository.Measurement
+			measurement, err = i.toMeasurement(ctx, resolver, record)
+			switch {
+			case errors.As(err, &rowErr):
+			case err != nil:
+				return nil, 0, abort(commit, row-1, fmt.Errorf("failed to import row %d: %w", row, err))
+			default:
+				batch = append(batch, measurement)
+				batchRows = append(batchRows, row)
+			}
+		}
+		if rowErr != nil {
+			pendingErrors = append(pendingErrors, repository.ImportRowError{Row: row, Error: rowErr.Error()})
+		}
+
+		if len(batch) >= i.batchSize {
+			if err := commit(row); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	imp.Status = repository.ImportStatusCompleted
+	if err := commit(max(row, imp.CommittedRows)); err != nil {
+		return nil, 0, err
+	}
+
+	return imp, min(skippedRows, row), nil
+}
+
+// dropDuplicates removes the duplicates from the batch. Under PolicyReject they're reported as row
+// errors, keeping the errors sorted by row.
+func (i *Importer) dropDuplicates(batch []*repository.Measurement, batchRows []int, duplicates []int, pendingErrors *[]repository.ImportRowError) []*repository.Measurement {
+	kept := make([]*repository.Measurement, 0, len(batch)-len(duplicates))
+	next := 0
+	for j, measurement := range batch {
+		if next < len(duplicates) && duplicates[next] == j {
+			next++
+			if i.deduplicator.Policy() == dedup.PolicyReject {
+				*pendingErrors = append(*pendingErrors, repository.ImportRowError{Row: batchRows[j], Error: dedup.ErrDuplicate.Error()})
+			}
+			continue
+		}
+		kept = append(kept, measurement)
+	}
+
+	slices.SortFunc(*pendingErrors, func(a, b repository.ImportRowError) int {
+		return a.Row - b.Row
+	})
+	return kept
+}
+
+// abort commits whatever was processed up to the row before returning err, so a retry resumes
+// right after it.
+func abort(commit func(row int) error, row int, err error) error {
+	if commitErr := commit(row); commitErr != nil {
+		log.Error().Err(commitErr).Msg("failed to commit import before aborting")
+	}
+	return err
+}
+
+func (i *Importer) toMeasurement(ctx context.Context, resolver *sensorResolver, record *Record) (*repository.Measurement, error) {
+	if err := record.Validate(); err != nil {
+		return nil, &RowError{Err: err}
+	}
+
+	sensor, err := resolver.resolve(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repository.Measurement{
+		Name:      record.Name,
+		SensorID:  sensor.ID.Hex(),
+		Unit:      record.Unit,
+		Value:     *record.Value,
+		Timestamp: record.Timestamp,
+		Labels:    sensor.Labels,
+	}, nil
+}
+
+// sensorResolver looks sensors up by ID or name, remembering the outcome so a file with millions
+// of rows for a handful of sensors doesn't hit MongoDB for every row.
+type sensorResolver struct {
+	sensorsRepository repository.SensorsRepository
+	sensors           map[string]*repository.Sensor
+	failures          map[string]error
+}
+
+func (s *sensorResolver) resolve(ctx context.Context, record *Record) (*repository.Sensor, error) {
+	key := "id:" + record.SensorID
+	if record.SensorID == "" {
+		key = "name:" + record.SensorName
+	}
+	if sensor, ok := s.sensors[key]; ok {
+		return sensor, nil
+	}
+	if err, ok := s.failures[key]; ok {
+		return nil, err
+	}
+
+	var sensor *repository.Sensor
+	var err error
+	if record.SensorID != "" {
+		sensor, err = s.sensorsRepository.GetSensorByID(ctx, record.SensorID)
+	} else {
+		sensor, err = s.sensorsRepository.GetSensorByName(ctx, record.SensorName)
+	}
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+			rowErr := &RowError{Err: fmt.Errorf("sensor %s not found", key[strings.Index(key, ":")+1:])}
+			s.failures[key] = rowErr
+			return nil, rowErr
+		}
+		return nil, fmt.Errorf("failed to get sensor: %w", err)
+	}
+
+	s.sensors[key] = sensor
+	return sensor, nil
+}
@@ -0,0 +1,91 @@
+package importer
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, reader Reader) ([]*Record, map[int]string) {
+	is := require.New(t)
+
+	records := []*Record{}
+	rowErrors := map[int]string{}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if rowErr, ok := err.(*RowError); ok {
+			rowErrors[row] = rowErr.Error()
+			continue
+		}
+		is.Nil(err)
+		if err := record.Validate(); err != nil {
+			rowErrors[row] = err.Error()
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, rowErrors
+}
+
+func TestReader(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when a CSV file is read, it should map the columns by their header and report the invalid rows", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		file := "timestamp,sensor_name,name,unit,value\n" +
+			"2024-10-22T15:00:00Z,farm-1,temperature,celsius,16.4\n" +
+			"yesterday,farm-1,temperature,celsius,16.5\n" +
+			"2024-10-22T15:00:02Z,farm-1,temperature,celsius,warm\n" +
+			"2024-10-22T15:00:03Z,farm-1,,celsius,16.6\n" +
+			"1969-12-31T23:59:59Z,farm-1,temperature,celsius,16.7\n"
+
+		reader, err := NewReader(FormatCSV, strings.NewReader(file))
+		is.Nil(err)
+
+		records, rowErrors := readAll(t, reader)
+		is.Len(records, 1)
+		is.Equal("farm-1", records[0].SensorName)
+		is.Equal(time.Date(2024, 10, 22, 15, 0, 0, 0, time.UTC), records[0].Timestamp)
+		is.Equal(16.4, *records[0].Value)
+		is.Equal(map[int]string{
+			2: `invalid timestamp "yesterday", expected RFC 3339`,
+			3: `invalid value "warm"`,
+			4: "name is required",
+			5: "timestamp must not be before 1970-01-01T00:00:00Z",
+		}, rowErrors)
+	})
+
+	t.Run("when a CSV header has no sensor column, it should refuse the file", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		_, err := NewReader(FormatCSV, strings.NewReader("timestamp,name,unit,value\n"))
+		is.ErrorContains(err, "the CSV header needs a sensor_id or a sensor_name column")
+	})
+
+	t.Run("when an NDJSON file is read, it should skip blank lines and report the invalid rows", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		file := `{"sensor_id": "6717bedc52536d1a81f9fca7", "timestamp": "2024-10-22T15:00:00Z", "name": "temperature", "unit": "celsius", "value": 0}` + "\n\n" +
+			`{"sensor_id": "6717bedc52536d1a81f9fca7", "timestamp": "2024-10-22T15:00:01Z", "name": "temperature", "unit": "celsius"}` + "\n" +
+			`{"sensor_id": ` + "\n"
+
+		reader, err := NewReader(FormatNDJSON, strings.NewReader(file))
+		is.Nil(err)
+
+		records, rowErrors := readAll(t, reader)
+		is.Len(records, 1)
+		is.Equal(0.0, *records[0].Value)
+		is.Equal("value is required", rowErrors[2])
+		is.Contains(rowErrors[3], "invalid JSON")
+	})
+}
@@ -0,0 +1,204 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+)
+
+func ParseFormat(value string) (Format, error) {
+	switch format := Format(value); format {
+	case FormatCSV, FormatNDJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported format: %s", value)
+	}
+}
+
+// Record is a row of an import file. The sensor is identified either by its ID or its name.
+type Record struct {
+	SensorID   string    `json:"sensor_id"`
+	SensorName string    `json:"sensor_name"`
+	Timestamp  time.Time `json:"timestamp"`
+	Name       string    `json:"name"`
+	Unit       string    `json:"unit"`
+	Value      *float64  `json:"value"`
+}
+
+func (r *Record) Validate() error {
+	var problems []string
+	if r.SensorID == "" && r.SensorName == "" {
+		problems = append(problems, "sensor_id or sensor_name is required")
+	}
+	if r.Timestamp.IsZero() {
+		problems = append(problems, "timestamp is required")
+	} else if err := repository.CheckTimestamp(r.Timestamp); err != nil {
+		problems = append(problems, "timestamp "+err.Error())
+	}
+	if r.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if r.Unit == "" {
+		problems = append(problems, "unit is required")
+	}
+	if r.Value == nil {
+		problems = append(problems, "value is required")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// RowError is returned by a Reader when a row can't be parsed. Reading can carry on after it.
+type RowError struct {
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads the records of an import file one row at a time. It returns io.EOF once the file
+// is over, a *RowError for a row that can't be parsed, and any other error when the file can't be
+// read at all.
+type Reader interface {
+	Read() (*Record, error)
+}
+
+func NewReader(format Format, r io.Reader) (Reader, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVReader(r)
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &ndjsonReader{scanner: scanner}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+var csvColumns = []string{"sensor_id", "sensor_name", "timestamp", "name", "unit", "value"}
+
+type csvReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("the CSV file is empty")
+		}
+		return nil, fmt.Errorf("failed to read the CSV header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	for _, column := range csvColumns[2:] {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("the CSV header is missing the %s column", column)
+		}
+	}
+	_, hasSensorID := columns["sensor_id"]
+	_, hasSensorName := columns["sensor_name"]
+	if !hasSensorID && !hasSensorName {
+		return nil, errors.New("the CSV header needs a sensor_id or a sensor_name column")
+	}
+
+	return &csvReader{reader: reader, columns: columns}, nil
+}
+
+func (c *csvReader) field(row []string, column string) string {
+	i, ok := c.columns[column]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+func (c *csvReader) Read() (*Record, error) {
+	row, err := c.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, &RowError{Err: parseErr.Err}
+		}
+		return nil, err
+	}
+
+	record := &Record{
+		SensorID:   c.field(row, "sensor_id"),
+		SensorName: c.field(row, "sensor_name"),
+		Name:       c.field(row, "name"),
+		Unit:       c.field(row, "unit"),
+	}
+
+	if timestamp := c.field(row, "timestamp"); timestamp != "" {
+		record.Timestamp, err = time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return nil, &RowError{Err: fmt.Errorf("invalid timestamp %q, expected RFC 3339", timestamp)}
+		}
+	}
+
+	if value := c.field(row, "value"); value != "" {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, &RowError{Err: fmt.Errorf("invalid value %q", value)}
+		}
+		record.Value = &v
+	}
+
+	return record, nil
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+}
+
+func (n *ndjsonReader) Read() (*Record, error) {
+	var line []byte
+	for len(line) == 0 {
+		if !n.scanner.Scan() {
+			if err := n.scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		line = bytes.TrimSpace(n.scanner.Bytes())
+	}
+
+	var record Record
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, &RowError{Err: fmt.Errorf("invalid JSON: %w", err)}
+	}
+	return &record, nil
+}
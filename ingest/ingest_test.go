@@ -0,0 +1,230 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+type fakeWriter struct {
+	mu      sync.Mutex
+	failing bool
+	// rejects tells the measurements refused for good
+	rejects func(measurement *repository.Measurement) bool
+	written []*repository.Measurement
+}
+
+func (f *fakeWriter) CreateMeasurements(ctx context.Context, measurements []*repository.Measurement) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return errors.New("influxdb is down")
+	}
+	if f.rejects != nil && slices.ContainsFunc(measurements, f.rejects) {
+		return fmt.Errorf("%w: field type conflict", repository.ErrMeasurementsRejected)
+	}
+	f.written = append(f.written, measurements...)
+	return nil
+}
+
+func (f *fakeWriter) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func (f *fakeWriter) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.written)
+}
+
+func newMeasurement(value float64) *repository.Measurement {
+	return &repository.Measurement{
+		Name:      "temperature",
+		SensorID:  "6717bedc52536d1a81f9fca7",
+		Unit:      "celsius",
+		Value:     value,
+		Timestamp: time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
+
+func TestSpool(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when measurements are spooled, they should survive reopening the spool", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		dir := t.TempDir()
+		spool, err := OpenSpool(dir, 1<<20, 1<<20)
+		is.Nil(err)
+		is.True(spool.Empty())
+
+		is.Nil(spool.Append([]*repository.Measurement{newMeasurement(1), newMeasurement(2)}))
+		is.Nil(spool.Close())
+
+		spool, err = OpenSpool(dir, 1<<20, 1<<20)
+		is.Nil(err)
+		is.False(spool.Empty())
+
+		name, measurements, err := spool.Oldest()
+		is.Nil(err)
+		is.Len(measurements, 2)
+		is.Equal(2.0, measurements[1].Value)
+
+		is.Nil(spool.Remove(name))
+		is.True(spool.Empty())
+	})
+
+	t.Run("when the spool is over its size, it should refuse more measurements", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		spool, err := OpenSpool(t.TempDir(), 10, 1<<20)
+		is.Nil(err)
+
+		is.Nil(spool.Append([]*repository.Measurement{newMeasurement(1)}))
+		is.ErrorIs(spool.Append([]*repository.Measurement{newMeasurement(2)}), ErrSpoolFull)
+	})
+}
+
+func TestPipeline(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when the queue is full, it should reject measurements", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		spool, err := OpenSpool(t.TempDir(), 1<<20, 1<<20)
+		is.Nil(err)
+		pipeline := newPipeline(&fakeWriter{}, spool, 1, 10, time.Hour, time.Hour, time.Second)
+
+		is.Nil(pipeline.Enqueue(newMeasurement(1)))
+		is.ErrorIs(pipeline.Enqueue(newMeasurement(2)), ErrQueueFull)
+		is.Equal(int64(1), pipeline.Stats().Rejected)
+		is.Equal(1, pipeline.Stats().QueueDepth)
+	})
+
+	t.Run("when InfluxDB is down, it should spool measurements and replay them once it's back", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		writer := &fakeWriter{failing: true}
+		spool, err := OpenSpool(t.TempDir(), 1<<20, 1<<20)
+		is.Nil(err)
+		pipeline := newPipeline(writer, spool, 10, 2, 10*time.Millisecond, 10*time.Millisecond, time.Second)
+		go pipeline.Run(context.Background())
+
+		is.Nil(pipeline.Enqueue(newMeasurement(1)))
+		is.Nil(pipeline.Enqueue(newMeasurement(2)))
+		is.Eventually(func() bool { return !pipeline.Stats().Healthy }, time.Second, 5*time.Millisecond)
+
+		// Accepted while unhealthy, straight to the spool
+		is.Nil(pipeline.Enqueue(newMeasurement(3)))
+		is.Equal(int64(3), pipeline.Stats().Spooled)
+		is.Equal(0, writer.count())
+
+		writer.setFailing(false)
+		is.Eventually(func() bool { return pipeline.Stats().Healthy }, time.Second, 5*time.Millisecond)
+		is.Equal(3, writer.count())
+		is.Equal(int64(3), pipeline.Stats().Replayed)
+
+		is.Nil(pipeline.Close(context.Background()))
+		is.ErrorIs(pipeline.Enqueue(newMeasurement(4)), ErrClosed)
+	})
+
+	t.Run("when the storage rejects a spooled measurement for good, it should set it aside and replay the rest", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		writer := &fakeWriter{failing: true, rejects: func(m *repository.Measurement) bool { return m.Value == 2 }}
+		dir := t.TempDir()
+		spool, err := OpenSpool(dir, 1<<20, 1<<20)
+		is.Nil(err)
+		pipeline := newPipeline(writer, spool, 10, 3, 10*time.Millisecond, 10*time.Millisecond, time.Second)
+		go pipeline.Run(context.Background())
+
+		is.Nil(pipeline.Enqueue(newMeasurement(1)))
+		is.Nil(pipeline.Enqueue(newMeasurement(2)))
+		is.Nil(pipeline.Enqueue(newMeasurement(3)))
+		is.Eventually(func() bool { return !pipeline.Stats().Healthy }, time.Second, 5*time.Millisecond)
+
+		writer.setFailing(false)
+		is.Eventually(func() bool { return pipeline.Stats().Healthy }, time.Second, 5*time.Millisecond)
+		is.Equal(2, writer.count())
+		stats := pipeline.Stats()
+		is.Equal(int64(2), stats.Replayed)
+		is.Equal(int64(1), stats.DeadLettered)
+		is.Equal(0, stats.SpoolSegments)
+
+		rejected, err := os.ReadDir(filepath.Join(dir, rejectedDir))
+		is.Nil(err)
+		is.Len(rejected, 1)
+
+		// Back to writing from the queue
+		is.Nil(pipeline.Enqueue(newMeasurement(4)))
+		is.Eventually(func() bool { return writer.count() == 3 }, time.Second, 5*time.Millisecond)
+		is.Nil(pipeline.Close(context.Background()))
+	})
+
+	t.Run("when the storage rejects a queued measurement for good, it should set it aside and stay healthy", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		writer := &fakeWriter{rejects: func(m *repository.Measurement) bool { return m.Value == 2 }}
+		spool, err := OpenSpool(t.TempDir(), 1<<20, 1<<20)
+		is.Nil(err)
+		pipeline := newPipeline(writer, spool, 10, 3, time.Hour, time.Hour, time.Second)
+		go pipeline.Run(context.Background())
+
+		is.Nil(pipeline.Enqueue(newMeasurement(1)))
+		is.Nil(pipeline.Enqueue(newMeasurement(2)))
+		is.Nil(pipeline.Enqueue(newMeasurement(3)))
+		is.Eventually(func() bool { return pipeline.Stats().DeadLettered == 1 }, time.Second, 5*time.Millisecond)
+
+		stats := pipeline.Stats()
+		is.True(stats.Healthy)
+		is.Equal(int64(2), stats.Written)
+		is.Equal(int64(0), stats.Spooled)
+		is.Equal(2, writer.count())
+		is.Nil(pipeline.Close(context.Background()))
+	})
+
+	t.Run("when the pipeline stats are collected, it should expose them as metrics", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		spool, err := OpenSpool(t.TempDir(), 1<<20, 1<<20)
+		is.Nil(err)
+		pipeline := newPipeline(&fakeWriter{}, spool, 1, 10, time.Hour, time.Hour, time.Second)
+		is.Nil(pipeline.Enqueue(newMeasurement(1)))
+		is.ErrorIs(pipeline.Enqueue(newMeasurement(2)), ErrQueueFull)
+
+		is.Nil(testutil.CollectAndCompare(pipeline.Collector(), strings.NewReader(`
+# HELP ingest_queue_depth Measurements waiting in the ingest queue.
+# TYPE ingest_queue_depth gauge
+ingest_queue_depth 1
+# HELP ingest_measurements_total Measurements by what happened to them in the pipeline.
+# TYPE ingest_measurements_total counter
+ingest_measurements_total{outcome="dead_lettered"} 0
+ingest_measurements_total{outcome="dropped"} 0
+ingest_measurements_total{outcome="enqueued"} 1
+ingest_measurements_total{outcome="rejected"} 1
+ingest_measurements_total{outcome="replayed"} 0
+ingest_measurements_total{outcome="spooled"} 0
+ingest_measurements_total{outcome="written"} 0
+`), "ingest_queue_depth", "ingest_measurements_total"))
+	})
+}
@@ -0,0 +1,56 @@
+package ingest
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	queueDepthDesc    = prometheus.NewDesc("ingest_queue_depth", "Measurements waiting in the ingest queue.", nil, nil)
+	queueCapacityDesc = prometheus.NewDesc("ingest_queue_capacity", "Capacity of the ingest queue.", nil, nil)
+	spoolSegmentsDesc = prometheus.NewDesc("ingest_spool_segments", "Segments in the spool on disk.", nil, nil)
+	spoolBytesDesc    = prometheus.NewDesc("ingest_spool_bytes", "Size of the spool on disk.", nil, nil)
+	healthyDesc       = prometheus.NewDesc("ingest_healthy", "Whether the measurements go to the queue, 1, or to the spool, 0.", nil, nil)
+	measurementsDesc  = prometheus.NewDesc("ingest_measurements_total", "Measurements by what happened to them in the pipeline.", []string{"outcome"}, nil)
+)
+
+// statsCollector exposes the stats of a pipeline, read when the metrics are scraped.
+type statsCollector struct {
+	pipeline *Pipeline
+}
+
+// Collector returns a Prometheus collector of the pipeline stats.
+func (p *Pipeline) Collector() prometheus.Collector {
+	return statsCollector{pipeline: p}
+}
+
+func (c statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- queueCapacityDesc
+	ch <- spoolSegmentsDesc
+	ch <- spoolBytesDesc
+	ch <- healthyDesc
+	ch <- measurementsDesc
+}
+
+func (c statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.pipeline.Stats()
+	healthy := 0.0
+	if stats.Healthy {
+		healthy = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(stats.QueueDepth))
+	ch <- prometheus.MustNewConstMetric(queueCapacityDesc, prometheus.GaugeValue, float64(stats.QueueCapacity))
+	ch <- prometheus.MustNewConstMetric(spoolSegmentsDesc, prometheus.GaugeValue, float64(stats.SpoolSegments))
+	ch <- prometheus.MustNewConstMetric(spoolBytesDesc, prometheus.GaugeValue, float64(stats.SpoolBytes))
+	ch <- prometheus.MustNewConstMetric(healthyDesc, prometheus.GaugeValue, healthy)
+	for outcome, count := range map[string]int64{
+		"enqueued":      stats.Enqueued,
+		"written":       stats.Written,
+		"spooled":       stats.Spooled,
+		"replayed":      stats.Replayed,
+		"rejected":      stats.Rejected,
+		"dead_lettered": stats.DeadLettered,
+		"dropped":       stats.Dropped,
+	} {
+		ch <- prometheus.MustNewConstMetric(measurementsDesc, prometheus.CounterValue, float64(count), outcome)
+	}
+}
@@ -0,0 +1,300 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+var (
+	ErrQueueFull = errors.New("the ingest queue is full")
+	ErrClosed    = errors.New("the ingest pipeline is closed")
+)
+
+type measurementWriter interface {
+	CreateMeasurements(ctx context.Context, measurements []*repository.Measurement) error
+}
+
+type Stats struct {
+	QueueDepth    int   `json:"queue_depth"`
+	QueueCapacity int   `json:"queue_capacity"`
+	SpoolSegments int   `json:"spool_segments"`
+	SpoolBytes    int64 `json:"spool_bytes"`
+	Healthy       bool  `json:"healthy"`
+	Enqueued      int64 `json:"enqueued"`
+	Written       int64 `json:"written"`
+	Spooled       int64 `json:"spooled"`
+	Replayed      int64 `json:"replayed"`
+	Rejected      int64 `json:"rejected"`
+	DeadLettered  int64 `json:"dead_lettered"`
+	Dropped       int64 `json:"dropped"`
+}
+
+// Pipeline decouples accepting measurements from writing them to InfluxDB. Measurements are
+// queued in memory and written in batches, by size or by time, whichever comes first. When a
+// write fails, the batch goes to the spool on disk and so does everything accepted until the
+// spool was fully replayed, so an InfluxDB outage doesn't lose readings. The measurements the
+// storage refuses for good aren't retried but set aside in the rejected directory of the spool.
+type Pipeline struct {
+	writer        measurementWriter
+	spool         *Spool
+	queue         chan *repository.Measurement
+	batchSize     int
+	flushInterval time.Duration
+	replayTimeout time.Duration
+	replayEvery   time.Duration
+	retryAfter    time.Duration
+
+	healthy atomic.Bool
+	closeMu sync.RWMutex
+	closed  bool
+	done    chan struct{}
+
+	enqueued     atomic.Int64
+	written      atomic.Int64
+	spooled      atomic.Int64
+	replayed     atomic.Int64
+	rejected     atomic.Int64
+	deadLettered atomic.Int64
+	dropped      atomic.Int64
+}
+
+func NewPipeline(envVars *config.EnvVars, measurementRepository repository.MeasurementRepository) (*Pipeline, error) {
+	spool, err := OpenSpool(envVars.Ingest.SpoolDir, envVars.Ingest.SpoolMaxBytes, envVars.Ingest.SpoolSegmentBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPipeline(measurementRepository, spool, envVars.Ingest.QueueSize, envVars.Ingest.BatchSize, envVars.Ingest.FlushInterval, envVars.Ingest.ReplayInterval, envVars.Ingest.RetryAfter), nil
+}
+
+func newPipeline(writer measurementWriter, spool *Spool, queueSize, batchSize int, flushInterval, replayEvery, retryAfter time.Duration) *Pipeline {
+	p := &Pipeline{
+		writer:        writer,
+		spool:         spool,
+		queue:         make(chan *repository.Measurement, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		replayTimeout: 30 * time.Second,
+		replayEvery:   replayEvery,
+		retryAfter:    retryAfter,
+		done:          make(chan struct{}),
+	}
+	// Segments left by a previous run have to be replayed before going back to the queue
+	p.healthy.Store(spool.Empty())
+	return p
+}
+
+// RetryAfter is how long clients should wait before retrying a rejected measurement.
+func (p *Pipeline) RetryAfter() time.Duration {
+	return p.retryAfter
+}
+
+// Spooling reports whether accepted measurements may be waiting in the spool rather than being
+// written to InfluxDB.
+func (p *Pipeline) Spooling() bool {
+	return !p.healthy.Load() || !p.spool.Empty()
+}
+
+// Enqueue accepts a measurement for writing. It returns ErrQueueFull when the queue is full,
+// ErrSpoolFull when InfluxDB is unavailable and the spool is full, and ErrClosed once the
+// pipeline is shutting down.
+func (p *Pipeline) Enqueue(measurement *repository.Measurement) error {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+
+	if p.closed {
+		p.rejected.Add(1)
+		return ErrClosed
+	}
+
+	if !p.healthy.Load() {
+		if err := p.spool.Append([]*repository.Measurement{measurement}); err != nil {
+			p.rejected.Add(1)
+			return err
+		}
+		p.enqueued.Add(1)
+		p.spooled.Add(1)
+		return nil
+	}
+
+	select {
+	case p.queue <- measurement:
+		p.enqueued.Add(1)
+		return nil
+	default:
+		p.rejected.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// Run writes the queued measurements and replays the spool until Close is called.
+func (p *Pipeline) Run(ctx context.Context) {
+	defer close(p.done)
+
+	flushTicker := time.NewTicker(p.flushInterval)
+	defer flushTicker.Stop()
+	replayTicker := time.NewTicker(p.replayEvery)
+	defer replayTicker.Stop()
+
+	batch := make([]*repository.Measurement, 0, p.batchSize)
+	for {
+		select {
+		case measurement, ok := <-p.queue:
+			if !ok {
+				p.flush(ctx, batch)
+				return
+			}
+			batch = append(batch, measurement)
+			if len(batch) >= p.batchSize {
+				p.flush(ctx, batch)
+				batch = batch[:0]
+			}
+		case <-flushTicker.C:
+			p.flush(ctx, batch)
+			batch = batch[:0]
+		case <-replayTicker.C:
+			p.replay(ctx)
+		}
+	}
+}
+
+func (p *Pipeline) flush(ctx context.Context, batch []*repository.Measurement) {
+	if len(batch) == 0 {
+		return
+	}
+
+	rejected, err := p.write(ctx, batch, 0)
+	if err != nil {
+		log.Error().Err(err).Int("measurements", len(batch)).Msg("failed to write measurements, spooling them")
+		p.healthy.Store(false)
+
+		if err := p.spool.Append(batch); err != nil {
+			log.Error().Err(err).Int("measurements", len(batch)).Msg("failed to spool measurements, dropping them")
+			p.dropped.Add(int64(len(batch)))
+			return
+		}
+		p.spooled.Add(int64(len(batch)))
+		return
+	}
+
+	p.written.Add(int64(len(batch) - rejected))
+}
+
+// write writes the measurements, and when the storage rejects them for good, writes them again
+// one by one so only the ones it refuses are set aside and the others still get written. It
+// returns how many were set aside, and only the errors worth retrying the whole batch for, which
+// may write some of its measurements twice, the storage keeping one point per series and time.
+func (p *Pipeline) write(ctx context.Context, measurements []*repository.Measurement, timeout time.Duration) (int, error) {
+	err := p.createMeasurements(ctx, measurements, timeout)
+	if !errors.Is(err, repository.ErrMeasurementsRejected) {
+		return 0, err
+	}
+	log.Warn().Err(err).Int("measurements", len(measurements)).Msg("the storage rejected a batch, writing its measurements one by one")
+
+	var rejected []*repository.Measurement
+	for _, measurement := range measurements {
+		err := p.createMeasurements(ctx, []*repository.Measurement{measurement}, timeout)
+		if errors.Is(err, repository.ErrMeasurementsRejected) {
+			rejected = append(rejected, measurement)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	log.Error().Int("measurements", len(rejected)).Msg("the storage rejected measurements, setting them aside")
+	if err := p.spool.Reject(rejected); err != nil {
+		log.Error().Err(err).Int("measurements", len(rejected)).Msg("failed to set rejected measurements aside, dropping them")
+		p.dropped.Add(int64(len(rejected)))
+		return len(rejected), nil
+	}
+	p.deadLettered.Add(int64(len(rejected)))
+	return len(rejected), nil
+}
+
+func (p *Pipeline) createMeasurements(ctx context.Context, measurements []*repository.Measurement, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return p.writer.CreateMeasurements(ctx, measurements)
+}
+
+// replay writes the spooled segments oldest first, and goes back to the queue once the spool is
+// empty. It stops at the first failure worth retrying and tries again at the next tick.
+func (p *Pipeline) replay(ctx context.Context) {
+	for !p.spool.Empty() {
+		name, measurements, err := p.spool.Oldest()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read the spool")
+			return
+		}
+
+		rejected := 0
+		if len(measurements) > 0 {
+			rejected, err = p.write(ctx, measurements, p.replayTimeout)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to replay the spool")
+				return
+			}
+		}
+
+		if err := p.spool.Remove(name); err != nil {
+			log.Error().Err(err).Msg("failed to remove a replayed spool segment")
+			return
+		}
+		p.replayed.Add(int64(len(measurements) - rejected))
+		p.written.Add(int64(len(measurements) - rejected))
+	}
+
+	if !p.healthy.Load() {
+		log.Info().Msg("spool replayed, back to queueing measurements")
+	}
+	p.healthy.Store(true)
+}
+
+// Close stops accepting measurements and waits for the queued ones to be written or spooled,
+// until the context is done.
+func (p *Pipeline) Close(ctx context.Context) error {
+	p.closeMu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.closeMu.Unlock()
+
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return p.spool.Close()
+}
+
+func (p *Pipeline) Stats() Stats {
+	segments, bytes := p.spool.Stats()
+	return Stats{
+		QueueDepth:    len(p.queue),
+		QueueCapacity: cap(p.queue),
+		SpoolSegments: segments,
+		SpoolBytes:    bytes,
+		Healthy:       p.healthy.Load(),
+		Enqueued:      p.enqueued.Load(),
+		Written:       p.written.Load(),
+		Spooled:       p.spooled.Load(),
+		Replayed:      p.replayed.Load(),
+		Rejected:      p.rejected.Load(),
+		DeadLettered:  p.deadLettered.Load(),
+		Dropped:       p.dropped.Load(),
+	}
+}
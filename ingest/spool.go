@@ -0,0 +1,284 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+var ErrSpoolFull = errors.New("the spool is full")
+
+const (
+	segmentExt = ".spool"
+	// rejectedDir is the directory of the spool keeping the measurements the storage refused
+	rejectedDir = "rejected"
+)
+
+type spoolRecord struct {
+	Name      string            `json:"name"`
+	SensorID  string            `json:"sensor_id"`
+	Unit      string            `json:"unit"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// Spool is a directory of append-only segment files holding the measurements that couldn't be
+// written to InfluxDB yet. Measurements are appended to the active segment, which is closed once
+// it reaches the segment size, and segments are replayed and removed oldest first.
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu         sync.Mutex
+	active     *os.File
+	activeName string
+	activeSize int64
+	segments   []string
+	sizes      map[string]int64
+	totalBytes int64
+	nextSeq    int64
+}
+
+// OpenSpool picks up the segments left in dir by a previous run. The directory is only created
+// once something needs to be spooled.
+func OpenSpool(dir string, maxBytes, segmentBytes int64) (*Spool, error) {
+	s := &Spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		sizes:        map[string]int64{},
+		nextSeq:      time.Now().UnixNano(),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read the spool directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), segmentExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat spool segment: %w", err)
+		}
+		s.segments = append(s.segments, entry.Name())
+		s.sizes[entry.Name()] = info.Size()
+		s.totalBytes += info.Size()
+	}
+	// Segment names are zero padded sequence numbers, so they sort by age
+	sort.Strings(s.segments)
+
+	return s, nil
+}
+
+// Append writes the measurements to the active segment and syncs it to disk.
+func (s *Spool) Append(measurements []*repository.Measurement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.totalBytes >= s.maxBytes {
+		return ErrSpoolFull
+	}
+
+	if s.active == nil {
+		if err := os.MkdirAll(s.dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create the spool directory: %w", err)
+		}
+		s.nextSeq++
+		s.activeName = fmt.Sprintf("%020d%s", s.nextSeq, segmentExt)
+		active, err := os.OpenFile(filepath.Join(s.dir, s.activeName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to create spool segment: %w", err)
+		}
+		s.active = active
+		s.activeSize = 0
+	}
+
+	data, err := encodeRecords(measurements)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.active.Write(data); err != nil {
+		return fmt.Errorf("failed to write to spool segment: %w", err)
+	}
+	if err := s.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool segment: %w", err)
+	}
+	s.activeSize += int64(len(data))
+	s.totalBytes += int64(len(data))
+
+	if s.activeSize >= s.segmentBytes {
+		return s.rotate()
+	}
+	return nil
+}
+
+// Reject keeps the measurements the storage refused for good in a segment of the rejected
+// directory of the spool, out of the way of the replay, so they can be looked into. Rejected
+// segments don't count towards the size of the spool.
+func (s *Spool) Reject(measurements []*repository.Measurement) error {
+	data, err := encodeRecords(measurements)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, rejectedDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create the rejected directory: %w", err)
+	}
+	s.nextSeq++
+	file, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d%s", s.nextSeq, segmentExt)), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create rejected segment: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write to rejected segment: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync rejected segment: %w", err)
+	}
+	return nil
+}
+
+func encodeRecords(measurements []*repository.Measurement) ([]byte, error) {
+	var data []byte
+	for _, m := range measurements {
+		line, err := json.Marshal(spoolRecord{Name: m.Name, SensorID: m.SensorID, Unit: m.Unit, Value: m.Value, Timestamp: m.Timestamp, Labels: m.Labels})
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return data, nil
+}
+
+// rotate closes the active segment so it can be replayed.
+func (s *Spool) rotate() error {
+	if s.active == nil {
+		return nil
+	}
+
+	err := s.active.Close()
+	s.segments = append(s.segments, s.activeName)
+	s.sizes[s.activeName] = s.activeSize
+	s.active = nil
+	s.activeName = ""
+	s.activeSize = 0
+	return err
+}
+
+// Oldest returns the oldest segment along with its measurements, closing the active segment when
+// it's the only one left. It returns an empty name when the spool is empty.
+func (s *Spool) Oldest() (string, []*repository.Measurement, error) {
+	s.mu.Lock()
+	if len(s.segments) == 0 {
+		if err := s.rotate(); err != nil {
+			s.mu.Unlock()
+			return "", nil, err
+		}
+	}
+	if len(s.segments) == 0 {
+		s.mu.Unlock()
+		return "", nil, nil
+	}
+	name := s.segments[0]
+	s.mu.Unlock()
+
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer file.Close()
+
+	measurements := []*repository.Measurement{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record spoolRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash in the middle of an append leaves a partial last line behind
+			log.Warn().Err(err).Str("segment", name).Msg("skipping corrupted spool record")
+			continue
+		}
+		measurements = append(measurements, &repository.Measurement{
+			Name:      record.Name,
+			SensorID:  record.SensorID,
+			Unit:      record.Unit,
+			Value:     record.Value,
+			Timestamp: record.Timestamp,
+			Labels:    record.Labels,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, fmt.Errorf("failed to read spool segment: %w", err)
+	}
+
+	return name, measurements, nil
+}
+
+// Remove deletes a segment returned by Oldest once it was replayed.
+func (s *Spool) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spool segment: %w", err)
+	}
+
+	for i, segment := range s.segments {
+		if segment == name {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+	s.totalBytes -= s.sizes[name]
+	delete(s.sizes, name)
+	return nil
+}
+
+// Empty reports whether there's nothing left to replay.
+func (s *Spool) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) == 0 && s.active == nil
+}
+
+func (s *Spool) Stats() (segments int, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments = len(s.segments)
+	if s.active != nil {
+		segments++
+	}
+	return segments, s.totalBytes
+}
+
+// Close closes the active segment. Whatever was spooled is replayed by the next run.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotate()
+}
@@ -0,0 +1,10 @@
+// Package testutil holds the helpers shared by the tests of several packages.
+package testutil
+
+import "github.com/go-faker/faker/v4"
+
+// UniqueSensorName keeps the sensors of a run from colliding with the ones left by previous runs,
+// since sensor names are unique.
+func UniqueSensorName() string {
+	return faker.Word() + "-" + faker.UUIDDigit()
+}
@@ -0,0 +1,150 @@
+package label
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Keys and values are restricted to characters that need no escaping in selectors, MongoDB field
+// paths or Flux, since labels end up in all of them. Keys can't have a '.', which MongoDB would
+// take for a nested field.
+var (
+	keyPattern   = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,62}$`)
+	valuePattern = regexp.MustCompile(`^[A-Za-z0-9_.:/-]{1,255}$`)
+)
+
+// reservedKeys are the tags and columns measurements already have in InfluxDB.
+var reservedKeys = []string{"sensor_id", "unit", "rollup", "result", "table"}
+
+func ValidateKey(key string) error {
+	if !keyPattern.MatchString(key) {
+		return fmt.Errorf("invalid label key %q: must start with a letter and only contain letters, digits, '_' and '-', up to 63 characters", key)
+	}
+	if slices.Contains(reservedKeys, key) {
+		return fmt.Errorf("invalid label key %q: reserved", key)
+	}
+	return nil
+}
+
+func ValidateValue(value string) error {
+	if !valuePattern.MatchString(value) {
+		return fmt.Errorf("invalid label value %q: must only contain letters, digits, '_', '.', ':', '/' and '-', up to 255 characters", value)
+	}
+	return nil
+}
+
+// Validate checks every key and value of the labels, in key order so the error is stable.
+func Validate(labels map[string]string) error {
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		if err := ValidateKey(key); err != nil {
+			return err
+		}
+		if err := ValidateValue(labels[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Operator string
+
+const (
+	OperatorEquals    Operator = "="
+	OperatorNotEquals Operator = "!="
+	OperatorExists    Operator = "exists"
+	OperatorNotExists Operator = "!exists"
+)
+
+// Requirement is a single condition of a selector. Value is empty for the exists operators.
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Value    string
+}
+
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case OperatorEquals:
+		return ok && value == r.Value
+	case OperatorNotEquals:
+		return !ok || value != r.Value
+	case OperatorExists:
+		return ok
+	case OperatorNotExists:
+		return !ok
+	default:
+		return false
+	}
+}
+
+// Selector is a set of requirements that must all be met, such as site=farm-3,zone!=south.
+type Selector []Requirement
+
+// ParseSelector parses comma separated requirements, each one being key=value (or key==value),
+// key!=value, key for the label being set or !key for it not being set. A label that isn't set
+// meets key!=value. An empty string selects everything.
+func ParseSelector(s string) (Selector, error) {
+	selector := Selector{}
+	if strings.TrimSpace(s) == "" {
+		return selector, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+
+		var requirement Requirement
+		switch {
+		case strings.Contains(part, "!="):
+			key, value, _ := strings.Cut(part, "!=")
+			requirement = Requirement{Key: strings.TrimSpace(key), Operator: OperatorNotEquals, Value: strings.TrimSpace(value)}
+		case strings.Contains(part, "="):
+			key, value, _ := strings.Cut(part, "=")
+			value = strings.TrimPrefix(value, "=")
+			requirement = Requirement{Key: strings.TrimSpace(key), Operator: OperatorEquals, Value: strings.TrimSpace(value)}
+		case strings.HasPrefix(part, "!"):
+			requirement = Requirement{Key: strings.TrimSpace(part[1:]), Operator: OperatorNotExists}
+		default:
+			requirement = Requirement{Key: part, Operator: OperatorExists}
+		}
+
+		if err := ValidateKey(requirement.Key); err != nil {
+			return nil, err
+		}
+		if requirement.Operator == OperatorEquals || requirement.Operator == OperatorNotEquals {
+			if err := ValidateValue(requirement.Value); err != nil {
+				return nil, err
+			}
+		}
+		selector = append(selector, requirement)
+	}
+
+	return selector, nil
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		if !requirement.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	parts := make([]string, 0, len(s))
+	for _, requirement := range s {
+		switch requirement.Operator {
+		case OperatorExists:
+			parts = append(parts, requirement.Key)
+		case OperatorNotExists:
+			parts = append(parts, "!"+requirement.Key)
+		default:
+			parts = append(parts, requirement.Key+string(requirement.Operator)+requirement.Value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
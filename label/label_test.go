@@ -0,0 +1,61 @@
+package label
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSelector(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when a selector has every kind of requirement, it should parse all of them", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		selector, err := ParseSelector("site=farm-3, zone!=south,env==prod,owner,!retired")
+		is.Nil(err)
+		is.Equal(Selector{
+			{Key: "site", Operator: OperatorEquals, Value: "farm-3"},
+			{Key: "zone", Operator: OperatorNotEquals, Value: "south"},
+			{Key: "env", Operator: OperatorEquals, Value: "prod"},
+			{Key: "owner", Operator: OperatorExists},
+			{Key: "retired", Operator: OperatorNotExists},
+		}, selector)
+		is.Equal("site=farm-3,zone!=south,env=prod,owner,!retired", selector.String())
+	})
+
+	t.Run("when a selector has an invalid key or value, it should return an error", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		for _, s := range []string{"site=", "=farm", "sensor_id=abc", `site=farm"3`, "site=a,,zone=b", "_field=value", "site.zone=b"} {
+			_, err := ParseSelector(s)
+			is.Error(err, s)
+		}
+	})
+
+	t.Run("when labels are matched, a missing label should meet the not equals requirement", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		selector, err := ParseSelector("site=farm-3,zone!=south")
+		is.Nil(err)
+
+		is.True(selector.Matches(map[string]string{"site": "farm-3"}))
+		is.True(selector.Matches(map[string]string{"site": "farm-3", "zone": "north"}))
+		is.False(selector.Matches(map[string]string{"site": "farm-3", "zone": "south"}))
+		is.False(selector.Matches(map[string]string{"zone": "north"}))
+	})
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	is := require.New(t)
+
+	is.Nil(Validate(map[string]string{"site": "farm-3", "zone": "north"}))
+	is.Error(Validate(map[string]string{"unit": "celsius"}))
+	is.Error(Validate(map[string]string{"site": "farm 3"}))
+	// A dotted key would be a nested field of the labels in MongoDB
+	is.Error(Validate(map[string]string{"site.zone": "north"}))
+}
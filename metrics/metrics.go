@@ -0,0 +1,77 @@
+// Package metrics holds the Prometheus collectors of the service, registered to Registry.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry is the registry exposed at /metrics. A registry of our own, rather than the default
+// one, keeps collectors registered by dependencies out of it.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of the HTTP requests by method, route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	repositoryCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "repository_call_duration_seconds",
+		Help:    "Duration of the repository method calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"repository", "method"})
+
+	repositoryCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "repository_call_errors_total",
+		Help: "Repository method calls that returned an error.",
+	}, []string{"repository", "method"})
+
+	measurementsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ingest_measurements_written_total",
+		Help: "Measurements written by storage backend.",
+	}, []string{"backend"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestDuration,
+		repositoryCallDuration,
+		repositoryCallErrors,
+		measurementsWritten,
+	)
+}
+
+// Handler serves the metrics of Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ObserveHTTPRequest records a request served by the route, the pattern it matched rather than
+// its path, which would make a series per sensor.
+func ObserveHTTPRequest(method, route string, status int, start time.Time) {
+	httpRequestDuration.WithLabelValues(method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveRepositoryCall records a call to a repository method that started at start and
+// returned err.
+func ObserveRepositoryCall(repository, method string, start time.Time, err error) {
+	repositoryCallDuration.WithLabelValues(repository, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		repositoryCallErrors.WithLabelValues(repository, method).Inc()
+	}
+}
+
+// AddMeasurementsWritten counts measurements written to the storage backend. The names of the
+// measurements are left out, being the clients' to choose, so they'd make unbounded series.
+func AddMeasurementsWritten(backend string, count int) {
+	measurementsWritten.WithLabelValues(backend).Add(float64(count))
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("when repository calls are observed, it should count only the failed ones as errors", func(t *testing.T) {
+		is := require.New(t)
+
+		ObserveRepositoryCall("test", "Succeeds", time.Now(), nil)
+		ObserveRepositoryCall("test", "Fails", time.Now(), errors.New("connection refused"))
+		ObserveRepositoryCall("test", "Fails", time.Now(), errors.New("connection refused"))
+
+		is.Equal(2, testutil.CollectAndCount(repositoryCallDuration, "repository_call_duration_seconds"))
+		is.Equal(0.0, testutil.ToFloat64(repositoryCallErrors.WithLabelValues("test", "Succeeds")))
+		is.Equal(2.0, testutil.ToFloat64(repositoryCallErrors.WithLabelValues("test", "Fails")))
+	})
+
+	t.Run("when measurements of many names are written, it should keep a single series per backend", func(t *testing.T) {
+		is := require.New(t)
+
+		AddMeasurementsWritten("embedded", 2)
+		AddMeasurementsWritten("embedded", 3)
+
+		is.Equal(1, testutil.CollectAndCount(measurementsWritten, "ingest_measurements_written_total"))
+		is.Equal(5.0, testutil.ToFloat64(measurementsWritten.WithLabelValues("embedded")))
+	})
+
+	t.Run("when the registry is gathered, it should include the runtime stats", func(t *testing.T) {
+		is := require.New(t)
+
+		families, err := Registry.Gather()
+		is.Nil(err)
+		names := map[string]bool{}
+		for _, family := range families {
+			names[family.GetName()] = true
+		}
+		is.True(names["go_goroutines"])
+		is.True(names["go_memstats_alloc_bytes"])
+	})
+}
@@ -0,0 +1,300 @@
+// Package ratelimit throttles the clients of the API with token buckets, kept in a Store so that
+// several instances of the server can share the budgets.
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+)
+
+const (
+	StoreMemory = "memory"
+
+	// sweepInterval is how often the memory store drops the buckets that are full again
+	sweepInterval = time.Minute
+)
+
+// Class is the kind of route a budget applies to, so reads can't exhaust the budget of writes and
+// the other way around.
+type Class string
+
+const (
+	ClassIngest Class = "ingest"
+	ClassQuery  Class = "query"
+	// ClassWrite is for the routes changing sensors, assets, geofences and channels
+	ClassWrite Class = "write"
+)
+
+// Limit is the budget of a bucket: Burst requests at once, refilled at Rate requests per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Result is the state of a bucket after a request took a token from it, or failed to.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until a request can be allowed, zero when this one was
+	RetryAfter time.Duration
+}
+
+// Bucket is the state of a token bucket, the tokens left as of the last update.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// NewBucket returns a full bucket.
+func NewBucket(limit Limit, now time.Time) Bucket {
+	return Bucket{Tokens: float64(limit.Burst), Updated: now}
+}
+
+// Take refills the bucket for the time passed since its last update and takes a token from it if
+// there's one. Stores keep the returned bucket, whether the request was allowed or not.
+func (b Bucket) Take(limit Limit, now time.Time) (Bucket, Result) {
+	if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		b.Tokens = min(float64(limit.Burst), b.Tokens+elapsed.Seconds()*limit.Rate)
+		b.Updated = now
+	}
+
+	result := Result{Limit: limit.Burst}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = refillTime(1-b.Tokens, limit.Rate)
+	}
+	result.Remaining = int(math.Floor(b.Tokens))
+	result.Reset = refillTime(float64(limit.Burst)-b.Tokens, limit.Rate)
+	return b, result
+}
+
+// Full tells whether the bucket refilled completely by now, being then the same as a new one.
+func (b Bucket) Full(limit Limit, now time.Time) bool {
+	return b.Tokens+now.Sub(b.Updated).Seconds()*limit.Rate >= float64(limit.Burst)
+}
+
+func refillTime(tokens, rate float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / rate * float64(time.Second))
+}
+
+// Store keeps the buckets by key. Take must be atomic for a key, a store shared by several
+// instances of the server, such as one backed by Redis, would run Bucket.Take in a transaction or
+// a script.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+// NewStore returns the store configured by RATE_LIMIT__STORE.
+func NewStore(envVars *config.EnvVars) (Store, error) {
+	switch envVars.RateLimit.Store {
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported rate limit store: %s", envVars.RateLimit.Store)
+	}
+}
+
+// MemoryStore keeps the buckets in memory, each instance of the server having its own budgets.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]bucketEntry
+}
+
+type bucketEntry struct {
+	bucket Bucket
+	limit  Limit
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]bucketEntry{}}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.buckets[key]
+	if !ok {
+		entry.bucket = NewBucket(limit, now)
+	}
+	var result Result
+	entry.bucket, result = entry.bucket.Take(limit, now)
+	entry.limit = limit
+	s.buckets[key] = entry
+	return result, nil
+}
+
+// Sweep drops the buckets that are full again, which would be created the same on the next
+// request, so the clients seen once don't stay in memory.
+func (s *MemoryStore) Sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, entry := range s.buckets {
+		if entry.bucket.Full(entry.limit, now) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// Run sweeps the buckets periodically until the context is done.
+func (s *MemoryStore) Run(ctx context.Context) error {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			s.Sweep(now)
+		}
+	}
+}
+
+// Limits are the budgets of the clients by class of route, and of the sensors on the ingest
+// routes, so a device can't flood the ingest through several clients either.
+type Limits struct {
+	Enabled bool
+	Ingest  Limit
+	Query   Limit
+	Write   Limit
+	Sensor  Limit
+	// APIKeys are the hashes of the keys having budgets of their own
+	APIKeys map[string]struct{}
+}
+
+func NewLimits(envVars *config.EnvVars) Limits {
+	apiKeys := map[string]struct{}{}
+	for _, apiKey := range strings.Split(envVars.RateLimit.APIKeys, ",") {
+		if apiKey = strings.TrimSpace(apiKey); apiKey != "" {
+			apiKeys[hashAPIKey(apiKey)] = struct{}{}
+		}
+	}
+
+	return Limits{
+		Enabled: envVars.RateLimit.Enabled,
+		Ingest:  Limit{Rate: envVars.RateLimit.IngestRate, Burst: envVars.RateLimit.IngestBurst},
+		Query:   Limit{Rate: envVars.RateLimit.QueryRate, Burst: envVars.RateLimit.QueryBurst},
+		Write:   Limit{Rate: envVars.RateLimit.WriteRate, Burst: envVars.RateLimit.WriteBurst},
+		Sensor:  Limit{Rate: envVars.RateLimit.SensorRate, Burst: envVars.RateLimit.SensorBurst},
+		APIKeys: apiKeys,
+	}
+}
+
+// hashAPIKey hashes a key, so the stores don't keep the keys themselves.
+func hashAPIKey(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// Client identifies who sent a request: its IP and the API key it sent, if any.
+type Client struct {
+	IP     string
+	APIKey string
+}
+
+// Limiter takes the tokens of the requests from the store, with limits that can change while
+// running.
+type Limiter struct {
+	store  Store
+	limits atomic.Pointer[Limits]
+	now    func() time.Time
+}
+
+func NewLimiter(envVars *config.EnvVars, store Store) *Limiter {
+	return newLimiter(store, NewLimits(envVars), time.Now)
+}
+
+func newLimiter(store Store, limits Limits, now func() time.Time) *Limiter {
+	l := &Limiter{store: store, now: now}
+	l.limits.Store(&limits)
+	return l
+}
+
+func (l *Limiter) Limits() Limits {
+	return *l.limits.Load()
+}
+
+// SetLimits changes the limits, the buckets keeping their tokens.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.limits.Store(&limits)
+}
+
+// Allow takes a token from the budget of the client's IP for the class, from the budget of its
+// API key too when it's one of the configured keys and, when sensorID isn't empty on an ingest
+// route, from the budget of the sensor. An unknown key is ignored, or clients could get a fresh
+// budget by sending a new key with every request. The request is allowed when every budget had a
+// token, the result being the one of the most restrictive budget.
+func (l *Limiter) Allow(ctx context.Context, class Class, client Client, sensorID string) (Result, error) {
+	limits := l.Limits()
+	now := l.now()
+
+	limit := limits.Query
+	switch class {
+	case ClassIngest:
+		limit = limits.Ingest
+	case ClassWrite:
+		limit = limits.Write
+	}
+	result, err := l.store.Take(ctx, string(class)+":ip:"+client.IP, limit, now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if client.APIKey != "" {
+		hash := hashAPIKey(client.APIKey)
+		if _, ok := limits.APIKeys[hash]; ok {
+			keyResult, err := l.store.Take(ctx, string(class)+":key:"+hash, limit, now)
+			if err != nil {
+				return Result{}, err
+			}
+			result = mostRestrictive(result, keyResult)
+		}
+	}
+
+	if class != ClassIngest || sensorID == "" {
+		return result, nil
+	}
+	sensorResult, err := l.store.Take(ctx, string(class)+":sensor:"+sensorID, limits.Sensor, now)
+	if err != nil {
+		return Result{}, err
+	}
+	return mostRestrictive(result, sensorResult), nil
+}
+
+func mostRestrictive(a, b Result) Result {
+	switch {
+	case a.Allowed != b.Allowed:
+		if !a.Allowed {
+			return a
+		}
+		return b
+	case !a.Allowed:
+		if a.RetryAfter >= b.RetryAfter {
+			return a
+		}
+		return b
+	case a.Remaining <= b.Remaining:
+		return a
+	default:
+		return b
+	}
+}
@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	limit := Limit{Rate: 2, Burst: 3}
+
+	t.Run("when the burst is used up, it should deny the request until a token is refilled", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		bucket := NewBucket(limit, start)
+		var result Result
+		for i := 0; i < 3; i++ {
+			bucket, result = bucket.Take(limit, start)
+			is.True(result.Allowed)
+			is.Equal(2-i, result.Remaining)
+		}
+
+		bucket, result = bucket.Take(limit, start)
+		is.False(result.Allowed)
+		is.Equal(3, result.Limit)
+		is.Equal(0, result.Remaining)
+		is.Equal(500*time.Millisecond, result.RetryAfter)
+		is.Equal(1500*time.Millisecond, result.Reset)
+
+		_, result = bucket.Take(limit, start.Add(500*time.Millisecond))
+		is.True(result.Allowed)
+		is.Zero(result.RetryAfter)
+	})
+
+	t.Run("when a bucket is left alone, it should refill up to the burst only", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		bucket := NewBucket(limit, start)
+		bucket, _ = bucket.Take(limit, start)
+		is.False(bucket.Full(limit, start))
+		is.True(bucket.Full(limit, start.Add(time.Second)))
+
+		_, result := bucket.Take(limit, start.Add(time.Hour))
+		is.True(result.Allowed)
+		is.Equal(2, result.Remaining)
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when the buckets are swept, it should only drop the full ones", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+		store := NewMemoryStore()
+		_, err := store.Take(context.Background(), "slow", Limit{Rate: 0.01, Burst: 1}, start)
+		is.Nil(err)
+		_, err = store.Take(context.Background(), "fast", Limit{Rate: 10, Burst: 1}, start)
+		is.Nil(err)
+
+		store.Sweep(start.Add(time.Second))
+		is.Len(store.buckets, 1)
+		is.Contains(store.buckets, "slow")
+	})
+}
+
+func TestLimiter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	limits := Limits{
+		Enabled: true,
+		Ingest:  Limit{Rate: 1, Burst: 5},
+		Query:   Limit{Rate: 1, Burst: 2},
+		Write:   Limit{Rate: 1, Burst: 1},
+		Sensor:  Limit{Rate: 1, Burst: 3},
+		APIKeys: map[string]struct{}{hashAPIKey("configured"): {}},
+	}
+
+	t.Run("when a sensor posts through several clients, it should be limited by the budget of the sensor", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		limiter := newLimiter(NewMemoryStore(), limits, clock)
+		for _, client := range []string{"a", "b", "c"} {
+			result, err := limiter.Allow(context.Background(), ClassIngest, Client{IP: client}, "sensor-1")
+			is.Nil(err)
+			is.True(result.Allowed)
+		}
+
+		result, err := limiter.Allow(context.Background(), ClassIngest, Client{IP: "d"}, "sensor-1")
+		is.Nil(err)
+		is.False(result.Allowed)
+		is.Equal(3, result.Limit)
+
+		result, err = limiter.Allow(context.Background(), ClassIngest, Client{IP: "d"}, "sensor-2")
+		is.Nil(err)
+		is.True(result.Allowed)
+		is.Equal(2, result.Remaining)
+	})
+
+	t.Run("when a client used up its query budget, it should still be able to ingest", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		limiter := newLimiter(NewMemoryStore(), limits, clock)
+		for i := 0; i < 2; i++ {
+			result, err := limiter.Allow(context.Background(), ClassQuery, Client{IP: "a"}, "sensor-1")
+			is.Nil(err)
+			is.True(result.Allowed)
+		}
+		result, err := limiter.Allow(context.Background(), ClassQuery, Client{IP: "a"}, "sensor-1")
+		is.Nil(err)
+		is.False(result.Allowed)
+
+		result, err = limiter.Allow(context.Background(), ClassIngest, Client{IP: "a"}, "sensor-1")
+		is.Nil(err)
+		is.True(result.Allowed)
+	})
+
+	t.Run("when the limits are raised, it should apply them to the existing buckets", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		limiter := newLimiter(NewMemoryStore(), limits, clock)
+		for i := 0; i < 2; i++ {
+			_, err := limiter.Allow(context.Background(), ClassQuery, Client{IP: "a"}, "")
+			is.Nil(err)
+		}
+
+		raised := limits
+		raised.Query = Limit{Rate: 1, Burst: 10}
+		limiter.SetLimits(raised)
+		is.Equal(raised, limiter.Limits())
+
+		// The bucket keeps its tokens, only refilling up to the new burst
+		result, err := limiter.Allow(context.Background(), ClassQuery, Client{IP: "a"}, "")
+		is.Nil(err)
+		is.False(result.Allowed)
+		is.Equal(10, result.Limit)
+	})
+
+	t.Run("when a client sends a new API key with every request, it should still be limited by its IP", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		limiter := newLimiter(NewMemoryStore(), limits, clock)
+		for _, apiKey := range []string{"", "random-1"} {
+			result, err := limiter.Allow(context.Background(), ClassQuery, Client{IP: "a", APIKey: apiKey}, "")
+			is.Nil(err)
+			is.True(result.Allowed)
+		}
+
+		result, err := limiter.Allow(context.Background(), ClassQuery, Client{IP: "a", APIKey: "random-2"}, "")
+		is.Nil(err)
+		is.False(result.Allowed)
+	})
+
+	t.Run("when a configured API key is used from several IPs, it should share the budget of the key", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		limiter := newLimiter(NewMemoryStore(), limits, clock)
+		result, err := limiter.Allow(context.Background(), ClassWrite, Client{IP: "a", APIKey: "configured"}, "")
+		is.Nil(err)
+		is.True(result.Allowed)
+
+		result, err = limiter.Allow(context.Background(), ClassWrite, Client{IP: "b", APIKey: "configured"}, "")
+		is.Nil(err)
+		is.False(result.Allowed)
+
+		result, err = limiter.Allow(context.Background(), ClassWrite, Client{IP: "c"}, "")
+		is.Nil(err)
+		is.True(result.Allowed)
+	})
+}
@@ -0,0 +1,181 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Retries of a sensor change losing the race against a concurrent update
+const maxSensorAttempts = 5
+
+// sensorFields are the fields of a sensor revision replicated, as DiffSensorStates names them. The
+// asset isn't, the assets being local to each server.
+var sensorFields = []string{"name", "location", "tags", "description", "altitude", "labels", "hardware", "installed_at"}
+
+// Actor is who the revisions of the sensor changes replicated from the source are recorded as.
+func Actor(source string) string {
+	return "replication:" + source
+}
+
+// Applier applies the batches shipped by the servers replicating to this one. The sensors keep
+// the IDs they have on their server, so their measurements need no translation.
+type Applier struct {
+	sensorsRepository     repository.SensorsRepository
+	measurementRepository repository.MeasurementRepository
+}
+
+func NewApplier(sensorsRepository repository.SensorsRepository, measurementRepository repository.MeasurementRepository) *Applier {
+	return &Applier{
+		sensorsRepository:     sensorsRepository,
+		measurementRepository: measurementRepository,
+	}
+}
+
+// Apply applies the sensor changes of the batch in order, then writes its measurements. Applying
+// a batch again changes nothing, so the source can retry the batches it didn't get an answer for.
+// The invalid measurements are rejected one by one rather than failing the batch, as they'd fail
+// it again on every retry.
+func (a *Applier) Apply(ctx context.Context, batch *Batch) (*BatchResult, error) {
+	ctx = repository.WithActor(ctx, Actor(batch.Source))
+	result := &BatchResult{Sensors: []SensorResult{}}
+
+	measurements := []*repository.Measurement{}
+	for _, entry := range batch.Entries {
+		if entry.Sensor != nil {
+			sensorResult, err := a.applySensorChange(ctx, batch.Source, entry.Sensor)
+			if err != nil {
+				return nil, err
+			}
+			result.Sensors = append(result.Sensors, *sensorResult)
+		}
+		for i, record := range entry.Measurements {
+			if err := record.validate(); err != nil {
+				result.RejectedMeasurements = append(result.RejectedMeasurements, MeasurementResult{Seq: entry.Seq, Index: i, Error: err.Error()})
+				continue
+			}
+			measurements = append(measurements, record.measurement())
+		}
+	}
+
+	if len(measurements) > 0 {
+		if err := a.measurementRepository.CreateMeasurements(ctx, measurements); err != nil {
+			return nil, fmt.Errorf("failed to write the replicated measurements: %w", err)
+		}
+	}
+	result.Measurements = len(measurements)
+	return result, nil
+}
+
+// applySensorChange creates the sensor when it doesn't exist yet, or else merges the change into
+// it. The changes breaking a unique index are rejected rather than failing the batch, as they'd
+// fail it again on every retry.
+func (a *Applier) applySensorChange(ctx context.Context, source string, change *SensorChange) (*SensorResult, error) {
+	result := &SensorResult{SensorID: change.SensorID.Hex(), Version: change.Version}
+	for attempt := 1; ; attempt++ {
+		existing, err := a.sensorsRepository.GetSensorByID(ctx, change.SensorID.Hex())
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			sensor := &repository.Sensor{ID: change.SensorID, ExternalID: change.ExternalID}
+			applyFields(sensor, change.State, sensorFields)
+			switch err = a.sensorsRepository.CreateSensor(ctx, sensor); {
+			case err == nil:
+				result.Status = SensorCreated
+				return result, nil
+			case mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "_id_") && attempt < maxSensorAttempts:
+				// Created concurrently, the change is merged into it by the next attempt
+				continue
+			case errors.Is(err, repository.ErrNameTaken) || mongo.IsDuplicateKeyError(err):
+				result.Status, result.Error = SensorRejected, err.Error()
+				return result, nil
+			default:
+				return nil, fmt.Errorf("failed to create the replicated sensor: %w", err)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the replicated sensor: %w", err)
+		}
+
+		revisions, err := a.sensorsRepository.GetSensorHistory(ctx, change.SensorID.Hex())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the history of the replicated sensor: %w", err)
+		}
+		merged, kept := mergeSensor(existing, revisions, change, Actor(source))
+		result.Kept = kept
+		if merged == nil {
+			result.Status = SensorUnchanged
+			return result, nil
+		}
+
+		err = a.sensorsRepository.UpdateSensor(ctx, change.SensorID.Hex(), merged, existing.Version)
+		if errors.Is(err, repository.ErrVersionConflict) && attempt < maxSensorAttempts {
+			continue
+		}
+		if errors.Is(err, repository.ErrNameTaken) {
+			result.Status, result.Error = SensorRejected, err.Error()
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update the replicated sensor: %w", err)
+		}
+		result.Status = SensorUpdated
+		return result, nil
+	}
+}
+
+// mergeSensor applies the fields the change made to the sensor, field by field, the last edit
+// winning: a field edited here at the time of the change or after it, by anyone but the source,
+// keeps its value here and is listed in kept. It returns a nil sensor when nothing changes.
+func mergeSensor(existing *repository.Sensor, revisions []*repository.SensorRevision, change *SensorChange, actor string) (_ *repository.Sensor, kept []string) {
+	applied := []string{}
+	for _, field := range change.Changed {
+		if editedSince(revisions, field, change, actor) {
+			kept = append(kept, field)
+			continue
+		}
+		applied = append(applied, field)
+	}
+
+	merged := *existing
+	applyFields(&merged, change.State, applied)
+	if len(repository.DiffSensorStates(repository.NewSensorState(existing), repository.NewSensorState(&merged))) == 0 {
+		return nil, kept
+	}
+	return &merged, kept
+}
+
+func editedSince(revisions []*repository.SensorRevision, field string, change *SensorChange, actor string) bool {
+	for _, revision := range revisions {
+		if revision.Actor != actor && !revision.Timestamp.Before(change.Timestamp) && slices.Contains(revision.Changed, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func applyFields(sensor *repository.Sensor, state repository.SensorState, fields []string) {
+	for _, field := range fields {
+		switch field {
+		case "name":
+			sensor.Name = state.Name
+		case "location":
+			sensor.Location = state.Location
+		case "tags":
+			sensor.Tags = state.Tags
+		case "description":
+			sensor.Description = state.Description
+		case "altitude":
+			sensor.Altitude = state.Altitude
+		case "labels":
+			sensor.Labels = state.Labels
+		case "hardware":
+			sensor.Hardware = state.Hardware
+		case "installed_at":
+			sensor.InstalledAt = state.InstalledAt
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	SensorCreated   = "created"
+	SensorUpdated   = "updated"
+	SensorUnchanged = "unchanged"
+	SensorRejected  = "rejected"
+)
+
+// Entry is a change accepted locally, numbered in the order it was recorded: either measurements
+// written or a revision of a sensor.
+type Entry struct {
+	Seq          uint64              `json:"seq"`
+	Measurements []MeasurementRecord `json:"measurements,omitempty"`
+	Sensor       *SensorChange       `json:"sensor,omitempty"`
+}
+
+type MeasurementRecord struct {
+	Name      string            `json:"name"`
+	SensorID  string            `json:"sensor_id"`
+	Unit      string            `json:"unit"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// SensorChange is a revision of a sensor: the fields it changed, when, and the state of the sensor
+// after it.
+type SensorChange struct {
+	SensorID   primitive.ObjectID     `json:"sensor_id"`
+	ExternalID string                 `json:"external_id,omitempty"`
+	Version    int                    `json:"version"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Changed    []string               `json:"changed"`
+	State      repository.SensorState `json:"state"`
+}
+
+// Batch is what a server sends upstream: the entries following its high-water mark, in order.
+type Batch struct {
+	Source  string  `json:"source"`
+	Entries []Entry `json:"entries"`
+}
+
+// SensorResult tells what became of a sensor change upstream. The fields edited upstream after the
+// change are kept, and listed in Kept; the changes breaking a unique name or external ID are
+// rejected.
+type SensorResult struct {
+	SensorID string   `json:"sensor_id"`
+	Version  int      `json:"version"`
+	Status   string   `json:"status"`
+	Kept     []string `json:"kept,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// MeasurementResult tells why a measurement of the batch was rejected upstream. The measurement
+// is the one at Index among the measurements of the entry Seq.
+type MeasurementResult struct {
+	Seq   uint64 `json:"seq"`
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+type BatchResult struct {
+	Measurements         int                 `json:"measurements"`
+	RejectedMeasurements []MeasurementResult `json:"rejected_measurements,omitempty"`
+	Sensors              []SensorResult      `json:"sensors"`
+}
+
+func newMeasurementRecords(measurements []*repository.Measurement) []MeasurementRecord {
+	records := make([]MeasurementRecord, 0, len(measurements))
+	for _, m := range measurements {
+		records = append(records, MeasurementRecord{Name: m.Name, SensorID: m.SensorID, Unit: m.Unit, Value: m.Value, Timestamp: m.Timestamp, Labels: m.Labels})
+	}
+	return records
+}
+
+// validate refuses the measurements the API would have refused, which would either fail the
+// whole batch on every retry or end up in the tags of their series.
+func (r MeasurementRecord) validate() error {
+	if _, err := primitive.ObjectIDFromHex(r.SensorID); err != nil {
+		return fmt.Errorf("invalid sensor_id %q", r.SensorID)
+	}
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if r.Unit == "" {
+		return errors.New("unit is required")
+	}
+	if err := repository.CheckTimestamp(r.Timestamp); err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+	return label.Validate(r.Labels)
+}
+
+func (r MeasurementRecord) measurement() *repository.Measurement {
+	return &repository.Measurement{
+		Name:      r.Name,
+		SensorID:  r.SensorID,
+		Unit:      r.Unit,
+		Value:     r.Value,
+		Timestamp: r.Timestamp,
+		Labels:    r.Labels,
+	}
+}
+
+// size is what the entry counts for in a batch, a measurement or a sensor change each counting
+// for one.
+func (e Entry) size() int {
+	if e.Sensor != nil {
+		return 1
+	}
+	return len(e.Measurements)
+}
@@ -0,0 +1,421 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	journalExt   = ".journal"
+	positionFile = "position"
+)
+
+var ErrJournalClosed = errors.New("the replication journal is closed")
+
+type journalSegment struct {
+	name  string
+	first uint64 // Number of its first entry
+	size  int64  // Bytes written and synced, which readers stop at
+}
+
+type JournalStats struct {
+	Position uint64 `json:"position"`
+	Head     uint64 `json:"head"`
+	Segments int    `json:"segments"`
+	Bytes    int64  `json:"bytes"`
+	Dropped  int64  `json:"dropped"`
+}
+
+// Journal is a directory of append-only segment files holding the changes accepted locally until
+// they're shipped upstream. The entries are numbered in the order they were appended and the
+// high-water mark, the number of the last entry acknowledged upstream, is kept in a file of its
+// own, so shipping resumes where it stopped after a restart. The segments whose entries were all
+// acknowledged are removed, and once the journal outgrows its maximum size the oldest segments are
+// dropped, so a long disconnection costs the oldest changes rather than the local writes.
+type Journal struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu         sync.Mutex
+	segments   []*journalSegment // Oldest first, the last one being the active one while it's open
+	active     *os.File
+	totalBytes int64
+	next       uint64 // Number of the next entry
+	position   uint64
+	dropped    int64
+	closed     bool
+}
+
+// OpenJournal picks up the segments and the high-water mark left in dir by a previous run.
+func OpenJournal(dir string, maxBytes, segmentBytes int64) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the replication directory: %w", err)
+	}
+	j := &Journal{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, positionFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Nothing was shipped yet
+	case err != nil:
+		return nil, fmt.Errorf("failed to read the replication position: %w", err)
+	default:
+		if j.position, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse the replication position: %w", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the replication directory: %w", err)
+	}
+	for _, entry := range entries {
+		first, ok := parseSegmentName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		size, err := terminateSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			// Created right before a crash, it holds nothing
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove empty journal segment: %w", err)
+			}
+			continue
+		}
+		j.segments = append(j.segments, &journalSegment{name: entry.Name(), first: first, size: size})
+		j.totalBytes += size
+	}
+	sort.Slice(j.segments, func(i, k int) bool { return j.segments[i].first < j.segments[k].first })
+
+	j.next = j.position + 1
+	if len(j.segments) > 0 {
+		last := *j.segments[len(j.segments)-1]
+		if last.first > j.next {
+			j.next = last.first
+		}
+		_, err := j.readSegment(last, func(entry *Entry) bool {
+			if entry.Seq >= j.next {
+				j.next = entry.Seq + 1
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return j, nil
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d%s", first, journalExt)
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, journalExt) {
+		return 0, false
+	}
+	first, err := strconv.ParseUint(strings.TrimSuffix(name, journalExt), 10, 64)
+	return first, err == nil
+}
+
+// terminateSegment ends the segment with a newline when a crash in the middle of an append left a
+// partial line behind, so the next entries start a line of their own. It returns the size of the
+// segment.
+func terminateSegment(path string) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open journal segment: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat journal segment: %w", err)
+	}
+	if info.Size() == 0 {
+		return 0, nil
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return 0, fmt.Errorf("failed to read journal segment: %w", err)
+	}
+	if last[0] == '\n' {
+		return info.Size(), nil
+	}
+	if _, err := file.Write([]byte{'\n'}); err != nil {
+		return 0, fmt.Errorf("failed to repair journal segment: %w", err)
+	}
+	return info.Size() + 1, file.Sync()
+}
+
+// Append numbers the entries, writes them to the active segment and syncs it to disk.
+func (j *Journal) Append(entries ...Entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return ErrJournalClosed
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var data []byte
+	for i := range entries {
+		entries[i].Seq = j.next + uint64(i)
+		line, err := json.Marshal(entries[i])
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	if j.active == nil {
+		name := segmentName(j.next)
+		active, err := os.OpenFile(filepath.Join(j.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to create journal segment: %w", err)
+		}
+		j.active = active
+		j.segments = append(j.segments, &journalSegment{name: name, first: j.next})
+	}
+	seg := j.segments[len(j.segments)-1]
+
+	if _, err := j.active.Write(data); err != nil {
+		// Whatever made it to the file is cut, so a retry doesn't leave a partial line before it
+		if truncErr := j.active.Truncate(seg.size); truncErr != nil {
+			log.Error().Err(truncErr).Str("segment", seg.name).Msg("failed to truncate journal segment")
+		}
+		return fmt.Errorf("failed to write to journal segment: %w", err)
+	}
+	if err := j.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal segment: %w", err)
+	}
+	j.next += uint64(len(entries))
+	seg.size += int64(len(data))
+	j.totalBytes += int64(len(data))
+
+	if seg.size >= j.segmentBytes {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	j.dropOldest()
+	return nil
+}
+
+// rotate closes the active segment, the next append starting a new one.
+func (j *Journal) rotate() error {
+	if j.active == nil {
+		return nil
+	}
+	err := j.active.Close()
+	j.active = nil
+	return err
+}
+
+// lastSeq is the number of the last entry of the segment at the index.
+func (j *Journal) lastSeq(i int) uint64 {
+	if i+1 < len(j.segments) {
+		return j.segments[i+1].first - 1
+	}
+	return j.next - 1
+}
+
+// dropOldest drops the oldest segments until the journal fits its maximum size, moving the
+// high-water mark past the entries dropped. The active segment is always kept. The sensor changes
+// dropped along with the measurements are made up for by the replicator, which records the
+// sensors again once it sees entries were dropped.
+func (j *Journal) dropOldest() {
+	for j.totalBytes > j.maxBytes && len(j.segments) > 1 {
+		seg, last := j.segments[0], j.lastSeq(0)
+		if err := os.Remove(filepath.Join(j.dir, seg.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error().Err(err).Str("segment", seg.name).Msg("failed to drop journal segment")
+			return
+		}
+		j.segments = j.segments[1:]
+		j.totalBytes -= seg.size
+
+		if last > j.position {
+			dropped := last - max(j.position, seg.first-1)
+			j.dropped += int64(dropped)
+			log.Warn().Uint64("entries", dropped).Str("segment", seg.name).Msg("replication journal full, dropped its oldest entries")
+			j.position = last
+			if err := j.savePosition(last); err != nil {
+				log.Error().Err(err).Msg("failed to save the replication position")
+			}
+		}
+	}
+}
+
+// Read returns the entries following the high-water mark, in order, up to limit measurements and
+// sensor changes, but at least one entry.
+func (j *Journal) Read(limit int) ([]Entry, error) {
+	// The sizes are taken at once, so the appends made while reading are left out rather than
+	// read halfway
+	j.mu.Lock()
+	position := j.position
+	type pending struct {
+		seg  journalSegment
+		last uint64
+	}
+	segments := []pending{}
+	for i, seg := range j.segments {
+		if last := j.lastSeq(i); last > position {
+			segments = append(segments, pending{seg: *seg, last: last})
+		}
+	}
+	j.mu.Unlock()
+
+	entries := []Entry{}
+	count := 0
+	for _, p := range segments {
+		complete, err := j.readSegment(p.seg, func(entry *Entry) bool {
+			if entry.Seq <= position {
+				return true
+			}
+			if count > 0 && count+entry.size() > limit {
+				return false
+			}
+			entries = append(entries, *entry)
+			count += entry.size()
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// readSegment passes the entries of the segment to fn until it returns false, telling whether
+// the whole segment was read. A segment dropped in the meantime reads as empty.
+func (j *Journal) readSegment(seg journalSegment, fn func(*Entry) bool) (bool, error) {
+	file, err := os.Open(filepath.Join(j.dir, seg.name))
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open journal segment: %w", err)
+	}
+	defer file.Close()
+
+	// Lines of large batches don't fit the buffer of a bufio.Scanner
+	reader := bufio.NewReader(io.LimitReader(file, seg.size))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry Entry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				log.Warn().Err(err).Str("segment", seg.name).Msg("skipping corrupted journal entry")
+			} else if !fn(&entry) {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read journal segment: %w", err)
+		}
+	}
+}
+
+// Acknowledge moves the high-water mark to the entry, once it was applied upstream along with
+// everything before it, and removes the segments left with nothing to ship.
+func (j *Journal) Acknowledge(seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if seq <= j.position {
+		return nil
+	}
+	if err := j.savePosition(seq); err != nil {
+		return err
+	}
+	j.position = seq
+
+	for len(j.segments) > 0 && j.lastSeq(0) <= seq {
+		seg := j.segments[0]
+		if len(j.segments) == 1 && j.active != nil {
+			// Shipped as soon as written, the active segment is left to fill up
+			break
+		}
+		if err := os.Remove(filepath.Join(j.dir, seg.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove shipped journal segment: %w", err)
+		}
+		j.segments = j.segments[1:]
+		j.totalBytes -= seg.size
+	}
+	return nil
+}
+
+// savePosition replaces the position file with a new one, so a crash leaves either of them. The
+// caller holds the mutex.
+func (j *Journal) savePosition(seq uint64) error {
+	path := filepath.Join(j.dir, positionFile)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save the replication position: %w", err)
+	}
+	if _, err := file.WriteString(strconv.FormatUint(seq, 10) + "\n"); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to save the replication position: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to save the replication position: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to save the replication position: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save the replication position: %w", err)
+	}
+	return nil
+}
+
+func (j *Journal) Stats() JournalStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JournalStats{
+		Position: j.position,
+		Head:     j.next - 1,
+		Segments: len(j.segments),
+		Bytes:    j.totalBytes,
+		Dropped:  j.dropped,
+	}
+}
+
+// Close closes the active segment. Whatever wasn't shipped is shipped by the next run.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.closed = true
+	return j.rotate()
+}
@@ -0,0 +1,40 @@
+package replication
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	pendingDesc         = prometheus.NewDesc("replication_pending_entries", "Entries of the journal not shipped upstream yet.", nil, nil)
+	journalSegmentsDesc = prometheus.NewDesc("replication_journal_segments", "Segments of the journal on disk.", nil, nil)
+	journalBytesDesc    = prometheus.NewDesc("replication_journal_bytes", "Size of the journal on disk.", nil, nil)
+	entriesDesc         = prometheus.NewDesc("replication_entries_total", "Entries of the journal by what happened to them.", []string{"outcome"}, nil)
+	failuresDesc        = prometheus.NewDesc("replication_failures_total", "Batches that failed to ship.", nil, nil)
+)
+
+// statsCollector exposes the stats of a replicator, read when the metrics are scraped.
+type statsCollector struct {
+	replicator *Replicator
+}
+
+// Collector returns a Prometheus collector of the replication stats.
+func (r *Replicator) Collector() prometheus.Collector {
+	return statsCollector{replicator: r}
+}
+
+func (c statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingDesc
+	ch <- journalSegmentsDesc
+	ch <- journalBytesDesc
+	ch <- entriesDesc
+	ch <- failuresDesc
+}
+
+func (c statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.replicator.Stats()
+
+	ch <- prometheus.MustNewConstMetric(pendingDesc, prometheus.GaugeValue, float64(stats.Pending))
+	ch <- prometheus.MustNewConstMetric(journalSegmentsDesc, prometheus.GaugeValue, float64(stats.Segments))
+	ch <- prometheus.MustNewConstMetric(journalBytesDesc, prometheus.GaugeValue, float64(stats.Bytes))
+	ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.CounterValue, float64(stats.Shipped), "shipped")
+	ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.CounterValue, float64(stats.Dropped), "dropped")
+	ch <- prometheus.MustNewConstMetric(failuresDesc, prometheus.CounterValue, float64(stats.Failures))
+}
@@ -0,0 +1,148 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+// recordedSensors records the revisions of the sensors written through it in the journal.
+type recordedSensors struct {
+	repository.SensorsRepository
+	journal *Journal
+}
+
+func (s *recordedSensors) CreateSensor(ctx context.Context, sensor *repository.Sensor) error {
+	if err := s.SensorsRepository.CreateSensor(ctx, sensor); err != nil {
+		return err
+	}
+	return s.record(ctx, sensor)
+}
+
+func (s *recordedSensors) RegisterSensor(ctx context.Context, sensor *repository.Sensor) (bool, error) {
+	created, err := s.SensorsRepository.RegisterSensor(ctx, sensor)
+	if err != nil || !created {
+		return created, err
+	}
+	return created, s.record(ctx, sensor)
+}
+
+func (s *recordedSensors) UpdateSensor(ctx context.Context, id string, sensor *repository.Sensor, expectedVersion int) error {
+	if err := s.SensorsRepository.UpdateSensor(ctx, id, sensor, expectedVersion); err != nil {
+		return err
+	}
+	// The sensor passed in doesn't carry the external ID
+	updated, err := s.SensorsRepository.GetSensorByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("sensor updated but failed to record it for replication: %w", err)
+	}
+	return s.record(ctx, updated)
+}
+
+func (s *recordedSensors) AddSensorTag(ctx context.Context, id, tag string, expectedVersion int) (*repository.Sensor, error) {
+	sensor, err := s.SensorsRepository.AddSensorTag(ctx, id, tag, expectedVersion)
+	if err != nil {
+		return sensor, err
+	}
+	return sensor, s.record(ctx, sensor)
+}
+
+func (s *recordedSensors) RemoveSensorTag(ctx context.Context, id, tag string, expectedVersion int) (*repository.Sensor, error) {
+	sensor, err := s.SensorsRepository.RemoveSensorTag(ctx, id, tag, expectedVersion)
+	if err != nil {
+		return sensor, err
+	}
+	return sensor, s.record(ctx, sensor)
+}
+
+func (s *recordedSensors) MoveSensor(ctx context.Context, id string, fix *repository.SensorFix) (*repository.Sensor, error) {
+	before, err := s.SensorsRepository.MoveSensor(ctx, id, fix)
+	if err != nil || before == nil {
+		return before, err
+	}
+	moved, err := s.SensorsRepository.GetSensorByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("sensor moved but failed to record it for replication: %w", err)
+	}
+	// Fixes at the same location only update the last fix, which isn't replicated
+	if moved.Version == before.Version {
+		return before, nil
+	}
+	return before, s.record(ctx, moved)
+}
+
+// record appends the revision that brought the sensor to its current version. Recording a
+// revision twice is harmless, upstream applies it once.
+func (s *recordedSensors) record(ctx context.Context, sensor *repository.Sensor) error {
+	revisions, err := s.SensorsRepository.GetSensorHistory(ctx, sensor.ID.Hex())
+	if err != nil {
+		return fmt.Errorf("sensor saved but failed to record it for replication: %w", err)
+	}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if revisions[i].Version != sensor.Version {
+			continue
+		}
+		if err := s.journal.Append(Entry{Sensor: newSensorChange(sensor, revisions[i])}); err != nil {
+			return fmt.Errorf("sensor saved but failed to record it for replication: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("sensor saved but its revision %d wasn't found to record it for replication", sensor.Version)
+}
+
+func newSensorChange(sensor *repository.Sensor, revision *repository.SensorRevision) *SensorChange {
+	return &SensorChange{
+		SensorID:   sensor.ID,
+		ExternalID: sensor.ExternalID,
+		Version:    revision.Version,
+		Timestamp:  revision.Timestamp,
+		Changed:    revision.Changed,
+		State:      revision.After,
+	}
+}
+
+// recordedMeasurements records the measurements written through it in the journal, before they're
+// written: a server stopping in between would otherwise leave them out of the journal for good.
+// When the write fails they're recorded again along with the retry, points written twice
+// replacing each other upstream.
+type recordedMeasurements struct {
+	repository.MeasurementRepository
+	journal *Journal
+}
+
+func (m *recordedMeasurements) CreateMeasurement(ctx context.Context, measurement *repository.Measurement) error {
+	// Stamped here rather than by the repository, so the journal has the same time
+	measurement.Timestamp = time.Now()
+	if err := m.record([]*repository.Measurement{measurement}); err != nil {
+		return err
+	}
+	return m.MeasurementRepository.CreateMeasurements(ctx, []*repository.Measurement{measurement})
+}
+
+func (m *recordedMeasurements) CreateMeasurements(ctx context.Context, measurements []*repository.Measurement) error {
+	if err := m.record(measurements); err != nil {
+		return err
+	}
+	return m.MeasurementRepository.CreateMeasurements(ctx, measurements)
+}
+
+// record fails the write when the measurements can't be recorded, so the ingest pipeline spools
+// them and writes them again later.
+func (m *recordedMeasurements) record(measurements []*repository.Measurement) error {
+	if len(measurements) == 0 {
+		return nil
+	}
+	if err := m.journal.Append(Entry{Measurements: newMeasurementRecords(measurements)}); err != nil {
+		return fmt.Errorf("failed to record the measurements for replication: %w", err)
+	}
+	return nil
+}
+
+// recordedRollupMeasurements keeps the rollups of the backends writing their own, which the
+// roller finds by asserting the repository is a RollupWriter.
+type recordedRollupMeasurements struct {
+	*recordedMeasurements
+	repository.RollupWriter
+}
@@ -0,0 +1,156 @@
+package replication
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+func measurementEntry(value float64) Entry {
+	return Entry{Measurements: []MeasurementRecord{{
+		Name:      "temperature",
+		SensorID:  "sensor",
+		Unit:      "celsius",
+		Value:     value,
+		Timestamp: time.Unix(int64(value), 0).UTC(),
+	}}}
+}
+
+func TestJournal(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when entries are acknowledged, it should read from the high-water mark on after reopening", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		dir := t.TempDir()
+		journal, err := OpenJournal(dir, 1<<20, 256)
+		is.Nil(err)
+		for i := 1; i <= 10; i++ {
+			is.Nil(journal.Append(measurementEntry(float64(i))))
+		}
+
+		entries, err := journal.Read(4)
+		is.Nil(err)
+		is.Len(entries, 4)
+		is.Equal(uint64(1), entries[0].Seq)
+		is.Nil(journal.Acknowledge(entries[3].Seq))
+		is.Nil(journal.Close())
+
+		journal, err = OpenJournal(dir, 1<<20, 256)
+		is.Nil(err)
+		defer journal.Close()
+		entries, err = journal.Read(100)
+		is.Nil(err)
+		is.Len(entries, 6)
+		is.Equal(uint64(5), entries[0].Seq)
+		is.Equal(5.0, entries[0].Measurements[0].Value)
+
+		// Numbering goes on where it stopped
+		is.Nil(journal.Append(measurementEntry(11)))
+		stats := journal.Stats()
+		is.Equal(uint64(4), stats.Position)
+		is.Equal(uint64(11), stats.Head)
+	})
+
+	t.Run("when the journal outgrows its maximum size, it should drop the oldest segments", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		journal, err := OpenJournal(t.TempDir(), 1024, 256)
+		is.Nil(err)
+		defer journal.Close()
+		for i := 1; i <= 50; i++ {
+			is.Nil(journal.Append(measurementEntry(float64(i))))
+		}
+
+		stats := journal.Stats()
+		is.LessOrEqual(stats.Bytes, int64(1024))
+		is.Positive(stats.Dropped)
+		entries, err := journal.Read(100)
+		is.Nil(err)
+		is.Equal(stats.Position+1, entries[0].Seq)
+		is.Equal(uint64(50), entries[len(entries)-1].Seq)
+	})
+
+	t.Run("when a segment ends with a partial line, it should skip it after reopening", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		dir := t.TempDir()
+		journal, err := OpenJournal(dir, 1<<20, 1<<20)
+		is.Nil(err)
+		is.Nil(journal.Append(measurementEntry(1), measurementEntry(2)))
+		is.Nil(journal.Close())
+
+		segment, err := os.OpenFile(filepath.Join(dir, segmentName(1)), os.O_APPEND|os.O_WRONLY, 0o644)
+		is.Nil(err)
+		_, err = segment.WriteString(`{"seq":3,"measurements":[{"na`)
+		is.Nil(err)
+		is.Nil(segment.Close())
+
+		journal, err = OpenJournal(dir, 1<<20, 1<<20)
+		is.Nil(err)
+		defer journal.Close()
+		is.Nil(journal.Append(measurementEntry(3)))
+		entries, err := journal.Read(100)
+		is.Nil(err)
+		is.Len(entries, 3)
+		is.Equal(uint64(3), entries[2].Seq)
+		is.Equal(3.0, entries[2].Measurements[0].Value)
+	})
+}
+
+func TestMergeSensor(t *testing.T) {
+	t.Parallel()
+
+	changedAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	existing := &repository.Sensor{Name: "upstream", Tags: []string{"a"}, Version: 3}
+	change := &SensorChange{
+		Timestamp: changedAt,
+		Changed:   []string{"name", "tags"},
+		State:     repository.SensorState{Name: "edge", Tags: []string{"a", "b"}},
+	}
+
+	t.Run("when a field was edited upstream after the change, it should keep the upstream value", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		revisions := []*repository.SensorRevision{
+			{Version: 2, Actor: "operator", Timestamp: changedAt.Add(-time.Minute), Changed: []string{"tags"}},
+			{Version: 3, Actor: "operator", Timestamp: changedAt.Add(time.Minute), Changed: []string{"name"}},
+		}
+		merged, kept := mergeSensor(existing, revisions, change, Actor("edge"))
+		is.NotNil(merged)
+		is.Equal([]string{"name"}, kept)
+		is.Equal("upstream", merged.Name)
+		is.Equal([]string{"a", "b"}, merged.Tags)
+	})
+
+	t.Run("when the later edits upstream came from the source, it should apply the change", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		revisions := []*repository.SensorRevision{
+			{Version: 3, Actor: Actor("edge"), Timestamp: changedAt.Add(time.Minute), Changed: []string{"name"}},
+		}
+		merged, kept := mergeSensor(existing, revisions, change, Actor("edge"))
+		is.NotNil(merged)
+		is.Empty(kept)
+		is.Equal("edge", merged.Name)
+	})
+
+	t.Run("when the change was already applied, it should change nothing", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		applied := &repository.Sensor{Name: "edge", Tags: []string{"a", "b"}, Version: 4}
+		merged, kept := mergeSensor(applied, nil, change, Actor("edge"))
+		is.Nil(merged)
+		is.Empty(kept)
+	})
+}
@@ -0,0 +1,283 @@
+package replication
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+// BatchesPath is where the servers replicating to this one send their batches.
+const BatchesPath = "/replication/batches"
+
+type Stats struct {
+	Enabled  bool   `json:"enabled"`
+	Upstream string `json:"upstream,omitempty"`
+	Source   string `json:"source,omitempty"`
+	JournalStats
+	Pending       uint64     `json:"pending"`
+	Shipped       int64      `json:"shipped"`
+	Failures      int64      `json:"failures"`
+	LastShippedAt *time.Time `json:"last_shipped_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// Replicator ships the sensor changes and the measurements accepted locally to the upstream
+// server, in compressed batches of the entries of the journal following its high-water mark.
+// While upstream can't be reached the entries pile up in the journal, and shipping is retried
+// with a backoff doubling from the interval up to the maximum backoff.
+type Replicator struct {
+	enabled    bool
+	journal    *Journal
+	client     *resty.Client
+	upstream   string
+	source     string
+	batchSize  int
+	interval   time.Duration
+	maxBackoff time.Duration
+	sensors    *recordedSensors
+
+	shipped       atomic.Int64
+	failures      atomic.Int64
+	lastShippedAt atomic.Int64
+	mu            sync.Mutex
+	lastError     string
+}
+
+// NewReplicator returns a replicator that is only enabled when there's an upstream server, the
+// journal being opened then.
+func NewReplicator(envVars *config.EnvVars) (*Replicator, error) {
+	r := &Replicator{
+		enabled:    envVars.Replication.UpstreamURL != "",
+		upstream:   envVars.Replication.UpstreamURL,
+		source:     envVars.Replication.Source,
+		batchSize:  envVars.Replication.BatchSize,
+		interval:   envVars.Replication.Interval,
+		maxBackoff: envVars.Replication.MaxBackoff,
+	}
+	if !r.enabled {
+		return r, nil
+	}
+
+	if r.source == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to name the replication source, set REPLICATION__SOURCE: %w", err)
+		}
+		r.source = hostname
+	}
+
+	journal, err := OpenJournal(envVars.Replication.Dir, envVars.Replication.MaxBytes, envVars.Replication.SegmentBytes)
+	if err != nil {
+		return nil, err
+	}
+	r.journal = journal
+	r.client = resty.New().
+		SetBaseURL(envVars.Replication.UpstreamURL).
+		SetAuthToken(envVars.Replication.Token).
+		SetTimeout(envVars.Replication.Timeout)
+	return r, nil
+}
+
+func (r *Replicator) Enabled() bool {
+	return r.enabled
+}
+
+// RecordSensors returns the repository recording the sensor revisions for replication, or the
+// repository itself when replication is disabled.
+func (r *Replicator) RecordSensors(sensorsRepository repository.SensorsRepository) repository.SensorsRepository {
+	if !r.enabled {
+		return sensorsRepository
+	}
+	r.sensors = &recordedSensors{SensorsRepository: sensorsRepository, journal: r.journal}
+	return r.sensors
+}
+
+// RecordMeasurements returns the repository recording the measurements for replication, or the
+// repository itself when replication is disabled.
+func (r *Replicator) RecordMeasurements(measurementRepository repository.MeasurementRepository) repository.MeasurementRepository {
+	if !r.enabled {
+		return measurementRepository
+	}
+	recorded := &recordedMeasurements{MeasurementRepository: measurementRepository, journal: r.journal}
+	if rollupWriter, ok := measurementRepository.(repository.RollupWriter); ok {
+		return &recordedRollupMeasurements{recordedMeasurements: recorded, RollupWriter: rollupWriter}
+	}
+	return recorded
+}
+
+// Run ships the journal until the context is cancelled. It first records the sensors as they
+// are, and again whenever the journal drops entries, see resync.
+func (r *Replicator) Run(ctx context.Context) error {
+	resynced := int64(-1)
+	backoff := r.interval
+	for {
+		var shipped int
+		dropped := r.journal.Stats().Dropped
+		err := r.resync(ctx, dropped != resynced)
+		if err == nil {
+			resynced = dropped
+			shipped, err = r.ShipOnce(ctx)
+		}
+
+		wait := r.interval
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return nil
+		case err != nil:
+			log.Warn().Err(err).Dur("retry_in", backoff).Msg("failed to ship the replication journal")
+			wait = backoff
+			backoff = min(backoff*2, r.maxBackoff)
+		case shipped > 0:
+			// Catching up, the next batch is shipped right away
+			wait = 0
+			backoff = r.interval
+		default:
+			backoff = r.interval
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// resync records the latest revision of every sensor, when needed. A sensor change can go
+// missing from the journal, either because it was dropped along with the oldest entries or
+// because the server stopped between saving the sensor and recording it, and what's recorded
+// after it in the journal only carries what changed. Recording the sensors as they are makes up
+// for it, upstream leaving the sensors that are already up to date unchanged.
+func (r *Replicator) resync(ctx context.Context, needed bool) error {
+	if !needed || r.sensors == nil {
+		return nil
+	}
+	sensors, err := r.sensors.GetSensors(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get the sensors to replicate: %w", err)
+	}
+	for _, sensor := range sensors {
+		if err := r.sensors.record(ctx, sensor); err != nil {
+			return err
+		}
+	}
+	log.Info().Int("sensors", len(sensors)).Msg("recorded the sensors for replication")
+	return nil
+}
+
+// ShipOnce sends the next batch upstream and moves the high-water mark past it once upstream
+// applied it. It returns the number of entries shipped, 0 when there was nothing to ship.
+func (r *Replicator) ShipOnce(ctx context.Context) (int, error) {
+	entries, err := r.journal.Read(r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	result, err := r.send(ctx, &Batch{Source: r.source, Entries: entries})
+	if err != nil {
+		r.failures.Add(1)
+		r.setLastError(err.Error())
+		return 0, err
+	}
+	for _, measurement := range result.RejectedMeasurements {
+		log.Warn().Uint64("seq", measurement.Seq).Int("index", measurement.Index).Str("error", measurement.Error).Msg("measurement rejected upstream")
+	}
+	for _, sensor := range result.Sensors {
+		switch {
+		case sensor.Status == SensorRejected:
+			log.Warn().Str("sensor_id", sensor.SensorID).Int("version", sensor.Version).Str("error", sensor.Error).Msg("sensor change rejected upstream")
+		case len(sensor.Kept) > 0:
+			log.Info().Str("sensor_id", sensor.SensorID).Int("version", sensor.Version).Strs("kept", sensor.Kept).Msg("sensor fields edited upstream since were kept there")
+		}
+	}
+
+	if err := r.journal.Acknowledge(entries[len(entries)-1].Seq); err != nil {
+		return 0, err
+	}
+	r.shipped.Add(int64(len(entries)))
+	r.lastShippedAt.Store(time.Now().UnixNano())
+	r.setLastError("")
+	return len(entries), nil
+}
+
+func (r *Replicator) send(ctx context.Context, batch *Batch) (*BatchResult, error) {
+	var body bytes.Buffer
+	writer := gzip.NewWriter(&body)
+	if err := json.NewEncoder(writer).Encode(batch); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var result BatchResult
+	resp, err := r.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Content-Encoding", "gzip").
+		SetBody(body.Bytes()).
+		SetResult(&result).
+		Post(BatchesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send the replication batch: %w", err)
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("upstream refused the replication batch with %s: %s", resp.Status(), bytes.TrimSpace(resp.Body()))
+	}
+	return &result, nil
+}
+
+func (r *Replicator) setLastError(lastError string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastError = lastError
+}
+
+func (r *Replicator) Stats() Stats {
+	if !r.enabled {
+		return Stats{}
+	}
+
+	journalStats := r.journal.Stats()
+	stats := Stats{
+		Enabled:      true,
+		Upstream:     r.upstream,
+		Source:       r.source,
+		JournalStats: journalStats,
+		Shipped:      r.shipped.Load(),
+		Failures:     r.failures.Load(),
+	}
+	if journalStats.Head > journalStats.Position {
+		stats.Pending = journalStats.Head - journalStats.Position
+	}
+	if lastShippedAt := r.lastShippedAt.Load(); lastShippedAt != 0 {
+		t := time.Unix(0, lastShippedAt)
+		stats.LastShippedAt = &t
+	}
+	r.mu.Lock()
+	stats.LastError = r.lastError
+	r.mu.Unlock()
+	return stats
+}
+
+// Close closes the journal, once nothing writes to the repositories anymore.
+func (r *Replicator) Close() error {
+	if !r.enabled {
+		return nil
+	}
+	return r.journal.Close()
+}
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Anomaly struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	SensorID    string             `bson:"sensor_id" json:"sensor_id"`
+	Measurement string             `bson:"measurement" json:"measurement"`
+	Unit        string             `bson:"unit" json:"unit"`
+	Method      string             `bson:"method" json:"method"`
+	Timestamp   time.Time          `bson:"timestamp" json:"timestamp"`
+	Value       float64            `bson:"value" json:"value"`
+	Expected    float64            `bson:"expected" json:"expected"`
+	Lower       float64            `bson:"lower" json:"lower"`
+	Upper       float64            `bson:"upper" json:"upper"`
+	Score       float64            `bson:"score" json:"score"`
+	DetectedAt  time.Time          `bson:"detected_at" json:"detected_at"`
+}
+
+type AnomaliesRepository interface {
+	// SaveAnomalies upserts the anomalies so detecting over the same range more than once doesn't
+	// produce duplicates.
+	SaveAnomalies(ctx context.Context, anomalies []*Anomaly) error
+	// GetAnomalies returns the anomalies of a sensor within the time range, oldest first,
+	// optionally narrowed down to a measurement and unit when they're not empty.
+	GetAnomalies(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) ([]*Anomaly, error)
+}
+
+type MongoAnomaliesRepository struct {
+	anomaliesColl *mongo.Collection
+}
+
+func NewMongoAnomaliesRepository(envVars *config.EnvVars, mongoClient *mongo.Client) (AnomaliesRepository, error) {
+	anomaliesColl := mongoClient.Database(envVars.MongoDB.Database).Collection("anomalies")
+	_, err := anomaliesColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "sensor_id", Value: 1},
+			{Key: "measurement", Value: 1},
+			{Key: "unit", Value: 1},
+			{Key: "timestamp", Value: 1},
+			{Key: "method", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoAnomaliesRepository{
+		anomaliesColl: anomaliesColl,
+	}, nil
+}
+
+// SaveAnomalies upserts the anomalies so detecting over the same range more than once doesn't
+// produce duplicates.
+func (a *MongoAnomaliesRepository) SaveAnomalies(ctx context.Context, anomalies []*Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{
+				"sensor_id":   anomaly.SensorID,
+				"measurement": anomaly.Measurement,
+				"unit":        anomaly.Unit,
+				"timestamp":   anomaly.Timestamp,
+				"method":      anomaly.Method,
+			}).
+			SetReplacement(anomaly).
+			SetUpsert(true))
+	}
+
+	_, err := a.anomaliesColl.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// GetAnomalies returns the anomalies of a sensor within the time range, optionally narrowed down
+// to a measurement and unit when they're not empty.
+func (a *MongoAnomaliesRepository) GetAnomalies(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) ([]*Anomaly, error) {
+	filter := bson.M{
+		"sensor_id": sensorID,
+		"timestamp": bson.M{
+			"$gte": start,
+			"$lt":  end,
+		},
+	}
+	if measurement != "" {
+		filter["measurement"] = measurement
+	}
+	if unit != "" {
+		filter["unit"] = unit
+	}
+
+	cursor, err := a.anomaliesColl.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	anomalies := []*Anomaly{}
+	if err := cursor.All(ctx, &anomalies); err != nil {
+		return nil, err
+	}
+	return anomalies, nil
+}
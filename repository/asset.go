@@ -0,0 +1,314 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AssetKind string
+
+const (
+	AssetKindSite     AssetKind = "site"
+	AssetKindBuilding AssetKind = "building"
+	AssetKindRoom     AssetKind = "room"
+)
+
+// AssetKinds are the levels of the hierarchy, from the top. Each asset is a child of an asset of
+// the level above, sites being the roots.
+var AssetKinds = []AssetKind{AssetKindSite, AssetKindBuilding, AssetKindRoom}
+
+var (
+	ErrInvalidAssetParent = errors.New("the asset can't be a child of the parent")
+	ErrAssetNameTaken     = errors.New("another asset of the parent already has this name")
+	ErrAssetNotEmpty      = errors.New("the asset still has assets or sensors under it")
+)
+
+// Asset is a node of the site, building and room hierarchy sensors are attached to.
+type Asset struct {
+	ID          primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
+	ParentID    *primitive.ObjectID  `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	Ancestors   []primitive.ObjectID `bson:"ancestors" json:"ancestors"` // From the root down to the parent
+	Kind        AssetKind            `bson:"kind" json:"kind"`
+	Name        string               `bson:"name" json:"name"`
+	Description string               `bson:"description,omitempty" json:"description,omitempty"`
+}
+
+// AssetsRepository also attaches sensors to the assets, through the asset_id of the sensors.
+type AssetsRepository interface {
+	// CreateAsset creates the asset under its parent, returning ErrInvalidAssetParent when the
+	// parent doesn't exist or isn't of the level right above the asset.
+	CreateAsset(ctx context.Context, asset *Asset) error
+	// GetAsset returns nil when there's no asset with the ID.
+	GetAsset(ctx context.Context, id string) (*Asset, error)
+	// GetAssets returns the children of the asset sorted by name, or the sites when parentID is
+	// empty.
+	GetAssets(ctx context.Context, parentID string) ([]*Asset, error)
+	// GetSubtreeIDs returns the ID of the asset along with the IDs of every asset under it.
+	GetSubtreeIDs(ctx context.Context, asset *Asset) ([]primitive.ObjectID, error)
+	// UpdateAsset renames the asset and replaces its description.
+	UpdateAsset(ctx context.Context, id string, asset *Asset) error
+	// DeleteAsset deletes the asset and reports whether it existed, returning ErrAssetNotEmpty for
+	// the assets with children or sensors.
+	DeleteAsset(ctx context.Context, id string) (bool, error)
+	// AttachSensor attaches the sensor to the asset and reports whether the sensor exists.
+	AttachSensor(ctx context.Context, asset *Asset, sensorID string) (bool, error)
+	// DetachSensor detaches the sensor from the asset and reports whether it was attached to it.
+	DetachSensor(ctx context.Context, asset *Asset, sensorID string) (bool, error)
+	// GetAssetSensors returns the sensors attached to the asset or to any asset under it, sorted
+	// by name.
+	GetAssetSensors(ctx context.Context, asset *Asset) ([]*Sensor, error)
+}
+
+type MongoAssetsRepository struct {
+	assetsColl  *mongo.Collection
+	sensorsColl *mongo.Collection
+	// sensorsRepository attaches the sensors, so the attachments are versioned and recorded in
+	// the history of the sensors as their other changes
+	sensorsRepository SensorsRepository
+}
+
+func NewMongoAssetsRepository(envVars *config.EnvVars, mongoClient *mongo.Client, sensorsRepository SensorsRepository) (AssetsRepository, error) {
+	assetsColl := mongoClient.Database(envVars.MongoDB.Database).Collection("assets")
+	_, err := assetsColl.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			// Sites have no parent, so the index also keeps site names unique
+			Keys:    bson.D{{Key: "parent_id", Value: 1}, {Key: "name", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "ancestors", Value: 1}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sensorsColl := mongoClient.Database(envVars.MongoDB.Database).Collection("sensors")
+	_, err = sensorsColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "asset_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoAssetsRepository{
+		assetsColl:        assetsColl,
+		sensorsColl:       sensorsColl,
+		sensorsRepository: sensorsRepository,
+	}, nil
+}
+
+// childKind returns the kind of the children of an asset of the kind, or false for the lowest
+// level.
+func childKind(kind AssetKind) (AssetKind, bool) {
+	i := slices.Index(AssetKinds, kind)
+	if i < 0 || i == len(AssetKinds)-1 {
+		return "", false
+	}
+	return AssetKinds[i+1], true
+}
+
+// CreateAsset creates the asset under its parent, returning ErrInvalidAssetParent when the parent
+// doesn't exist or isn't of the level right above the asset.
+func (a *MongoAssetsRepository) CreateAsset(ctx context.Context, asset *Asset) error {
+	asset.Ancestors = []primitive.ObjectID{}
+	if asset.ParentID == nil {
+		if asset.Kind != AssetKinds[0] {
+			return ErrInvalidAssetParent
+		}
+	} else {
+		parent, err := a.GetAsset(ctx, asset.ParentID.Hex())
+		if err != nil {
+			return err
+		}
+		if parent == nil {
+			return ErrInvalidAssetParent
+		}
+		if kind, ok := childKind(parent.Kind); !ok || kind != asset.Kind {
+			return ErrInvalidAssetParent
+		}
+		asset.Ancestors = append(slices.Clone(parent.Ancestors), parent.ID)
+	}
+
+	result, err := a.assetsColl.InsertOne(ctx, asset)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAssetNameTaken
+	}
+	if err != nil {
+		return err
+	}
+	asset.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetAsset returns nil when there's no asset with the ID.
+func (a *MongoAssetsRepository) GetAsset(ctx context.Context, id string) (*Asset, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var asset Asset
+	if err := a.assetsColl.FindOne(ctx, bson.M{"_id": objectID}).Decode(&asset); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &asset, nil
+}
+
+// GetAssets returns the children of the asset sorted by name, or the sites when parentID is
+// empty.
+func (a *MongoAssetsRepository) GetAssets(ctx context.Context, parentID string) ([]*Asset, error) {
+	filter := bson.M{"parent_id": bson.M{"$exists": false}}
+	if parentID != "" {
+		objectID, err := primitive.ObjectIDFromHex(parentID)
+		if err != nil {
+			return nil, err
+		}
+		filter = bson.M{"parent_id": objectID}
+	}
+
+	cursor, err := a.assetsColl.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	assets := []*Asset{}
+	if err := cursor.All(ctx, &assets); err != nil {
+		return nil, err
+	}
+	return assets, nil
+}
+
+// GetSubtreeIDs returns the ID of the asset along with the IDs of every asset under it.
+func (a *MongoAssetsRepository) GetSubtreeIDs(ctx context.Context, asset *Asset) ([]primitive.ObjectID, error) {
+	cursor, err := a.assetsColl.Find(ctx, bson.M{"ancestors": asset.ID}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var descendants []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &descendants); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(descendants)+1)
+	ids = append(ids, asset.ID)
+	for _, descendant := range descendants {
+		ids = append(ids, descendant.ID)
+	}
+	return ids, nil
+}
+
+// UpdateAsset renames the asset and replaces its description. The kind and the parent of an asset
+// can't be changed.
+func (a *MongoAssetsRepository) UpdateAsset(ctx context.Context, id string, asset *Asset) error {
+	current, err := a.GetAsset(ctx, id)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return mongo.ErrNoDocuments
+	}
+
+	asset.ID = current.ID
+	asset.ParentID = current.ParentID
+	asset.Ancestors = current.Ancestors
+	asset.Kind = current.Kind
+
+	_, err = a.assetsColl.UpdateOne(ctx, bson.M{"_id": current.ID}, bson.M{
+		"$set": bson.M{"name": asset.Name, "description": asset.Description},
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAssetNameTaken
+	}
+	return err
+}
+
+// DeleteAsset deletes the asset and reports whether it existed. Assets with children or with
+// sensors attached can't be deleted.
+func (a *MongoAssetsRepository) DeleteAsset(ctx context.Context, id string) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+
+	children, err := a.assetsColl.CountDocuments(ctx, bson.M{"parent_id": objectID}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	if children > 0 {
+		return false, ErrAssetNotEmpty
+	}
+	sensors, err := a.sensorsColl.CountDocuments(ctx, bson.M{"asset_id": objectID}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	if sensors > 0 {
+		return false, ErrAssetNotEmpty
+	}
+
+	result, err := a.assetsColl.DeleteOne(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+// AttachSensor attaches the sensor to the asset, detaching it from the asset it was attached to,
+// and reports whether the sensor exists.
+func (a *MongoAssetsRepository) AttachSensor(ctx context.Context, asset *Asset, sensorID string) (bool, error) {
+	return attachSensor(ctx, a.sensorsRepository, asset, sensorID)
+}
+
+// DetachSensor detaches the sensor from the asset and reports whether it was attached to it.
+func (a *MongoAssetsRepository) DetachSensor(ctx context.Context, asset *Asset, sensorID string) (bool, error) {
+	return detachSensor(ctx, a.sensorsRepository, asset, sensorID)
+}
+
+func attachSensor(ctx context.Context, sensorsRepository SensorsRepository, asset *Asset, sensorID string) (bool, error) {
+	attached, err := sensorsRepository.SetSensorAsset(ctx, sensorID, &asset.ID, nil)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return attached, err
+}
+
+func detachSensor(ctx context.Context, sensorsRepository SensorsRepository, asset *Asset, sensorID string) (bool, error) {
+	detached, err := sensorsRepository.SetSensorAsset(ctx, sensorID, nil, &asset.ID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return detached, err
+}
+
+// GetAssetSensors returns the sensors attached to the asset or to any asset under it, sorted by
+// name.
+func (a *MongoAssetsRepository) GetAssetSensors(ctx context.Context, asset *Asset) ([]*Sensor, error) {
+	ids, err := a.GetSubtreeIDs(ctx, asset)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := a.sensorsColl.Find(ctx, bson.M{"asset_id": bson.M{"$in": ids}}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	sensors := []*Sensor{}
+	if err := cursor.All(ctx, &sensors); err != nil {
+		return nil, err
+	}
+	return sensors, nil
+}
@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Channel is a virtual measurement of a sensor computed from an expression over other series.
+type Channel struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	SensorID   string             `bson:"sensor_id" json:"sensor_id"`
+	Name       string             `bson:"name" json:"name"`
+	Unit       string             `bson:"unit" json:"unit"`
+	Expression string             `bson:"expression" json:"expression"`
+	Inputs     []ChannelInput     `bson:"inputs" json:"inputs"`
+	Alignment  time.Duration      `bson:"alignment" json:"alignment"` // Window the inputs are averaged over before being combined
+}
+
+type ChannelInput struct {
+	Variable    string `bson:"variable" json:"variable"`
+	SensorID    string `bson:"sensor_id" json:"sensor_id"`
+	Measurement string `bson:"measurement" json:"measurement"`
+	Unit        string `bson:"unit" json:"unit"`
+}
+
+type ChannelsRepository interface {
+	CreateChannel(ctx context.Context, channel *Channel) error
+	// GetChannel returns the channel of the sensor with the given measurement name and unit, or
+	// nil when the series isn't a virtual one.
+	GetChannel(ctx context.Context, sensorID, name, unit string) (*Channel, error)
+	GetChannels(ctx context.Context, sensorID string) ([]*Channel, error)
+	// DeleteChannel deletes the channel and reports whether it existed.
+	DeleteChannel(ctx context.Context, sensorID, id string) (bool, error)
+}
+
+type MongoChannelsRepository struct {
+	channelsColl *mongo.Collection
+}
+
+func NewMongoChannelsRepository(envVars *config.EnvVars, mongoClient *mongo.Client) (ChannelsRepository, error) {
+	channelsColl := mongoClient.Database(envVars.MongoDB.Database).Collection("channels")
+	_, err := channelsColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "sensor_id", Value: 1},
+			{Key: "name", Value: 1},
+			{Key: "unit", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoChannelsRepository{
+		channelsColl: channelsColl,
+	}, nil
+}
+
+func (r *MongoChannelsRepository) CreateChannel(ctx context.Context, channel *Channel) error {
+	result, err := r.channelsColl.InsertOne(ctx, channel)
+	if err != nil {
+		return err
+	}
+	channel.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetChannel returns the channel of the sensor with the given measurement name and unit, or nil
+// when the series isn't a virtual one.
+func (r *MongoChannelsRepository) GetChannel(ctx context.Context, sensorID, name, unit string) (*Channel, error) {
+	var channel Channel
+	if err := r.channelsColl.FindOne(ctx, bson.M{"sensor_id": sensorID, "name": name, "unit": unit}).Decode(&channel); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &channel, nil
+}
+
+func (r *MongoChannelsRepository) GetChannels(ctx context.Context, sensorID string) ([]*Channel, error) {
+	cursor, err := r.channelsColl.Find(ctx, bson.M{"sensor_id": sensorID}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	channels := []*Channel{}
+	if err := cursor.All(ctx, &channels); err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+// DeleteChannel deletes the channel and reports whether it existed.
+func (r *MongoChannelsRepository) DeleteChannel(ctx context.Context, sensorID, id string) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := r.channelsColl.DeleteOne(ctx, bson.M{"_id": objectID, "sensor_id": sensorID})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
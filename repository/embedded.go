@@ -0,0 +1,183 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const StorageEmbedded = "embedded"
+
+// Buckets of the embedded store, named after the MongoDB collections they replace
+var (
+	sensorsBucket           = []byte("sensors")
+	sensorRevisionsBucket   = []byte("sensor_revisions")
+	assetsBucket            = []byte("assets")
+	channelsBucket          = []byte("channels")
+	geofencesBucket         = []byte("geofences")
+	geofenceEventsBucket    = []byte("geofence_events")
+	tracksBucket            = []byte("sensor_tracks")
+	anomaliesBucket         = []byte("anomalies")
+	idempotencyBucket       = []byte("idempotency_keys")
+	importsBucket           = []byte("imports")
+	rollupCheckpointsBucket = []byte("rollup_checkpoints")
+)
+
+// MetadataStore returns the name of the database everything but the measurements is kept in with
+// the storage backend.
+func MetadataStore(backend string) string {
+	if backend == StorageEmbedded {
+		return "bbolt"
+	}
+	return "mongodb"
+}
+
+// EmbeddedStore is the bbolt database the embedded repositories keep what MongoDB keeps otherwise,
+// a bucket per collection holding the documents encoded as BSON. There are no secondary indexes,
+// the queries scan their bucket, which is fine for the few thousand sensors of an edge
+// deployment. bbolt runs a single write transaction at a time, so the checks of the unique fields
+// and of the versions are done within the transactions writing them.
+type EmbeddedStore struct {
+	db *bbolt.DB
+}
+
+// NewEmbeddedStore opens, or creates, the database in the directory of the embedded mode.
+func NewEmbeddedStore(envVars *config.EnvVars) (*EmbeddedStore, error) {
+	if err := os.MkdirAll(envVars.Embedded.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the embedded directory: %w", err)
+	}
+
+	// The timeout keeps a second server started on the same directory from waiting forever
+	db, err := bbolt.Open(filepath.Join(envVars.Embedded.Dir, "metadata.db"), 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the embedded store: %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{
+			sensorsBucket, sensorRevisionsBucket, assetsBucket, channelsBucket, geofencesBucket, geofenceEventsBucket,
+			tracksBucket, anomaliesBucket, idempotencyBucket, importsBucket, rollupCheckpointsBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the embedded buckets: %w", err)
+	}
+
+	return &EmbeddedStore{db: db}, nil
+}
+
+func (s *EmbeddedStore) Close() error {
+	return s.db.Close()
+}
+
+// Ping fails once the store was closed.
+func (s *EmbeddedStore) Ping() error {
+	return s.db.View(func(*bbolt.Tx) error { return nil })
+}
+
+func (s *EmbeddedStore) view(fn func(tx *bbolt.Tx) error) error {
+	return s.db.View(fn)
+}
+
+func (s *EmbeddedStore) update(fn func(tx *bbolt.Tx) error) error {
+	return s.db.Update(fn)
+}
+
+// getDocument decodes the document with the key, returning mongo.ErrNoDocuments when there's none,
+// as MongoDB would.
+func getDocument[T any](bucket *bbolt.Bucket, key []byte) (*T, error) {
+	data := bucket.Get(key)
+	if data == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	var document T
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+func putDocument(bucket *bbolt.Bucket, key []byte, document any) error {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+// findDocuments decodes the documents whose keys start with the prefix, in the order of their keys,
+// keeping the ones matching.
+func findDocuments[T any](bucket *bbolt.Bucket, prefix []byte, match func(*T) bool) ([]*T, error) {
+	documents := []*T{}
+	cursor := bucket.Cursor()
+	for key, data := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, data = cursor.Next() {
+		var document T
+		if err := bson.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+		if match == nil || match(&document) {
+			documents = append(documents, &document)
+		}
+	}
+	return documents, nil
+}
+
+// duplicateKeyError is what MongoDB returns for a write breaking a unique index, so the callers
+// handle the writes refused by both stores alike.
+func duplicateKeyError(index string) error {
+	return mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{{
+			Code:    11000,
+			Message: "E11000 duplicate key error index: " + index,
+		}},
+	}
+}
+
+// timeKey encodes the time so the keys sort as the times do, dates before 1970 included.
+func timeKey(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano())^(1<<63))
+}
+
+// compositeKey joins the parts of a key with a separator they can't contain.
+func compositeKey(parts ...[]byte) []byte {
+	return bytes.Join(parts, []byte{0})
+}
+
+// findRange decodes the documents whose keys are the prefix followed by a time key within the
+// range, in the order of their keys, keeping the ones matching.
+func findRange[T any](bucket *bbolt.Bucket, prefix []byte, start, end time.Time, match func(*T) bool) ([]*T, error) {
+	documents := []*T{}
+	endKey := append(bytes.Clone(prefix), timeKey(end)...)
+	cursor := bucket.Cursor()
+	for key, data := cursor.Seek(append(bytes.Clone(prefix), timeKey(start)...)); key != nil && bytes.Compare(key, endKey) < 0; key, data = cursor.Next() {
+		var document T
+		if err := bson.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+		if match == nil || match(&document) {
+			documents = append(documents, &document)
+		}
+	}
+	return documents, nil
+}
+
+// storedTime is the time as MongoDB stores it, BSON dates having a millisecond precision, so the
+// documents keyed by a time replace each other as they would in MongoDB.
+func storedTime(t time.Time) time.Time {
+	return time.UnixMilli(t.UnixMilli())
+}
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type EmbeddedAnomaliesRepository struct {
+	store *EmbeddedStore
+}
+
+func NewEmbeddedAnomaliesRepository(store *EmbeddedStore) AnomaliesRepository {
+	return &EmbeddedAnomaliesRepository{store: store}
+}
+
+// anomalyKey orders the anomalies of a sensor by time, the rest of the unique index of MongoDB
+// following.
+func anomalyKey(anomaly *Anomaly) []byte {
+	return compositeKey(
+		[]byte(anomaly.SensorID),
+		timeKey(anomaly.Timestamp),
+		[]byte(anomaly.Measurement),
+		[]byte(anomaly.Unit),
+		[]byte(anomaly.Method),
+	)
+}
+
+// SaveAnomalies upserts the anomalies so detecting over the same range more than once doesn't
+// produce duplicates.
+func (a *EmbeddedAnomaliesRepository) SaveAnomalies(ctx context.Context, anomalies []*Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	return a.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(anomaliesBucket)
+		for _, anomaly := range anomalies {
+			document := *anomaly
+			document.Timestamp = storedTime(anomaly.Timestamp)
+			key := anomalyKey(&document)
+			if existing, err := getDocument[Anomaly](bucket, key); err == nil {
+				document.ID = existing.ID
+			} else if document.ID.IsZero() {
+				document.ID = primitive.NewObjectID()
+			}
+			if err := putDocument(bucket, key, &document); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetAnomalies returns the anomalies of a sensor within the time range, optionally narrowed down
+// to a measurement and unit when they're not empty.
+func (a *EmbeddedAnomaliesRepository) GetAnomalies(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) ([]*Anomaly, error) {
+	var anomalies []*Anomaly
+	err := a.store.view(func(tx *bbolt.Tx) (err error) {
+		anomalies, err = findRange(tx.Bucket(anomaliesBucket), compositeKey([]byte(sensorID), nil), start, end, func(anomaly *Anomaly) bool {
+			return (measurement == "" || anomaly.Measurement == measurement) && (unit == "" || anomaly.Unit == unit)
+		})
+		return err
+	})
+	return anomalies, err
+}
@@ -0,0 +1,234 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"sort"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type EmbeddedAssetsRepository struct {
+	store             *EmbeddedStore
+	sensorsRepository SensorsRepository
+}
+
+func NewEmbeddedAssetsRepository(store *EmbeddedStore, sensorsRepository SensorsRepository) AssetsRepository {
+	return &EmbeddedAssetsRepository{store: store, sensorsRepository: sensorsRepository}
+}
+
+// CreateAsset creates the asset under its parent, returning ErrInvalidAssetParent when the parent
+// doesn't exist or isn't of the level right above the asset.
+func (a *EmbeddedAssetsRepository) CreateAsset(ctx context.Context, asset *Asset) error {
+	id := primitive.NewObjectID()
+	err := a.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(assetsBucket)
+		ancestors := []primitive.ObjectID{}
+		if asset.ParentID == nil {
+			if asset.Kind != AssetKinds[0] {
+				return ErrInvalidAssetParent
+			}
+		} else {
+			parent, err := getDocument[Asset](bucket, asset.ParentID[:])
+			if err == mongo.ErrNoDocuments {
+				return ErrInvalidAssetParent
+			}
+			if err != nil {
+				return err
+			}
+			if kind, ok := childKind(parent.Kind); !ok || kind != asset.Kind {
+				return ErrInvalidAssetParent
+			}
+			ancestors = append(slices.Clone(parent.Ancestors), parent.ID)
+		}
+
+		if err := checkAssetName(bucket, id, asset.ParentID, asset.Name); err != nil {
+			return err
+		}
+		document := *asset
+		document.ID = id
+		document.Ancestors = ancestors
+		if err := putDocument(bucket, id[:], &document); err != nil {
+			return err
+		}
+		asset.Ancestors = ancestors
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	asset.ID = id
+	return nil
+}
+
+// checkAssetName returns ErrAssetNameTaken when another asset of the parent has the name.
+func checkAssetName(bucket *bbolt.Bucket, id primitive.ObjectID, parentID *primitive.ObjectID, name string) error {
+	siblings, err := findDocuments(bucket, nil, func(other *Asset) bool {
+		return other.ID != id && other.Name == name && equalPointers(other.ParentID, parentID, func(a, b primitive.ObjectID) bool { return a == b })
+	})
+	if err != nil {
+		return err
+	}
+	if len(siblings) > 0 {
+		return ErrAssetNameTaken
+	}
+	return nil
+}
+
+// GetAsset returns nil when there's no asset with the ID.
+func (a *EmbeddedAssetsRepository) GetAsset(ctx context.Context, id string) (*Asset, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var asset *Asset
+	err = a.store.view(func(tx *bbolt.Tx) (err error) {
+		asset, err = getDocument[Asset](tx.Bucket(assetsBucket), objectID[:])
+		return err
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return asset, err
+}
+
+// GetAssets returns the children of the asset sorted by name, or the sites when parentID is
+// empty.
+func (a *EmbeddedAssetsRepository) GetAssets(ctx context.Context, parentID string) ([]*Asset, error) {
+	var parent *primitive.ObjectID
+	if parentID != "" {
+		objectID, err := primitive.ObjectIDFromHex(parentID)
+		if err != nil {
+			return nil, err
+		}
+		parent = &objectID
+	}
+
+	assets, err := a.findAssets(func(asset *Asset) bool {
+		return equalPointers(asset.ParentID, parent, func(a, b primitive.ObjectID) bool { return a == b })
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(assets, func(i, j int) bool { return assets[i].Name < assets[j].Name })
+	return assets, nil
+}
+
+func (a *EmbeddedAssetsRepository) findAssets(match func(*Asset) bool) ([]*Asset, error) {
+	var assets []*Asset
+	err := a.store.view(func(tx *bbolt.Tx) (err error) {
+		assets, err = findDocuments(tx.Bucket(assetsBucket), nil, match)
+		return err
+	})
+	return assets, err
+}
+
+// GetSubtreeIDs returns the ID of the asset along with the IDs of every asset under it.
+func (a *EmbeddedAssetsRepository) GetSubtreeIDs(ctx context.Context, asset *Asset) ([]primitive.ObjectID, error) {
+	descendants, err := a.findAssets(func(other *Asset) bool { return slices.Contains(other.Ancestors, asset.ID) })
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(descendants)+1)
+	ids = append(ids, asset.ID)
+	for _, descendant := range descendants {
+		ids = append(ids, descendant.ID)
+	}
+	return ids, nil
+}
+
+// UpdateAsset renames the asset and replaces its description. The kind and the parent of an asset
+// can't be changed.
+func (a *EmbeddedAssetsRepository) UpdateAsset(ctx context.Context, id string, asset *Asset) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	return a.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(assetsBucket)
+		current, err := getDocument[Asset](bucket, objectID[:])
+		if err != nil {
+			return err
+		}
+
+		asset.ID = current.ID
+		asset.ParentID = current.ParentID
+		asset.Ancestors = current.Ancestors
+		asset.Kind = current.Kind
+		if err := checkAssetName(bucket, current.ID, current.ParentID, asset.Name); err != nil {
+			return err
+		}
+		return putDocument(bucket, objectID[:], asset)
+	})
+}
+
+// DeleteAsset deletes the asset and reports whether it existed. Assets with children or with
+// sensors attached can't be deleted.
+func (a *EmbeddedAssetsRepository) DeleteAsset(ctx context.Context, id string) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+
+	var existed bool
+	err = a.store.update(func(tx *bbolt.Tx) error {
+		children, err := findDocuments(tx.Bucket(assetsBucket), nil, func(other *Asset) bool {
+			return other.ParentID != nil && *other.ParentID == objectID
+		})
+		if err != nil {
+			return err
+		}
+		sensors, err := findDocuments(tx.Bucket(sensorsBucket), nil, func(sensor *Sensor) bool {
+			return sensor.AssetID != nil && *sensor.AssetID == objectID
+		})
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 || len(sensors) > 0 {
+			return ErrAssetNotEmpty
+		}
+
+		bucket := tx.Bucket(assetsBucket)
+		existed = bucket.Get(objectID[:]) != nil
+		return bucket.Delete(objectID[:])
+	})
+	return existed, err
+}
+
+// AttachSensor attaches the sensor to the asset, detaching it from the asset it was attached to,
+// and reports whether the sensor exists.
+func (a *EmbeddedAssetsRepository) AttachSensor(ctx context.Context, asset *Asset, sensorID string) (bool, error) {
+	return attachSensor(ctx, a.sensorsRepository, asset, sensorID)
+}
+
+// DetachSensor detaches the sensor from the asset and reports whether it was attached to it.
+func (a *EmbeddedAssetsRepository) DetachSensor(ctx context.Context, asset *Asset, sensorID string) (bool, error) {
+	return detachSensor(ctx, a.sensorsRepository, asset, sensorID)
+}
+
+// GetAssetSensors returns the sensors attached to the asset or to any asset under it, sorted by
+// name.
+func (a *EmbeddedAssetsRepository) GetAssetSensors(ctx context.Context, asset *Asset) ([]*Sensor, error) {
+	ids, err := a.GetSubtreeIDs(ctx, asset)
+	if err != nil {
+		return nil, err
+	}
+
+	var sensors []*Sensor
+	err = a.store.view(func(tx *bbolt.Tx) (err error) {
+		sensors, err = findDocuments(tx.Bucket(sensorsBucket), nil, func(sensor *Sensor) bool {
+			return sensor.AssetID != nil && slices.Contains(ids, *sensor.AssetID)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(sensors, func(i, j int) bool { return sensors[i].Name < sensors[j].Name })
+	return sensors, nil
+}
@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"context"
+	"sort"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const channelSeriesIndex = "sensor_id_1_name_1_unit_1"
+
+type EmbeddedChannelsRepository struct {
+	store *EmbeddedStore
+}
+
+func NewEmbeddedChannelsRepository(store *EmbeddedStore) ChannelsRepository {
+	return &EmbeddedChannelsRepository{store: store}
+}
+
+// CreateChannel returns the duplicate key error of MongoDB when the sensor already has a channel
+// with the name and unit.
+func (r *EmbeddedChannelsRepository) CreateChannel(ctx context.Context, channel *Channel) error {
+	id := primitive.NewObjectID()
+	err := r.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(channelsBucket)
+		existing, err := findChannels(bucket, channel.SensorID, channel.Name, channel.Unit)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return duplicateKeyError(channelSeriesIndex)
+		}
+
+		document := *channel
+		document.ID = id
+		return putDocument(bucket, id[:], &document)
+	})
+	if err != nil {
+		return err
+	}
+	channel.ID = id
+	return nil
+}
+
+// findChannels returns the channels of the sensor, narrowed down to a name and unit when they're
+// not empty.
+func findChannels(bucket *bbolt.Bucket, sensorID, name, unit string) ([]*Channel, error) {
+	return findDocuments(bucket, nil, func(channel *Channel) bool {
+		return channel.SensorID == sensorID &&
+			(name == "" || channel.Name == name) &&
+			(unit == "" || channel.Unit == unit)
+	})
+}
+
+// GetChannel returns the channel of the sensor with the given measurement name and unit, or nil
+// when the series isn't a virtual one.
+func (r *EmbeddedChannelsRepository) GetChannel(ctx context.Context, sensorID, name, unit string) (*Channel, error) {
+	var channel *Channel
+	err := r.store.view(func(tx *bbolt.Tx) error {
+		channels, err := findDocuments(tx.Bucket(channelsBucket), nil, func(c *Channel) bool {
+			return c.SensorID == sensorID && c.Name == name && c.Unit == unit
+		})
+		if len(channels) > 0 {
+			channel = channels[0]
+		}
+		return err
+	})
+	return channel, err
+}
+
+func (r *EmbeddedChannelsRepository) GetChannels(ctx context.Context, sensorID string) ([]*Channel, error) {
+	var channels []*Channel
+	err := r.store.view(func(tx *bbolt.Tx) (err error) {
+		channels, err = findChannels(tx.Bucket(channelsBucket), sensorID, "", "")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels, nil
+}
+
+// DeleteChannel deletes the channel and reports whether it existed.
+func (r *EmbeddedChannelsRepository) DeleteChannel(ctx context.Context, sensorID, id string) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+
+	var existed bool
+	err = r.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(channelsBucket)
+		channel, err := getDocument[Channel](bucket, objectID[:])
+		if err == mongo.ErrNoDocuments || err == nil && channel.SensorID != sensorID {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		existed = true
+		return bucket.Delete(objectID[:])
+	})
+	return existed, err
+}
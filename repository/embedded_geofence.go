@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const geofenceNameIndex = "name_1"
+
+type EmbeddedGeofencesRepository struct {
+	store *EmbeddedStore
+}
+
+func NewEmbeddedGeofencesRepository(store *EmbeddedStore) GeofencesRepository {
+	return &EmbeddedGeofencesRepository{store: store}
+}
+
+// CreateGeofence returns ErrInvalidGeofenceArea when the area isn't a polygon MongoDB would index,
+// and the duplicate key error of MongoDB when another geofence has the name.
+func (g *EmbeddedGeofencesRepository) CreateGeofence(ctx context.Context, geofence *Geofence) error {
+	if !validPolygon(geofence.Area) {
+		return ErrInvalidGeofenceArea
+	}
+
+	id := primitive.NewObjectID()
+	err := g.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(geofencesBucket)
+		named, err := findDocuments(bucket, nil, func(other *Geofence) bool { return other.Name == geofence.Name })
+		if err != nil {
+			return err
+		}
+		if len(named) > 0 {
+			return duplicateKeyError(geofenceNameIndex)
+		}
+
+		document := *geofence
+		document.ID = id
+		return putDocument(bucket, id[:], &document)
+	})
+	if err != nil {
+		return err
+	}
+	geofence.ID = id
+	return nil
+}
+
+// GetGeofence returns nil when there's no geofence with the ID.
+func (g *EmbeddedGeofencesRepository) GetGeofence(ctx context.Context, id string) (*Geofence, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var geofence *Geofence
+	err = g.store.view(func(tx *bbolt.Tx) (err error) {
+		geofence, err = getDocument[Geofence](tx.Bucket(geofencesBucket), objectID[:])
+		return err
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return geofence, err
+}
+
+func (g *EmbeddedGeofencesRepository) GetGeofences(ctx context.Context) ([]*Geofence, error) {
+	return g.findGeofences(nil)
+}
+
+// GetGeofencesContaining returns the geofences the point is within, boundaries included.
+func (g *EmbeddedGeofencesRepository) GetGeofencesContaining(ctx context.Context, point GeoJSONPoint) ([]*Geofence, error) {
+	return g.findGeofences(func(geofence *Geofence) bool { return polygonContains(geofence.Area, point) })
+}
+
+// GetGeofencesByIDs returns the geofences that still exist out of the IDs.
+func (g *EmbeddedGeofencesRepository) GetGeofencesByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*Geofence, error) {
+	return g.findGeofences(func(geofence *Geofence) bool { return slices.Contains(ids, geofence.ID) })
+}
+
+func (g *EmbeddedGeofencesRepository) findGeofences(match func(*Geofence) bool) ([]*Geofence, error) {
+	var geofences []*Geofence
+	err := g.store.view(func(tx *bbolt.Tx) (err error) {
+		geofences, err = findGeofences(tx, match)
+		return err
+	})
+	return geofences, err
+}
+
+// findGeofences returns the geofences matching, sorted by name.
+func findGeofences(tx *bbolt.Tx, match func(*Geofence) bool) ([]*Geofence, error) {
+	geofences, err := findDocuments(tx.Bucket(geofencesBucket), nil, match)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(geofences, func(i, j int) bool { return geofences[i].Name < geofences[j].Name })
+	return geofences, nil
+}
+
+// DeleteGeofence deletes the geofence, keeping its events, and reports whether it existed.
+func (g *EmbeddedGeofencesRepository) DeleteGeofence(ctx context.Context, id string) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+
+	var existed bool
+	err = g.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(geofencesBucket)
+		existed = bucket.Get(objectID[:]) != nil
+		return bucket.Delete(objectID[:])
+	})
+	return existed, err
+}
+
+func (g *EmbeddedGeofencesRepository) SaveEvents(ctx context.Context, events []*GeofenceEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return g.store.update(func(tx *bbolt.Tx) error {
+		return putGeofenceEvents(tx, events)
+	})
+}
+
+// putGeofenceEvents keys the events by sensor and time, the events of a geofence being found by
+// scanning them all.
+func putGeofenceEvents(tx *bbolt.Tx, events []*GeofenceEvent) error {
+	bucket := tx.Bucket(geofenceEventsBucket)
+	for _, event := range events {
+		event.ID = primitive.NewObjectID()
+		key := append(append(event.SensorID[:], timeKey(storedTime(event.Timestamp))...), event.ID[:]...)
+		if err := putDocument(bucket, key, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSensorEvents returns the events of the sensor within the time range, oldest first.
+func (g *EmbeddedGeofencesRepository) GetSensorEvents(ctx context.Context, sensorID primitive.ObjectID, start, end time.Time) ([]*GeofenceEvent, error) {
+	var events []*GeofenceEvent
+	err := g.store.view(func(tx *bbolt.Tx) (err error) {
+		events, err = findRange[GeofenceEvent](tx.Bucket(geofenceEventsBucket), sensorID[:], start, end, nil)
+		return err
+	})
+	return events, err
+}
+
+// GetGeofenceEvents returns the events of the geofence within the time range, oldest first.
+func (g *EmbeddedGeofencesRepository) GetGeofenceEvents(ctx context.Context, geofenceID primitive.ObjectID, start, end time.Time) ([]*GeofenceEvent, error) {
+	var events []*GeofenceEvent
+	err := g.store.view(func(tx *bbolt.Tx) (err error) {
+		events, err = findDocuments(tx.Bucket(geofenceEventsBucket), nil, func(event *GeofenceEvent) bool {
+			return event.GeofenceID == geofenceID && !event.Timestamp.Before(start) && event.Timestamp.Before(end)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Timestamp.Before(events[j].Timestamp) })
+	return events, nil
+}
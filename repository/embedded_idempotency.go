@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type EmbeddedIdempotencyRepository struct {
+	store          *EmbeddedStore
+	window         time.Duration
+	pendingTimeout time.Duration
+}
+
+func NewEmbeddedIdempotencyRepository(envVars *config.EnvVars, store *EmbeddedStore) IdempotencyRepository {
+	return &EmbeddedIdempotencyRepository{
+		store:          store,
+		window:         envVars.Idempotency.Window,
+		pendingTimeout: envVars.Idempotency.PendingTimeout,
+	}
+}
+
+// expired tells whether the record can be claimed over: it's past the window, or it's pending
+// past the pending timeout, having been left by a request that never finished.
+func (r *EmbeddedIdempotencyRepository) expired(record *IdempotencyRecord, now time.Time) bool {
+	return record.CreatedAt.Before(now.Add(-r.window)) ||
+		record.Status == IdempotencyStatusPending && record.CreatedAt.Before(now.Add(-r.pendingTimeout))
+}
+
+// Reserve claims the key for a request. It returns nil when the key was claimed, and the record of
+// the request that holds it otherwise.
+func (r *EmbeddedIdempotencyRepository) Reserve(ctx context.Context, key, fingerprint string) (*IdempotencyRecord, error) {
+	var held *IdempotencyRecord
+	err := r.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		now := time.Now()
+		record, err := getDocument[IdempotencyRecord](bucket, []byte(key))
+		if err == nil && !r.expired(record, now) {
+			held = record
+			return nil
+		}
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+
+		return putDocument(bucket, []byte(key), &IdempotencyRecord{
+			Key:         key,
+			Fingerprint: fingerprint,
+			Status:      IdempotencyStatusPending,
+			CreatedAt:   now,
+		})
+	})
+	return held, err
+}
+
+// Complete stores the response of the request that reserved the key.
+func (r *EmbeddedIdempotencyRepository) Complete(ctx context.Context, key string, statusCode int, contentType string, body []byte) error {
+	return r.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		record, err := getDocument[IdempotencyRecord](bucket, []byte(key))
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		record.Status = IdempotencyStatusCompleted
+		record.StatusCode = statusCode
+		record.ContentType = contentType
+		record.Body = body
+		return putDocument(bucket, []byte(key), record)
+	})
+}
+
+// Release frees the key of a request that failed in a way worth retrying.
+func (r *EmbeddedIdempotencyRepository) Release(ctx context.Context, key string) error {
+	return r.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		record, err := getDocument[IdempotencyRecord](bucket, []byte(key))
+		if err == mongo.ErrNoDocuments || err == nil && record.Status != IdempotencyStatusPending {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+// Sweep removes the records past the window, which MongoDB does on its own with a TTL index.
+func (r *EmbeddedIdempotencyRepository) Sweep(now time.Time) error {
+	return r.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		expired, err := findDocuments(bucket, nil, func(record *IdempotencyRecord) bool {
+			return record.CreatedAt.Before(now.Add(-r.window))
+		})
+		if err != nil {
+			return err
+		}
+		for _, record := range expired {
+			if err := bucket.Delete([]byte(record.Key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Run sweeps the expired records every minute or so, as MongoDB does, until the context is done.
+func (r *EmbeddedIdempotencyRepository) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := r.Sweep(now); err != nil {
+				log.Error().Err(err).Msg("failed to sweep the expired idempotency keys")
+			}
+		}
+	}
+}
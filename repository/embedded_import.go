@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type EmbeddedImportsRepository struct {
+	store *EmbeddedStore
+}
+
+func NewEmbeddedImportsRepository(store *EmbeddedStore) ImportsRepository {
+	return &EmbeddedImportsRepository{store: store}
+}
+
+// GetImport returns nil when there's no import with the ID.
+func (r *EmbeddedImportsRepository) GetImport(ctx context.Context, id string) (*Import, error) {
+	var imp *Import
+	err := r.store.view(func(tx *bbolt.Tx) (err error) {
+		imp, err = getDocument[Import](tx.Bucket(importsBucket), []byte(id))
+		return err
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return imp, err
+}
+
+func (r *EmbeddedImportsRepository) SaveImport(ctx context.Context, imp *Import) error {
+	imp.UpdatedAt = time.Now()
+	return r.store.update(func(tx *bbolt.Tx) error {
+		return putDocument(tx.Bucket(importsBucket), []byte(imp.ID), imp)
+	})
+}
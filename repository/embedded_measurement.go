@@ -0,0 +1,786 @@
+package repository
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
+	"github.com/zignd/pingthings-collaborative-technical-interview/metrics"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	segmentExt        = ".jsonl"
+	segmentTimeLayout = "20060102T150405.000000000Z"
+)
+
+var (
+	errMeasurementStoreClosed = errors.New("the measurement store is closed")
+	errPointsLimit            = errors.New("the partition has more points than the limit")
+)
+
+// PartitionTooLargeError is returned by the embedded queries reading a partition with more
+// matching points than EMBEDDED__MAX_PARTITION_POINTS, a partition being held in memory at once.
+type PartitionTooLargeError struct {
+	Max int
+}
+
+func (e *PartitionTooLargeError) Error() string {
+	return fmt.Sprintf("a partition of the range has more than %d matching points", e.Max)
+}
+
+type segmentRecord struct {
+	Name      string            `json:"name"`
+	SensorID  string            `json:"sensor_id"`
+	Unit      string            `json:"unit"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// segment is the file of the measurements of a partition, named after its start and length so the
+// partitions written before the length was changed are still found.
+type segment struct {
+	name       string
+	start, end time.Time
+	size       int64 // Bytes written and synced, which readers stop at
+}
+
+func segmentName(start time.Time, length time.Duration) string {
+	return start.UTC().Format(segmentTimeLayout) + "_" + length.String() + segmentExt
+}
+
+func parseSegmentName(name string) (*segment, bool) {
+	startPart, lengthPart, ok := strings.Cut(strings.TrimSuffix(name, segmentExt), "_")
+	if !ok || !strings.HasSuffix(name, segmentExt) {
+		return nil, false
+	}
+	start, err := time.Parse(segmentTimeLayout, startPart)
+	if err != nil {
+		return nil, false
+	}
+	length, err := time.ParseDuration(lengthPart)
+	if err != nil || length <= 0 {
+		return nil, false
+	}
+	return &segment{name: name, start: start, end: start.Add(length)}, true
+}
+
+// floorDiv divides rounding down, so the partitions and windows of times before 1970 are aligned
+// as the others.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// alignTime returns the start of the interval of length d, aligned on the Unix epoch, the time is
+// within.
+func alignTime(t time.Time, d time.Duration) time.Time {
+	return time.Unix(0, floorDiv(t.UnixNano(), int64(d))*int64(d)).UTC()
+}
+
+// EmbeddedMeasurementRepository keeps the measurements in a directory of append-only segment files,
+// one per partition of time, as JSON lines. Writes are synced before they're acknowledged, a point
+// written again for the same time of its series replaces the previous one when read, and whole
+// partitions are removed once past the retention. There's no index: the queries read the
+// partitions overlapping their range one at a time, holding at most EMBEDDED__MAX_PARTITION_POINTS
+// points of a partition in memory, and the raw queries stop reading once they have more than
+// QUERY__MAX_POINTS. It's meant for the edge deployments running without the
+// external services, not as a replacement for InfluxDB or TimescaleDB.
+type EmbeddedMeasurementRepository struct {
+	dir       string
+	partition time.Duration
+	retention time.Duration
+	maxPoints int
+	// maxPartitionPoints bounds the points of a partition the queries hold in memory
+	maxPartitionPoints int
+
+	mu         sync.Mutex
+	segments   map[string]*segment
+	active     *os.File // Segment of the current partition, kept open as most writes go there
+	activeName string
+	closed     bool
+}
+
+// NewEmbeddedMeasurementRepository picks up the segments left by previous runs and removes the ones
+// past the retention.
+func NewEmbeddedMeasurementRepository(envVars *config.EnvVars) (*EmbeddedMeasurementRepository, error) {
+	m := &EmbeddedMeasurementRepository{
+		dir:       filepath.Join(envVars.Embedded.Dir, "measurements"),
+		partition: envVars.Embedded.Partition,
+		retention: envVars.Embedded.Retention,
+		maxPoints: envVars.Query.MaxPoints,
+		segments:  map[string]*segment{},
+
+		maxPartitionPoints: envVars.Embedded.MaxPartitionPoints,
+	}
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the measurements directory: %w", err)
+	}
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the measurements directory: %w", err)
+	}
+	for _, entry := range entries {
+		seg, ok := parseSegmentName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+		if seg.size, err = terminateSegment(filepath.Join(m.dir, seg.name)); err != nil {
+			return nil, err
+		}
+		m.segments[seg.name] = seg
+	}
+
+	m.removeExpired(time.Now())
+	return m, nil
+}
+
+// terminateSegment ends the segment with a newline when a crash in the middle of an append left a
+// partial line behind, so the next append starts a line of its own. It returns the size of the
+// segment.
+func terminateSegment(path string) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open measurement segment: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat measurement segment: %w", err)
+	}
+	if info.Size() == 0 {
+		return 0, nil
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return 0, fmt.Errorf("failed to read measurement segment: %w", err)
+	}
+	if last[0] == '\n' {
+		return info.Size(), nil
+	}
+	if _, err := file.Write([]byte{'\n'}); err != nil {
+		return 0, fmt.Errorf("failed to repair measurement segment: %w", err)
+	}
+	return info.Size() + 1, file.Sync()
+}
+
+// removeExpired removes the segments ending before the retention. The caller holds the mutex, or
+// is the constructor.
+func (m *EmbeddedMeasurementRepository) removeExpired(now time.Time) {
+	if m.retention == 0 {
+		return
+	}
+	cutoff := now.Add(-m.retention)
+	for name, seg := range m.segments {
+		if seg.end.After(cutoff) || name == m.activeName {
+			continue
+		}
+		// Readers that opened the segment before keep reading it
+		if err := os.Remove(filepath.Join(m.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Str("segment", name).Msg("failed to remove expired measurement segment")
+			continue
+		}
+		delete(m.segments, name)
+	}
+}
+
+func (m *EmbeddedMeasurementRepository) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	if m.active == nil {
+		return nil
+	}
+	err := m.active.Close()
+	m.active = nil
+	m.activeName = ""
+	return err
+}
+
+// Ping checks the measurements directory is still there.
+func (m *EmbeddedMeasurementRepository) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		return errMeasurementStoreClosed
+	}
+
+	_, err := os.Stat(m.dir)
+	return err
+}
+
+func (m *EmbeddedMeasurementRepository) CreateMeasurement(ctx context.Context, measurement *Measurement) (err error) {
+	_, finish := instrument(ctx, measurementRepositoryName, "CreateMeasurement", append(sensorAttributes(measurement.SensorID), attribute.String("measurement.name", measurement.Name))...)
+	defer func() { finish(err) }()
+
+	timestamp := time.Now()
+	point := *measurement
+	point.Timestamp = timestamp
+	if err := m.append([]*Measurement{&point}); err != nil {
+		return fmt.Errorf("failed to write the measurement point: %w", err)
+	}
+
+	measurement.Timestamp = timestamp
+	metrics.AddMeasurementsWritten(StorageEmbedded, 1)
+
+	return nil
+}
+
+func (m *EmbeddedMeasurementRepository) CreateMeasurements(ctx context.Context, measurements []*Measurement) (err error) {
+	_, finish := instrument(ctx, measurementRepositoryName, "CreateMeasurements", attribute.Int("measurement.count", len(measurements)))
+	defer func() { finish(err) }()
+
+	if err := m.append(measurements); err != nil {
+		return fmt.Errorf("failed to write the measurement points: %w", err)
+	}
+
+	metrics.AddMeasurementsWritten(StorageEmbedded, len(measurements))
+
+	return nil
+}
+
+// append writes the measurements to the segments of their partitions, syncing each of them.
+func (m *EmbeddedMeasurementRepository) append(measurements []*Measurement) error {
+	lines := map[string][]byte{}
+	starts := map[string]time.Time{}
+	for _, measurement := range measurements {
+		// Empty labels aren't kept, as InfluxDB doesn't keep empty tags
+		var labels map[string]string
+		for key, value := range measurement.Labels {
+			if value == "" {
+				continue
+			}
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[key] = value
+		}
+		line, err := json.Marshal(segmentRecord{
+			Name:      measurement.Name,
+			SensorID:  measurement.SensorID,
+			Unit:      measurement.Unit,
+			Value:     measurement.Value,
+			Timestamp: measurement.Timestamp.UTC(),
+			Labels:    labels,
+		})
+		if err != nil {
+			// Such as a value JSON can't hold
+			return rejected(err)
+		}
+
+		start := alignTime(measurement.Timestamp, m.partition)
+		name := segmentName(start, m.partition)
+		starts[name] = start
+		lines[name] = append(append(lines[name], line...), '\n')
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errMeasurementStoreClosed
+	}
+
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	created := false
+	for _, name := range names {
+		seg, ok := m.segments[name]
+		if !ok {
+			seg = &segment{name: name, start: starts[name], end: starts[name].Add(m.partition)}
+			m.segments[name] = seg
+			created = true
+		}
+		if err := m.appendToSegment(seg, lines[name]); err != nil {
+			return err
+		}
+	}
+
+	if created {
+		m.removeExpired(time.Now())
+	}
+	return nil
+}
+
+func (m *EmbeddedMeasurementRepository) appendToSegment(seg *segment, data []byte) error {
+	file, err := m.segmentFile(seg)
+	if err != nil {
+		return err
+	}
+	if file != m.active {
+		defer file.Close()
+	}
+
+	if _, err := file.Write(data); err != nil {
+		// Readers stop at the synced size, the next append starting over from there
+		file.Truncate(seg.size)
+		return fmt.Errorf("failed to write to measurement segment: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Truncate(seg.size)
+		return fmt.Errorf("failed to sync measurement segment: %w", err)
+	}
+	seg.size += int64(len(data))
+	return nil
+}
+
+// segmentFile opens the segment for appending. The segment of the current partition stays open,
+// the others are opened for a write at a time, being only written when backfilling.
+func (m *EmbeddedMeasurementRepository) segmentFile(seg *segment) (*os.File, error) {
+	if seg.name == m.activeName {
+		return m.active, nil
+	}
+
+	file, err := os.OpenFile(filepath.Join(m.dir, seg.name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open measurement segment: %w", err)
+	}
+
+	now := time.Now()
+	if !now.Before(seg.start) && now.Before(seg.end) {
+		if m.active != nil {
+			m.active.Close()
+		}
+		m.active = file
+		m.activeName = seg.name
+	}
+	return file, nil
+}
+
+type pointKey struct {
+	name, sensorID, unit string
+	timestamp            int64
+}
+
+// scan calls fn with the points within the range that match, a partition at a time in time
+// order, each time sorted by measurement, sensor, unit and time, keeping the last one written of
+// the points of a series at the same time. Segments overlapping each other, left by a change of
+// the partition length, are read as one partition. Reading stops with errPointsLimit as soon as a
+// partition has more than limit points. Labels are only returned when asked for.
+func (m *EmbeddedMeasurementRepository) scan(ctx context.Context, start, end time.Time, withLabels bool, match func(*segmentRecord) bool, limit int, fn func([]*Measurement) error) error {
+	// The sizes are taken at once, so the appends made while reading are left out rather than
+	// read halfway
+	m.mu.Lock()
+	segments := []segment{}
+	for _, seg := range m.segments {
+		if seg.start.Before(end) && seg.end.After(start) && seg.size > 0 {
+			segments = append(segments, *seg)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(segments, func(i, j int) bool {
+		if !segments[i].start.Equal(segments[j].start) {
+			return segments[i].start.Before(segments[j].start)
+		}
+		return segments[i].name < segments[j].name
+	})
+
+	for len(segments) > 0 {
+		partition, partitionEnd := 1, segments[0].end
+		for partition < len(segments) && segments[partition].start.Before(partitionEnd) {
+			if segments[partition].end.After(partitionEnd) {
+				partitionEnd = segments[partition].end
+			}
+			partition++
+		}
+
+		points, err := m.readPartition(ctx, segments[:partition], start, end, withLabels, match, limit)
+		if err != nil {
+			return err
+		}
+		if err := fn(points); err != nil {
+			return err
+		}
+		segments = segments[partition:]
+	}
+	return nil
+}
+
+func (m *EmbeddedMeasurementRepository) readPartition(ctx context.Context, segments []segment, start, end time.Time, withLabels bool, match func(*segmentRecord) bool, limit int) ([]*Measurement, error) {
+	points := []*Measurement{}
+	indexes := map[pointKey]int{}
+	for _, seg := range segments {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		err := m.readSegment(seg, func(record *segmentRecord) error {
+			if record.Timestamp.Before(start) || !record.Timestamp.Before(end) || !match(record) {
+				return nil
+			}
+			point := &Measurement{
+				Name:      record.Name,
+				SensorID:  record.SensorID,
+				Unit:      record.Unit,
+				Value:     record.Value,
+				Timestamp: record.Timestamp,
+			}
+			if withLabels {
+				point.Labels = record.Labels
+				if point.Labels == nil {
+					point.Labels = map[string]string{}
+				}
+			}
+
+			key := pointKey{record.Name, record.SensorID, record.Unit, record.Timestamp.UnixNano()}
+			if i, ok := indexes[key]; ok {
+				points[i] = point
+				return nil
+			}
+			if len(points) == limit {
+				return errPointsLimit
+			}
+			indexes[key] = len(points)
+			points = append(points, point)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sortMeasurements(points)
+	return points, nil
+}
+
+func sortMeasurements(points []*Measurement) {
+	sort.SliceStable(points, func(i, j int) bool {
+		a, b := points[i], points[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.SensorID != b.SensorID {
+			return a.SensorID < b.SensorID
+		}
+		if a.Unit != b.Unit {
+			return a.Unit < b.Unit
+		}
+		return a.Timestamp.Before(b.Timestamp)
+	})
+}
+
+// read returns the points within the range that match sorted as scan does, or
+// TooManyPointsError as soon as there are more than the maximum of the raw queries.
+func (m *EmbeddedMeasurementRepository) read(ctx context.Context, start, end time.Time, withLabels bool, match func(*segmentRecord) bool) ([]*Measurement, error) {
+	points := []*Measurement{}
+	err := m.scan(ctx, start, end, withLabels, match, m.maxPoints, func(partition []*Measurement) error {
+		if len(points)+len(partition) > m.maxPoints {
+			return errPointsLimit
+		}
+		points = append(points, partition...)
+		return nil
+	})
+	if errors.Is(err, errPointsLimit) {
+		return nil, &TooManyPointsError{Max: m.maxPoints}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sortMeasurements(points)
+	return points, nil
+}
+
+// scanPartitions scans the points within the range that match a partition at a time, returning
+// PartitionTooLargeError when a partition has too many to be held in memory.
+func (m *EmbeddedMeasurementRepository) scanPartitions(ctx context.Context, start, end time.Time, match func(*segmentRecord) bool, fn func([]*Measurement) error) error {
+	err := m.scan(ctx, start, end, false, match, m.maxPartitionPoints, fn)
+	if errors.Is(err, errPointsLimit) {
+		return &PartitionTooLargeError{Max: m.maxPartitionPoints}
+	}
+	return err
+}
+
+// readSegment calls fn with the records of the segment until it returns an error.
+func (m *EmbeddedMeasurementRepository) readSegment(seg segment, fn func(*segmentRecord) error) error {
+	file, err := os.Open(filepath.Join(m.dir, seg.name))
+	if errors.Is(err, os.ErrNotExist) {
+		// Removed by the retention in the meantime
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open measurement segment: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(file, seg.size))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record segmentRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash in the middle of an append leaves a partial line behind
+			log.Warn().Err(err).Str("segment", seg.name).Msg("skipping corrupted measurement record")
+			continue
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read measurement segment: %w", err)
+	}
+	return nil
+}
+
+// seriesMatch matches the records of the sensors, all of them when there are none, with the
+// measurement and unit, any of them when they're empty.
+func seriesMatch(sensorIDs []string, measurement, unit string) func(*segmentRecord) bool {
+	return func(record *segmentRecord) bool {
+		return (len(sensorIDs) == 0 || slices.Contains(sensorIDs, record.SensorID)) &&
+			(measurement == "" || record.Name == measurement) &&
+			(unit == "" || record.Unit == unit)
+	}
+}
+
+func (m *EmbeddedMeasurementRepository) GetMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (_ []*Measurement, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurements", seriesAttributes([]string{sensorID}, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	measurements, err := m.read(ctx, start, end, false, seriesMatch([]string{sensorID}, measurement, unit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurements: %w", err)
+	}
+	return measurements, nil
+}
+
+func (m *EmbeddedMeasurementRepository) GetMeasurementTimestamps(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (_ []time.Time, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurementTimestamps", seriesAttributes([]string{sensorID}, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	timestamps := []time.Time{}
+	err = m.scanPartitions(ctx, start, end, seriesMatch([]string{sensorID}, measurement, unit), func(partition []*Measurement) error {
+		for _, measurement := range partition {
+			timestamps = append(timestamps, measurement.Timestamp)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurement timestamps: %w", err)
+	}
+	return timestamps, nil
+}
+
+// StreamMeasurements calls fn for every measurement of the sensors within the range, a partition
+// at a time, as the points of a series can be spread over the segments of a partition out of
+// order. Unlike the other backends, the measurements are grouped by series within each partition
+// only, and a partition with more than EMBEDDED__MAX_PARTITION_POINTS matching points fails the
+// export with PartitionTooLargeError.
+func (m *EmbeddedMeasurementRepository) StreamMeasurements(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time, fn func(*Measurement) error) (err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "StreamMeasurements", seriesAttributes(sensorIDs, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	if len(sensorIDs) == 0 {
+		return nil
+	}
+
+	var fnErr error
+	err = m.scanPartitions(ctx, start, end, seriesMatch(sensorIDs, measurement, unit), func(partition []*Measurement) error {
+		for _, measurement := range partition {
+			if fnErr = fn(measurement); fnErr != nil {
+				return fnErr
+			}
+		}
+		return nil
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query measurements: %w", err)
+	}
+	return nil
+}
+
+func (m *EmbeddedMeasurementRepository) GetSensorValues(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time, fn string) (_ map[string]float64, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetSensorValues", append(seriesAttributes(sensorIDs, measurement, unit, start, end), attribute.String("query.fn", fn))...)
+	defer func() { finish(err) }()
+
+	values := map[string]float64{}
+	if len(sensorIDs) == 0 {
+		return values, nil
+	}
+	if _, err := fluxFunction(fn); err != nil {
+		return nil, err
+	}
+
+	series := map[string][]float64{}
+	err = m.scanPartitions(ctx, start, end, seriesMatch(sensorIDs, measurement, unit), func(partition []*Measurement) error {
+		for _, measurement := range partition {
+			series[measurement.SensorID] = append(series[measurement.SensorID], measurement.Value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sensor values: %w", err)
+	}
+	for sensorID, sensorValues := range series {
+		values[sensorID] = aggregateValues(fn, sensorValues)
+	}
+	return values, nil
+}
+
+func (m *EmbeddedMeasurementRepository) GetMeasurementsByLabels(ctx context.Context, selector label.Selector, measurement, unit string, start, end time.Time) (_ []*Measurement, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurementsByLabels", append(seriesAttributes(nil, measurement, unit, start, end), attribute.String("label.selector", selector.String()))...)
+	defer func() { finish(err) }()
+
+	matchSeries := seriesMatch(nil, measurement, unit)
+	measurements, err := m.read(ctx, start, end, true, func(record *segmentRecord) bool {
+		return matchSeries(record) && selector.Matches(record.Labels)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurements: %w", err)
+	}
+	return measurements, nil
+}
+
+// GetAggregatedMeasurements windows the series by every, aligned on the Unix epoch, and stamps
+// each window with its end, or the end of the range for the last one, as InfluxDB does.
+func (m *EmbeddedMeasurementRepository) GetAggregatedMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time, every time.Duration, fn string) (_ []*Measurement, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetAggregatedMeasurements", append(seriesAttributes([]string{sensorID}, measurement, unit, start, end), attribute.String("query.every", every.String()), attribute.String("query.fn", fn))...)
+	defer func() { finish(err) }()
+
+	if _, err := fluxFunction(fn); err != nil {
+		return nil, err
+	}
+
+	measurements := []*Measurement{}
+	var values []float64
+	var windowEnd time.Time
+	flush := func() {
+		if len(values) > 0 {
+			measurements = append(measurements, &Measurement{Name: measurement, SensorID: sensorID, Unit: unit, Value: aggregateValues(fn, values), Timestamp: windowEnd})
+		}
+	}
+	// The partitions come in time order, so a window spread over several is aggregated once
+	// they're all read
+	err = m.scanPartitions(ctx, start, end, seriesMatch([]string{sensorID}, measurement, unit), func(points []*Measurement) error {
+		for _, point := range points {
+			pointWindowEnd := alignTime(point.Timestamp, every).Add(every)
+			if pointWindowEnd.After(end) {
+				pointWindowEnd = end
+			}
+			if !pointWindowEnd.Equal(windowEnd) {
+				flush()
+				values, windowEnd = nil, pointWindowEnd
+			}
+			values = append(values, point.Value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query aggregated measurements: %w", err)
+	}
+	flush()
+
+	return measurements, nil
+}
+
+// GetMeasurementSummary summarizes the raw measurements, there are no rollups in the embedded mode.
+func (m *EmbeddedMeasurementRepository) GetMeasurementSummary(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (_ *MeasurementSummary, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurementSummary", seriesAttributes([]string{sensorID}, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	return m.getMeasurementSummary(ctx, []string{sensorID}, measurement, unit, start, end)
+}
+
+func (m *EmbeddedMeasurementRepository) GetSensorsMeasurementSummary(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time) (_ *MeasurementSummary, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetSensorsMeasurementSummary", seriesAttributes(sensorIDs, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	if len(sensorIDs) == 0 {
+		return &MeasurementSummary{Unit: unit}, nil
+	}
+	return m.getMeasurementSummary(ctx, sensorIDs, measurement, unit, start, end)
+}
+
+func (m *EmbeddedMeasurementRepository) getMeasurementSummary(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time) (*MeasurementSummary, error) {
+	if !end.After(start) {
+		return nil, fmt.Errorf("failed to query measurement summary: %w", errEmptyRange)
+	}
+
+	// Only the values are kept, the median needing them all
+	values := []float64{}
+	err := m.scanPartitions(ctx, start, end, seriesMatch(sensorIDs, measurement, unit), func(partition []*Measurement) error {
+		for _, measurement := range partition {
+			values = append(values, measurement.Value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurement summary: %w", err)
+	}
+
+	summary := &MeasurementSummary{}
+	if len(values) == 0 {
+		return summary, nil
+	}
+	summary.Count = len(values)
+	summary.MinValue = aggregateValues("min", values)
+	summary.MaxValue = aggregateValues("max", values)
+	summary.MeanValue = aggregateValues("mean", values)
+	summary.MedianValue = aggregateValues("median", values)
+	summary.Unit = unit
+
+	return summary, nil
+}
+
+// aggregateValues reduces the values, in time order, with one of fluxFunctions. The median is
+// interpolated between the middle values, as percentile_cont does.
+func aggregateValues(fn string, values []float64) float64 {
+	switch fn {
+	case "mean":
+		return aggregateValues("sum", values) / float64(len(values))
+	case "median":
+		sorted := slices.Clone(values)
+		slices.Sort(sorted)
+		middle := len(sorted) / 2
+		if len(sorted)%2 == 1 {
+			return sorted[middle]
+		}
+		return (sorted[middle-1] + sorted[middle]) / 2
+	case "min":
+		return slices.Min(values)
+	case "max":
+		return slices.Max(values)
+	case "sum":
+		var sum float64
+		for _, value := range values {
+			sum += value
+		}
+		return sum
+	case "count":
+		return float64(len(values))
+	case "first":
+		return values[0]
+	case "last":
+		return values[len(values)-1]
+	default:
+		return math.NaN()
+	}
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// EmbeddedRollupCheckpointsRepository keeps the watermarks of the roller in the embedded mode. The
+// embedded measurement repository writes no rollups, so the roller stays disabled, but it's built
+// regardless of the backend.
+type EmbeddedRollupCheckpointsRepository struct {
+	store *EmbeddedStore
+}
+
+func NewEmbeddedRollupCheckpointsRepository(store *EmbeddedStore) RollupCheckpointsRepository {
+	return &EmbeddedRollupCheckpointsRepository{store: store}
+}
+
+// GetWatermark returns the zero time when the resolution was never rolled up.
+func (r *EmbeddedRollupCheckpointsRepository) GetWatermark(ctx context.Context, resolution time.Duration) (time.Time, error) {
+	var checkpoint *rollupCheckpoint
+	err := r.store.view(func(tx *bbolt.Tx) (err error) {
+		checkpoint, err = getDocument[rollupCheckpoint](tx.Bucket(rollupCheckpointsBucket), []byte(rollupTag(resolution)))
+		return err
+	})
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return checkpoint.Watermark, nil
+}
+
+func (r *EmbeddedRollupCheckpointsRepository) SaveWatermark(ctx context.Context, resolution time.Duration, watermark time.Time) error {
+	return r.store.update(func(tx *bbolt.Tx) error {
+		checkpoint := rollupCheckpoint{Resolution: rollupTag(resolution), Watermark: watermark}
+		return putDocument(tx.Bucket(rollupCheckpointsBucket), []byte(checkpoint.Resolution), &checkpoint)
+	})
+}
@@ -0,0 +1,561 @@
+package repository
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type EmbeddedSensorsRepository struct {
+	store                *EmbeddedStore
+	caseInsensitiveNames bool
+}
+
+func NewEmbeddedSensorsRepository(envVars *config.EnvVars, store *EmbeddedStore) (SensorsRepository, error) {
+	s := &EmbeddedSensorsRepository{
+		store:                store,
+		caseInsensitiveNames: envVars.Sensors.CaseInsensitiveNames,
+	}
+
+	// Switching to case insensitive names can't be done while names differ only by their case, as
+	// MongoDB refuses to build the index then
+	err := store.view(func(tx *bbolt.Tx) error {
+		sensors, err := findDocuments[Sensor](tx.Bucket(sensorsBucket), nil, nil)
+		if err != nil {
+			return err
+		}
+		for i, sensor := range sensors {
+			for _, other := range sensors[i+1:] {
+				if s.sameName(sensor.Name, other.Name) {
+					return duplicateKeyError(sensorNameIndex)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to make sensor names unique, rename the sensors sharing a name first: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *EmbeddedSensorsRepository) sameName(a, b string) bool {
+	if s.caseInsensitiveNames {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// checkUnique returns the error MongoDB returns for a sensor sharing its name or its external ID
+// with another one.
+func (s *EmbeddedSensorsRepository) checkUnique(bucket *bbolt.Bucket, sensor *Sensor) error {
+	sensors, err := findDocuments(bucket, nil, func(other *Sensor) bool { return other.ID != sensor.ID })
+	if err != nil {
+		return err
+	}
+	for _, other := range sensors {
+		if s.sameName(other.Name, sensor.Name) {
+			return duplicateKeyError(sensorNameIndex)
+		}
+		if sensor.ExternalID != "" && other.ExternalID == sensor.ExternalID {
+			return duplicateKeyError(sensorExternalIDIndex)
+		}
+	}
+	return nil
+}
+
+// revisionKey orders the revisions of a sensor by their version.
+func revisionKey(sensorID primitive.ObjectID, version int) []byte {
+	return binary.BigEndian.AppendUint64(sensorID[:], uint64(version))
+}
+
+func (s *EmbeddedSensorsRepository) putRevision(ctx context.Context, tx *bbolt.Tx, sensorID primitive.ObjectID, version int, before *SensorState, after SensorState) error {
+	revision := newSensorRevision(ctx, sensorID, version, before, after)
+	revision.ID = primitive.NewObjectID()
+	return putDocument(tx.Bucket(sensorRevisionsBucket), revisionKey(sensorID, version), revision)
+}
+
+func (s *EmbeddedSensorsRepository) Close() error {
+	return s.store.Close()
+}
+
+// Ping checks that the embedded store is open.
+func (s *EmbeddedSensorsRepository) Ping(ctx context.Context) error {
+	return s.store.Ping()
+}
+
+func (s *EmbeddedSensorsRepository) CreateSensor(ctx context.Context, sensor *Sensor) (err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "CreateSensor")
+	defer func() { finish(err) }()
+
+	sensor.Name = normalizeSensorName(sensor.Name)
+	sensor.Version = 1
+	id := sensor.ID
+	if id.IsZero() {
+		id = primitive.NewObjectID()
+	}
+	err = s.store.update(func(tx *bbolt.Tx) error {
+		return s.createSensor(ctx, tx, id, sensor)
+	})
+	if err != nil {
+		return sensorWriteError(err)
+	}
+	sensor.ID = id
+	return nil
+}
+
+func (s *EmbeddedSensorsRepository) createSensor(ctx context.Context, tx *bbolt.Tx, id primitive.ObjectID, sensor *Sensor) error {
+	document := *sensor
+	document.ID = id
+	bucket := tx.Bucket(sensorsBucket)
+	if bucket.Get(id[:]) != nil {
+		return duplicateKeyError("_id_")
+	}
+	if err := s.checkUnique(bucket, &document); err != nil {
+		return err
+	}
+	if err := putDocument(bucket, id[:], &document); err != nil {
+		return err
+	}
+	return s.putRevision(ctx, tx, id, document.Version, nil, NewSensorState(&document))
+}
+
+func (s *EmbeddedSensorsRepository) GetSensorByID(ctx context.Context, id string) (_ *Sensor, err error) {
+	_, finish := instrument(ctx, sensorsRepositoryName, "GetSensorByID", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	var sensor *Sensor
+	err = s.store.view(func(tx *bbolt.Tx) error {
+		sensor, err = getDocument[Sensor](tx.Bucket(sensorsBucket), objectID[:])
+		return err
+	})
+	return sensor, err
+}
+
+// RegisterSensor creates the sensor unless there's already one with its external ID, in which
+// case the sensor is replaced by the existing one. Both happen in the same transaction, so
+// concurrent registrations can't race. It tells whether the sensor was created.
+func (s *EmbeddedSensorsRepository) RegisterSensor(ctx context.Context, sensor *Sensor) (_ bool, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "RegisterSensor", attribute.String("sensor.external_id", sensor.ExternalID))
+	defer func() { finish(err) }()
+
+	if sensor.ExternalID == "" {
+		return true, s.CreateSensor(ctx, sensor)
+	}
+
+	sensor.Name = normalizeSensorName(sensor.Name)
+	sensor.Version = 1
+	id := primitive.NewObjectID()
+	var existing *Sensor
+	err = s.store.update(func(tx *bbolt.Tx) error {
+		existing, err = s.findSensor(tx, func(other *Sensor) bool { return other.ExternalID == sensor.ExternalID })
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+		existing = nil
+		return s.createSensor(ctx, tx, id, sensor)
+	})
+	if err != nil {
+		return false, sensorWriteError(err)
+	}
+	if existing != nil {
+		*sensor = *existing
+		return false, nil
+	}
+	sensor.ID = id
+	return true, nil
+}
+
+// findSensor returns the first sensor matching, or mongo.ErrNoDocuments when there's none.
+func (s *EmbeddedSensorsRepository) findSensor(tx *bbolt.Tx, match func(*Sensor) bool) (*Sensor, error) {
+	sensors, err := findDocuments(tx.Bucket(sensorsBucket), nil, match)
+	if err != nil {
+		return nil, err
+	}
+	if len(sensors) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return sensors[0], nil
+}
+
+func (s *EmbeddedSensorsRepository) findSensors(match func(*Sensor) bool) ([]*Sensor, error) {
+	var sensors []*Sensor
+	err := s.store.view(func(tx *bbolt.Tx) (err error) {
+		sensors, err = findDocuments(tx.Bucket(sensorsBucket), nil, match)
+		return err
+	})
+	return sensors, err
+}
+
+// GetSensorByExternalID returns nil when there's no sensor with the external ID.
+func (s *EmbeddedSensorsRepository) GetSensorByExternalID(ctx context.Context, externalID string) (_ *Sensor, err error) {
+	_, finish := instrument(ctx, sensorsRepositoryName, "GetSensorByExternalID", attribute.String("sensor.external_id", externalID))
+	defer func() { finish(err) }()
+
+	sensors, err := s.findSensors(func(sensor *Sensor) bool { return sensor.ExternalID == externalID })
+	if err != nil || len(sensors) == 0 {
+		return nil, err
+	}
+	return sensors[0], nil
+}
+
+func (s *EmbeddedSensorsRepository) GetSensorByName(ctx context.Context, name string) (_ *Sensor, err error) {
+	_, finish := instrument(ctx, sensorsRepositoryName, "GetSensorByName", attribute.String("sensor.name", name))
+	defer func() { finish(err) }()
+
+	name = normalizeSensorName(name)
+	sensors, err := s.findSensors(func(sensor *Sensor) bool { return s.sameName(sensor.Name, name) })
+	if err != nil {
+		return nil, err
+	}
+	if len(sensors) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return sensors[0], nil
+}
+
+func (s *EmbeddedSensorsRepository) GetSensorsByTag(ctx context.Context, tag string) (_ []*Sensor, err error) {
+	_, finish := instrument(ctx, sensorsRepositoryName, "GetSensorsByTag", attribute.String("sensor.tag", tag))
+	defer func() { finish(err) }()
+
+	return s.findSensors(func(sensor *Sensor) bool { return slices.Contains(sensor.Tags, tag) })
+}
+
+// GetSensors returns the sensors whose labels meet the selector, sorted by name.
+func (s *EmbeddedSensorsRepository) GetSensors(ctx context.Context, selector label.Selector) (_ []*Sensor, err error) {
+	_, finish := instrument(ctx, sensorsRepositoryName, "GetSensors", attribute.String("label.selector", selector.String()))
+	defer func() { finish(err) }()
+
+	sensors, err := s.findSensors(func(sensor *Sensor) bool { return selector.Matches(sensor.Labels) })
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(sensors, func(i, j int) bool { return sensors[i].Name < sensors[j].Name })
+	return sensors, nil
+}
+
+// GetSensorsWithin returns the sensors located within the bounding box, in degrees.
+func (s *EmbeddedSensorsRepository) GetSensorsWithin(ctx context.Context, minLongitude, minLatitude, maxLongitude, maxLatitude float64) (_ []*Sensor, err error) {
+	_, finish := instrument(ctx, sensorsRepositoryName, "GetSensorsWithin")
+	defer func() { finish(err) }()
+
+	return s.findSensors(func(sensor *Sensor) bool {
+		coordinates := sensor.Location.Coordinates
+		return len(coordinates) >= 2 &&
+			minLongitude <= coordinates[0] && coordinates[0] <= maxLongitude &&
+			minLatitude <= coordinates[1] && coordinates[1] <= maxLatitude
+	})
+}
+
+func (s *EmbeddedSensorsRepository) GetNearestSensor(ctx context.Context, latitude, longitude, maxDistance float64) (_ *Sensor, err error) {
+	_, finish := instrument(ctx, sensorsRepositoryName, "GetNearestSensor")
+	defer func() { finish(err) }()
+
+	sensors, err := s.findSensors(func(sensor *Sensor) bool { return len(sensor.Location.Coordinates) >= 2 })
+	if err != nil {
+		return nil, err
+	}
+
+	var nearest *Sensor
+	nearestDistance := maxDistance
+	for _, sensor := range sensors {
+		d := distance(longitude, latitude, sensor.Location.Coordinates[0], sensor.Location.Coordinates[1])
+		if d <= nearestDistance {
+			nearest, nearestDistance = sensor, d
+		}
+	}
+	return nearest, nil
+}
+
+// UpdateSensor replaces everything but the IDs, the asset and the version of the sensor, recording a revision when
+// anything changed. It returns ErrVersionConflict when the sensor isn't at the expected version.
+func (s *EmbeddedSensorsRepository) UpdateSensor(ctx context.Context, id string, sensor *Sensor, expectedVersion int) (err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "UpdateSensor", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	return s.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(sensorsBucket)
+		current, err := getDocument[Sensor](bucket, objectID[:])
+		if err != nil {
+			return err
+		}
+		if expectedVersion != AnyVersion && current.Version != expectedVersion {
+			return ErrVersionConflict
+		}
+
+		sensor.ID = current.ID
+		sensor.ExternalID = current.ExternalID
+		sensor.AssetID = current.AssetID
+		sensor.Name = normalizeSensorName(sensor.Name)
+		sensor.Version = current.Version
+		before := NewSensorState(current)
+		after := NewSensorState(sensor)
+		if len(DiffSensorStates(before, after)) == 0 {
+			return nil
+		}
+
+		// The location fix and the geofences are kept, as the $set of MongoDB does
+		updated := *current
+		applySensorState(&updated, after)
+		updated.Version = current.Version + 1
+		if err := s.checkUnique(bucket, &updated); err != nil {
+			return sensorWriteError(err)
+		}
+		if err := putDocument(bucket, objectID[:], &updated); err != nil {
+			return err
+		}
+		if err := s.putRevision(ctx, tx, objectID, updated.Version, &before, after); err != nil {
+			return err
+		}
+		sensor.Version = updated.Version
+		return nil
+	})
+}
+
+func applySensorState(sensor *Sensor, state SensorState) {
+	sensor.Name = state.Name
+	sensor.Description = state.Description
+	sensor.Location = state.Location
+	sensor.Altitude = state.Altitude
+	sensor.Tags = state.Tags
+	sensor.Labels = state.Labels
+	sensor.Hardware = state.Hardware
+	sensor.InstalledAt = state.InstalledAt
+	sensor.AssetID = state.AssetID
+}
+
+func (s *EmbeddedSensorsRepository) MoveSensor(ctx context.Context, id string, fix *SensorFix) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "MoveSensor", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var before *Sensor
+	err = s.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(sensorsBucket)
+		current, err := getDocument[Sensor](bucket, objectID[:])
+		if err != nil {
+			return err
+		}
+		fixedAt := storedTime(fix.Timestamp)
+		if current.LastFixAt != nil && !current.LastFixAt.Before(fixedAt) {
+			return nil
+		}
+
+		moved := *current
+		moved.Location = fix.Location
+		if fix.Altitude != nil {
+			moved.Altitude = fix.Altitude
+		}
+		moved.LastFixAt = &fixedAt
+		moved.GeofenceIDs = fix.GeofenceIDs
+		beforeState := NewSensorState(current)
+		after := NewSensorState(&moved)
+		changed := len(DiffSensorStates(beforeState, after)) > 0
+		if changed {
+			moved.Version = current.Version + 1
+		}
+		if err := putDocument(bucket, objectID[:], &moved); err != nil {
+			return err
+		}
+		if changed {
+			if err := s.putRevision(ctx, tx, objectID, moved.Version, &beforeState, after); err != nil {
+				return err
+			}
+		}
+		before = current
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return before, nil
+}
+
+func (s *EmbeddedSensorsRepository) SetSensorAsset(ctx context.Context, id string, assetID, from *primitive.ObjectID) (_ bool, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "SetSensorAsset", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+
+	var applied bool
+	err = s.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(sensorsBucket)
+		current, err := getDocument[Sensor](bucket, objectID[:])
+		if err != nil {
+			return err
+		}
+		if from != nil && !sameAsset(current.AssetID, from) {
+			return nil
+		}
+		applied = true
+		if sameAsset(current.AssetID, assetID) {
+			return nil
+		}
+
+		updated := *current
+		updated.AssetID = assetID
+		updated.Version = current.Version + 1
+		if err := putDocument(bucket, objectID[:], &updated); err != nil {
+			return err
+		}
+		before := NewSensorState(current)
+		return s.putRevision(ctx, tx, objectID, updated.Version, &before, NewSensorState(&updated))
+	})
+	if err != nil {
+		return false, err
+	}
+	return applied, nil
+}
+
+// AddSensorTag adds the tag to the sensor. Adding a tag the sensor already has changes nothing.
+func (s *EmbeddedSensorsRepository) AddSensorTag(ctx context.Context, id, tag string, expectedVersion int) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "AddSensorTag", append(sensorAttributes(id), attribute.String("sensor.tag", tag))...)
+	defer func() { finish(err) }()
+
+	return s.updateSensorTags(ctx, id, expectedVersion, func(tags []string) ([]string, error) {
+		if slices.Contains(tags, tag) {
+			return nil, nil
+		}
+		return append(slices.Clone(tags), tag), nil
+	})
+}
+
+// RemoveSensorTag removes the tag from the sensor, unless it's the last one. Removing a tag the
+// sensor doesn't have changes nothing.
+func (s *EmbeddedSensorsRepository) RemoveSensorTag(ctx context.Context, id, tag string, expectedVersion int) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "RemoveSensorTag", append(sensorAttributes(id), attribute.String("sensor.tag", tag))...)
+	defer func() { finish(err) }()
+
+	return s.updateSensorTags(ctx, id, expectedVersion, func(tags []string) ([]string, error) {
+		if !slices.Contains(tags, tag) {
+			return nil, nil
+		}
+		if len(tags) == 1 {
+			return nil, ErrLastTag
+		}
+		return slices.DeleteFunc(slices.Clone(tags), func(t string) bool { return t == tag }), nil
+	})
+}
+
+// updateSensorTags applies the change to the tags of the sensor, bumping its version and recording
+// a revision, unless the change returns no tags, in which case the sensor is returned as is.
+func (s *EmbeddedSensorsRepository) updateSensorTags(ctx context.Context, id string, expectedVersion int, change func([]string) ([]string, error)) (*Sensor, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var sensor *Sensor
+	err = s.store.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(sensorsBucket)
+		current, err := getDocument[Sensor](bucket, objectID[:])
+		if err != nil {
+			return err
+		}
+		if expectedVersion != AnyVersion && current.Version != expectedVersion {
+			return ErrVersionConflict
+		}
+
+		tags, err := change(current.Tags)
+		if err != nil {
+			return err
+		}
+		if tags == nil {
+			sensor = current
+			return nil
+		}
+
+		updated := *current
+		updated.Tags = tags
+		updated.Version = current.Version + 1
+		if err := putDocument(bucket, objectID[:], &updated); err != nil {
+			return err
+		}
+		before := NewSensorState(current)
+		if err := s.putRevision(ctx, tx, objectID, updated.Version, &before, NewSensorState(&updated)); err != nil {
+			return err
+		}
+		sensor = &updated
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sensor, nil
+}
+
+// GetSensorHistory returns the revisions of a sensor, oldest first.
+func (s *EmbeddedSensorsRepository) GetSensorHistory(ctx context.Context, id string) (_ []*SensorRevision, err error) {
+	_, finish := instrument(ctx, sensorsRepositoryName, "GetSensorHistory", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.revisions(objectID)
+}
+
+func (s *EmbeddedSensorsRepository) revisions(sensorID primitive.ObjectID) ([]*SensorRevision, error) {
+	var revisions []*SensorRevision
+	err := s.store.view(func(tx *bbolt.Tx) (err error) {
+		revisions, err = findDocuments[SensorRevision](tx.Bucket(sensorRevisionsBucket), sensorID[:], nil)
+		return err
+	})
+	return revisions, err
+}
+
+// GetSensorStateAt returns the state a sensor was in at the time, or nil when it didn't exist yet.
+func (s *EmbeddedSensorsRepository) GetSensorStateAt(ctx context.Context, id string, at time.Time) (_ *SensorState, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetSensorStateAt", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	sensor, err := s.GetSensorByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	revisions, err := s.revisions(sensor.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		state := NewSensorState(sensor)
+		return &state, nil
+	}
+
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if !revisions[i].Timestamp.After(at) {
+			return &revisions[i].After, nil
+		}
+	}
+	// Nothing happened to the sensor up to the time, so it was in the state before the first revision
+	return revisions[0].Before, nil
+}
@@ -0,0 +1,225 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbedded(t *testing.T) {
+	t.Parallel()
+
+	square := GeoJSONPolygon{
+		Type: "Polygon",
+		Coordinates: [][][]float64{
+			{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+			{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}},
+		},
+	}
+
+	t.Run("when a point is on the boundary of a polygon or of its hole, it should be within the polygon", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		point := func(longitude, latitude float64) GeoJSONPoint {
+			return GeoJSONPoint{Type: "Point", Coordinates: []float64{longitude, latitude}}
+		}
+		is.True(polygonContains(square, point(2, 2)))
+		is.True(polygonContains(square, point(10, 5)))
+		is.True(polygonContains(square, point(4, 5)))
+		is.False(polygonContains(square, point(5, 5)))
+		is.False(polygonContains(square, point(11, 5)))
+	})
+
+	t.Run("when a polygon is open or its edges cross, it should be invalid", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		is.True(validPolygon(square))
+		is.False(validPolygon(GeoJSONPolygon{Type: "Polygon", Coordinates: [][][]float64{{{0, 0}, {10, 0}, {10, 10}, {0, 10}}}}))
+		is.False(validPolygon(GeoJSONPolygon{Type: "Polygon", Coordinates: [][][]float64{{{0, 0}, {10, 10}, {10, 0}, {0, 10}, {0, 0}}}}))
+		is.False(validPolygon(GeoJSONPolygon{Type: "Polygon", Coordinates: [][][]float64{{{0, 0}, {200, 0}, {0, 10}, {0, 0}}}}))
+	})
+
+	t.Run("when the distance between two points is computed, it should follow the great circle", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		is.InDelta(111195, distance(0, 0, 1, 0), 1)
+		is.InDelta(111195, distance(0, 0, 0, 1), 1)
+		is.Zero(distance(3, 4, 3, 4))
+	})
+
+	t.Run("when times are encoded as keys, it should sort them as the times, before 1970 included", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		before := timeKey(time.Date(1969, 12, 31, 23, 0, 0, 0, time.UTC))
+		epoch := timeKey(time.Unix(0, 0))
+		after := timeKey(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		is.Less(string(before), string(epoch))
+		is.Less(string(epoch), string(after))
+	})
+
+	t.Run("when a segment name is parsed, it should return the partition it was named after", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		start := alignTime(time.Date(1969, 12, 31, 13, 0, 0, 0, time.UTC), 24*time.Hour)
+		is.Equal(time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC), start)
+
+		seg, ok := parseSegmentName(segmentName(start, 24*time.Hour))
+		is.True(ok)
+		is.Equal(start, seg.start)
+		is.Equal(start.Add(24*time.Hour), seg.end)
+
+		_, ok = parseSegmentName("19691231T000000.000000000Z_0s.jsonl")
+		is.False(ok)
+		_, ok = parseSegmentName("notes.txt")
+		is.False(ok)
+	})
+
+	t.Run("when a segment was left with a partial line, it should skip it and keep the points around it", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		envVars := embeddedEnvVars(t)
+		ctx := context.Background()
+		now := time.Now().UTC().Truncate(time.Second)
+
+		measurementRepository, err := NewEmbeddedMeasurementRepository(envVars)
+		is.Nil(err)
+		is.Nil(measurementRepository.CreateMeasurements(ctx, []*Measurement{
+			{Name: "temperature", SensorID: "s1", Unit: "celsius", Value: 1, Timestamp: now},
+		}))
+		is.Nil(measurementRepository.Close())
+
+		path := filepath.Join(envVars.Embedded.Dir, "measurements", segmentName(alignTime(now, envVars.Embedded.Partition), envVars.Embedded.Partition))
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+		is.Nil(err)
+		_, err = file.WriteString(`{"name":"temperature","sensor_id":"s1"`)
+		is.Nil(err)
+		is.Nil(file.Close())
+
+		measurementRepository, err = NewEmbeddedMeasurementRepository(envVars)
+		is.Nil(err)
+		defer measurementRepository.Close()
+		is.Nil(measurementRepository.CreateMeasurements(ctx, []*Measurement{
+			{Name: "temperature", SensorID: "s1", Unit: "celsius", Value: 2, Timestamp: now.Add(time.Second)},
+		}))
+
+		measurements, err := measurementRepository.GetMeasurements(ctx, "s1", "temperature", "celsius", now, now.Add(time.Minute))
+		is.Nil(err)
+		is.Len(measurements, 2)
+		is.Equal(1.0, measurements[0].Value)
+		is.Equal(2.0, measurements[1].Value)
+	})
+
+	t.Run("when a point is written again for the same time, it should replace the previous one", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		measurementRepository, err := NewEmbeddedMeasurementRepository(embeddedEnvVars(t))
+		is.Nil(err)
+		defer measurementRepository.Close()
+
+		ctx := context.Background()
+		now := time.Now().UTC()
+		is.Nil(measurementRepository.CreateMeasurements(ctx, []*Measurement{
+			{Name: "temperature", SensorID: "s1", Unit: "celsius", Value: 1, Timestamp: now},
+		}))
+		is.Nil(measurementRepository.CreateMeasurements(ctx, []*Measurement{
+			{Name: "temperature", SensorID: "s1", Unit: "celsius", Value: 3, Timestamp: now},
+		}))
+
+		measurements, err := measurementRepository.GetMeasurements(ctx, "s1", "temperature", "celsius", now.Add(-time.Minute), now.Add(time.Minute))
+		is.Nil(err)
+		is.Len(measurements, 1)
+		is.Equal(3.0, measurements[0].Value)
+	})
+
+	t.Run("when a range has more points than the limits, it should stop reading and stream the rest by partition", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		envVars := embeddedEnvVars(t)
+		envVars.Embedded.Partition = time.Hour
+		envVars.Embedded.MaxPartitionPoints = 4
+		envVars.Query.MaxPoints = 3
+		measurementRepository, err := NewEmbeddedMeasurementRepository(envVars)
+		is.Nil(err)
+		defer measurementRepository.Close()
+
+		ctx := context.Background()
+		start := alignTime(time.Now().UTC(), time.Hour).Add(-2 * time.Hour)
+		points := []*Measurement{}
+		for i := 0; i < 6; i++ {
+			// Three points in each of two partitions, written newest first
+			points = append(points, &Measurement{Name: "temperature", SensorID: "s1", Unit: "celsius", Value: float64(5 - i), Timestamp: start.Add(time.Duration(5-i) * 20 * time.Minute)})
+		}
+		is.Nil(measurementRepository.CreateMeasurements(ctx, points))
+
+		_, err = measurementRepository.GetMeasurements(ctx, "s1", "temperature", "celsius", start, start.Add(2*time.Hour))
+		var tooManyPoints *TooManyPointsError
+		is.ErrorAs(err, &tooManyPoints)
+		is.Equal(3, tooManyPoints.Max)
+
+		values := []float64{}
+		is.Nil(measurementRepository.StreamMeasurements(ctx, []string{"s1"}, "temperature", "celsius", start, start.Add(2*time.Hour), func(m *Measurement) error {
+			values = append(values, m.Value)
+			return nil
+		}))
+		is.Equal([]float64{0, 1, 2, 3, 4, 5}, values)
+
+		is.Nil(measurementRepository.CreateMeasurements(ctx, []*Measurement{
+			{Name: "temperature", SensorID: "s1", Unit: "celsius", Value: 6, Timestamp: start.Add(10 * time.Minute)},
+			{Name: "temperature", SensorID: "s1", Unit: "celsius", Value: 7, Timestamp: start.Add(30 * time.Minute)},
+		}))
+		err = measurementRepository.StreamMeasurements(ctx, []string{"s1"}, "temperature", "celsius", start, start.Add(2*time.Hour), func(m *Measurement) error {
+			return nil
+		})
+		var partitionTooLarge *PartitionTooLargeError
+		is.ErrorAs(err, &partitionTooLarge)
+		is.Equal(4, partitionTooLarge.Max)
+	})
+
+	t.Run("when segments are past the retention, it should remove them when opening the store", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		envVars := embeddedEnvVars(t)
+		envVars.Embedded.Retention = 48 * time.Hour
+		dir := filepath.Join(envVars.Embedded.Dir, "measurements")
+		is.Nil(os.MkdirAll(dir, 0o755))
+
+		now := time.Now()
+		expired := segmentName(alignTime(now.Add(-72*time.Hour), time.Hour), time.Hour)
+		kept := segmentName(alignTime(now.Add(-24*time.Hour), time.Hour), time.Hour)
+		for _, name := range []string{expired, kept} {
+			is.Nil(os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+		}
+
+		measurementRepository, err := NewEmbeddedMeasurementRepository(envVars)
+		is.Nil(err)
+		defer measurementRepository.Close()
+
+		_, err = os.Stat(filepath.Join(dir, expired))
+		is.True(os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(dir, kept))
+		is.Nil(err)
+	})
+
+	t.Run("when the median of an even number of values is computed, it should interpolate the middle values", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		is.Equal(2.5, aggregateValues("median", []float64{4, 1, 3, 2}))
+		is.Equal(3.0, aggregateValues("median", []float64{5, 1, 3}))
+		is.Equal(2.5, aggregateValues("mean", []float64{4, 1, 3, 2}))
+		is.Equal(2.0, aggregateValues("last", []float64{4, 1, 3, 2}))
+	})
+}
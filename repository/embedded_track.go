@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type EmbeddedTracksRepository struct {
+	store               *EmbeddedStore
+	sensorsRepository   SensorsRepository
+	geofencesRepository GeofencesRepository
+}
+
+func NewEmbeddedTracksRepository(store *EmbeddedStore, sensorsRepository SensorsRepository, geofencesRepository GeofencesRepository) TracksRepository {
+	return &EmbeddedTracksRepository{store: store, sensorsRepository: sensorsRepository, geofencesRepository: geofencesRepository}
+}
+
+func trackKey(sensorID primitive.ObjectID, timestamp time.Time) []byte {
+	return append(sensorID[:], timeKey(timestamp)...)
+}
+
+// RecordLocation adds the point to the track of its sensor and, unless the sensor already has a
+// more recent point, moves the sensor there. It returns the enter and exit events of the move,
+// which are also stored. Points reported again for the same time replace the previous ones.
+func (t *EmbeddedTracksRepository) RecordLocation(ctx context.Context, point *TrackPoint) ([]*GeofenceEvent, error) {
+	err := t.store.update(func(tx *bbolt.Tx) error {
+		tracks := tx.Bucket(tracksBucket)
+		document := *point
+		document.Timestamp = storedTime(point.Timestamp)
+		key := trackKey(document.SensorID, document.Timestamp)
+		if existing, err := getDocument[TrackPoint](tracks, key); err == nil {
+			document.ID = existing.ID
+		} else {
+			document.ID = primitive.NewObjectID()
+		}
+		return putDocument(tracks, key, &document)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record track point: %w", err)
+	}
+
+	return moveSensor(ctx, point, t.sensorsRepository, t.geofencesRepository)
+}
+
+// GetTrack returns the points of the sensor within the time range, oldest first.
+func (t *EmbeddedTracksRepository) GetTrack(ctx context.Context, sensorID primitive.ObjectID, start, end time.Time) ([]*TrackPoint, error) {
+	var points []*TrackPoint
+	err := t.store.view(func(tx *bbolt.Tx) (err error) {
+		points, err = findRange[TrackPoint](tx.Bucket(tracksBucket), sensorID[:], start, end, nil)
+		return err
+	})
+	return points, err
+}
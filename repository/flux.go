@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Flux queries are built from templates whose @name placeholders are replaced by the literals of
+// their arguments, rendered by type. The text of a query only comes from the constants of the
+// code, so no value, such as a measurement name sent by a client, can end a string literal and
+// add to the query. InfluxDB OSS doesn't support query parameters, which would keep the values
+// out of the query altogether, so the values are escaped instead.
+var fluxPlaceholder = regexp.MustCompile(`@[a-z_][a-z0-9_]*`)
+
+type fluxArgs map[string]any
+
+// fluxExpr is Flux code rendered by this package, such as a predicate, inserted as is.
+type fluxExpr string
+
+// flux renders the template with the arguments: strings and string slices as string literals and
+// arrays, times as time literals, durations as duration literals, ints as integer literals and
+// fluxExpr as is. It panics on a placeholder without an argument or an argument of another type,
+// which are errors of the code rather than of the values.
+func flux(template string, args fluxArgs) fluxExpr {
+	return fluxExpr(fluxPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value, ok := args[placeholder[1:]]
+		if !ok {
+			panic(fmt.Sprintf("flux: no argument for %s", placeholder))
+		}
+		return fluxLiteral(value)
+	}))
+}
+
+func fluxLiteral(value any) string {
+	switch v := value.(type) {
+	case string:
+		return fluxString(v)
+	case []string:
+		literals := make([]string, 0, len(v))
+		for _, s := range v {
+			literals = append(literals, fluxString(s))
+		}
+		return "[" + strings.Join(literals, ", ") + "]"
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case time.Duration:
+		return formatFluxDuration(v)
+	case int:
+		return strconv.Itoa(v)
+	case fluxExpr:
+		return string(v)
+	default:
+		panic(fmt.Sprintf("flux: unsupported argument type %T", value))
+	}
+}
+
+// fluxString quotes s as a Flux string literal. Besides the quotes and backslashes, "${" is
+// escaped since it starts an interpolation, and the control characters are written as bytes.
+// Invalid UTF-8 is replaced, as Flux queries must be valid UTF-8.
+func fluxString(s string) string {
+	s = strings.ToValidUTF8(s, string(utf8.RuneError))
+
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i, r := range s {
+		switch {
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '$' && strings.HasPrefix(s[i+1:], "{"):
+			b.WriteString(`\$`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Functions that can be passed by name to the queries, as aggregates or selectors
+var fluxFunctions = map[string]bool{
+	"mean":   true,
+	"median": true,
+	"min":    true,
+	"max":    true,
+	"sum":    true,
+	"count":  true,
+	"first":  true,
+	"last":   true,
+}
+
+// fluxFunction returns the Flux function of the name, which must be one of fluxFunctions.
+func fluxFunction(name string) (fluxExpr, error) {
+	if !fluxFunctions[name] {
+		return "", fmt.Errorf("unsupported function: %q", name)
+	}
+	return fluxExpr(name), nil
+}
+
+// formatFluxDuration formats d as a Flux duration literal, which unlike time.Duration.String
+// doesn't accept fractional values.
+func formatFluxDuration(d time.Duration) string {
+	switch {
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	case d%time.Millisecond == 0:
+		return fmt.Sprintf("%dms", d/time.Millisecond)
+	default:
+		return fmt.Sprintf("%dns", d.Nanoseconds())
+	}
+}
@@ -0,0 +1,216 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	influxdb2api "github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
+)
+
+var errQueryCaptured = errors.New("query captured")
+
+// capturingQueryAPI records the queries instead of running them.
+type capturingQueryAPI struct {
+	influxdb2api.QueryAPI
+	queries []string
+}
+
+func (c *capturingQueryAPI) Query(_ context.Context, query string) (*influxdb2api.QueryTableResult, error) {
+	c.queries = append(c.queries, query)
+	return nil, errQueryCaptured
+}
+
+// scanFlux replaces the string literals of a query by "?", returning them unescaped. It fails on
+// what Flux wouldn't read as a plain string, such as an interpolation or an unterminated literal,
+// so the skeletons of two queries are the same when only the values of their strings differ.
+func scanFlux(query string) (string, []string, error) {
+	var skeleton strings.Builder
+	var literals []string
+	for i := 0; i < len(query); i++ {
+		if query[i] != '"' {
+			skeleton.WriteByte(query[i])
+			continue
+		}
+
+		var literal strings.Builder
+		for i++; ; i++ {
+			if i >= len(query) {
+				return "", nil, errors.New("unterminated string literal")
+			}
+			ch := query[i]
+			if ch == '"' {
+				break
+			}
+			if ch == '$' && i+1 < len(query) && query[i+1] == '{' {
+				return "", nil, errors.New("interpolation in string literal")
+			}
+			if ch != '\\' {
+				literal.WriteByte(ch)
+				continue
+			}
+
+			i++
+			if i >= len(query) {
+				return "", nil, errors.New("unterminated escape")
+			}
+			switch query[i] {
+			case '"', '\\', '$':
+				literal.WriteByte(query[i])
+			case 'n':
+				literal.WriteByte('\n')
+			case 'r':
+				literal.WriteByte('\r')
+			case 't':
+				literal.WriteByte('\t')
+			case 'x':
+				var b byte
+				if _, err := fmt.Sscanf(query[i+1:min(i+3, len(query))], "%02x", &b); err != nil {
+					return "", nil, fmt.Errorf("invalid byte escape: %w", err)
+				}
+				literal.WriteByte(b)
+				i += 2
+			default:
+				return "", nil, fmt.Errorf("invalid escape \\%c", query[i])
+			}
+		}
+		skeleton.WriteString(`"?"`)
+		literals = append(literals, literal.String())
+	}
+	return skeleton.String(), literals, nil
+}
+
+// measurementQueries returns the queries of the repository, the summaries and aggregates being read
+// from both the raw bucket and the rollups, followed by the query of the hourly rollup job.
+func measurementQueries(measurement, unit, sensorID, labelKey, labelValue string) []string {
+	api := &capturingQueryAPI{}
+	raw := &InfluxMeasurementRepository{bucket: "raw", org: "org", maxPoints: 10, queryAPI: api}
+	rollups := &InfluxMeasurementRepository{
+		bucket:       "raw",
+		rollupBucket: "rollups",
+		org:          "org",
+		rollup:       rollupPolicy{rawMaxRange: time.Hour, rawRetention: time.Hour, hourlyMaxRange: 30 * 24 * time.Hour},
+		queryAPI:     api,
+	}
+
+	ctx := context.Background()
+	end := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	start := end.Add(-48 * time.Hour)
+	sensorIDs := []string{sensorID, "other"}
+	selector := label.Selector{
+		{Key: labelKey, Operator: label.OperatorEquals, Value: labelValue},
+		{Key: labelKey, Operator: label.OperatorNotEquals, Value: labelValue},
+		{Key: labelKey, Operator: label.OperatorExists},
+	}
+
+	_, _ = raw.GetMeasurements(ctx, sensorID, measurement, unit, start, end)
+	_, _ = raw.GetMeasurementTimestamps(ctx, sensorID, measurement, unit, start, end)
+	_ = raw.StreamMeasurements(ctx, sensorIDs, measurement, unit, start, end, nil)
+	_, _ = raw.GetSensorValues(ctx, sensorIDs, measurement, unit, start, end, "mean")
+	_, _ = raw.GetMeasurementsByLabels(ctx, selector, measurement, unit, start, end)
+	_, _ = raw.GetAggregatedMeasurements(ctx, sensorID, measurement, unit, start, end, time.Minute, "max")
+	_, _ = raw.GetMeasurementSummary(ctx, sensorID, measurement, unit, start, end)
+	_, _ = rollups.GetMeasurementSummary(ctx, sensorID, measurement, unit, start, end)
+	for _, fn := range []string{"min", "count", "mean"} {
+		_, _ = rollups.GetAggregatedMeasurements(ctx, sensorID, measurement, unit, start, end, time.Hour, fn)
+	}
+	_ = rollups.RollupMeasurements(ctx, RollupHourly, start, end)
+	return api.queries
+}
+
+func TestFlux(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when a string is quoted, it should escape what could end it or interpolate", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		is.Equal(`"temperature"`, fluxString("temperature"))
+		is.Equal(`"\") |> drop() |> yield(name: \"x"`, fluxString(`") |> drop() |> yield(name: "x`))
+		is.Equal(`"\\\" or true or \"\\"`, fluxString(`\" or true or "\`))
+		is.Equal(`"\${r._value} costs $5"`, fluxString("${r._value} costs $5"))
+		is.Equal(`"a\nb\tc\x00"`, fluxString("a\nb\tc\x00"))
+		is.Equal(`"`+string(utf8.RuneError)+`"`, fluxString("\xff"))
+	})
+
+	t.Run("when a template is rendered, it should format the arguments as literals of their type", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		query := flux(`range(start: @start, stop: @stop) |> window(every: @every) |> limit(n: @n) |> filter(fn: (r) => contains(value: r.id, set: @ids))`, fluxArgs{
+			"start": time.Date(2024, 10, 1, 0, 0, 0, 500, time.UTC),
+			"stop":  time.Date(2024, 10, 2, 3, 0, 0, 0, time.FixedZone("", 3*60*60)),
+			"every": 90 * time.Second,
+			"n":     10,
+			"ids":   []string{"a", `b"`},
+		})
+		is.Equal(`range(start: 2024-10-01T00:00:00.0000005Z, stop: 2024-10-02T00:00:00Z) |> window(every: 90s) |> limit(n: 10) |> filter(fn: (r) => contains(value: r.id, set: ["a", "b\""]))`, string(query))
+		is.Panics(func() { flux(`from(bucket: @bucket)`, fluxArgs{}) })
+	})
+
+	t.Run("when a function isn't one of the allowed ones, it should be rejected", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		_, err := fluxFunction("mean")
+		is.Nil(err)
+		_, err = fluxFunction(`mean, createEmpty: true) |> drop(`)
+		is.NotNil(err)
+
+		_, err = (&InfluxMeasurementRepository{queryAPI: &capturingQueryAPI{}}).GetSensorValues(context.Background(), []string{"a"}, "temperature", "celsius", time.Now().Add(-time.Hour), time.Now(), "yield")
+		is.ErrorContains(err, "unsupported function")
+	})
+
+	t.Run("when the queries of the repository are built, they should only hold well formed string literals", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		queries := measurementQueries("temperature", "celsius", "sensor", "site", "north")
+		is.Len(queries, 12)
+		for _, query := range queries {
+			_, _, err := scanFlux(query)
+			is.Nil(err, query)
+		}
+	})
+}
+
+// FuzzMeasurementQueries checks that no value can change the structure of the queries: with any
+// values, the queries are the same as with harmless ones once their strings are left out, and
+// their strings hold the values unchanged.
+func FuzzMeasurementQueries(f *testing.F) {
+	f.Add("temperature", "celsius", "sensor", "site", "north")
+	f.Add(`temperature") |> drop() |> yield(name: "x`, `celsius" or true or "`, `") |> to(bucket: "other`, `site"] or r["x`, `north" or 1 == 1 or "`)
+	f.Add(`\`, `\"`, `${r._value}`, `$`, `{`)
+	f.Add("a\nb", "\r\t", "\x00\x1f\x7f", "\xff\xfe", "é")
+	f.Add(`"`, `""`, `\\"`, `@bucket`, `@start`)
+
+	expected := measurementQueries("temperature", "celsius", "sensor", "site", "north")
+	skeletons := make([]string, len(expected))
+	for i, query := range expected {
+		skeleton, _, err := scanFlux(query)
+		require.Nil(f, err)
+		skeletons[i] = skeleton
+	}
+
+	f.Fuzz(func(t *testing.T, measurement, unit, sensorID, labelKey, labelValue string) {
+		is := require.New(t)
+
+		queries := measurementQueries(measurement, unit, sensorID, labelKey, labelValue)
+		is.Len(queries, len(skeletons))
+		for i, query := range queries {
+			skeleton, literals, err := scanFlux(query)
+			is.Nil(err, query)
+			is.Equal(skeletons[i], skeleton)
+			// The rollup job, the last query, runs for all the measurements
+			if i < len(queries)-1 {
+				is.Contains(literals, strings.ToValidUTF8(measurement, string(utf8.RuneError)))
+			}
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"math"
+)
+
+const earthRadius = 6371008.8 // Meters
+
+// The embedded store has no geospatial index, so it answers the queries MongoDB answers with its
+// 2dsphere indexes by computing them. The edges of the polygons are taken as straight lines in
+// longitude and latitude rather than as the great circles MongoDB follows, which only tells the
+// difference for areas spanning hundreds of kilometers.
+
+// distance is the great-circle distance in meters.
+func distance(longitude1, latitude1, longitude2, latitude2 float64) float64 {
+	lat1 := latitude1 * math.Pi / 180
+	lat2 := latitude2 * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (longitude2 - longitude1) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// validPolygon tells whether the polygon is one MongoDB would index: rings of at least four
+// positions within the valid coordinates, each closed and without edges crossing each other.
+func validPolygon(polygon GeoJSONPolygon) bool {
+	if polygon.Type != "Polygon" || len(polygon.Coordinates) == 0 {
+		return false
+	}
+	for _, ring := range polygon.Coordinates {
+		if len(ring) < 4 {
+			return false
+		}
+		for _, position := range ring {
+			if len(position) < 2 || math.Abs(position[0]) > 180 || math.Abs(position[1]) > 90 {
+				return false
+			}
+		}
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			return false
+		}
+		if selfIntersecting(ring) {
+			return false
+		}
+	}
+	return true
+}
+
+// selfIntersecting tells whether edges of the closed ring that aren't next to each other touch.
+func selfIntersecting(ring [][]float64) bool {
+	edges := len(ring) - 1
+	for i := 0; i < edges; i++ {
+		for j := i + 2; j < edges; j++ {
+			if i == 0 && j == edges-1 {
+				// The first and last edges share the closing position
+				continue
+			}
+			if segmentsIntersect(ring[i], ring[i+1], ring[j], ring[j+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func segmentsIntersect(a, b, c, d []float64) bool {
+	o1 := orientation(a, b, c)
+	o2 := orientation(a, b, d)
+	o3 := orientation(c, d, a)
+	o4 := orientation(c, d, b)
+	if o1 != o2 && o3 != o4 {
+		return true
+	}
+	return o1 == 0 && onSegment(c, a, b) ||
+		o2 == 0 && onSegment(d, a, b) ||
+		o3 == 0 && onSegment(a, c, d) ||
+		o4 == 0 && onSegment(b, c, d)
+}
+
+// orientation is 1 when c is to the left of the line from a to b, -1 when it's to the right and 0
+// when the three positions are aligned.
+func orientation(a, b, c []float64) int {
+	cross := (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+	switch {
+	case cross > 0:
+		return 1
+	case cross < 0:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// onSegment tells whether p, aligned with a and b, lies between them.
+func onSegment(p, a, b []float64) bool {
+	return math.Min(a[0], b[0]) <= p[0] && p[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= p[1] && p[1] <= math.Max(a[1], b[1])
+}
+
+// polygonContains tells whether the point is within the outer ring of the polygon and outside of
+// its holes, boundaries included, as $geoIntersects does.
+func polygonContains(polygon GeoJSONPolygon, point GeoJSONPoint) bool {
+	if len(polygon.Coordinates) == 0 || len(point.Coordinates) < 2 {
+		return false
+	}
+	p := point.Coordinates
+	if !ringContains(polygon.Coordinates[0], p) && !ringBoundary(polygon.Coordinates[0], p) {
+		return false
+	}
+	for _, hole := range polygon.Coordinates[1:] {
+		if ringContains(hole, p) && !ringBoundary(hole, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains casts a ray from the point, which is within the ring when it crosses an odd number
+// of edges.
+func ringContains(ring [][]float64, p []float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func ringBoundary(ring [][]float64, p []float64) bool {
+	for i := 0; i+1 < len(ring); i++ {
+		if orientation(ring[i], ring[i+1], p) == 0 && onSegment(p, ring[i], ring[i+1]) {
+			return true
+		}
+	}
+	return false
+}
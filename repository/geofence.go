@@ -0,0 +1,235 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	GeofenceEventEnter = "enter"
+	GeofenceEventExit  = "exit"
+)
+
+// ErrInvalidGeofenceArea is returned for the polygons of geofences that can't be indexed, such as
+// the ones whose edges cross each other.
+var ErrInvalidGeofenceArea = errors.New("the area of the geofence isn't a valid polygon")
+
+type GeoJSONPolygon struct {
+	Type        string        `bson:"type" json:"type"`               // Should be "Polygon"
+	Coordinates [][][]float64 `bson:"coordinates" json:"coordinates"` // Closed rings of longitude, latitude pairs, the outer one first
+}
+
+type Geofence struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name string             `bson:"name" json:"name"`
+	Area GeoJSONPolygon     `bson:"area" json:"area"`
+}
+
+// GeofenceEvent records a sensor crossing the boundary of a geofence.
+type GeofenceEvent struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	SensorID     primitive.ObjectID `bson:"sensor_id" json:"sensor_id"`
+	GeofenceID   primitive.ObjectID `bson:"geofence_id" json:"geofence_id"`
+	GeofenceName string             `bson:"geofence_name" json:"geofence_name"`
+	Type         string             `bson:"type" json:"type"`
+	Timestamp    time.Time          `bson:"timestamp" json:"timestamp"`
+	Location     GeoJSONPoint       `bson:"location" json:"location"`
+}
+
+type GeofencesRepository interface {
+	// CreateGeofence returns ErrInvalidGeofenceArea when the area isn't a valid polygon.
+	CreateGeofence(ctx context.Context, geofence *Geofence) error
+	// GetGeofence returns nil when there's no geofence with the ID.
+	GetGeofence(ctx context.Context, id string) (*Geofence, error)
+	GetGeofences(ctx context.Context) ([]*Geofence, error)
+	// GetGeofencesContaining returns the geofences the point is within, boundaries included.
+	GetGeofencesContaining(ctx context.Context, point GeoJSONPoint) ([]*Geofence, error)
+	// GetGeofencesByIDs returns the geofences that still exist out of the IDs.
+	GetGeofencesByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*Geofence, error)
+	// DeleteGeofence deletes the geofence, keeping its events, and reports whether it existed.
+	DeleteGeofence(ctx context.Context, id string) (bool, error)
+
+	SaveEvents(ctx context.Context, events []*GeofenceEvent) error
+	// GetSensorEvents returns the events of the sensor within the time range, oldest first.
+	GetSensorEvents(ctx context.Context, sensorID primitive.ObjectID, start, end time.Time) ([]*GeofenceEvent, error)
+	// GetGeofenceEvents returns the events of the geofence within the time range, oldest first.
+	GetGeofenceEvents(ctx context.Context, geofenceID primitive.ObjectID, start, end time.Time) ([]*GeofenceEvent, error)
+}
+
+type MongoGeofencesRepository struct {
+	geofencesColl *mongo.Collection
+	eventsColl    *mongo.Collection
+}
+
+func NewMongoGeofencesRepository(envVars *config.EnvVars, mongoClient *mongo.Client) (GeofencesRepository, error) {
+	geofencesColl := mongoClient.Database(envVars.MongoDB.Database).Collection("geofences")
+	_, err := geofencesColl.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys: bson.M{"area": "2dsphere"},
+		},
+		{
+			Keys:    bson.D{{Key: "name", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	eventsColl := mongoClient.Database(envVars.MongoDB.Database).Collection("geofence_events")
+	_, err = eventsColl.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "sensor_id", Value: 1}, {Key: "timestamp", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "geofence_id", Value: 1}, {Key: "timestamp", Value: 1}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoGeofencesRepository{
+		geofencesColl: geofencesColl,
+		eventsColl:    eventsColl,
+	}, nil
+}
+
+// CreateGeofence returns ErrInvalidGeofenceArea when MongoDB can't index the area.
+func (g *MongoGeofencesRepository) CreateGeofence(ctx context.Context, geofence *Geofence) error {
+	result, err := g.geofencesColl.InsertOne(ctx, geofence)
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			// Can't extract geo keys
+			if e.Code == 16755 {
+				return ErrInvalidGeofenceArea
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	geofence.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetGeofence returns nil when there's no geofence with the ID.
+func (g *MongoGeofencesRepository) GetGeofence(ctx context.Context, id string) (*Geofence, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var geofence Geofence
+	if err := g.geofencesColl.FindOne(ctx, bson.M{"_id": objectID}).Decode(&geofence); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &geofence, nil
+}
+
+func (g *MongoGeofencesRepository) GetGeofences(ctx context.Context) ([]*Geofence, error) {
+	return g.findGeofences(ctx, bson.M{})
+}
+
+// GetGeofencesContaining returns the geofences the point is within, boundaries included.
+func (g *MongoGeofencesRepository) GetGeofencesContaining(ctx context.Context, point GeoJSONPoint) ([]*Geofence, error) {
+	return g.findGeofences(ctx, bson.M{
+		"area": bson.M{
+			"$geoIntersects": bson.M{"$geometry": point},
+		},
+	})
+}
+
+// GetGeofencesByIDs returns the geofences that still exist out of the IDs.
+func (g *MongoGeofencesRepository) GetGeofencesByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*Geofence, error) {
+	if len(ids) == 0 {
+		return []*Geofence{}, nil
+	}
+	return g.findGeofences(ctx, bson.M{"_id": bson.M{"$in": ids}})
+}
+
+func (g *MongoGeofencesRepository) findGeofences(ctx context.Context, filter bson.M) ([]*Geofence, error) {
+	cursor, err := g.geofencesColl.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	geofences := []*Geofence{}
+	if err := cursor.All(ctx, &geofences); err != nil {
+		return nil, err
+	}
+	return geofences, nil
+}
+
+// DeleteGeofence deletes the geofence, keeping its events, and reports whether it existed.
+func (g *MongoGeofencesRepository) DeleteGeofence(ctx context.Context, id string) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := g.geofencesColl.DeleteOne(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (g *MongoGeofencesRepository) SaveEvents(ctx context.Context, events []*GeofenceEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	documents := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		documents = append(documents, event)
+	}
+	result, err := g.eventsColl.InsertMany(ctx, documents)
+	if err != nil {
+		return err
+	}
+	for i, id := range result.InsertedIDs {
+		events[i].ID = id.(primitive.ObjectID)
+	}
+	return nil
+}
+
+// GetSensorEvents returns the events of the sensor within the time range, oldest first.
+func (g *MongoGeofencesRepository) GetSensorEvents(ctx context.Context, sensorID primitive.ObjectID, start, end time.Time) ([]*GeofenceEvent, error) {
+	return g.findEvents(ctx, bson.M{
+		"sensor_id": sensorID,
+		"timestamp": bson.M{"$gte": start, "$lt": end},
+	})
+}
+
+// GetGeofenceEvents returns the events of the geofence within the time range, oldest first.
+func (g *MongoGeofencesRepository) GetGeofenceEvents(ctx context.Context, geofenceID primitive.ObjectID, start, end time.Time) ([]*GeofenceEvent, error) {
+	return g.findEvents(ctx, bson.M{
+		"geofence_id": geofenceID,
+		"timestamp":   bson.M{"$gte": start, "$lt": end},
+	})
+}
+
+func (g *MongoGeofencesRepository) findEvents(ctx context.Context, filter bson.M) ([]*GeofenceEvent, error) {
+	cursor, err := g.eventsColl.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*GeofenceEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
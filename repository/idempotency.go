@@ -0,0 +1,153 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	IdempotencyStatusPending   = "pending"
+	IdempotencyStatusCompleted = "completed"
+)
+
+// IdempotencyRecord is the response given to the first request with an idempotency key, replayed
+// for the requests repeating it. It's pending while the first request is being handled.
+type IdempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	Fingerprint string    `bson:"fingerprint"`
+	Status      string    `bson:"status"`
+	StatusCode  int       `bson:"status_code"`
+	ContentType string    `bson:"content_type"`
+	Body        []byte    `bson:"body"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+type IdempotencyRepository interface {
+	// Reserve claims the key for a request. It returns nil when the key was claimed, and the
+	// record of the request that holds it otherwise.
+	Reserve(ctx context.Context, key, fingerprint string) (*IdempotencyRecord, error)
+	// Complete stores the response of the request that reserved the key.
+	Complete(ctx context.Context, key string, statusCode int, contentType string, body []byte) error
+	// Release frees the key of a request that failed in a way worth retrying.
+	Release(ctx context.Context, key string) error
+}
+
+type MongoIdempotencyRepository struct {
+	idempotencyColl *mongo.Collection
+	window          time.Duration
+	pendingTimeout  time.Duration
+}
+
+func NewMongoIdempotencyRepository(envVars *config.EnvVars, mongoClient *mongo.Client) (IdempotencyRepository, error) {
+	database := mongoClient.Database(envVars.MongoDB.Database)
+	idempotencyColl := database.Collection("idempotency_keys")
+
+	// MongoDB removes the expired records on its own, every minute or so
+	expireAfter := int32(envVars.Idempotency.Window.Seconds())
+	_, err := idempotencyColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetName("created_at_ttl").SetExpireAfterSeconds(expireAfter),
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "IndexOptionsConflict" {
+		// The window changed since the index was created
+		err = database.RunCommand(context.Background(), bson.D{
+			{Key: "collMod", Value: idempotencyColl.Name()},
+			{Key: "index", Value: bson.D{
+				{Key: "name", Value: "created_at_ttl"},
+				{Key: "expireAfterSeconds", Value: expireAfter},
+			}},
+		}).Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoIdempotencyRepository{
+		idempotencyColl: idempotencyColl,
+		window:          envVars.Idempotency.Window,
+		pendingTimeout:  envVars.Idempotency.PendingTimeout,
+	}, nil
+}
+
+// Reserve claims the key for a request. It returns nil when the key was claimed, and the record of
+// the request that holds it otherwise. Records past the window, and pending records past the
+// pending timeout, which are left by requests that never finished, are claimed over.
+func (r *MongoIdempotencyRepository) Reserve(ctx context.Context, key, fingerprint string) (*IdempotencyRecord, error) {
+	for {
+		now := time.Now()
+		_, err := r.idempotencyColl.InsertOne(ctx, &IdempotencyRecord{
+			Key:         key,
+			Fingerprint: fingerprint,
+			Status:      IdempotencyStatusPending,
+			CreatedAt:   now,
+		})
+		if err == nil {
+			return nil, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		err = r.idempotencyColl.FindOneAndUpdate(ctx,
+			bson.M{
+				"_id": key,
+				"$or": bson.A{
+					bson.M{"created_at": bson.M{"$lt": now.Add(-r.window)}},
+					bson.M{"status": IdempotencyStatusPending, "created_at": bson.M{"$lt": now.Add(-r.pendingTimeout)}},
+				},
+			},
+			bson.M{"$set": bson.M{
+				"fingerprint":  fingerprint,
+				"status":       IdempotencyStatusPending,
+				"status_code":  0,
+				"content_type": "",
+				"body":         nil,
+				"created_at":   now,
+			}},
+		).Err()
+		if err == nil {
+			return nil, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+
+		var record IdempotencyRecord
+		err = r.idempotencyColl.FindOne(ctx, bson.M{"_id": key}).Decode(&record)
+		if err == mongo.ErrNoDocuments {
+			// Expired in between, so it's free to be claimed again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+}
+
+// Complete stores the response of the request that reserved the key.
+func (r *MongoIdempotencyRepository) Complete(ctx context.Context, key string, statusCode int, contentType string, body []byte) error {
+	_, err := r.idempotencyColl.UpdateOne(ctx,
+		bson.M{"_id": key},
+		bson.M{"$set": bson.M{
+			"status":       IdempotencyStatusCompleted,
+			"status_code":  statusCode,
+			"content_type": contentType,
+			"body":         body,
+		}},
+	)
+	return err
+}
+
+// Release frees the key of a request that failed in a way worth retrying.
+func (r *MongoIdempotencyRepository) Release(ctx context.Context, key string) error {
+	_, err := r.idempotencyColl.DeleteOne(ctx, bson.M{"_id": key, "status": IdempotencyStatusPending})
+	return err
+}
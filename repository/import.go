@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ImportStatusRunning   = "running"
+	ImportStatusCompleted = "completed"
+)
+
+// Import tracks the progress of a bulk import so it can be resumed. Rows are numbered from 1 in
+// the order they appear in the file, and every row up to CommittedRows was either written or
+// reported as failed.
+type Import struct {
+	ID              string           `bson:"_id" json:"import_id"`
+	Status          string           `bson:"status" json:"status"`
+	CommittedRows   int              `bson:"committed_rows" json:"committed_rows"`
+	ImportedRows    int              `bson:"imported_rows" json:"imported_rows"`
+	FailedRows      int              `bson:"failed_rows" json:"failed_rows"`
+	DuplicateRows   int              `bson:"duplicate_rows" json:"duplicate_rows"`
+	Errors          []ImportRowError `bson:"errors" json:"errors"`
+	ErrorsTruncated bool             `bson:"errors_truncated" json:"errors_truncated"`
+	StartedAt       time.Time        `bson:"started_at" json:"started_at"`
+	UpdatedAt       time.Time        `bson:"updated_at" json:"updated_at"`
+}
+
+type ImportRowError struct {
+	Row   int    `bson:"row" json:"row"`
+	Error string `bson:"error" json:"error"`
+}
+
+type ImportsRepository interface {
+	// GetImport returns nil when there's no import with the ID.
+	GetImport(ctx context.Context, id string) (*Import, error)
+	SaveImport(ctx context.Context, imp *Import) error
+}
+
+type MongoImportsRepository struct {
+	importsColl *mongo.Collection
+}
+
+func NewMongoImportsRepository(envVars *config.EnvVars, mongoClient *mongo.Client) ImportsRepository {
+	return &MongoImportsRepository{
+		importsColl: mongoClient.Database(envVars.MongoDB.Database).Collection("imports"),
+	}
+}
+
+// GetImport returns nil when there's no import with the ID.
+func (r *MongoImportsRepository) GetImport(ctx context.Context, id string) (*Import, error) {
+	var imp Import
+	if err := r.importsColl.FindOne(ctx, bson.M{"_id": id}).Decode(&imp); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &imp, nil
+}
+
+func (r *MongoImportsRepository) SaveImport(ctx context.Context, imp *Import) error {
+	imp.UpdatedAt = time.Now()
+	_, err := r.importsColl.ReplaceOne(ctx, bson.M{"_id": imp.ID}, imp, options.Replace().SetUpsert(true))
+	return err
+}
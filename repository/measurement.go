@@ -2,13 +2,23 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	influxdb2api "github.com/influxdata/influxdb-client-go/v2/api"
+	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
 	"github.com/rs/zerolog/log"
 	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
+	"github.com/zignd/pingthings-collaborative-technical-interview/metrics"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Measurement struct {
@@ -17,6 +27,8 @@ type Measurement struct {
 	Unit      string
 	Value     float64
 	Timestamp time.Time
+	// Labels of the sensor when the measurement was taken, written as tags
+	Labels map[string]string
 }
 
 type MeasurementSummary struct {
@@ -28,17 +40,150 @@ type MeasurementSummary struct {
 	Count       int     `json:"count"`
 }
 
-type MeasurementRepository struct {
-	client   influxdb2.Client
-	bucket   string
-	writeAPI influxdb2api.WriteAPIBlocking
-	queryAPI influxdb2api.QueryAPI
+// TooManyPointsError is returned by the raw queries matching more points than the maximum.
+type TooManyPointsError struct {
+	Max int
 }
 
-func NewMeasurementRepository(envVars *config.EnvVars) *MeasurementRepository {
-	m := &MeasurementRepository{
-		client: influxdb2.NewClient(envVars.InfluxDB.ServerURL, envVars.InfluxDB.Token),
-		bucket: envVars.InfluxDB.Bucket,
+func (e *TooManyPointsError) Error() string {
+	return fmt.Sprintf("the query matches more than %d points", e.Max)
+}
+
+// ErrMeasurementsRejected is returned by CreateMeasurements when the storage refuses the
+// measurements for good, such as for a field type conflict, so writing them again won't help.
+var ErrMeasurementsRejected = errors.New("the storage rejected the measurements")
+
+// rejected marks the error of a write the storage refused for good.
+func rejected(err error) error {
+	return fmt.Errorf("%w: %w", ErrMeasurementsRejected, err)
+}
+
+// MaxClockSkew is how far ahead of the server's clock a measurement can be timestamped.
+const MaxClockSkew = time.Hour
+
+// CheckTimestamp refuses the timestamps no measurement can have: before the Unix epoch, which
+// the seasonal buckets and some backends don't handle, or too far in the future to be anything
+// but a wrong clock. Such points would otherwise fail to be written long after being accepted.
+func CheckTimestamp(timestamp time.Time) error {
+	if timestamp.Before(time.Unix(0, 0)) {
+		return errors.New("must not be before 1970-01-01T00:00:00Z")
+	}
+	if timestamp.After(time.Now().Add(MaxClockSkew)) {
+		return fmt.Errorf("must not be more than %s in the future", MaxClockSkew)
+	}
+	return nil
+}
+
+const (
+	StorageInfluxDB    = "influxdb"
+	StorageTimescaleDB = "timescaledb"
+)
+
+// MeasurementRepository stores the measurements in a time series database, the one selected by
+// STORAGE__BACKEND. The implementations answer the same queries the same way, so the rest of the
+// server doesn't depend on the backend.
+type MeasurementRepository interface {
+	// Ping checks the database is reachable and ready to be used.
+	Ping(ctx context.Context) error
+	Close() error
+
+	// CreateMeasurement writes the measurement stamped with the current time, setting its
+	// Timestamp.
+	CreateMeasurement(ctx context.Context, measurement *Measurement) error
+	// CreateMeasurements writes the measurements in a single request, keeping their timestamps. A
+	// measurement at the same time as a point of its series replaces it.
+	CreateMeasurements(ctx context.Context, measurements []*Measurement) error
+
+	// GetMeasurements returns the points of a series within the range sorted by time, or
+	// TooManyPointsError when there are more than the maximum.
+	GetMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) ([]*Measurement, error)
+	// GetMeasurementTimestamps returns the timestamps of the points a series has within the range,
+	// without their values.
+	GetMeasurementTimestamps(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) ([]time.Time, error)
+	// StreamMeasurements calls fn for every measurement of the sensors within the range as they're
+	// read, so the range is never held in memory. The measurements are grouped by series and
+	// sorted by time within each series, the embedded backend only grouping them within each of
+	// its partitions. The measurement and unit filters are optional.
+	StreamMeasurements(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time, fn func(*Measurement) error) error
+	// GetSensorValues reduces the series of each sensor within the range to a single value with
+	// the function, one of last, mean, median, min and max, returning the values by sensor ID.
+	// Sensors without measurements are left out.
+	GetSensorValues(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time, fn string) (map[string]float64, error)
+	// GetMeasurementsByLabels returns the measurements, within the range, whose labels meet the
+	// selector, regardless of the sensor they came from. Measurements are matched by the labels
+	// they were written with, not by the current labels of their sensors. The measurement and unit
+	// filters are optional.
+	GetMeasurementsByLabels(ctx context.Context, selector label.Selector, measurement, unit string, start, end time.Time) ([]*Measurement, error)
+	// GetAggregatedMeasurements windows the series by every and aggregates each window with fn, one
+	// of mean, median, min, max, sum, count, first and last, each point being stamped with the end
+	// of its window.
+	GetAggregatedMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time, every time.Duration, fn string) ([]*Measurement, error)
+	// GetMeasurementSummary summarizes the series within the range, from the rollups when the
+	// range reaches past the raw retention or is too long to scan.
+	GetMeasurementSummary(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (*MeasurementSummary, error)
+	// GetSensorsMeasurementSummary summarizes the series of all the sensors together, as a single
+	// series, the same way GetMeasurementSummary does for one sensor.
+	GetSensorsMeasurementSummary(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time) (*MeasurementSummary, error)
+}
+
+// RollupWriter is implemented by the repositories whose rollups are written by the roller, rather
+// than maintained by the database itself.
+type RollupWriter interface {
+	// RollupsEnabled tells whether the rollups are configured.
+	RollupsEnabled() bool
+	// PrepareRollups creates where the rollups are written, if needed.
+	PrepareRollups(ctx context.Context) error
+	// RollupMeasurements writes the rollups of the resolution for the windows within the range.
+	RollupMeasurements(ctx context.Context, resolution time.Duration, start, end time.Time) error
+	// TakeEarliestWrite returns the earliest timestamp of the measurements written since the
+	// previous call, or the zero time when none was, so the windows written late can be rolled up
+	// again.
+	TakeEarliestWrite() time.Time
+}
+
+// NewMeasurementRepository returns the repository of the backend configured by STORAGE__BACKEND.
+func NewMeasurementRepository(envVars *config.EnvVars) (MeasurementRepository, error) {
+	switch envVars.Storage.Backend {
+	case StorageInfluxDB:
+		return NewInfluxMeasurementRepository(envVars), nil
+	case StorageTimescaleDB:
+		return NewTimescaleMeasurementRepository(envVars)
+	case StorageEmbedded:
+		return NewEmbeddedMeasurementRepository(envVars)
+	default:
+		return nil, fmt.Errorf("unsupported storage backend: %s", envVars.Storage.Backend)
+	}
+}
+
+// InfluxMeasurementRepository keeps the measurements in an InfluxDB bucket, the sensor ID, the
+// unit and the labels being tags of the points, and the rollups in another bucket.
+type InfluxMeasurementRepository struct {
+	client       influxdb2.Client
+	org          string
+	bucket       string
+	rollupBucket string
+	rollup       rollupPolicy
+	maxPoints    int
+	writeAPI     influxdb2api.WriteAPIBlocking
+	queryAPI     influxdb2api.QueryAPI
+
+	writesMu      sync.Mutex
+	earliestWrite time.Time
+}
+
+func NewInfluxMeasurementRepository(envVars *config.EnvVars) *InfluxMeasurementRepository {
+	m := &InfluxMeasurementRepository{
+		client:       influxdb2.NewClient(envVars.InfluxDB.ServerURL, envVars.InfluxDB.Token),
+		org:          envVars.InfluxDB.Org,
+		bucket:       envVars.InfluxDB.Bucket,
+		rollupBucket: envVars.InfluxDB.RollupBucket,
+		rollup: rollupPolicy{
+			interval:       envVars.Rollup.Interval,
+			rawRetention:   envVars.Rollup.RawRetention,
+			rawMaxRange:    envVars.Rollup.RawMaxRange,
+			hourlyMaxRange: envVars.Rollup.HourlyMaxRange,
+		},
+		maxPoints: envVars.Query.MaxPoints,
 	}
 
 	m.writeAPI = m.client.WriteAPIBlocking(envVars.InfluxDB.Org, envVars.InfluxDB.Bucket)
@@ -47,42 +192,505 @@ func NewMeasurementRepository(envVars *config.EnvVars) *MeasurementRepository {
 	return m
 }
 
-func (m *MeasurementRepository) Close() error {
+func (m *InfluxMeasurementRepository) Close() error {
 	m.client.Close()
 	return nil
 }
 
-func (m *MeasurementRepository) CreateMeasurement(ctx context.Context, measurement *Measurement) error {
+// Ping checks the health endpoint of InfluxDB.
+func (m *InfluxMeasurementRepository) Ping(ctx context.Context) error {
+	health, err := m.client.Health(ctx)
+	if err != nil {
+		return err
+	}
+	if health.Status != domain.HealthCheckStatusPass {
+		if health.Message != nil {
+			return fmt.Errorf("influxdb is %s: %s", health.Status, *health.Message)
+		}
+		return fmt.Errorf("influxdb is %s", health.Status)
+	}
+	return nil
+}
+
+// query records the query on the span of the context and runs it.
+func (m *InfluxMeasurementRepository) query(ctx context.Context, query fluxExpr) (*influxdb2api.QueryTableResult, error) {
+	log.Debug().Str("query", string(query)).Msg("executing query")
+	recordQuery(ctx, "influxdb", string(query))
+	return m.queryAPI.Query(ctx, string(query))
+}
+
+func (m *InfluxMeasurementRepository) CreateMeasurement(ctx context.Context, measurement *Measurement) (err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "CreateMeasurement", append(sensorAttributes(measurement.SensorID), attribute.String("measurement.name", measurement.Name))...)
+	defer func() { finish(err) }()
+
 	timestamp := time.Now()
 
-	p := influxdb2.NewPointWithMeasurement(measurement.Name).
-		AddTag("unit", measurement.Unit).
-		AddTag("sensor_id", measurement.SensorID).
-		AddField("value", measurement.Value).
-		SetTime(timestamp)
+	p := newMeasurementPoint(measurement).SetTime(timestamp)
 	if err := m.writeAPI.WritePoint(ctx, p); err != nil {
 		return fmt.Errorf("failed to write the measurement point: %w", err)
 	}
 
 	measurement.Timestamp = timestamp
+	metrics.AddMeasurementsWritten(StorageInfluxDB, 1)
+
+	return nil
+}
+
+func newMeasurementPoint(measurement *Measurement) *write.Point {
+	p := influxdb2.NewPointWithMeasurement(measurement.Name).
+		AddTag("unit", measurement.Unit).
+		AddTag("sensor_id", measurement.SensorID).
+		AddField("value", measurement.Value)
+	for key, value := range measurement.Labels {
+		p.AddTag(key, value)
+	}
+	return p
+}
+
+// CreateMeasurements writes the measurements in a single request, keeping their timestamps.
+func (m *InfluxMeasurementRepository) CreateMeasurements(ctx context.Context, measurements []*Measurement) (err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "CreateMeasurements", attribute.Int("measurement.count", len(measurements)))
+	defer func() { finish(err) }()
+
+	points := make([]*write.Point, 0, len(measurements))
+	for _, measurement := range measurements {
+		points = append(points, newMeasurementPoint(measurement).SetTime(measurement.Timestamp))
+	}
+
+	if err := m.writeAPI.WritePoint(ctx, points...); err != nil {
+		if influxRejected(err) {
+			err = rejected(err)
+		}
+		return fmt.Errorf("failed to write the measurement points: %w", err)
+	}
+
+	metrics.AddMeasurementsWritten(StorageInfluxDB, len(measurements))
+	m.recordWrite(measurements)
+
+	return nil
+}
+
+// influxRejected tells apart the writes InfluxDB refused for good: the points it can't encode and
+// the ones it answers with a bad request, such as a field type conflict, a request too large or
+// points outside of the retention of the bucket.
+func influxRejected(err error) bool {
+	var httpErr *influxdb2http.Error
+	if !errors.As(err, &httpErr) {
+		// Anything but the request failing is the points failing to be encoded
+		return true
+	}
+	switch httpErr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+func (m *InfluxMeasurementRepository) GetMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (_ []*Measurement, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurements", seriesAttributes([]string{sensorID}, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	query := flux(
+		`from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => r["_measurement"] == @measurement)
+			|> filter(fn: (r) => r["sensor_id"] == @sensor_id)
+			|> filter(fn: (r) => r["unit"] == @unit)
+			|> filter(fn: (r) => r["_field"] == "value")
+			|> group(columns: ["_measurement", "sensor_id", "unit", "_field"])
+			|> sort(columns: ["_time"])
+			|> limit(n: @limit)`,
+		fluxArgs{"bucket": m.bucket, "start": start, "stop": end, "measurement": measurement, "sensor_id": sensorID, "unit": unit, "limit": m.maxPoints + 1})
+
+	result, err := m.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurements: %w", err)
+	}
+	defer result.Close()
+
+	measurements := []*Measurement{}
+	for result.Next() {
+		if len(measurements) == m.maxPoints {
+			return nil, &TooManyPointsError{Max: m.maxPoints}
+		}
+
+		value, ok := result.Record().Value().(float64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type for measurement value: %T", result.Record().Value())
+		}
+
+		measurements = append(measurements, &Measurement{
+			Name:      measurement,
+			SensorID:  sensorID,
+			Unit:      unit,
+			Value:     value,
+			Timestamp: result.Record().Time(),
+		})
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", result.Err())
+	}
+
+	return measurements, nil
+}
+
+// GetMeasurementTimestamps returns the timestamps of the points a series has within the range,
+// without their values.
+func (m *InfluxMeasurementRepository) GetMeasurementTimestamps(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (_ []time.Time, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurementTimestamps", seriesAttributes([]string{sensorID}, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	query := flux(
+		`from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => r["_measurement"] == @measurement)
+			|> filter(fn: (r) => r["sensor_id"] == @sensor_id)
+			|> filter(fn: (r) => r["unit"] == @unit)
+			|> filter(fn: (r) => r["_field"] == "value")
+			|> keep(columns: ["_time"])`,
+		fluxArgs{"bucket": m.bucket, "start": start, "stop": end, "measurement": measurement, "sensor_id": sensorID, "unit": unit})
+
+	result, err := m.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurement timestamps: %w", err)
+	}
+
+	timestamps := []time.Time{}
+	for result.Next() {
+		timestamps = append(timestamps, result.Record().Time())
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", result.Err())
+	}
+
+	return timestamps, nil
+}
+
+// StreamMeasurements calls fn for every measurement of the sensors within the range as they're
+// read from InfluxDB, so the range is never held in memory. The measurements are grouped by
+// series and sorted by time within each series. The measurement and unit filters are optional.
+func (m *InfluxMeasurementRepository) StreamMeasurements(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time, fn func(*Measurement) error) (err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "StreamMeasurements", seriesAttributes(sensorIDs, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	query := flux(
+		`from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => @sensor_ids)
+			|> filter(fn: (r) => r["_field"] == "value")`,
+		fluxArgs{"bucket": m.bucket, "start": start, "stop": end, "sensor_ids": sensorIDsPredicate(sensorIDs)})
+	if measurement != "" {
+		query += flux(`
+			|> filter(fn: (r) => r["_measurement"] == @measurement)`, fluxArgs{"measurement": measurement})
+	}
+	if unit != "" {
+		query += flux(`
+			|> filter(fn: (r) => r["unit"] == @unit)`, fluxArgs{"unit": unit})
+	}
+	query += `
+			|> group(columns: ["_measurement", "sensor_id", "unit", "_field"])
+			|> sort(columns: ["_time"])`
+
+	result, err := m.query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to query measurements: %w", err)
+	}
+	defer result.Close()
+
+	for result.Next() {
+		record := result.Record()
+		value, ok := record.Value().(float64)
+		if !ok {
+			return fmt.Errorf("unexpected type for measurement value: %T", record.Value())
+		}
+		sensorID, _ := record.ValueByKey("sensor_id").(string)
+		unit, _ := record.ValueByKey("unit").(string)
+
+		if err := fn(&Measurement{
+			Name:      record.Measurement(),
+			SensorID:  sensorID,
+			Unit:      unit,
+			Value:     value,
+			Timestamp: record.Time(),
+		}); err != nil {
+			return err
+		}
+	}
+	if result.Err() != nil {
+		return fmt.Errorf("query error: %w", result.Err())
+	}
 
 	return nil
 }
 
-func (m *MeasurementRepository) GetMeasurementSummary(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (*MeasurementSummary, error) {
-	query := fmt.Sprintf(
-		`result = from(bucket: "%s")
-			|> range(start: %s, stop: %s)
-			|> filter(fn: (r) => r["_measurement"] == "%s")
-			|> filter(fn: (r) => r["sensor_id"] == "%s")
-			|> filter(fn: (r) => r["unit"] == "%s")
-			
+// GetSensorValues reduces the series of each sensor within the range to a single value with the
+// function, one of last, mean, median, min and max, returning the values by sensor ID. Sensors
+// without measurements are left out.
+func (m *InfluxMeasurementRepository) GetSensorValues(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time, fn string) (_ map[string]float64, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetSensorValues", append(seriesAttributes(sensorIDs, measurement, unit, start, end), attribute.String("query.fn", fn))...)
+	defer func() { finish(err) }()
+
+	values := map[string]float64{}
+	if len(sensorIDs) == 0 {
+		return values, nil
+	}
+
+	function, err := fluxFunction(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	query := flux(
+		`from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => r["_measurement"] == @measurement)
+			|> filter(fn: (r) => @sensor_ids)
+			|> filter(fn: (r) => r["unit"] == @unit)
+			|> filter(fn: (r) => r["_field"] == "value")
+			|> group(columns: ["sensor_id"])
+			|> sort(columns: ["_time"])
+			|> @fn()`,
+		fluxArgs{"bucket": m.bucket, "start": start, "stop": end, "measurement": measurement, "sensor_ids": sensorIDsPredicate(sensorIDs), "unit": unit, "fn": function})
+
+	result, err := m.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sensor values: %w", err)
+	}
+	defer result.Close()
+
+	for result.Next() {
+		value, ok := result.Record().Value().(float64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type for sensor value: %T", result.Record().Value())
+		}
+		sensorID, _ := result.Record().ValueByKey("sensor_id").(string)
+		values[sensorID] = value
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", result.Err())
+	}
+
+	return values, nil
+}
+
+// GetMeasurementsByLabels returns the measurements, within the range, whose labels meet the
+// selector, regardless of the sensor they came from. Measurements are matched by the labels they
+// were written with, not by the current labels of their sensors. The measurement and unit filters
+// are optional.
+func (m *InfluxMeasurementRepository) GetMeasurementsByLabels(ctx context.Context, selector label.Selector, measurement, unit string, start, end time.Time) (_ []*Measurement, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurementsByLabels", append(seriesAttributes(nil, measurement, unit, start, end), attribute.String("label.selector", selector.String()))...)
+	defer func() { finish(err) }()
+
+	query := flux(
+		`from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => r["_field"] == "value")`,
+		fluxArgs{"bucket": m.bucket, "start": start, "stop": end})
+	if measurement != "" {
+		query += flux(`
+			|> filter(fn: (r) => r["_measurement"] == @measurement)`, fluxArgs{"measurement": measurement})
+	}
+	if unit != "" {
+		query += flux(`
+			|> filter(fn: (r) => r["unit"] == @unit)`, fluxArgs{"unit": unit})
+	}
+	for _, requirement := range selector {
+		query += flux(`
+			|> filter(fn: (r) => @predicate)`, fluxArgs{"predicate": labelPredicate(requirement)})
+	}
+	// The limit applies to every series, so the points are counted across them below as well
+	query += flux(`
+			|> limit(n: @limit)`, fluxArgs{"limit": m.maxPoints + 1})
+
+	result, err := m.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurements: %w", err)
+	}
+	defer result.Close()
+
+	measurements := []*Measurement{}
+	for result.Next() {
+		if len(measurements) == m.maxPoints {
+			return nil, &TooManyPointsError{Max: m.maxPoints}
+		}
+
+		record := result.Record()
+		value, ok := record.Value().(float64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type for measurement value: %T", record.Value())
+		}
+		sensorID, _ := record.ValueByKey("sensor_id").(string)
+		unit, _ := record.ValueByKey("unit").(string)
+
+		measurements = append(measurements, &Measurement{
+			Name:      record.Measurement(),
+			SensorID:  sensorID,
+			Unit:      unit,
+			Value:     value,
+			Timestamp: record.Time(),
+			Labels:    recordLabels(record.Values()),
+		})
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", result.Err())
+	}
+
+	return measurements, nil
+}
+
+// labelPredicate translates a requirement to a Flux predicate.
+func labelPredicate(requirement label.Requirement) fluxExpr {
+	args := fluxArgs{"key": requirement.Key, "value": requirement.Value}
+	switch requirement.Operator {
+	case label.OperatorNotEquals:
+		return flux(`not exists r[@key] or r[@key] != @value`, args)
+	case label.OperatorExists:
+		return flux(`exists r[@key]`, args)
+	case label.OperatorNotExists:
+		return flux(`not exists r[@key]`, args)
+	default:
+		return flux(`r[@key] == @value`, args)
+	}
+}
+
+// recordLabels picks the labels out of the columns of a record, which are the tags that aren't
+// the sensor ID and the unit.
+func recordLabels(values map[string]interface{}) map[string]string {
+	labels := map[string]string{}
+	for key, value := range values {
+		if strings.HasPrefix(key, "_") || key == "sensor_id" || key == "unit" || key == "result" || key == "table" {
+			continue
+		}
+		if value, ok := value.(string); ok && value != "" {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// GetAggregatedMeasurements windows the series by every and aggregates each window with fn, which
+// must be the name of a Flux aggregate or selector function such as mean, max or count.
+func (m *InfluxMeasurementRepository) GetAggregatedMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time, every time.Duration, fn string) (_ []*Measurement, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetAggregatedMeasurements", append(seriesAttributes([]string{sensorID}, measurement, unit, start, end), attribute.String("query.every", every.String()), attribute.String("query.fn", fn))...)
+	defer func() { finish(err) }()
+
+	if resolution, ok := m.rollupResolution(start, end); ok && every%resolution == 0 && rollupAggregates[fn] {
+		return m.getRollupAggregatedMeasurements(ctx, sensorID, measurement, unit, start, end, every, fn, resolution)
+	}
+
+	function, err := fluxFunction(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	query := flux(
+		`from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => r["_measurement"] == @measurement)
+			|> filter(fn: (r) => r["sensor_id"] == @sensor_id)
+			|> filter(fn: (r) => r["unit"] == @unit)
+			|> filter(fn: (r) => r["_field"] == "value")
+			|> group(columns: ["_measurement", "sensor_id", "unit", "_field"])
+			|> sort(columns: ["_time"])
+			|> aggregateWindow(every: @every, fn: @fn, createEmpty: false)`,
+		fluxArgs{"bucket": m.bucket, "start": start, "stop": end, "measurement": measurement, "sensor_id": sensorID, "unit": unit, "every": every, "fn": function})
+
+	result, err := m.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query aggregated measurements: %w", err)
+	}
+
+	measurements := []*Measurement{}
+	for result.Next() {
+		var value float64
+		switch v := result.Record().Value().(type) {
+		case float64:
+			value = v
+		case int64:
+			value = float64(v)
+		default:
+			return nil, fmt.Errorf("unexpected type for aggregated value: %T", result.Record().Value())
+		}
+
+		measurements = append(measurements, &Measurement{
+			Name:      measurement,
+			SensorID:  sensorID,
+			Unit:      unit,
+			Value:     value,
+			Timestamp: result.Record().Time(),
+		})
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", result.Err())
+	}
+
+	return measurements, nil
+}
+
+// GetMeasurementSummary summarizes the series from the raw bucket or, when the range reaches past
+// the raw retention or is too long to scan, from the rollups. Since rollups are only written for
+// completed windows, the most recent part of the range is still read from the raw bucket, as are
+// the partial windows at its ends.
+func (m *InfluxMeasurementRepository) GetMeasurementSummary(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (_ *MeasurementSummary, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurementSummary", seriesAttributes([]string{sensorID}, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	return m.getMeasurementSummary(ctx, []string{sensorID}, measurement, unit, start, end)
+}
+
+// GetSensorsMeasurementSummary summarizes the series of all the sensors together, as a single
+// series, the same way GetMeasurementSummary does for one sensor.
+func (m *InfluxMeasurementRepository) GetSensorsMeasurementSummary(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time) (_ *MeasurementSummary, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetSensorsMeasurementSummary", seriesAttributes(sensorIDs, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	if len(sensorIDs) == 0 {
+		return &MeasurementSummary{Unit: unit}, nil
+	}
+	return m.getMeasurementSummary(ctx, sensorIDs, measurement, unit, start, end)
+}
+
+func (m *InfluxMeasurementRepository) getMeasurementSummary(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time) (*MeasurementSummary, error) {
+	raw := func(start, end time.Time) (*MeasurementSummary, error) {
+		return m.getRawMeasurementSummary(ctx, sensorIDs, measurement, unit, start, end)
+	}
+	resolution, ok := m.rollupResolution(start, end)
+	if !ok {
+		return raw(start, end)
+	}
+
+	rollup := func(start, end time.Time) (*MeasurementSummary, error) {
+		return m.getRollupMeasurementSummary(ctx, sensorIDs, measurement, unit, start, end, resolution)
+	}
+	return summarizeRollups(start, end, m.rollupBoundary(resolution), resolution, raw, rollup)
+}
+
+// sensorIDsPredicate is a Flux predicate matching the records of any of the sensors.
+func sensorIDsPredicate(sensorIDs []string) fluxExpr {
+	if len(sensorIDs) == 1 {
+		return flux(`r["sensor_id"] == @sensor_id`, fluxArgs{"sensor_id": sensorIDs[0]})
+	}
+	return flux(`contains(value: r["sensor_id"], set: @sensor_ids)`, fluxArgs{"sensor_ids": sensorIDs})
+}
+
+func (m *InfluxMeasurementRepository) getRawMeasurementSummary(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time) (_ *MeasurementSummary, err error) {
+	ctx, span := startSpan(ctx, "measurement.getRawMeasurementSummary", seriesAttributes(sensorIDs, measurement, unit, start, end)...)
+	defer func() { endSpan(span, err) }()
+
+	query := flux(
+		`result = from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => r["_measurement"] == @measurement)
+			|> filter(fn: (r) => @sensor_ids)
+			|> filter(fn: (r) => r["unit"] == @unit)
+			|> group(columns: ["_measurement", "unit", "_field"])
+
 		result
-			|> aggregateWindow(every: 1d, fn: mean, createEmpty: false)
+			|> mean()
 			|> yield(name: "mean")
 
 		result
-			|> aggregateWindow(every: 1d, fn: median, createEmpty: false)
+			|> median()
 			|> yield(name: "median")
 
 		result
@@ -94,13 +702,11 @@ func (m *MeasurementRepository) GetMeasurementSummary(ctx context.Context, senso
 			|> yield(name: "min")
 
 		result
-			|> min()
+			|> max()
 			|> yield(name: "max")`,
-		m.bucket, start.Format(time.RFC3339), end.Format(time.RFC3339), measurement, sensorID, unit)
-
-	log.Info().Str("query", query).Msg("executing query")
+		fluxArgs{"bucket": m.bucket, "start": start, "stop": end, "measurement": measurement, "sensor_ids": sensorIDsPredicate(sensorIDs), "unit": unit})
 
-	result, err := m.queryAPI.Query(ctx, query)
+	result, err := m.query(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query measurement summary: %w", err)
 	}
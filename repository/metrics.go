@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/metrics"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	sensorsRepositoryName     = "sensors"
+	measurementRepositoryName = "measurement"
+)
+
+// isFailure tells apart the errors that are failures from the ones that are an answer, such as a
+// missing sensor or a version conflict, so only the former are alerted on.
+func isFailure(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, mongo.ErrNoDocuments),
+		errors.Is(err, primitive.ErrInvalidHex),
+		errors.Is(err, ErrVersionConflict),
+		errors.Is(err, ErrLastTag),
+		errors.Is(err, ErrNameTaken),
+		mongo.IsDuplicateKeyError(err):
+		return false
+	}
+	return true
+}
+
+// observe records a call to a repository method.
+func observe(repository, method string, start time.Time, err error) {
+	if !isFailure(err) {
+		err = nil
+	}
+	metrics.ObserveRepositoryCall(repository, method, start, err)
+}
@@ -0,0 +1,17 @@
+CREATE EXTENSION IF NOT EXISTS timescaledb;
+
+CREATE TABLE measurements (
+	time        TIMESTAMPTZ      NOT NULL,
+	sensor_id   TEXT             NOT NULL,
+	measurement TEXT             NOT NULL,
+	unit        TEXT             NOT NULL,
+	value       DOUBLE PRECISION NOT NULL,
+	-- Labels of the sensor when the measurement was taken
+	labels      JSONB            NOT NULL DEFAULT '{}'
+);
+
+SELECT create_hypertable('measurements', 'time', chunk_time_interval => INTERVAL '1 day');
+
+-- A series has a single point at a time, as in InfluxDB, so writing it again replaces it
+CREATE UNIQUE INDEX measurements_series_time_idx ON measurements (sensor_id, measurement, unit, time DESC);
+CREATE INDEX measurements_labels_idx ON measurements USING GIN (labels);
@@ -0,0 +1,45 @@
+-- The rollups are continuous aggregates, refreshed by their policies. Since they aren't
+-- materialized only, the buckets not refreshed yet are aggregated from the raw measurements when
+-- queried, so the rollups are always up to date.
+
+CREATE MATERIALIZED VIEW measurements_hourly
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT
+	time_bucket(INTERVAL '1 hour', time) AS bucket,
+	sensor_id,
+	measurement,
+	unit,
+	min(value) AS min_value,
+	max(value) AS max_value,
+	avg(value) AS mean_value,
+	count(*) AS count
+FROM measurements
+GROUP BY bucket, sensor_id, measurement, unit
+WITH NO DATA;
+
+CREATE MATERIALIZED VIEW measurements_daily
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT
+	time_bucket(INTERVAL '1 day', time) AS bucket,
+	sensor_id,
+	measurement,
+	unit,
+	min(value) AS min_value,
+	max(value) AS max_value,
+	avg(value) AS mean_value,
+	count(*) AS count
+FROM measurements
+GROUP BY bucket, sensor_id, measurement, unit
+WITH NO DATA;
+
+-- Without a start offset the refreshes reach back to the oldest change, so imported history and
+-- late measurements are rolled up as well
+SELECT add_continuous_aggregate_policy('measurements_hourly',
+	start_offset => NULL,
+	end_offset => INTERVAL '1 hour',
+	schedule_interval => INTERVAL '5 minutes');
+
+SELECT add_continuous_aggregate_policy('measurements_daily',
+	start_offset => NULL,
+	end_offset => INTERVAL '1 day',
+	schedule_interval => INTERVAL '1 hour');
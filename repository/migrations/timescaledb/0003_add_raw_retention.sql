@@ -0,0 +1,5 @@
+-- The raw measurements are dropped once past the raw retention, the rollups being kept. The
+-- server replaces this policy with one dropping them after ROLLUP__RAW_RETENTION when it starts,
+-- since the queries read the rollups for the ranges starting before it. Dropping chunks doesn't
+-- invalidate the continuous aggregates, so their buckets outlive the raw measurements.
+SELECT add_retention_policy('measurements', drop_after => INTERVAL '30 days', if_not_exists => true);
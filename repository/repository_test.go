@@ -2,15 +2,22 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand/v2"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/go-faker/faker/v4"
 	"github.com/golobby/container/v3"
+	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/require"
 	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/internal/testutil"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -33,87 +40,476 @@ func setupContainer() (*container.Container, error) {
 	if err := cont.Singleton(buildMongoClient); err != nil {
 		return nil, err
 	}
-	if err := cont.Singleton(NewSensorsRepository); err != nil {
+	if err := cont.Singleton(NewMongoSensorsRepository); err != nil {
 		return nil, err
 	}
 	if err := cont.Singleton(NewMeasurementRepository); err != nil {
 		return nil, err
 	}
+	if err := cont.Singleton(NewMongoAnomaliesRepository); err != nil {
+		return nil, err
+	}
 
 	return &cont, nil
 }
 
-func TestSensorsRepository(t *testing.T) {
-	t.Parallel()
-	is := require.New(t)
-
-	cont, err := setupContainer()
-	is.Nil(err)
-
-	var envVars *config.EnvVars
-	is.Nil(cont.Resolve(&envVars))
-
-	var mongoClient *mongo.Client
-	is.Nil(cont.Resolve(&mongoClient))
-
-	sensorsRepository, err := NewSensorsRepository(envVars, mongoClient)
-	is.Nil(err)
+// embeddedEnvVars configures the embedded mode in a temporary directory, which needs nothing else
+// to run.
+func embeddedEnvVars(t *testing.T) *config.EnvVars {
+	envVars := &config.EnvVars{}
+	envVars.Storage.Backend = StorageEmbedded
+	envVars.Embedded.Dir = t.TempDir()
+	envVars.Embedded.Partition = 24 * time.Hour
+	envVars.Embedded.MaxPartitionPoints = 1000000
+	envVars.Query.MaxPoints = 100000
+	return envVars
+}
 
-	ctx := context.Background()
+type metadataRepositories struct {
+	sensors   SensorsRepository
+	assets    AssetsRepository
+	geofences GeofencesRepository
+	tracks    TracksRepository
+	anomalies AnomaliesRepository
+}
 
-	t.Run("when CreateSensor is invoked with a valid sensor, it should create that sensor in the database", func(t *testing.T) {
+// forEachMetadataStore runs the test against the repositories of both the stores everything but
+// the measurements can be kept in, the embedded one and MongoDB.
+func forEachMetadataStore(t *testing.T, test func(t *testing.T, repositories *metadataRepositories)) {
+	t.Run(StorageEmbedded, func(t *testing.T) {
 		t.Parallel()
 		is := require.New(t)
 
-		newSensor := &Sensor{
-			Name: "Sensor 1",
-			Location: GeoJSONPoint{
-				Type:        "Point",
-				Coordinates: []float64{1.0, 1.0},
-			},
-			Tags: []string{"tag1", "tag2"},
-		}
-		err = sensorsRepository.CreateSensor(ctx, newSensor)
+		envVars := embeddedEnvVars(t)
+		store, err := NewEmbeddedStore(envVars)
 		is.Nil(err)
-		is.False(newSensor.ID.IsZero())
+		t.Cleanup(func() { store.Close() })
+
+		sensorsRepository, err := NewEmbeddedSensorsRepository(envVars, store)
+		is.Nil(err)
+		geofencesRepository := NewEmbeddedGeofencesRepository(store)
+		test(t, &metadataRepositories{
+			sensors:   sensorsRepository,
+			assets:    NewEmbeddedAssetsRepository(store, sensorsRepository),
+			geofences: geofencesRepository,
+			tracks:    NewEmbeddedTracksRepository(store, sensorsRepository, geofencesRepository),
+			anomalies: NewEmbeddedAnomaliesRepository(store),
+		})
 	})
 
-	t.Run("when GetSensorByID is invoke with a valid sensor ID, it should return that sensor", func(t *testing.T) {
+	t.Run("mongodb", func(t *testing.T) {
 		t.Parallel()
 		is := require.New(t)
 
-		newSensor := &Sensor{
-			Name: "Sensor 2",
-			Location: GeoJSONPoint{
-				Type:        "Point",
-				Coordinates: []float64{2.0, 2.0},
-			},
-			Tags: []string{"tag3", "tag4"},
-		}
-		err = sensorsRepository.CreateSensor(ctx, newSensor)
+		cont, err := setupContainer()
 		is.Nil(err)
 
-		foundSensor, err := sensorsRepository.GetSensorByID(ctx, newSensor.ID.Hex())
+		var envVars *config.EnvVars
+		is.Nil(cont.Resolve(&envVars))
+
+		var mongoClient *mongo.Client
+		is.Nil(cont.Resolve(&mongoClient))
+
+		var repositories metadataRepositories
+		is.Nil(cont.Resolve(&repositories.sensors))
+		is.Nil(cont.Resolve(&repositories.anomalies))
+		repositories.assets, err = NewMongoAssetsRepository(envVars, mongoClient, repositories.sensors)
+		is.Nil(err)
+		repositories.geofences, err = NewMongoGeofencesRepository(envVars, mongoClient)
 		is.Nil(err)
+		repositories.tracks, err = NewMongoTracksRepository(envVars, mongoClient, repositories.sensors, repositories.geofences)
+		is.Nil(err)
+		test(t, &repositories)
+	})
+}
+
+func TestSensorsRepository(t *testing.T) {
+	t.Parallel()
+
+	forEachMetadataStore(t, func(t *testing.T, repositories *metadataRepositories) {
+		sensorsRepository := repositories.sensors
+		ctx := context.Background()
+		var err error
+
+		t.Run("when CreateSensor is invoked with a valid sensor, it should create that sensor in the database", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			newSensor := &Sensor{
+				Name: "Sensor 1 " + faker.UUIDDigit(),
+				Location: GeoJSONPoint{
+					Type:        "Point",
+					Coordinates: []float64{1.0, 1.0},
+				},
+				Tags: []string{"tag1", "tag2"},
+			}
+			err = sensorsRepository.CreateSensor(ctx, newSensor)
+			is.Nil(err)
+			is.False(newSensor.ID.IsZero())
+		})
+
+		t.Run("when GetSensorByID is invoke with a valid sensor ID, it should return that sensor", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			newSensor := &Sensor{
+				Name: "Sensor 2 " + faker.UUIDDigit(),
+				Location: GeoJSONPoint{
+					Type:        "Point",
+					Coordinates: []float64{2.0, 2.0},
+				},
+				Tags: []string{"tag3", "tag4"},
+			}
+			err = sensorsRepository.CreateSensor(ctx, newSensor)
+			is.Nil(err)
+
+			foundSensor, err := sensorsRepository.GetSensorByID(ctx, newSensor.ID.Hex())
+			is.Nil(err)
+
+			is.Equal(newSensor.ID, foundSensor.ID)
+		})
+
+		t.Run("when a sensor is relocated, it should record a revision and keep its old location", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			newSensor := &Sensor{
+				Name: testutil.UniqueSensorName(),
+				Location: GeoJSONPoint{
+					Type:        "Point",
+					Coordinates: []float64{3.0, 3.0},
+				},
+				Tags: []string{"tag5"},
+			}
+			err := sensorsRepository.CreateSensor(ctx, newSensor)
+			is.Nil(err)
+			createdAt := time.Now()
+			// The revisions are stored with a millisecond precision
+			time.Sleep(time.Millisecond)
+
+			relocatedSensor := *newSensor
+			relocatedSensor.Location = GeoJSONPoint{Type: "Point", Coordinates: []float64{4.0, 4.0}}
+			err = sensorsRepository.UpdateSensor(WithActor(ctx, "operator"), newSensor.ID.Hex(), &relocatedSensor, AnyVersion)
+			is.Nil(err)
+			is.Equal(2, relocatedSensor.Version)
+
+			revisions, err := sensorsRepository.GetSensorHistory(ctx, newSensor.ID.Hex())
+			is.Nil(err)
+			is.Len(revisions, 2)
+			is.Equal(SensorActionUpdated, revisions[1].Action)
+			is.Equal("operator", revisions[1].Actor)
+			is.Equal([]string{"location"}, revisions[1].Changed)
+
+			state, err := sensorsRepository.GetSensorStateAt(ctx, newSensor.ID.Hex(), createdAt)
+			is.Nil(err)
+			is.Equal([]float64{3.0, 3.0}, state.Location.Coordinates)
+
+			state, err = sensorsRepository.GetSensorStateAt(ctx, newSensor.ID.Hex(), createdAt.Add(-time.Hour))
+			is.Nil(err)
+			is.Nil(state)
+		})
+
+		t.Run("when a sensor is updated from a stale version, it should return a version conflict", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			newSensor := &Sensor{
+				Name: testutil.UniqueSensorName(),
+				Location: GeoJSONPoint{
+					Type:        "Point",
+					Coordinates: []float64{5.0, 5.0},
+				},
+				Tags: []string{"tag6"},
+			}
+			is.Nil(sensorsRepository.CreateSensor(ctx, newSensor))
 
-		is.Equal(newSensor.ID, foundSensor.ID)
+			taggedSensor, err := sensorsRepository.AddSensorTag(ctx, newSensor.ID.Hex(), "tag7", newSensor.Version)
+			is.Nil(err)
+			is.Equal([]string{"tag6", "tag7"}, taggedSensor.Tags)
+			is.Equal(2, taggedSensor.Version)
+
+			_, err = sensorsRepository.AddSensorTag(ctx, newSensor.ID.Hex(), "tag8", newSensor.Version)
+			is.ErrorIs(err, ErrVersionConflict)
+
+			renamedSensor := *taggedSensor
+			renamedSensor.Name = testutil.UniqueSensorName()
+			err = sensorsRepository.UpdateSensor(ctx, newSensor.ID.Hex(), &renamedSensor, newSensor.Version)
+			is.ErrorIs(err, ErrVersionConflict)
+
+			untaggedSensor, err := sensorsRepository.RemoveSensorTag(ctx, newSensor.ID.Hex(), "tag6", AnyVersion)
+			is.Nil(err)
+			is.Equal([]string{"tag7"}, untaggedSensor.Tags)
+
+			_, err = sensorsRepository.RemoveSensorTag(ctx, newSensor.ID.Hex(), "tag7", AnyVersion)
+			is.ErrorIs(err, ErrLastTag)
+		})
+
+		t.Run("when sensors are listed with a label selector, it should return only the ones meeting it", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			site := "farm-" + faker.UUIDDigit()
+			northSensor := &Sensor{
+				Name:     testutil.UniqueSensorName(),
+				Location: GeoJSONPoint{Type: "Point", Coordinates: []float64{6.0, 6.0}},
+				Tags:     []string{"tag9"},
+				Labels:   map[string]string{"site": site, "zone": "north"},
+			}
+			is.Nil(sensorsRepository.CreateSensor(ctx, northSensor))
+			southSensor := &Sensor{
+				Name:     testutil.UniqueSensorName(),
+				Location: GeoJSONPoint{Type: "Point", Coordinates: []float64{6.0, 6.0}},
+				Tags:     []string{"tag9"},
+				Labels:   map[string]string{"site": site, "zone": "south"},
+			}
+			is.Nil(sensorsRepository.CreateSensor(ctx, southSensor))
+			unzonedSensor := &Sensor{
+				Name:     testutil.UniqueSensorName(),
+				Location: GeoJSONPoint{Type: "Point", Coordinates: []float64{6.0, 6.0}},
+				Tags:     []string{"tag9"},
+				Labels:   map[string]string{"site": site},
+			}
+			is.Nil(sensorsRepository.CreateSensor(ctx, unzonedSensor))
+
+			selector, err := label.ParseSelector("site=" + site + ",zone!=south")
+			is.Nil(err)
+			sensors, err := sensorsRepository.GetSensors(ctx, selector)
+			is.Nil(err)
+			is.Len(sensors, 2)
+			is.ElementsMatch([]string{northSensor.Name, unzonedSensor.Name}, []string{sensors[0].Name, sensors[1].Name})
+		})
+
+		t.Run("when sensors are listed within a bounding box, it should return only the ones inside it", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			inside := &Sensor{
+				Name:     testutil.UniqueSensorName(),
+				Location: GeoJSONPoint{Type: "Point", Coordinates: []float64{-120.5, -60.5}},
+				Tags:     []string{"tag9"},
+			}
+			is.Nil(sensorsRepository.CreateSensor(ctx, inside))
+			outside := &Sensor{
+				Name:     testutil.UniqueSensorName(),
+				Location: GeoJSONPoint{Type: "Point", Coordinates: []float64{-119.5, -60.5}},
+				Tags:     []string{"tag9"},
+			}
+			is.Nil(sensorsRepository.CreateSensor(ctx, outside))
+
+			sensors, err := sensorsRepository.GetSensorsWithin(ctx, -121, -61, -120, -60)
+			is.Nil(err)
+			is.Len(sensors, 1)
+			is.Equal(inside.Name, sensors[0].Name)
+		})
 	})
 }
 
+func TestAssetsRepository(t *testing.T) {
+	t.Parallel()
+
+	forEachMetadataStore(t, func(t *testing.T, repositories *metadataRepositories) {
+		sensorsRepository, assetsRepository := repositories.sensors, repositories.assets
+		ctx := context.Background()
+
+		t.Run("when sensors are attached under a site, it should return them from every asset above them", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			site := &Asset{Kind: AssetKindSite, Name: testutil.UniqueSensorName()}
+			is.Nil(assetsRepository.CreateAsset(ctx, site))
+			building := &Asset{Kind: AssetKindBuilding, Name: "building", ParentID: &site.ID}
+			is.Nil(assetsRepository.CreateAsset(ctx, building))
+			room := &Asset{Kind: AssetKindRoom, Name: "room", ParentID: &building.ID}
+			is.Nil(assetsRepository.CreateAsset(ctx, room))
+			is.Equal([]primitive.ObjectID{site.ID, building.ID}, room.Ancestors)
+
+			is.ErrorIs(assetsRepository.CreateAsset(ctx, &Asset{Kind: AssetKindRoom, Name: "room", ParentID: &site.ID}), ErrInvalidAssetParent)
+			is.ErrorIs(assetsRepository.CreateAsset(ctx, &Asset{Kind: AssetKindBuilding, Name: "building", ParentID: &site.ID}), ErrAssetNameTaken)
+
+			buildingSensor := &Sensor{Name: testutil.UniqueSensorName(), Location: GeoJSONPoint{Type: "Point", Coordinates: []float64{7.0, 7.0}}, Tags: []string{"tag10"}}
+			is.Nil(sensorsRepository.CreateSensor(ctx, buildingSensor))
+			roomSensor := &Sensor{Name: testutil.UniqueSensorName(), Location: GeoJSONPoint{Type: "Point", Coordinates: []float64{7.0, 7.0}}, Tags: []string{"tag10"}}
+			is.Nil(sensorsRepository.CreateSensor(ctx, roomSensor))
+
+			attached, err := assetsRepository.AttachSensor(ctx, building, buildingSensor.ID.Hex())
+			is.Nil(err)
+			is.True(attached)
+			attached, err = assetsRepository.AttachSensor(ctx, room, roomSensor.ID.Hex())
+			is.Nil(err)
+			is.True(attached)
+
+			sensors, err := assetsRepository.GetAssetSensors(ctx, site)
+			is.Nil(err)
+			is.Len(sensors, 2)
+			sensors, err = assetsRepository.GetAssetSensors(ctx, room)
+			is.Nil(err)
+			is.Len(sensors, 1)
+			is.Equal(roomSensor.ID, sensors[0].ID)
+
+			_, err = assetsRepository.DeleteAsset(ctx, room.ID.Hex())
+			is.ErrorIs(err, ErrAssetNotEmpty)
+
+			// Attaching is versioned, so an update made with the version read before fails
+			attachedSensor, err := sensorsRepository.GetSensorByID(ctx, roomSensor.ID.Hex())
+			is.Nil(err)
+			is.Equal(roomSensor.Version+1, attachedSensor.Version)
+			history, err := sensorsRepository.GetSensorHistory(ctx, roomSensor.ID.Hex())
+			is.Nil(err)
+			is.Equal([]string{"asset_id"}, history[len(history)-1].Changed)
+			is.ErrorIs(sensorsRepository.UpdateSensor(ctx, roomSensor.ID.Hex(), roomSensor, roomSensor.Version), ErrVersionConflict)
+
+			detached, err := assetsRepository.DetachSensor(ctx, building, roomSensor.ID.Hex())
+			is.Nil(err)
+			is.False(detached)
+			detached, err = assetsRepository.DetachSensor(ctx, room, roomSensor.ID.Hex())
+			is.Nil(err)
+			is.True(detached)
+			attached, err = assetsRepository.AttachSensor(ctx, room, primitive.NewObjectID().Hex())
+			is.Nil(err)
+			is.False(attached)
+			deleted, err := assetsRepository.DeleteAsset(ctx, room.ID.Hex())
+			is.Nil(err)
+			is.True(deleted)
+		})
+	})
+}
+
+func TestTracksRepository(t *testing.T) {
+	t.Parallel()
+
+	forEachMetadataStore(t, func(t *testing.T, repositories *metadataRepositories) {
+		sensorsRepository, geofencesRepository, tracksRepository := repositories.sensors, repositories.geofences, repositories.tracks
+		ctx := context.Background()
+
+		t.Run("when a sensor moves in and out of a geofence, it should record an enter and an exit event", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			// A small square far from the locations used by the other tests
+			geofence := &Geofence{
+				Name: testutil.UniqueSensorName(),
+				Area: GeoJSONPolygon{
+					Type:        "Polygon",
+					Coordinates: [][][]float64{{{-60, -60}, {-59, -60}, {-59, -59}, {-60, -59}, {-60, -60}}},
+				},
+			}
+			is.Nil(geofencesRepository.CreateGeofence(ctx, geofence))
+
+			sensor := &Sensor{Name: testutil.UniqueSensorName(), Location: GeoJSONPoint{Type: "Point", Coordinates: []float64{-61, -61}}, Tags: []string{"tag11"}}
+			is.Nil(sensorsRepository.CreateSensor(ctx, sensor))
+
+			start := time.Now().Truncate(time.Second)
+			move := func(offset time.Duration, longitude, latitude float64) []*GeofenceEvent {
+				events, err := tracksRepository.RecordLocation(ctx, &TrackPoint{
+					SensorID:  sensor.ID,
+					Timestamp: start.Add(offset),
+					Location:  GeoJSONPoint{Type: "Point", Coordinates: []float64{longitude, latitude}},
+				})
+				is.Nil(err)
+				return events
+			}
+
+			is.Empty(move(time.Second, -61, -61))
+			events := move(2*time.Second, -59.5, -59.5)
+			is.Len(events, 1)
+			is.Equal(GeofenceEventEnter, events[0].Type)
+			is.Equal(geofence.ID, events[0].GeofenceID)
+			is.Empty(move(3*time.Second, -59.4, -59.4))
+			// Arriving late, the point is recorded but doesn't move the sensor
+			is.Empty(move(2500*time.Millisecond, -61, -61))
+			events = move(4*time.Second, -58, -58)
+			is.Len(events, 1)
+			is.Equal(GeofenceEventExit, events[0].Type)
+
+			track, err := tracksRepository.GetTrack(ctx, sensor.ID, start, start.Add(time.Minute))
+			is.Nil(err)
+			is.Len(track, 5)
+
+			events, err = geofencesRepository.GetSensorEvents(ctx, sensor.ID, start, start.Add(time.Minute))
+			is.Nil(err)
+			is.Len(events, 2)
+		})
+
+		t.Run("when a sensor moves, it should bump its version and record a revision, unless it stayed put", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			sensor := &Sensor{Name: testutil.UniqueSensorName(), Location: GeoJSONPoint{Type: "Point", Coordinates: []float64{-62, -62}}, Tags: []string{"tag12"}}
+			is.Nil(sensorsRepository.CreateSensor(ctx, sensor))
+
+			start := time.Now().Truncate(time.Second)
+			_, err := tracksRepository.RecordLocation(ctx, &TrackPoint{
+				SensorID:  sensor.ID,
+				Timestamp: start,
+				Location:  GeoJSONPoint{Type: "Point", Coordinates: []float64{-62.5, -62.5}},
+			})
+			is.Nil(err)
+			_, err = tracksRepository.RecordLocation(ctx, &TrackPoint{
+				SensorID:  sensor.ID,
+				Timestamp: start.Add(time.Second),
+				Location:  GeoJSONPoint{Type: "Point", Coordinates: []float64{-62.5, -62.5}},
+			})
+			is.Nil(err)
+
+			moved, err := sensorsRepository.GetSensorByID(ctx, sensor.ID.Hex())
+			is.Nil(err)
+			is.Equal(sensor.Version+1, moved.Version)
+			is.Equal([]float64{-62.5, -62.5}, moved.Location.Coordinates)
+			is.True(moved.LastFixAt.Equal(start.Add(time.Second)))
+
+			history, err := sensorsRepository.GetSensorHistory(ctx, sensor.ID.Hex())
+			is.Nil(err)
+			is.Len(history, 2)
+			is.Equal([]string{"location"}, history[1].Changed)
+
+			// An update expecting the version before the move conflicts with it
+			err = sensorsRepository.UpdateSensor(ctx, sensor.ID.Hex(), &Sensor{Name: sensor.Name, Location: sensor.Location, Tags: sensor.Tags}, sensor.Version)
+			is.ErrorIs(err, ErrVersionConflict)
+		})
+	})
+}
+
+// TestMeasurementRepository runs the same tests against every storage backend, skipping the ones
+// whose database isn't configured. The embedded one needs no configuration.
 func TestMeasurementRepository(t *testing.T) {
 	t.Parallel()
+
+	t.Run(StorageEmbedded, func(t *testing.T) {
+		t.Parallel()
+		testMeasurementRepository(t, embeddedEnvVars(t), StorageEmbedded)
+	})
+
 	is := require.New(t)
 
-	cont, err := setupContainer()
+	envVars, err := config.Get()
 	is.Nil(err)
 
-	var envVars *config.EnvVars
-	is.Nil(cont.Resolve(&envVars))
+	backends := map[string]string{
+		StorageInfluxDB:    envVars.InfluxDB.ServerURL,
+		StorageTimescaleDB: envVars.TimescaleDB.URL,
+	}
+	for backend, url := range backends {
+		t.Run(backend, func(t *testing.T) {
+			t.Parallel()
+			if url == "" {
+				t.Skipf("the %s backend isn't configured", backend)
+			}
+			testMeasurementRepository(t, envVars, backend)
+		})
+	}
+}
+
+func testMeasurementRepository(t *testing.T, envVars *config.EnvVars, backend string) {
+	is := require.New(t)
 
-	var measurementRepository *MeasurementRepository
-	is.Nil(cont.Resolve(&measurementRepository))
+	backendEnvVars := *envVars
+	backendEnvVars.Storage.Backend = backend
+	measurementRepository, err := NewMeasurementRepository(&backendEnvVars)
+	is.Nil(err)
+	t.Cleanup(func() { measurementRepository.Close() })
 
 	ctx := context.Background()
+	is.Nil(measurementRepository.Ping(ctx))
 
 	t.Run("when CreateMeasurement is invoked with a valid measurement, it should create that measurement in the database", func(t *testing.T) {
 		t.Parallel()
@@ -125,7 +521,7 @@ func TestMeasurementRepository(t *testing.T) {
 			Unit:     "celsius",
 			Value:    15.3,
 		}
-		err = measurementRepository.CreateMeasurement(ctx, newMeasurement)
+		err := measurementRepository.CreateMeasurement(ctx, newMeasurement)
 		is.Nil(err)
 		is.NotZero(newMeasurement.Timestamp)
 	})
@@ -146,7 +542,7 @@ func TestMeasurementRepository(t *testing.T) {
 				Unit:     measurementUnit,
 				Value:    randomTemperature,
 			}
-			err = measurementRepository.CreateMeasurement(ctx, newMeasurement)
+			err := measurementRepository.CreateMeasurement(ctx, newMeasurement)
 			is.Nil(err)
 		}
 
@@ -174,6 +570,155 @@ func TestMeasurementRepository(t *testing.T) {
 		end := time.Now().Add(1 * time.Hour)
 
 		_, err := measurementRepository.GetMeasurementSummary(ctx, sensorID, "temperature", "celsius", end, start)
-		is.ErrorContains(err, "failed to query measurement summary: invalid: error in building plan while starting program: cannot query an empty range")
+		is.ErrorContains(err, "failed to query measurement summary")
+		is.ErrorContains(err, "cannot query an empty range")
+	})
+}
+
+func TestAnomaliesRepository(t *testing.T) {
+	t.Parallel()
+
+	forEachMetadataStore(t, func(t *testing.T, repositories *metadataRepositories) {
+		anomaliesRepository := repositories.anomalies
+		ctx := context.Background()
+
+		t.Run("when the same anomalies are saved twice, it should store them only once", func(t *testing.T) {
+			t.Parallel()
+			is := require.New(t)
+
+			sensorID := faker.UUIDHyphenated()
+			timestamp := time.Now().UTC().Truncate(time.Millisecond)
+			newAnomalies := []*Anomaly{
+				{SensorID: sensorID, Measurement: "temperature", Unit: "celsius", Method: "zscore", Timestamp: timestamp, Value: 40},
+				{SensorID: sensorID, Measurement: "temperature", Unit: "celsius", Method: "ewma", Timestamp: timestamp, Value: 40},
+			}
+			is.Nil(anomaliesRepository.SaveAnomalies(ctx, newAnomalies))
+			is.Nil(anomaliesRepository.SaveAnomalies(ctx, newAnomalies))
+
+			foundAnomalies, err := anomaliesRepository.GetAnomalies(ctx, sensorID, "temperature", "celsius", timestamp.Add(-time.Minute), timestamp.Add(time.Minute))
+			is.Nil(err)
+			is.Len(foundAnomalies, 2)
+		})
+	})
+}
+
+func TestRollupSelection(t *testing.T) {
+	t.Parallel()
+
+	m := &InfluxMeasurementRepository{
+		rollupBucket: "rollups",
+		rollup: rollupPolicy{
+			interval:       5 * time.Minute,
+			rawRetention:   30 * 24 * time.Hour,
+			rawMaxRange:    7 * 24 * time.Hour,
+			hourlyMaxRange: 90 * 24 * time.Hour,
+		},
+	}
+
+	t.Run("when the range is short and recent, it should read the raw bucket", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		_, ok := m.rollupResolution(time.Now().Add(-24*time.Hour), time.Now())
+		is.False(ok)
+	})
+
+	t.Run("when the range starts before the raw retention, it should read the hourly rollups", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		resolution, ok := m.rollupResolution(time.Now().Add(-40*24*time.Hour), time.Now().Add(-39*24*time.Hour))
+		is.True(ok)
+		is.Equal(RollupHourly, resolution)
+	})
+
+	t.Run("when the range is longer than the hourly max range, it should read the daily rollups", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		resolution, ok := m.rollupResolution(time.Now().Add(-365*24*time.Hour), time.Now())
+		is.True(ok)
+		is.Equal(RollupDaily, resolution)
+	})
+
+	t.Run("when there's no rollup bucket, it should always read the raw bucket", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		_, ok := (&InfluxMeasurementRepository{}).rollupResolution(time.Now().Add(-365*24*time.Hour), time.Now())
+		is.False(ok)
+	})
+
+	t.Run("when two summaries are merged, it should weight the mean by their counts", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		merged := mergeMeasurementSummaries(
+			&MeasurementSummary{MinValue: 10, MaxValue: 20, MeanValue: 15, MedianValue: 15, Unit: "celsius", Count: 30},
+			&MeasurementSummary{MinValue: 5, MaxValue: 18, MeanValue: 11, MedianValue: 11, Unit: "celsius", Count: 10},
+		)
+		is.Equal(5.0, merged.MinValue)
+		is.Equal(20.0, merged.MaxValue)
+		is.Equal(14.0, merged.MeanValue)
+		is.Equal(40, merged.Count)
+	})
+}
+
+func TestSensorWriteError(t *testing.T) {
+	t.Parallel()
+
+	duplicateKey := func(message string) error {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: message}}}
+	}
+
+	t.Run("when the write breaks either of the name indexes, it should return ErrNameTaken", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		is.ErrorIs(sensorWriteError(duplicateKey(`E11000 duplicate key error collection: db.sensors index: name_unique dup key: { name: "a" }`)), ErrNameTaken)
+		is.ErrorIs(sensorWriteError(duplicateKey(`E11000 duplicate key error collection: db.sensors index: name_unique_ci dup key: { name: "a" }`)), ErrNameTaken)
+		is.ErrorIs(sensorWriteError(duplicateKeyError(sensorNameIndex)), ErrNameTaken)
+	})
+
+	t.Run("when the write breaks another index, it should return the error as is", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		err := duplicateKey(`E11000 duplicate key error collection: db.sensors index: external_id_unique dup key: { external_id: "name_unique" }`)
+		is.NotErrorIs(sensorWriteError(err), ErrNameTaken)
+		is.True(duplicateKeyIndex(err, sensorExternalIDIndex))
+	})
+}
+
+func TestRejectedWrites(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when InfluxDB answers a bad request, it should be a rejection", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		is.True(influxRejected(&influxdb2http.Error{StatusCode: http.StatusBadRequest, Code: "invalid", Message: "field type conflict"}))
+		is.True(influxRejected(&influxdb2http.Error{StatusCode: http.StatusUnprocessableEntity}))
+		is.False(influxRejected(&influxdb2http.Error{StatusCode: http.StatusServiceUnavailable}))
+		is.False(influxRejected(&influxdb2http.Error{Err: context.DeadlineExceeded}))
+	})
+
+	t.Run("when PostgreSQL raises a data exception or breaks a constraint, it should be a rejection", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		is.True(timescaleRejected(fmt.Errorf("insert: %w", &pgconn.PgError{Code: "22003"})))
+		is.True(timescaleRejected(&pgconn.PgError{Code: "23502"}))
+		is.False(timescaleRejected(&pgconn.PgError{Code: "57P01"}))
+		is.False(timescaleRejected(context.DeadlineExceeded))
+	})
+
+	t.Run("when a rejection is returned, it should be told apart with ErrMeasurementsRejected", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		err := rejected(errors.New("field type conflict"))
+		is.ErrorIs(err, ErrMeasurementsRejected)
+		is.ErrorContains(err, "field type conflict")
 	})
 }
@@ -0,0 +1,419 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	RollupHourly = time.Hour
+	RollupDaily  = 24 * time.Hour
+)
+
+// Aggregate functions that can be answered from the min, max, mean and count of the rollups
+var rollupAggregates = map[string]bool{
+	"min":   true,
+	"max":   true,
+	"mean":  true,
+	"sum":   true,
+	"count": true,
+}
+
+type rollupPolicy struct {
+	interval       time.Duration
+	rawRetention   time.Duration
+	rawMaxRange    time.Duration
+	hourlyMaxRange time.Duration
+}
+
+// resolution decides whether a range should be read from the rollups and at which resolution.
+// Ranges starting before the raw retention have lost their raw data, and ranges longer than
+// rawMaxRange would scan too many raw points.
+func (p rollupPolicy) resolution(start, end time.Time) (time.Duration, bool) {
+	length := end.Sub(start)
+	if length <= p.rawMaxRange && !start.Before(time.Now().Add(-p.rawRetention)) {
+		return 0, false
+	}
+
+	if length > p.hourlyMaxRange {
+		return RollupDaily, true
+	}
+	return RollupHourly, true
+}
+
+// rollupResolution is the resolution of the policy, when there's a rollup bucket.
+func (m *InfluxMeasurementRepository) rollupResolution(start, end time.Time) (time.Duration, bool) {
+	if m.rollupBucket == "" {
+		return 0, false
+	}
+	return m.rollup.resolution(start, end)
+}
+
+// rollupBoundary is the time up to which the rollups of the resolution are expected to have been
+// written, given the roller completes the previous windows at every interval.
+func (m *InfluxMeasurementRepository) rollupBoundary(resolution time.Duration) time.Time {
+	return time.Now().Add(-m.rollup.interval).Truncate(resolution)
+}
+
+func (m *InfluxMeasurementRepository) RollupsEnabled() bool {
+	return m.rollupBucket != ""
+}
+
+// recordWrite keeps the earliest timestamp written until the roller takes it.
+func (m *InfluxMeasurementRepository) recordWrite(measurements []*Measurement) {
+	m.writesMu.Lock()
+	defer m.writesMu.Unlock()
+
+	for _, measurement := range measurements {
+		if m.earliestWrite.IsZero() || measurement.Timestamp.Before(m.earliestWrite) {
+			m.earliestWrite = measurement.Timestamp
+		}
+	}
+}
+
+func (m *InfluxMeasurementRepository) TakeEarliestWrite() time.Time {
+	m.writesMu.Lock()
+	defer m.writesMu.Unlock()
+
+	earliest := m.earliestWrite
+	m.earliestWrite = time.Time{}
+	return earliest
+}
+
+// PrepareRollups creates the rollup bucket, without a retention, if it doesn't exist yet.
+func (m *InfluxMeasurementRepository) PrepareRollups(ctx context.Context) (err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "PrepareRollups")
+	defer func() { finish(err) }()
+
+	bucketsAPI := m.client.BucketsAPI()
+	bucket, err := bucketsAPI.FindBucketByName(ctx, m.rollupBucket)
+	if err == nil && bucket != nil {
+		return nil
+	}
+
+	org, err := m.client.OrganizationsAPI().FindOrganizationByName(ctx, m.org)
+	if err != nil {
+		return fmt.Errorf("failed to find the organization: %w", err)
+	}
+
+	if _, err := bucketsAPI.CreateBucketWithName(ctx, org, m.rollupBucket, domain.RetentionRule{EverySeconds: 0}); err != nil {
+		return fmt.Errorf("failed to create the rollup bucket: %w", err)
+	}
+
+	return nil
+}
+
+// RollupMeasurements writes the min, max, mean and count of every series of the raw bucket to
+// the rollup bucket, for each window of the resolution within the range. The points are stamped
+// with the start of their window and tagged with the resolution.
+func (m *InfluxMeasurementRepository) RollupMeasurements(ctx context.Context, resolution time.Duration, start, end time.Time) (err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "RollupMeasurements", attribute.String("rollup.resolution", resolution.String()), attribute.String("query.start", start.Format(time.RFC3339)), attribute.String("query.end", end.Format(time.RFC3339)))
+	defer func() { finish(err) }()
+
+	query := flux(
+		`data = from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => r["_field"] == "value")
+			|> group(columns: ["_measurement", "sensor_id", "unit", "_field"])
+			|> sort(columns: ["_time"])
+
+		union(tables: [
+			data |> aggregateWindow(every: @every, fn: min, timeSrc: "_start", createEmpty: false) |> set(key: "_field", value: "min"),
+			data |> aggregateWindow(every: @every, fn: max, timeSrc: "_start", createEmpty: false) |> set(key: "_field", value: "max"),
+			data |> aggregateWindow(every: @every, fn: mean, timeSrc: "_start", createEmpty: false) |> set(key: "_field", value: "mean"),
+			data |> aggregateWindow(every: @every, fn: count, timeSrc: "_start", createEmpty: false) |> toFloat() |> set(key: "_field", value: "count"),
+		])
+			|> set(key: "rollup", value: @rollup)
+			|> to(bucket: @rollup_bucket, org: @org)`,
+		fluxArgs{"bucket": m.bucket, "start": start, "stop": end, "every": resolution, "rollup": rollupTag(resolution), "rollup_bucket": m.rollupBucket, "org": m.org})
+
+	result, err := m.query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to roll up measurements: %w", err)
+	}
+	// Nothing is returned other than the written rows, but the results still need to be read for
+	// the errors to surface
+	for result.Next() {
+	}
+	if result.Err() != nil {
+		return fmt.Errorf("query error: %w", result.Err())
+	}
+
+	return nil
+}
+
+func (m *InfluxMeasurementRepository) getRollupMeasurementSummary(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time, resolution time.Duration) (_ *MeasurementSummary, err error) {
+	ctx, span := startSpan(ctx, "measurement.getRollupMeasurementSummary", append(seriesAttributes(sensorIDs, measurement, unit, start, end), attribute.String("rollup.resolution", resolution.String()))...)
+	defer func() { endSpan(span, err) }()
+
+	query := flux(
+		`result = from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => r["_measurement"] == @measurement)
+			|> filter(fn: (r) => @sensor_ids)
+			|> filter(fn: (r) => r["unit"] == @unit)
+			|> filter(fn: (r) => r["rollup"] == @rollup)
+			|> group(columns: ["_measurement", "unit", "rollup", "_field"])
+
+		result
+			|> filter(fn: (r) => r["_field"] == "min")
+			|> min()
+			|> yield(name: "min")
+
+		result
+			|> filter(fn: (r) => r["_field"] == "max")
+			|> max()
+			|> yield(name: "max")
+
+		result
+			|> filter(fn: (r) => r["_field"] == "count")
+			|> sum()
+			|> yield(name: "count")
+
+		result
+			|> filter(fn: (r) => r["_field"] == "mean")
+			|> median()
+			|> yield(name: "median")
+
+		result
+			|> filter(fn: (r) => r["_field"] == "mean" or r["_field"] == "count")
+			|> pivot(rowKey: ["_time", "sensor_id"], columnKey: ["_field"], valueColumn: "_value")
+			|> map(fn: (r) => ({r with _value: r.mean * r.count}))
+			|> sum()
+			|> yield(name: "sum")`,
+		fluxArgs{"bucket": m.rollupBucket, "start": start, "stop": end, "measurement": measurement, "sensor_ids": sensorIDsPredicate(sensorIDs), "unit": unit, "rollup": rollupTag(resolution)})
+
+	result, err := m.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rollup summary: %w", err)
+	}
+
+	summary := MeasurementSummary{Unit: unit}
+	var sum float64
+	for result.Next() {
+		value, ok := result.Record().Value().(float64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type for %s value: %T", result.Record().Result(), result.Record().Value())
+		}
+
+		switch result.Record().Result() {
+		case "min":
+			summary.MinValue = value
+		case "max":
+			summary.MaxValue = value
+		case "count":
+			summary.Count = int(value)
+		case "median":
+			summary.MedianValue = value
+		case "sum":
+			sum = value
+		default:
+			return nil, fmt.Errorf("unexpected result name: %s", result.Record().Result())
+		}
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", result.Err())
+	}
+
+	if summary.Count > 0 {
+		summary.MeanValue = sum / float64(summary.Count)
+	}
+
+	return &summary, nil
+}
+
+func (m *InfluxMeasurementRepository) getRollupAggregatedMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time, every time.Duration, fn string, resolution time.Duration) ([]*Measurement, error) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("rollup.resolution", resolution.String()))
+
+	var aggregation fluxExpr
+	switch fn {
+	case "min", "max":
+		aggregation = flux(
+			`|> filter(fn: (r) => r["_field"] == @field)
+			|> aggregateWindow(every: @every, fn: @fn, createEmpty: false)`,
+			fluxArgs{"field": fn, "every": every, "fn": fluxExpr(fn)})
+	case "count":
+		aggregation = flux(
+			`|> filter(fn: (r) => r["_field"] == "count")
+			|> aggregateWindow(every: @every, fn: sum, createEmpty: false)`,
+			fluxArgs{"every": every})
+	case "mean", "sum":
+		value := fluxExpr("r.sum / r.count")
+		if fn == "sum" {
+			value = "r.sum"
+		}
+		aggregation = flux(
+			`|> filter(fn: (r) => r["_field"] == "mean" or r["_field"] == "count")
+			|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+			|> window(every: @every)
+			|> reduce(
+				identity: {sum: 0.0, count: 0.0},
+				fn: (r, accumulator) => ({sum: accumulator.sum + r.mean * r.count, count: accumulator.count + r.count}),
+			)
+			|> map(fn: (r) => ({_time: r._stop, _value: @value}))`,
+			fluxArgs{"every": every, "value": value})
+	default:
+		return nil, fmt.Errorf("unsupported rollup aggregate function: %s", fn)
+	}
+
+	query := flux(
+		`from(bucket: @bucket)
+			|> range(start: @start, stop: @stop)
+			|> filter(fn: (r) => r["_measurement"] == @measurement)
+			|> filter(fn: (r) => r["sensor_id"] == @sensor_id)
+			|> filter(fn: (r) => r["unit"] == @unit)
+			|> filter(fn: (r) => r["rollup"] == @rollup)
+			@aggregation
+			|> group()
+			|> sort(columns: ["_time"])`,
+		fluxArgs{"bucket": m.rollupBucket, "start": start, "stop": end, "measurement": measurement, "sensor_id": sensorID, "unit": unit, "rollup": rollupTag(resolution), "aggregation": aggregation})
+
+	result, err := m.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rollup aggregated measurements: %w", err)
+	}
+
+	measurements := []*Measurement{}
+	for result.Next() {
+		value, ok := result.Record().Value().(float64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type for aggregated value: %T", result.Record().Value())
+		}
+
+		measurements = append(measurements, &Measurement{
+			Name:      measurement,
+			SensorID:  sensorID,
+			Unit:      unit,
+			Value:     value,
+			Timestamp: result.Record().Time(),
+		})
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", result.Err())
+	}
+
+	return measurements, nil
+}
+
+// mergeMeasurementSummaries combines the summaries of two adjacent ranges. The median can't be
+// merged exactly, so it's approximated by the count weighted mean of both medians.
+func mergeMeasurementSummaries(a, b *MeasurementSummary) *MeasurementSummary {
+	if a.Count == 0 {
+		return b
+	}
+	if b.Count == 0 {
+		return a
+	}
+
+	count := float64(a.Count + b.Count)
+	return &MeasurementSummary{
+		MinValue:    math.Min(a.MinValue, b.MinValue),
+		MaxValue:    math.Max(a.MaxValue, b.MaxValue),
+		MedianValue: (a.MedianValue*float64(a.Count) + b.MedianValue*float64(b.Count)) / count,
+		MeanValue:   (a.MeanValue*float64(a.Count) + b.MeanValue*float64(b.Count)) / count,
+		Unit:        a.Unit,
+		Count:       a.Count + b.Count,
+	}
+}
+
+func rollupTag(resolution time.Duration) string {
+	switch {
+	case resolution%RollupDaily == 0:
+		return fmt.Sprintf("%dd", resolution/RollupDaily)
+	case resolution%time.Hour == 0:
+		return fmt.Sprintf("%dh", resolution/time.Hour)
+	default:
+		return formatFluxDuration(resolution)
+	}
+}
+
+// summarizeRollups summarizes the range with rollup over the whole windows of the resolution it
+// holds up to rollupEnd, the rollups covering their windows whole, and with raw over what's left
+// at both ends. The ends read from raw are shorter than a window, but lose whatever the raw
+// retention dropped already.
+func summarizeRollups(start, end, rollupEnd time.Time, resolution time.Duration, raw, rollup func(start, end time.Time) (*MeasurementSummary, error)) (*MeasurementSummary, error) {
+	rollupStart := alignTime(start, resolution)
+	if rollupStart.Before(start) {
+		rollupStart = rollupStart.Add(resolution)
+	}
+	rollupEnd = alignTime(minTime(end, rollupEnd), resolution)
+	if !rollupEnd.After(rollupStart) {
+		return raw(start, end)
+	}
+
+	summary, err := rollup(rollupStart, rollupEnd)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range [][2]time.Time{{start, rollupStart}, {rollupEnd, end}} {
+		if !part[1].After(part[0]) {
+			continue
+		}
+		partSummary, err := raw(part[0], part[1])
+		if err != nil {
+			return nil, err
+		}
+		summary = mergeMeasurementSummaries(summary, partSummary)
+	}
+	return summary, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// RollupCheckpointsRepository keeps, per resolution, the time up to which the rollups were
+// written, so the roller can resume where it stopped.
+type RollupCheckpointsRepository interface {
+	// GetWatermark returns the zero time when the resolution was never rolled up.
+	GetWatermark(ctx context.Context, resolution time.Duration) (time.Time, error)
+	SaveWatermark(ctx context.Context, resolution time.Duration, watermark time.Time) error
+}
+
+type MongoRollupCheckpointsRepository struct {
+	checkpointsColl *mongo.Collection
+}
+
+type rollupCheckpoint struct {
+	Resolution string    `bson:"_id"`
+	Watermark  time.Time `bson:"watermark"`
+}
+
+func NewMongoRollupCheckpointsRepository(envVars *config.EnvVars, mongoClient *mongo.Client) RollupCheckpointsRepository {
+	return &MongoRollupCheckpointsRepository{
+		checkpointsColl: mongoClient.Database(envVars.MongoDB.Database).Collection("rollup_checkpoints"),
+	}
+}
+
+// GetWatermark returns the zero time when the resolution was never rolled up.
+func (r *MongoRollupCheckpointsRepository) GetWatermark(ctx context.Context, resolution time.Duration) (time.Time, error) {
+	var checkpoint rollupCheckpoint
+	if err := r.checkpointsColl.FindOne(ctx, bson.M{"_id": rollupTag(resolution)}).Decode(&checkpoint); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return checkpoint.Watermark, nil
+}
+
+func (r *MongoRollupCheckpointsRepository) SaveWatermark(ctx context.Context, resolution time.Duration, watermark time.Time) error {
+	_, err := r.checkpointsColl.ReplaceOne(ctx,
+		bson.M{"_id": rollupTag(resolution)},
+		rollupCheckpoint{Resolution: rollupTag(resolution), Watermark: watermark},
+		options.Replace().SetUpsert(true))
+	return err
+}
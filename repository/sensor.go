@@ -2,18 +2,59 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var (
+	ErrVersionConflict = errors.New("the sensor was modified since the expected version")
+	ErrLastTag         = errors.New("a sensor must keep at least one tag")
+	ErrNameTaken       = errors.New("another sensor already has this name")
+)
+
+const (
+	sensorNameIndex                = "name_unique"
+	sensorNameCaseInsensitiveIndex = "name_unique_ci"
+	sensorExternalIDIndex          = "external_id_unique"
+)
+
+// AnyVersion skips the version check of the sensor updates.
+const AnyVersion = -1
+
 type Sensor struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Name     string             `bson:"name" json:"name"`
-	Location GeoJSONPoint       `bson:"location" json:"location"`
-	Tags     []string           `bson:"tags" json:"tags"`
+	ID          primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
+	ExternalID  string               `bson:"external_id,omitempty" json:"external_id,omitempty"`
+	Name        string               `bson:"name" json:"name"`
+	Description string               `bson:"description,omitempty" json:"description,omitempty"`
+	Location    GeoJSONPoint         `bson:"location" json:"location"`
+	Altitude    *float64             `bson:"altitude,omitempty" json:"altitude,omitempty"` // Meters above sea level
+	Tags        []string             `bson:"tags" json:"tags"`
+	Labels      map[string]string    `bson:"labels,omitempty" json:"labels,omitempty"`
+	Hardware    *SensorHardware      `bson:"hardware,omitempty" json:"hardware,omitempty"`
+	InstalledAt *time.Time           `bson:"installed_at,omitempty" json:"installed_at,omitempty"`
+	AssetID     *primitive.ObjectID  `bson:"asset_id,omitempty" json:"asset_id,omitempty"`         // Set by attaching the sensor to an asset
+	LastFixAt   *time.Time           `bson:"last_fix_at,omitempty" json:"last_fix_at,omitempty"`   // Time of the last location update
+	GeofenceIDs []primitive.ObjectID `bson:"geofence_ids,omitempty" json:"geofence_ids,omitempty"` // Geofences the sensor was within at the last location update
+	Version     int                  `bson:"version" json:"version"`
+}
+
+type SensorHardware struct {
+	Manufacturer    string `bson:"manufacturer,omitempty" json:"manufacturer,omitempty"`
+	Model           string `bson:"model,omitempty" json:"model,omitempty"`
+	SerialNumber    string `bson:"serial_number,omitempty" json:"serial_number,omitempty"`
+	FirmwareVersion string `bson:"firmware_version,omitempty" json:"firmware_version,omitempty"`
 }
 
 type GeoJSONPoint struct {
@@ -21,12 +62,71 @@ type GeoJSONPoint struct {
 	Coordinates []float64 `bson:"coordinates" json:"coordinates"` // Longitude, Latitude
 }
 
-type SensorsRepository struct {
-	mongoClient *mongo.Client
-	sensorsColl *mongo.Collection
+// SensorFix is a location reported by a sensor, along with the geofences the location is within.
+type SensorFix struct {
+	Location    GeoJSONPoint
+	Altitude    *float64
+	Timestamp   time.Time
+	GeofenceIDs []primitive.ObjectID
+}
+
+// SensorsRepository keeps the sensors along with their revisions, in MongoDB or, in the embedded
+// mode, in the embedded store.
+type SensorsRepository interface {
+	Ping(ctx context.Context) error
+	// Close closes the store, which is shared by the other repositories, so it's closed last.
+	Close() error
+
+	// CreateSensor keeps the ID of the sensor when it's set, so the sensors replicated from another
+	// server keep theirs.
+	CreateSensor(ctx context.Context, sensor *Sensor) error
+	GetSensorByID(ctx context.Context, id string) (*Sensor, error)
+	// RegisterSensor creates the sensor unless there's already one with its external ID, in which
+	// case the sensor is replaced by the existing one. It tells whether the sensor was created.
+	RegisterSensor(ctx context.Context, sensor *Sensor) (bool, error)
+	// GetSensorByExternalID returns nil when there's no sensor with the external ID.
+	GetSensorByExternalID(ctx context.Context, externalID string) (*Sensor, error)
+	GetSensorByName(ctx context.Context, name string) (*Sensor, error)
+	GetSensorsByTag(ctx context.Context, tag string) ([]*Sensor, error)
+	// GetSensors returns the sensors whose labels meet the selector, sorted by name.
+	GetSensors(ctx context.Context, selector label.Selector) ([]*Sensor, error)
+	// GetSensorsWithin returns the sensors located within the bounding box, in degrees.
+	GetSensorsWithin(ctx context.Context, minLongitude, minLatitude, maxLongitude, maxLatitude float64) ([]*Sensor, error)
+	// GetNearestSensor returns the sensor nearest to the location within maxDistance meters, or nil
+	// when there's none.
+	GetNearestSensor(ctx context.Context, latitude, longitude, maxDistance float64) (*Sensor, error)
+	// UpdateSensor replaces everything but the IDs, the asset and the version of the sensor,
+	// returning ErrVersionConflict when the sensor isn't at the expected version.
+	UpdateSensor(ctx context.Context, id string, sensor *Sensor, expectedVersion int) error
+	AddSensorTag(ctx context.Context, id, tag string, expectedVersion int) (*Sensor, error)
+	// RemoveSensorTag returns ErrLastTag when the tag is the last one of the sensor.
+	RemoveSensorTag(ctx context.Context, id, tag string, expectedVersion int) (*Sensor, error)
+	// MoveSensor moves the sensor to the location of the fix, unless it already has a more recent
+	// one. A move changing the location or the altitude bumps the version and records a revision,
+	// as the other updates do. It returns the sensor as it was before the move, or nil when the fix
+	// arrived late.
+	MoveSensor(ctx context.Context, id string, fix *SensorFix) (*Sensor, error)
+	// SetSensorAsset attaches the sensor to the asset, or detaches it with a nil asset, bumping the
+	// version and recording a revision as the other updates do. With from, the change only applies
+	// while the sensor is attached to that asset. It reports whether it applied, returning
+	// mongo.ErrNoDocuments when there's no such sensor.
+	SetSensorAsset(ctx context.Context, id string, assetID, from *primitive.ObjectID) (bool, error)
+
+	// GetSensorHistory returns the revisions of a sensor, oldest first.
+	GetSensorHistory(ctx context.Context, id string) ([]*SensorRevision, error)
+	// GetSensorStateAt returns the state a sensor was in at the time, or nil when it didn't exist
+	// yet.
+	GetSensorStateAt(ctx context.Context, id string, at time.Time) (*SensorState, error)
+}
+
+type MongoSensorsRepository struct {
+	mongoClient   *mongo.Client
+	sensorsColl   *mongo.Collection
+	revisionsColl *mongo.Collection
+	nameCollation *options.Collation
 }
 
-func NewSensorsRepository(envVars *config.EnvVars, mongoClient *mongo.Client) (*SensorsRepository, error) {
+func NewMongoSensorsRepository(envVars *config.EnvVars, mongoClient *mongo.Client) (SensorsRepository, error) {
 	sensorsColl := mongoClient.Database(envVars.MongoDB.Database).Collection("sensors")
 	_, err := sensorsColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
 		Keys: bson.M{
@@ -37,26 +137,129 @@ func NewSensorsRepository(envVars *config.EnvVars, mongoClient *mongo.Client) (*
 		return nil, err
 	}
 
-	return &SensorsRepository{
-		mongoClient: mongoClient,
-		sensorsColl: sensorsColl,
+	var nameCollation *options.Collation
+	if envVars.Sensors.CaseInsensitiveNames {
+		nameCollation = &options.Collation{Locale: "en", Strength: 2}
+	}
+	if err := createSensorNameIndexes(sensorsColl, nameCollation); err != nil {
+		return nil, err
+	}
+
+	revisionsColl := mongoClient.Database(envVars.MongoDB.Database).Collection("sensor_revisions")
+	if err := createSensorRevisionsIndexes(revisionsColl); err != nil {
+		return nil, err
+	}
+
+	return &MongoSensorsRepository{
+		mongoClient:   mongoClient,
+		sensorsColl:   sensorsColl,
+		revisionsColl: revisionsColl,
+		nameCollation: nameCollation,
 	}, nil
 }
 
-func (s *SensorsRepository) Close() error {
+// createSensorNameIndexes makes the names unique, compared with the collation when there's one,
+// and the external IDs of the sensors having one unique.
+func createSensorNameIndexes(sensorsColl *mongo.Collection, nameCollation *options.Collation) error {
+	ctx := context.Background()
+
+	nameIndex, staleNameIndex := sensorNameIndex, sensorNameCaseInsensitiveIndex
+	if nameCollation != nil {
+		nameIndex, staleNameIndex = staleNameIndex, nameIndex
+	}
+	_, err := sensorsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "name", Value: 1}},
+			Options: options.Index().SetName(nameIndex).SetUnique(true).SetCollation(nameCollation),
+		},
+		{
+			Keys: bson.D{{Key: "external_id", Value: 1}},
+			Options: options.Index().SetName(sensorExternalIDIndex).SetUnique(true).
+				SetPartialFilterExpression(bson.M{"external_id": bson.M{"$type": "string"}}),
+		},
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("failed to make sensor names unique, rename the sensors sharing a name first: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Switching between case sensitive and insensitive names leaves the other index behind
+	_, err = sensorsColl.Indexes().DropOne(ctx, staleNameIndex)
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound") {
+		return err
+	}
+	return nil
+}
+
+// normalizeSensorName trims the name and collapses its inner whitespace, so names that only differ
+// by spacing are the same name.
+func normalizeSensorName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// duplicateKeyIndex tells whether the write was refused for breaking the unique index, reading
+// the index names out of the duplicate key errors, whose messages name the index as
+// "index: <name> dup key: ...".
+func duplicateKeyIndex(err error, index string) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+	for _, e := range writeErr.WriteErrors {
+		if e.Code != 11000 {
+			continue
+		}
+		_, after, ok := strings.Cut(e.Message, "index: ")
+		if fields := strings.Fields(after); ok && len(fields) > 0 && fields[0] == index {
+			return true
+		}
+	}
+	return false
+}
+
+// sensorWriteError tells apart the writes refused because of the unique name, whichever of the
+// name indexes is in use.
+func sensorWriteError(err error) error {
+	if duplicateKeyIndex(err, sensorNameIndex) || duplicateKeyIndex(err, sensorNameCaseInsensitiveIndex) {
+		return ErrNameTaken
+	}
+	return err
+}
+
+func (s *MongoSensorsRepository) Close() error {
 	return s.mongoClient.Disconnect(context.Background())
 }
 
-func (s *SensorsRepository) CreateSensor(ctx context.Context, sensor *Sensor) error {
+// Ping checks that the MongoDB primary answers.
+func (s *MongoSensorsRepository) Ping(ctx context.Context) error {
+	return s.mongoClient.Ping(ctx, readpref.Primary())
+}
+
+func (s *MongoSensorsRepository) CreateSensor(ctx context.Context, sensor *Sensor) (err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "CreateSensor")
+	defer func() { finish(err) }()
+
+	sensor.Name = normalizeSensorName(sensor.Name)
+	sensor.Version = 1
 	result, err := s.sensorsColl.InsertOne(ctx, sensor)
 	if err != nil {
-		return err
+		return sensorWriteError(err)
 	}
 	sensor.ID = result.InsertedID.(primitive.ObjectID)
+
+	if err := s.recordRevision(ctx, sensor.ID, sensor.Version, nil, NewSensorState(sensor)); err != nil {
+		return fmt.Errorf("sensor created but failed to record its revision: %w", err)
+	}
 	return nil
 }
 
-func (s *SensorsRepository) GetSensorByID(ctx context.Context, id string) (*Sensor, error) {
+func (s *MongoSensorsRepository) GetSensorByID(ctx context.Context, id string) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetSensorByID", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return nil, err
@@ -68,15 +271,152 @@ func (s *SensorsRepository) GetSensorByID(ctx context.Context, id string) (*Sens
 	return &sensor, nil
 }
 
-func (s *SensorsRepository) GetSensorByName(ctx context.Context, name string) (*Sensor, error) {
+// RegisterSensor creates the sensor unless there's already one with its external ID, in which
+// case the sensor is replaced by the existing one, so devices can register themselves every time
+// they boot. It tells whether the sensor was created.
+func (s *MongoSensorsRepository) RegisterSensor(ctx context.Context, sensor *Sensor) (_ bool, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "RegisterSensor", attribute.String("sensor.external_id", sensor.ExternalID))
+	defer func() { finish(err) }()
+
+	if sensor.ExternalID == "" {
+		return true, s.CreateSensor(ctx, sensor)
+	}
+
+	for {
+		existing, err := s.GetSensorByExternalID(ctx, sensor.ExternalID)
+		if err != nil {
+			return false, err
+		}
+		if existing != nil {
+			*sensor = *existing
+			return false, nil
+		}
+
+		err = s.CreateSensor(ctx, sensor)
+		if duplicateKeyIndex(err, sensorExternalIDIndex) {
+			// Registered concurrently, the existing sensor is picked up on the next iteration
+			continue
+		}
+		return err == nil, err
+	}
+}
+
+// GetSensorByExternalID returns nil when there's no sensor with the external ID.
+func (s *MongoSensorsRepository) GetSensorByExternalID(ctx context.Context, externalID string) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetSensorByExternalID", attribute.String("sensor.external_id", externalID))
+	defer func() { finish(err) }()
+
+	var sensor Sensor
+	if err := s.sensorsColl.FindOne(ctx, bson.M{"external_id": externalID}).Decode(&sensor); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &sensor, nil
+}
+
+func (s *MongoSensorsRepository) GetSensorByName(ctx context.Context, name string) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetSensorByName", attribute.String("sensor.name", name))
+	defer func() { finish(err) }()
+
 	var sensor Sensor
-	if err := s.sensorsColl.FindOne(ctx, bson.M{"name": name}).Decode(&sensor); err != nil {
+	opts := options.FindOne().SetCollation(s.nameCollation)
+	if err := s.sensorsColl.FindOne(ctx, bson.M{"name": normalizeSensorName(name)}, opts).Decode(&sensor); err != nil {
 		return nil, err
 	}
 	return &sensor, nil
 }
 
-func (s *SensorsRepository) GetNearestSensor(ctx context.Context, latitude, longitude, maxDistance float64) (*Sensor, error) {
+func (s *MongoSensorsRepository) GetSensorsByTag(ctx context.Context, tag string) (_ []*Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetSensorsByTag", attribute.String("sensor.tag", tag))
+	defer func() { finish(err) }()
+
+	cursor, err := s.sensorsColl.Find(ctx, bson.M{"tags": tag})
+	if err != nil {
+		return nil, err
+	}
+
+	sensors := []*Sensor{}
+	if err := cursor.All(ctx, &sensors); err != nil {
+		return nil, err
+	}
+	return sensors, nil
+}
+
+// GetSensors returns the sensors whose labels meet the selector, sorted by name.
+func (s *MongoSensorsRepository) GetSensors(ctx context.Context, selector label.Selector) (_ []*Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetSensors", attribute.String("label.selector", selector.String()))
+	defer func() { finish(err) }()
+
+	filter := bson.M{}
+	conditions := bson.A{}
+	for _, requirement := range selector {
+		field := "labels." + requirement.Key
+		switch requirement.Operator {
+		case label.OperatorEquals:
+			conditions = append(conditions, bson.M{field: requirement.Value})
+		case label.OperatorNotEquals:
+			// A missing label also meets $ne
+			conditions = append(conditions, bson.M{field: bson.M{"$ne": requirement.Value}})
+		case label.OperatorExists:
+			conditions = append(conditions, bson.M{field: bson.M{"$exists": true}})
+		case label.OperatorNotExists:
+			conditions = append(conditions, bson.M{field: bson.M{"$exists": false}})
+		}
+	}
+	if len(conditions) > 0 {
+		filter["$and"] = conditions
+	}
+
+	cursor, err := s.sensorsColl.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	sensors := []*Sensor{}
+	if err := cursor.All(ctx, &sensors); err != nil {
+		return nil, err
+	}
+	return sensors, nil
+}
+
+// GetSensorsWithin returns the sensors located within the bounding box, in degrees.
+func (s *MongoSensorsRepository) GetSensorsWithin(ctx context.Context, minLongitude, minLatitude, maxLongitude, maxLatitude float64) (_ []*Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetSensorsWithin")
+	defer func() { finish(err) }()
+
+	cursor, err := s.sensorsColl.Find(ctx, bson.M{
+		"location": bson.M{
+			"$geoWithin": bson.M{
+				"$geometry": GeoJSONPolygon{
+					Type: "Polygon",
+					Coordinates: [][][]float64{{
+						{minLongitude, minLatitude},
+						{maxLongitude, minLatitude},
+						{maxLongitude, maxLatitude},
+						{minLongitude, maxLatitude},
+						{minLongitude, minLatitude},
+					}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sensors := []*Sensor{}
+	if err := cursor.All(ctx, &sensors); err != nil {
+		return nil, err
+	}
+	return sensors, nil
+}
+
+func (s *MongoSensorsRepository) GetNearestSensor(ctx context.Context, latitude, longitude, maxDistance float64) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetNearestSensor")
+	defer func() { finish(err) }()
+
 	var sensor Sensor
 	if err := s.sensorsColl.FindOne(ctx, bson.M{
 		"location": bson.M{
@@ -97,21 +437,260 @@ func (s *SensorsRepository) GetNearestSensor(ctx context.Context, latitude, long
 	return &sensor, nil
 }
 
-func (s *SensorsRepository) UpdateSensor(ctx context.Context, id string, sensor *Sensor) error {
+// UpdateSensor replaces everything but the IDs, the asset and the version of the sensor, recording a revision when
+// anything changed. It returns ErrVersionConflict when the sensor isn't at the expected version.
+// With AnyVersion, the update is applied to the version of the sensor the diff was computed
+// against, starting over if another update got in between.
+func (s *MongoSensorsRepository) UpdateSensor(ctx context.Context, id string, sensor *Sensor, expectedVersion int) (err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "UpdateSensor", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	for {
+		current, err := s.GetSensorByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != AnyVersion && current.Version != expectedVersion {
+			return ErrVersionConflict
+		}
+
+		sensor.ID = current.ID
+		sensor.ExternalID = current.ExternalID
+		sensor.AssetID = current.AssetID
+		sensor.Name = normalizeSensorName(sensor.Name)
+		sensor.Version = current.Version
+		before := NewSensorState(current)
+		after := NewSensorState(sensor)
+		if len(DiffSensorStates(before, after)) == 0 {
+			return nil
+		}
+
+		result, err := s.sensorsColl.UpdateOne(ctx,
+			bson.M{"_id": current.ID, "version": versionFilter(current.Version)},
+			bson.M{
+				"$set": after,
+				"$inc": bson.M{"version": 1},
+			},
+		)
+		if err != nil {
+			return sensorWriteError(err)
+		}
+		if result.MatchedCount == 0 {
+			if expectedVersion != AnyVersion {
+				return ErrVersionConflict
+			}
+			continue
+		}
+
+		sensor.Version = current.Version + 1
+		if err := s.recordRevision(ctx, sensor.ID, sensor.Version, &before, after); err != nil {
+			return fmt.Errorf("sensor updated but failed to record its revision: %w", err)
+		}
+		return nil
+	}
+}
+
+// MoveSensor sets the location of the sensor only if it's still at the version and the fix it was
+// read at, so concurrent moves each see the geofences left by the previous one and every crossing
+// is reported once.
+func (s *MongoSensorsRepository) MoveSensor(ctx context.Context, id string, fix *SensorFix) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "MoveSensor", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	for {
+		current, err := s.GetSensorByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if current.LastFixAt != nil && !current.LastFixAt.Before(fix.Timestamp) {
+			return nil, nil
+		}
+
+		moved := *current
+		moved.Location = fix.Location
+		if fix.Altitude != nil {
+			moved.Altitude = fix.Altitude
+		}
+		before := NewSensorState(current)
+		after := NewSensorState(&moved)
+		changed := len(DiffSensorStates(before, after)) > 0
+
+		filter := bson.M{"_id": current.ID, "version": versionFilter(current.Version)}
+		if current.LastFixAt == nil {
+			filter["last_fix_at"] = bson.M{"$exists": false}
+		} else {
+			filter["last_fix_at"] = current.LastFixAt
+		}
+		set := bson.M{
+			"location":     fix.Location,
+			"last_fix_at":  fix.Timestamp,
+			"geofence_ids": fix.GeofenceIDs,
+		}
+		if fix.Altitude != nil {
+			set["altitude"] = fix.Altitude
+		}
+		update := bson.M{"$set": set}
+		if changed {
+			update["$inc"] = bson.M{"version": 1}
+		}
+		result, err := s.sensorsColl.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			continue
+		}
+
+		if changed {
+			if err := s.recordRevision(ctx, current.ID, current.Version+1, &before, after); err != nil {
+				return nil, fmt.Errorf("sensor moved but failed to record its revision: %w", err)
+			}
+		}
+		return current, nil
+	}
+}
+
+// SetSensorAsset changes the asset of the sensor only if it's still at the version it was read at,
+// starting over otherwise.
+func (s *MongoSensorsRepository) SetSensorAsset(ctx context.Context, id string, assetID, from *primitive.ObjectID) (_ bool, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "SetSensorAsset", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	for {
+		current, err := s.GetSensorByID(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if from != nil && !sameAsset(current.AssetID, from) {
+			return false, nil
+		}
+		if sameAsset(current.AssetID, assetID) {
+			return true, nil
+		}
+
+		update := bson.M{"$inc": bson.M{"version": 1}}
+		if assetID == nil {
+			update["$unset"] = bson.M{"asset_id": ""}
+		} else {
+			update["$set"] = bson.M{"asset_id": assetID}
+		}
+		result, err := s.sensorsColl.UpdateOne(ctx, bson.M{"_id": current.ID, "version": versionFilter(current.Version)}, update)
+		if err != nil {
+			return false, err
+		}
+		if result.MatchedCount == 0 {
+			continue
+		}
+
+		updated := *current
+		updated.AssetID = assetID
+		before := NewSensorState(current)
+		if err := s.recordRevision(ctx, current.ID, current.Version+1, &before, NewSensorState(&updated)); err != nil {
+			return false, fmt.Errorf("sensor asset changed but failed to record its revision: %w", err)
+		}
+		return true, nil
+	}
+}
+
+func sameAsset(a, b *primitive.ObjectID) bool {
+	return equalPointers(a, b, func(a, b primitive.ObjectID) bool { return a == b })
+}
+
+// AddSensorTag adds the tag to the sensor in place, so concurrent tag changes don't overwrite
+// each other. Adding a tag the sensor already has changes nothing.
+func (s *MongoSensorsRepository) AddSensorTag(ctx context.Context, id, tag string, expectedVersion int) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "AddSensorTag", append(sensorAttributes(id), attribute.String("sensor.tag", tag))...)
+	defer func() { finish(err) }()
+
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = s.sensorsColl.UpdateByID(ctx, objectID, bson.M{
-		"$set": bson.M{
-			"name":     sensor.Name,
-			"location": sensor.Location,
-			"tags":     sensor.Tags,
-		},
+	filter := bson.M{"_id": objectID, "tags": bson.M{"$ne": tag}}
+	update := bson.M{"$addToSet": bson.M{"tags": tag}}
+	sensor, err := s.updateSensorTags(ctx, filter, update, expectedVersion, func(tags []string) []string {
+		return append(slices.Clone(tags), tag)
 	})
+	if err != mongo.ErrNoDocuments {
+		return sensor, err
+	}
+
+	return s.currentSensor(ctx, id, expectedVersion)
+}
 
-	sensor.ID = objectID
+// RemoveSensorTag removes the tag from the sensor in place, unless it's the last one. Removing a
+// tag the sensor doesn't have changes nothing.
+func (s *MongoSensorsRepository) RemoveSensorTag(ctx context.Context, id, tag string, expectedVersion int) (_ *Sensor, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "RemoveSensorTag", append(sensorAttributes(id), attribute.String("sensor.tag", tag))...)
+	defer func() { finish(err) }()
 
-	return err
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"_id": objectID, "tags": tag, "tags.1": bson.M{"$exists": true}}
+	update := bson.M{"$pull": bson.M{"tags": tag}}
+	sensor, err := s.updateSensorTags(ctx, filter, update, expectedVersion, func(tags []string) []string {
+		return slices.DeleteFunc(slices.Clone(tags), func(t string) bool { return t == tag })
+	})
+	if err != mongo.ErrNoDocuments {
+		return sensor, err
+	}
+
+	current, err := s.currentSensor(ctx, id, expectedVersion)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(current.Tags, tag) {
+		return nil, ErrLastTag
+	}
+	return current, nil
+}
+
+// updateSensorTags applies the update to the sensor matching the filter, bumping its version and
+// recording a revision. It returns mongo.ErrNoDocuments when no sensor matched.
+func (s *MongoSensorsRepository) updateSensorTags(ctx context.Context, filter, update bson.M, expectedVersion int, applyToTags func([]string) []string) (*Sensor, error) {
+	if expectedVersion != AnyVersion {
+		filter["version"] = versionFilter(expectedVersion)
+	}
+	update["$inc"] = bson.M{"version": 1}
+
+	var before Sensor
+	err := s.sensorsColl.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&before)
+	if err != nil {
+		return nil, err
+	}
+
+	after := before
+	after.Tags = applyToTags(before.Tags)
+	after.Version = before.Version + 1
+
+	beforeState := NewSensorState(&before)
+	if err := s.recordRevision(ctx, after.ID, after.Version, &beforeState, NewSensorState(&after)); err != nil {
+		return nil, fmt.Errorf("sensor updated but failed to record its revision: %w", err)
+	}
+	return &after, nil
+}
+
+// currentSensor returns the sensor after a tag change turned out to change nothing, or
+// ErrVersionConflict when it's not at the expected version.
+func (s *MongoSensorsRepository) currentSensor(ctx context.Context, id string, expectedVersion int) (*Sensor, error) {
+	current, err := s.GetSensorByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if expectedVersion != AnyVersion && current.Version != expectedVersion {
+		return nil, ErrVersionConflict
+	}
+	return current, nil
+}
+
+// versionFilter matches a sensor version, sensors created before versioning having none.
+func versionFilter(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
 }
@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SensorActionCreated = "created"
+	SensorActionUpdated = "updated"
+
+	anonymousActor = "anonymous"
+)
+
+// SensorState is what a revision records of a sensor, which is also everything an update can
+// change, so empty fields are kept to be cleared by the update.
+type SensorState struct {
+	Name        string            `bson:"name" json:"name"`
+	Description string            `bson:"description" json:"description"`
+	Location    GeoJSONPoint      `bson:"location" json:"location"`
+	Altitude    *float64          `bson:"altitude" json:"altitude"`
+	Tags        []string          `bson:"tags" json:"tags"`
+	Labels      map[string]string `bson:"labels" json:"labels"`
+	Hardware    *SensorHardware   `bson:"hardware" json:"hardware"`
+	InstalledAt *time.Time        `bson:"installed_at" json:"installed_at"`
+	// AssetID is only changed by attaching the sensor to an asset or detaching it
+	AssetID *primitive.ObjectID `bson:"asset_id" json:"asset_id"`
+}
+
+// SensorRevision records a mutation of a sensor: who made it, when, the fields it changed and the
+// state of the sensor before and after it. Revisions are numbered by the version of the sensor
+// they produced.
+type SensorRevision struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	SensorID  primitive.ObjectID `bson:"sensor_id" json:"sensor_id"`
+	Version   int                `bson:"version" json:"version"`
+	Action    string             `bson:"action" json:"action"`
+	Actor     string             `bson:"actor" json:"actor"`
+	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+	Changed   []string           `bson:"changed" json:"changed"`
+	Before    *SensorState       `bson:"before,omitempty" json:"before,omitempty"`
+	After     SensorState        `bson:"after" json:"after"`
+}
+
+type actorKey struct{}
+
+// WithActor sets who is behind the mutations made with the context, to be recorded in the
+// revisions.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return anonymousActor
+}
+
+func NewSensorState(sensor *Sensor) SensorState {
+	return SensorState{
+		Name:        sensor.Name,
+		Description: sensor.Description,
+		Location:    sensor.Location,
+		Altitude:    sensor.Altitude,
+		Tags:        sensor.Tags,
+		Labels:      sensor.Labels,
+		Hardware:    sensor.Hardware,
+		InstalledAt: sensor.InstalledAt,
+		AssetID:     sensor.AssetID,
+	}
+}
+
+// DiffSensorStates lists the fields that differ between the states.
+func DiffSensorStates(before, after SensorState) []string {
+	changed := []string{}
+	if before.Name != after.Name {
+		changed = append(changed, "name")
+	}
+	if !slices.Equal(before.Location.Coordinates, after.Location.Coordinates) {
+		changed = append(changed, "location")
+	}
+	if !slices.Equal(before.Tags, after.Tags) {
+		changed = append(changed, "tags")
+	}
+	if before.Description != after.Description {
+		changed = append(changed, "description")
+	}
+	if !equalPointers(before.Altitude, after.Altitude, func(a, b float64) bool { return a == b }) {
+		changed = append(changed, "altitude")
+	}
+	if !maps.Equal(before.Labels, after.Labels) {
+		changed = append(changed, "labels")
+	}
+	if !equalPointers(before.Hardware, after.Hardware, func(a, b SensorHardware) bool { return a == b }) {
+		changed = append(changed, "hardware")
+	}
+	if !equalPointers(before.InstalledAt, after.InstalledAt, time.Time.Equal) {
+		changed = append(changed, "installed_at")
+	}
+	if !equalPointers(before.AssetID, after.AssetID, func(a, b primitive.ObjectID) bool { return a == b }) {
+		changed = append(changed, "asset_id")
+	}
+	return changed
+}
+
+func equalPointers[T any](a, b *T, equal func(T, T) bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return equal(*a, *b)
+}
+
+func createSensorRevisionsIndexes(revisionsColl *mongo.Collection) error {
+	_, err := revisionsColl.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "sensor_id", Value: 1}, {Key: "version", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "sensor_id", Value: 1}, {Key: "timestamp", Value: 1}},
+		},
+	})
+	return err
+}
+
+// newSensorRevision makes the revision of a mutation, a creation when there's no state before it.
+func newSensorRevision(ctx context.Context, sensorID primitive.ObjectID, version int, before *SensorState, after SensorState) *SensorRevision {
+	revision := &SensorRevision{
+		SensorID:  sensorID,
+		Version:   version,
+		Action:    SensorActionUpdated,
+		Actor:     actorFromContext(ctx),
+		Timestamp: time.Now(),
+		After:     after,
+	}
+	if before == nil {
+		revision.Action = SensorActionCreated
+		revision.Changed = DiffSensorStates(SensorState{}, after)
+	} else {
+		revision.Before = before
+		revision.Changed = DiffSensorStates(*before, after)
+	}
+	return revision
+}
+
+func (s *MongoSensorsRepository) recordRevision(ctx context.Context, sensorID primitive.ObjectID, version int, before *SensorState, after SensorState) error {
+	_, err := s.revisionsColl.InsertOne(ctx, newSensorRevision(ctx, sensorID, version, before, after))
+	return err
+}
+
+// GetSensorHistory returns the revisions of a sensor, oldest first.
+func (s *MongoSensorsRepository) GetSensorHistory(ctx context.Context, id string) (_ []*SensorRevision, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetSensorHistory", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := s.revisionsColl.Find(ctx, bson.M{"sensor_id": objectID}, options.Find().SetSort(bson.D{{Key: "version", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []*SensorRevision{}
+	if err := cursor.All(ctx, &revisions); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// GetSensorStateAt returns the state a sensor was in at the time, or nil when it didn't exist yet.
+// Sensors created before revisions were recorded are assumed to have had the state preceding their
+// first revision since forever.
+func (s *MongoSensorsRepository) GetSensorStateAt(ctx context.Context, id string, at time.Time) (_ *SensorState, err error) {
+	ctx, finish := instrument(ctx, sensorsRepositoryName, "GetSensorStateAt", sensorAttributes(id)...)
+	defer func() { finish(err) }()
+
+	sensor, err := s.GetSensorByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var revision SensorRevision
+	err = s.revisionsColl.FindOne(ctx,
+		bson.M{"sensor_id": sensor.ID, "timestamp": bson.M{"$lte": at}},
+		options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}}),
+	).Decode(&revision)
+	if err == nil {
+		return &revision.After, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	// Nothing happened to the sensor up to the time, so it was in the state before the first revision
+	err = s.revisionsColl.FindOne(ctx,
+		bson.M{"sensor_id": sensor.ID},
+		options.FindOne().SetSort(bson.D{{Key: "version", Value: 1}}),
+	).Decode(&revision)
+	if err == mongo.ErrNoDocuments {
+		state := NewSensorState(sensor)
+		return &state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return revision.Before, nil
+}
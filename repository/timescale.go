@@ -0,0 +1,699 @@
+package repository
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
+	"github.com/zignd/pingthings-collaborative-technical-interview/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//go:embed migrations/timescaledb/*.sql
+var timescaleMigrations embed.FS
+
+// migrationLockID is the key of the advisory lock held while migrating, an arbitrary number no
+// other code of the database should use.
+const migrationLockID = 7_302_114_501
+
+var errEmptyRange = errors.New("cannot query an empty range")
+
+// Continuous aggregates of the rollups by resolution
+var rollupViews = map[time.Duration]string{
+	RollupHourly: "measurements_hourly",
+	RollupDaily:  "measurements_daily",
+}
+
+// SQL aggregates of the functions of fluxFunctions, so both backends accept the same ones
+var sqlAggregates = map[string]string{
+	"mean":   "avg(value)",
+	"median": "percentile_cont(0.5) WITHIN GROUP (ORDER BY value)",
+	"min":    "min(value)",
+	"max":    "max(value)",
+	"sum":    "sum(value)",
+	"count":  "count(*)::float8",
+	"first":  "first(value, time)",
+	"last":   "last(value, time)",
+}
+
+// SQL aggregates of the rollupAggregates over the rollups
+var sqlRollupAggregates = map[string]string{
+	"min":   "min(min_value)",
+	"max":   "max(max_value)",
+	"mean":  "sum(mean_value * count) / sum(count)",
+	"sum":   "sum(mean_value * count)",
+	"count": "sum(count)::float8",
+}
+
+func sqlAggregate(fn string) (string, error) {
+	aggregate, ok := sqlAggregates[fn]
+	if !ok {
+		return "", fmt.Errorf("unsupported function: %q", fn)
+	}
+	return aggregate, nil
+}
+
+// TimescaleMeasurementRepository keeps the measurements in a TimescaleDB hypertable and their
+// rollups in continuous aggregates, both created by the migrations. PostgreSQL keeps the times to
+// the microsecond, so the measurements lose their nanoseconds.
+type TimescaleMeasurementRepository struct {
+	pool      *pgxpool.Pool
+	rollup    rollupPolicy
+	maxPoints int
+
+	migrateMu sync.Mutex
+	migrated  bool
+}
+
+// NewTimescaleMeasurementRepository doesn't connect to the database yet, the connections are
+// opened when needed and the migrations applied by the first Ping reaching the database.
+func NewTimescaleMeasurementRepository(envVars *config.EnvVars) (*TimescaleMeasurementRepository, error) {
+	poolConfig, err := pgxpool.ParseConfig(envVars.TimescaleDB.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the TimescaleDB URL: %w", err)
+	}
+	poolConfig.MaxConns = int32(envVars.TimescaleDB.MaxConns)
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the TimescaleDB pool: %w", err)
+	}
+
+	return &TimescaleMeasurementRepository{
+		pool: pool,
+		rollup: rollupPolicy{
+			interval:       envVars.Rollup.Interval,
+			rawRetention:   envVars.Rollup.RawRetention,
+			rawMaxRange:    envVars.Rollup.RawMaxRange,
+			hourlyMaxRange: envVars.Rollup.HourlyMaxRange,
+		},
+		maxPoints: envVars.Query.MaxPoints,
+	}, nil
+}
+
+func (m *TimescaleMeasurementRepository) Close() error {
+	m.pool.Close()
+	return nil
+}
+
+// Ping checks the database is reachable and, the first time it is, applies the migrations, so the
+// server isn't ready before the schema is up to date.
+func (m *TimescaleMeasurementRepository) Ping(ctx context.Context) error {
+	if err := m.pool.Ping(ctx); err != nil {
+		return err
+	}
+	return m.Migrate(ctx)
+}
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations returns the embedded migrations sorted by version, the number their file names
+// start with.
+func loadMigrations() ([]migration, error) {
+	const dir = "migrations/timescaledb"
+	entries, err := fs.ReadDir(timescaleMigrations, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration name %s: %w", entry.Name(), err)
+		}
+		if len(migrations) > 0 && migrations[len(migrations)-1].version == version {
+			return nil, fmt.Errorf("duplicate migration version %d", version)
+		}
+
+		sql, err := fs.ReadFile(timescaleMigrations, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: entry.Name(), sql: string(sql)})
+	}
+	return migrations, nil
+}
+
+// Migrate applies the migrations not applied yet in the order of their versions, each in a
+// transaction along with its row in schema_migrations. An advisory lock keeps the servers started
+// at the same time from applying them together.
+func (m *TimescaleMeasurementRepository) Migrate(ctx context.Context) (err error) {
+	m.migrateMu.Lock()
+	defer m.migrateMu.Unlock()
+	if m.migrated {
+		return nil
+	}
+
+	ctx, finish := instrument(ctx, measurementRepositoryName, "Migrate")
+	defer func() { finish(err) }()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to load the migrations: %w", err)
+	}
+
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire a connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to lock the migrations: %w", err)
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			log.Warn().Err(err).Msg("failed to unlock the migrations")
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER     PRIMARY KEY,
+		name       TEXT        NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("failed to create the migrations table: %w", err)
+	}
+
+	rows, err := conn.Query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return fmt.Errorf("failed to query the applied migrations: %w", err)
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return fmt.Errorf("failed to read the applied migrations: %w", err)
+	}
+	applied := map[int]bool{}
+	for _, version := range versions {
+		applied[version] = true
+	}
+
+	for _, migration := range migrations {
+		if applied[migration.version] {
+			continue
+		}
+
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, migration.sql); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.version, migration.name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply the migration %s: %w", migration.name, err)
+		}
+		log.Info().Str("migration", migration.name).Msg("applied migration")
+	}
+
+	if err := m.applyRawRetention(ctx, conn); err != nil {
+		return err
+	}
+
+	m.migrated = true
+	return nil
+}
+
+// applyRawRetention replaces the retention policy of the raw measurements with one dropping them
+// after the raw retention of the rollup policy, or removes it when that's 0, which reads every
+// range past the present from the rollups already.
+func (m *TimescaleMeasurementRepository) applyRawRetention(ctx context.Context, conn *pgxpool.Conn) error {
+	err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT remove_retention_policy('measurements', if_exists => true)"); err != nil {
+			return err
+		}
+		if m.rollup.rawRetention <= 0 {
+			return nil
+		}
+		_, err := tx.Exec(ctx, "SELECT add_retention_policy('measurements', drop_after => make_interval(secs => $1))", m.rollup.rawRetention.Seconds())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to apply the raw retention: %w", err)
+	}
+	return nil
+}
+
+// query records the query on the span of the context and runs it.
+func (m *TimescaleMeasurementRepository) query(ctx context.Context, query string, args ...any) (pgx.Rows, error) {
+	log.Debug().Str("query", query).Msg("executing query")
+	recordQuery(ctx, "postgresql", query)
+	return m.pool.Query(ctx, query, args...)
+}
+
+// sqlWhere builds the conditions of a query, the values being passed as parameters. Each %s of a
+// condition is replaced by the placeholder of the next of its arguments.
+type sqlWhere struct {
+	conditions []string
+	args       []any
+}
+
+func (w *sqlWhere) add(condition string, args ...any) {
+	placeholders := make([]any, 0, len(args))
+	for _, arg := range args {
+		w.args = append(w.args, arg)
+		placeholders = append(placeholders, "$"+strconv.Itoa(len(w.args)))
+	}
+	w.conditions = append(w.conditions, fmt.Sprintf(condition, placeholders...))
+}
+
+// arg adds an argument without a condition, returning its placeholder.
+func (w *sqlWhere) arg(arg any) string {
+	w.args = append(w.args, arg)
+	return "$" + strconv.Itoa(len(w.args))
+}
+
+func (w *sqlWhere) String() string {
+	return strings.Join(w.conditions, " AND ")
+}
+
+// seriesWhere matches the points of the sensors within the range, the measurement and the unit
+// being optional. PostgreSQL keeping the times to the microsecond, the end of the range is
+// rounded up so a range ending a nanosecond after a point still matches it.
+func seriesWhere(column string, sensorIDs []string, measurement, unit string, start, end time.Time) *sqlWhere {
+	where := &sqlWhere{}
+	switch len(sensorIDs) {
+	case 0:
+	case 1:
+		where.add("sensor_id = %s", sensorIDs[0])
+	default:
+		where.add("sensor_id = ANY(%s)", sensorIDs)
+	}
+	if measurement != "" {
+		where.add("measurement = %s", measurement)
+	}
+	if unit != "" {
+		where.add("unit = %s", unit)
+	}
+	where.add(column+" >= %s", start.Truncate(time.Microsecond))
+	where.add(column+" < %s", end.Add(time.Microsecond-time.Nanosecond).Truncate(time.Microsecond))
+	return where
+}
+
+// labelCondition translates a requirement to a condition on the labels column.
+func labelCondition(where *sqlWhere, requirement label.Requirement) {
+	switch requirement.Operator {
+	case label.OperatorNotEquals:
+		where.add("labels->>%s IS DISTINCT FROM %s", requirement.Key, requirement.Value)
+	case label.OperatorExists:
+		where.add("labels ? %s", requirement.Key)
+	case label.OperatorNotExists:
+		where.add("NOT labels ? %s", requirement.Key)
+	default:
+		where.add("labels @> jsonb_build_object(%s::text, %s::text)", requirement.Key, requirement.Value)
+	}
+}
+
+func (m *TimescaleMeasurementRepository) CreateMeasurement(ctx context.Context, measurement *Measurement) (err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "CreateMeasurement", append(sensorAttributes(measurement.SensorID), attribute.String("measurement.name", measurement.Name))...)
+	defer func() { finish(err) }()
+
+	timestamp := time.Now().Truncate(time.Microsecond)
+	point := *measurement
+	point.Timestamp = timestamp
+	if err := m.insert(ctx, []*Measurement{&point}); err != nil {
+		return fmt.Errorf("failed to write the measurement point: %w", err)
+	}
+
+	measurement.Timestamp = timestamp
+	metrics.AddMeasurementsWritten(StorageTimescaleDB, 1)
+
+	return nil
+}
+
+func (m *TimescaleMeasurementRepository) CreateMeasurements(ctx context.Context, measurements []*Measurement) (err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "CreateMeasurements", attribute.Int("measurement.count", len(measurements)))
+	defer func() { finish(err) }()
+
+	if err := m.insert(ctx, measurements); err != nil {
+		if timescaleRejected(err) {
+			err = rejected(err)
+		}
+		return fmt.Errorf("failed to write the measurement points: %w", err)
+	}
+
+	metrics.AddMeasurementsWritten(StorageTimescaleDB, len(measurements))
+
+	return nil
+}
+
+// timescaleRejected tells apart the writes PostgreSQL refused for good, the ones raising a data
+// exception, such as a value out of range, or breaking an integrity constraint.
+func timescaleRejected(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
+
+// insert writes the measurements with a single statement, replacing the points of their series at
+// the same time. Only the last of the measurements of a batch at the same time is kept, as an
+// upsert can't change a row twice.
+func (m *TimescaleMeasurementRepository) insert(ctx context.Context, measurements []*Measurement) error {
+	type pointKey struct {
+		sensorID, measurement, unit string
+		timestamp                   time.Time
+	}
+	indexes := map[pointKey]int{}
+	var (
+		timestamps   []time.Time
+		sensorIDs    []string
+		names        []string
+		units        []string
+		values       []float64
+		labelsValues []string
+	)
+	for _, measurement := range measurements {
+		// Empty labels aren't kept, as InfluxDB doesn't keep empty tags
+		labels := map[string]string{}
+		for key, value := range measurement.Labels {
+			if value != "" {
+				labels[key] = value
+			}
+		}
+		encodedLabels, err := json.Marshal(labels)
+		if err != nil {
+			return err
+		}
+
+		timestamp := measurement.Timestamp.Truncate(time.Microsecond)
+		key := pointKey{measurement.SensorID, measurement.Name, measurement.Unit, timestamp.UTC()}
+		if i, ok := indexes[key]; ok {
+			values[i] = measurement.Value
+			labelsValues[i] = string(encodedLabels)
+			continue
+		}
+		indexes[key] = len(timestamps)
+		timestamps = append(timestamps, timestamp)
+		sensorIDs = append(sensorIDs, measurement.SensorID)
+		names = append(names, measurement.Name)
+		units = append(units, measurement.Unit)
+		values = append(values, measurement.Value)
+		labelsValues = append(labelsValues, string(encodedLabels))
+	}
+
+	const query = `INSERT INTO measurements (time, sensor_id, measurement, unit, value, labels)
+		SELECT time, sensor_id, measurement, unit, value, labels::jsonb
+		FROM unnest($1::timestamptz[], $2::text[], $3::text[], $4::text[], $5::float8[], $6::text[])
+			AS point(time, sensor_id, measurement, unit, value, labels)
+		ON CONFLICT (sensor_id, measurement, unit, time) DO UPDATE SET value = excluded.value, labels = excluded.labels`
+
+	log.Debug().Int("count", len(timestamps)).Msg("writing measurements")
+	recordQuery(ctx, "postgresql", query)
+	_, err := m.pool.Exec(ctx, query, timestamps, sensorIDs, names, units, values, labelsValues)
+	return err
+}
+
+func (m *TimescaleMeasurementRepository) GetMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (_ []*Measurement, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurements", seriesAttributes([]string{sensorID}, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	where := seriesWhere("time", []string{sensorID}, measurement, unit, start, end)
+	query := fmt.Sprintf(`SELECT time, value FROM measurements WHERE %s ORDER BY time LIMIT %s`, where, where.arg(m.maxPoints+1))
+
+	rows, err := m.query(ctx, query, where.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurements: %w", err)
+	}
+	defer rows.Close()
+
+	measurements := []*Measurement{}
+	for rows.Next() {
+		if len(measurements) == m.maxPoints {
+			return nil, &TooManyPointsError{Max: m.maxPoints}
+		}
+
+		point := &Measurement{Name: measurement, SensorID: sensorID, Unit: unit}
+		if err := rows.Scan(&point.Timestamp, &point.Value); err != nil {
+			return nil, fmt.Errorf("failed to read measurement: %w", err)
+		}
+		measurements = append(measurements, point)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", rows.Err())
+	}
+
+	return measurements, nil
+}
+
+func (m *TimescaleMeasurementRepository) GetMeasurementTimestamps(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (_ []time.Time, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurementTimestamps", seriesAttributes([]string{sensorID}, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	where := seriesWhere("time", []string{sensorID}, measurement, unit, start, end)
+	rows, err := m.query(ctx, fmt.Sprintf(`SELECT time FROM measurements WHERE %s ORDER BY time`, where), where.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurement timestamps: %w", err)
+	}
+
+	timestamps, err := pgx.CollectRows(rows, pgx.RowTo[time.Time])
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+
+	return timestamps, nil
+}
+
+func (m *TimescaleMeasurementRepository) StreamMeasurements(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time, fn func(*Measurement) error) (err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "StreamMeasurements", seriesAttributes(sensorIDs, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	if len(sensorIDs) == 0 {
+		return nil
+	}
+
+	where := seriesWhere("time", sensorIDs, measurement, unit, start, end)
+	query := fmt.Sprintf(`SELECT measurement, sensor_id, unit, value, time FROM measurements WHERE %s
+		ORDER BY measurement, sensor_id, unit, time`, where)
+
+	rows, err := m.query(ctx, query, where.args...)
+	if err != nil {
+		return fmt.Errorf("failed to query measurements: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		point := &Measurement{}
+		if err := rows.Scan(&point.Name, &point.SensorID, &point.Unit, &point.Value, &point.Timestamp); err != nil {
+			return fmt.Errorf("failed to read measurement: %w", err)
+		}
+		if err := fn(point); err != nil {
+			return err
+		}
+	}
+	if rows.Err() != nil {
+		return fmt.Errorf("query error: %w", rows.Err())
+	}
+
+	return nil
+}
+
+func (m *TimescaleMeasurementRepository) GetSensorValues(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time, fn string) (_ map[string]float64, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetSensorValues", append(seriesAttributes(sensorIDs, measurement, unit, start, end), attribute.String("query.fn", fn))...)
+	defer func() { finish(err) }()
+
+	values := map[string]float64{}
+	if len(sensorIDs) == 0 {
+		return values, nil
+	}
+
+	aggregate, err := sqlAggregate(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	where := seriesWhere("time", sensorIDs, measurement, unit, start, end)
+	query := fmt.Sprintf(`SELECT sensor_id, %s FROM measurements WHERE %s GROUP BY sensor_id`, aggregate, where)
+
+	rows, err := m.query(ctx, query, where.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sensor values: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sensorID string
+		var value float64
+		if err := rows.Scan(&sensorID, &value); err != nil {
+			return nil, fmt.Errorf("failed to read sensor value: %w", err)
+		}
+		values[sensorID] = value
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", rows.Err())
+	}
+
+	return values, nil
+}
+
+func (m *TimescaleMeasurementRepository) GetMeasurementsByLabels(ctx context.Context, selector label.Selector, measurement, unit string, start, end time.Time) (_ []*Measurement, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurementsByLabels", append(seriesAttributes(nil, measurement, unit, start, end), attribute.String("label.selector", selector.String()))...)
+	defer func() { finish(err) }()
+
+	where := seriesWhere("time", nil, measurement, unit, start, end)
+	for _, requirement := range selector {
+		labelCondition(where, requirement)
+	}
+	query := fmt.Sprintf(`SELECT measurement, sensor_id, unit, value, time, labels FROM measurements WHERE %s
+		ORDER BY measurement, sensor_id, unit, time LIMIT %s`, where, where.arg(m.maxPoints+1))
+
+	rows, err := m.query(ctx, query, where.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurements: %w", err)
+	}
+	defer rows.Close()
+
+	measurements := []*Measurement{}
+	for rows.Next() {
+		if len(measurements) == m.maxPoints {
+			return nil, &TooManyPointsError{Max: m.maxPoints}
+		}
+
+		point := &Measurement{}
+		if err := rows.Scan(&point.Name, &point.SensorID, &point.Unit, &point.Value, &point.Timestamp, &point.Labels); err != nil {
+			return nil, fmt.Errorf("failed to read measurement: %w", err)
+		}
+		measurements = append(measurements, point)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", rows.Err())
+	}
+
+	return measurements, nil
+}
+
+// GetAggregatedMeasurements windows the series by every, aligned on the Unix epoch, and stamps
+// each window with its end, or the end of the range for the last one, as InfluxDB does.
+func (m *TimescaleMeasurementRepository) GetAggregatedMeasurements(ctx context.Context, sensorID, measurement, unit string, start, end time.Time, every time.Duration, fn string) (_ []*Measurement, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetAggregatedMeasurements", append(seriesAttributes([]string{sensorID}, measurement, unit, start, end), attribute.String("query.every", every.String()), attribute.String("query.fn", fn))...)
+	defer func() { finish(err) }()
+
+	table, column, aggregate := "measurements", "time", sqlAggregates[fn]
+	if resolution, ok := m.rollup.resolution(start, end); ok && every%resolution == 0 && rollupAggregates[fn] {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("rollup.resolution", resolution.String()))
+		table, column, aggregate = rollupViews[resolution], "bucket", sqlRollupAggregates[fn]
+	} else if _, err := sqlAggregate(fn); err != nil {
+		return nil, err
+	}
+
+	where := seriesWhere(column, []string{sensorID}, measurement, unit, start, end)
+	everyArg, endArg := where.arg(every), where.arg(end)
+	query := fmt.Sprintf(`SELECT least(time_bucket(%[1]s, %[2]s, TIMESTAMPTZ 'epoch') + %[1]s, %[3]s) AS window_end, %[4]s
+		FROM %[5]s WHERE %[6]s GROUP BY window_end ORDER BY window_end`, everyArg, column, endArg, aggregate, table, where)
+
+	rows, err := m.query(ctx, query, where.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query aggregated measurements: %w", err)
+	}
+	defer rows.Close()
+
+	measurements := []*Measurement{}
+	for rows.Next() {
+		point := &Measurement{Name: measurement, SensorID: sensorID, Unit: unit}
+		if err := rows.Scan(&point.Timestamp, &point.Value); err != nil {
+			return nil, fmt.Errorf("failed to read aggregated measurement: %w", err)
+		}
+		measurements = append(measurements, point)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query error: %w", rows.Err())
+	}
+
+	return measurements, nil
+}
+
+// GetMeasurementSummary reads the raw measurements or, for the ranges the rollup policy sends to
+// the rollups, the continuous aggregates over the whole buckets of the range and the raw
+// measurements over the partial ones at its ends. Unlike with InfluxDB, the recent part of the
+// range doesn't need to be read apart, the continuous aggregates being up to date.
+func (m *TimescaleMeasurementRepository) GetMeasurementSummary(ctx context.Context, sensorID, measurement, unit string, start, end time.Time) (_ *MeasurementSummary, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetMeasurementSummary", seriesAttributes([]string{sensorID}, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	return m.getMeasurementSummary(ctx, []string{sensorID}, measurement, unit, start, end)
+}
+
+func (m *TimescaleMeasurementRepository) GetSensorsMeasurementSummary(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time) (_ *MeasurementSummary, err error) {
+	ctx, finish := instrument(ctx, measurementRepositoryName, "GetSensorsMeasurementSummary", seriesAttributes(sensorIDs, measurement, unit, start, end)...)
+	defer func() { finish(err) }()
+
+	if len(sensorIDs) == 0 {
+		return &MeasurementSummary{Unit: unit}, nil
+	}
+	return m.getMeasurementSummary(ctx, sensorIDs, measurement, unit, start, end)
+}
+
+func (m *TimescaleMeasurementRepository) getMeasurementSummary(ctx context.Context, sensorIDs []string, measurement, unit string, start, end time.Time) (*MeasurementSummary, error) {
+	if !end.After(start) {
+		return nil, fmt.Errorf("failed to query measurement summary: %w", errEmptyRange)
+	}
+
+	// The median of the rollups is approximated from the means of their windows
+	raw := func(start, end time.Time) (*MeasurementSummary, error) {
+		return m.querySummary(ctx, "measurements", "time", `count(*),
+			coalesce(min(value), 0),
+			coalesce(max(value), 0),
+			coalesce(avg(value), 0),
+			coalesce(percentile_cont(0.5) WITHIN GROUP (ORDER BY value), 0)`, sensorIDs, measurement, unit, start, end)
+	}
+	resolution, ok := m.rollup.resolution(start, end)
+	if !ok {
+		return raw(start, end)
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("rollup.resolution", resolution.String()))
+	rollup := func(start, end time.Time) (*MeasurementSummary, error) {
+		return m.querySummary(ctx, rollupViews[resolution], "bucket", `coalesce(sum(count), 0)::bigint,
+			coalesce(min(min_value), 0),
+			coalesce(max(max_value), 0),
+			coalesce(sum(mean_value * count) / nullif(sum(count), 0), 0),
+			coalesce(percentile_cont(0.5) WITHIN GROUP (ORDER BY mean_value), 0)`, sensorIDs, measurement, unit, start, end)
+	}
+	return summarizeRollups(start, end, end, resolution, raw, rollup)
+}
+
+// querySummary summarizes the series of the table within the range with the aggregates, which
+// must select the count, min, max, mean and median in that order.
+func (m *TimescaleMeasurementRepository) querySummary(ctx context.Context, table, column, aggregates string, sensorIDs []string, measurement, unit string, start, end time.Time) (*MeasurementSummary, error) {
+	where := seriesWhere(column, sensorIDs, measurement, unit, start, end)
+	rows, err := m.query(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE %s`, aggregates, table, where), where.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurement summary: %w", err)
+	}
+
+	summary, err := pgx.CollectExactlyOneRow(rows, func(row pgx.CollectableRow) (MeasurementSummary, error) {
+		var summary MeasurementSummary
+		err := row.Scan(&summary.Count, &summary.MinValue, &summary.MaxValue, &summary.MeanValue, &summary.MedianValue)
+		return summary, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurement summary: %w", err)
+	}
+	if summary.Count > 0 {
+		summary.Unit = unit
+	}
+
+	return &summary, nil
+}
@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/label"
+)
+
+func TestTimescale(t *testing.T) {
+	t.Parallel()
+
+	t.Run("when conditions are added, it should number their placeholders in order", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		end := start.Add(time.Hour + 1500*time.Nanosecond)
+		where := seriesWhere("time", []string{"a", "b"}, "temperature", "", start, end)
+		limit := where.arg(10)
+
+		is.Equal("sensor_id = ANY($1) AND measurement = $2 AND time >= $3 AND time < $4", where.String())
+		is.Equal("$5", limit)
+		is.Equal([]any{[]string{"a", "b"}, "temperature", start, start.Add(time.Hour + 2*time.Microsecond), 10}, where.args)
+	})
+
+	t.Run("when a label selector is translated, it should pass its keys and values as parameters", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		selector, err := label.ParseSelector(`site=north,floor!=1,env,!retired`)
+		is.Nil(err)
+
+		where := &sqlWhere{}
+		for _, requirement := range selector {
+			labelCondition(where, requirement)
+		}
+
+		is.Equal("labels @> jsonb_build_object($1::text, $2::text) AND labels->>$3 IS DISTINCT FROM $4 AND labels ? $5 AND NOT labels ? $6", where.String())
+		is.Equal([]any{"site", "north", "floor", "1", "env", "retired"}, where.args)
+	})
+
+	t.Run("when a summary reads the rollups, it should read the partial windows at its ends raw", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		start := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+		end := time.Date(2024, 1, 1, 14, 15, 0, 0, time.UTC)
+		var raws, rollups [][2]time.Time
+		summarize := func(ranges *[][2]time.Time, count int) func(start, end time.Time) (*MeasurementSummary, error) {
+			return func(start, end time.Time) (*MeasurementSummary, error) {
+				*ranges = append(*ranges, [2]time.Time{start, end})
+				return &MeasurementSummary{Count: count, MeanValue: 1}, nil
+			}
+		}
+
+		summary, err := summarizeRollups(start, end, end, time.Hour, summarize(&raws, 1), summarize(&rollups, 3))
+		is.Nil(err)
+		is.Equal(5, summary.Count)
+		is.Equal([][2]time.Time{{start.Add(30 * time.Minute), end.Add(-15 * time.Minute)}}, rollups)
+		is.Equal([][2]time.Time{{start, start.Add(30 * time.Minute)}, {end.Add(-15 * time.Minute), end}}, raws)
+
+		// Within a single window, there's nothing whole to read from the rollups
+		raws, rollups = nil, nil
+		_, err = summarizeRollups(start, start.Add(20*time.Minute), end, time.Hour, summarize(&raws, 1), summarize(&rollups, 3))
+		is.Nil(err)
+		is.Empty(rollups)
+		is.Equal([][2]time.Time{{start, start.Add(20 * time.Minute)}}, raws)
+	})
+
+	t.Run("when the migrations are loaded, it should sort them by their distinct versions", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		migrations, err := loadMigrations()
+		is.Nil(err)
+		is.NotEmpty(migrations)
+		for i, migration := range migrations {
+			is.Equal(i+1, migration.version)
+			is.NotEmpty(migration.sql)
+		}
+	})
+
+	t.Run("when a function is aggregated, it should accept the same functions as the Flux queries", func(t *testing.T) {
+		t.Parallel()
+		is := require.New(t)
+
+		for fn := range fluxFunctions {
+			_, err := sqlAggregate(fn)
+			is.Nil(err, fn)
+		}
+		is.Len(sqlAggregates, len(fluxFunctions))
+
+		_, err := sqlAggregate("stddev")
+		is.ErrorContains(err, `unsupported function: "stddev"`)
+
+		for fn := range rollupAggregates {
+			is.Contains(sqlRollupAggregates, fn)
+		}
+	})
+}
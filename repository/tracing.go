@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrument starts the span of a call to a repository method and returns the function that
+// ends it and records the call in the metrics once the method returns its error.
+func instrument(ctx context.Context, repository, method string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, repository+"."+method, attrs...)
+	return ctx, func(err error) {
+		observe(repository, method, start, err)
+		endSpan(span, err)
+	}
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if isFailure(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// recordQuery adds a query to the span of the context, the databases having no tracing of their
+// own. system is the database, such as influxdb or postgresql.
+func recordQuery(ctx context.Context, system, query string) {
+	trace.SpanFromContext(ctx).AddEvent(system+".query", trace.WithAttributes(
+		attribute.String("db.system", system),
+		attribute.String("db.query.text", query),
+	))
+}
+
+func sensorAttributes(sensorID string) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("sensor.id", sensorID)}
+}
+
+// seriesAttributes describe a query of the series of one sensor or, when sensorIDs has more than
+// one ID, of many sensors, which are counted rather than listed.
+func seriesAttributes(sensorIDs []string, measurement, unit string, start, end time.Time) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("measurement.name", measurement),
+		attribute.String("measurement.unit", unit),
+		attribute.String("query.start", start.Format(time.RFC3339)),
+		attribute.String("query.end", end.Format(time.RFC3339)),
+		attribute.String("query.range", end.Sub(start).String()),
+	}
+	if len(sensorIDs) == 1 {
+		return append(attrs, sensorAttributes(sensorIDs[0])...)
+	}
+	return append(attrs, attribute.Int("sensor.count", len(sensorIDs)))
+}
@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TrackPoint is a time-stamped position reported by a mobile sensor.
+type TrackPoint struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	SensorID  primitive.ObjectID `bson:"sensor_id" json:"sensor_id"`
+	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+	Location  GeoJSONPoint       `bson:"location" json:"location"`
+	Altitude  *float64           `bson:"altitude,omitempty" json:"altitude,omitempty"`
+}
+
+// TracksRepository records the positions of the sensors and moves them, detecting the geofences
+// they enter and exit.
+type TracksRepository interface {
+	// RecordLocation adds the point to the track of its sensor and, unless the sensor already has
+	// a more recent point, moves the sensor there. It returns the enter and exit events of the
+	// move, which are also stored.
+	RecordLocation(ctx context.Context, point *TrackPoint) ([]*GeofenceEvent, error)
+	// GetTrack returns the points of the sensor within the time range, oldest first.
+	GetTrack(ctx context.Context, sensorID primitive.ObjectID, start, end time.Time) ([]*TrackPoint, error)
+}
+
+type MongoTracksRepository struct {
+	tracksColl          *mongo.Collection
+	sensorsRepository   SensorsRepository
+	geofencesRepository GeofencesRepository
+}
+
+func NewMongoTracksRepository(envVars *config.EnvVars, mongoClient *mongo.Client, sensorsRepository SensorsRepository, geofencesRepository GeofencesRepository) (TracksRepository, error) {
+	tracksColl := mongoClient.Database(envVars.MongoDB.Database).Collection("sensor_tracks")
+	_, err := tracksColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "sensor_id", Value: 1}, {Key: "timestamp", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoTracksRepository{
+		tracksColl:          tracksColl,
+		sensorsRepository:   sensorsRepository,
+		geofencesRepository: geofencesRepository,
+	}, nil
+}
+
+// RecordLocation adds the point to the track of its sensor and, unless the sensor already has a
+// more recent point, moves the sensor there. It returns the enter and exit events of the move,
+// which are also stored. Points reported again for the same time replace the previous ones.
+func (t *MongoTracksRepository) RecordLocation(ctx context.Context, point *TrackPoint) ([]*GeofenceEvent, error) {
+	_, err := t.tracksColl.ReplaceOne(ctx,
+		bson.M{"sensor_id": point.SensorID, "timestamp": point.Timestamp},
+		point,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record track point: %w", err)
+	}
+
+	return moveSensor(ctx, point, t.sensorsRepository, t.geofencesRepository)
+}
+
+// moveSensor moves the sensor of the point there through the sensors repository, so the move is
+// versioned and replicated like the other updates, and stores the geofence events of the move.
+func moveSensor(ctx context.Context, point *TrackPoint, sensorsRepository SensorsRepository, geofencesRepository GeofencesRepository) ([]*GeofenceEvent, error) {
+	geofences, err := geofencesRepository.GetGeofencesContaining(ctx, point.Location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get geofences: %w", err)
+	}
+	geofenceIDs := make([]primitive.ObjectID, 0, len(geofences))
+	for _, geofence := range geofences {
+		geofenceIDs = append(geofenceIDs, geofence.ID)
+	}
+
+	// The geofences the sensor is within are kept along with its location, so the events are
+	// found from the ones left by the previous move
+	before, err := sensorsRepository.MoveSensor(ctx, point.SensorID.Hex(), &SensorFix{
+		Location:    point.Location,
+		Altitude:    point.Altitude,
+		Timestamp:   point.Timestamp,
+		GeofenceIDs: geofenceIDs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to move sensor: %w", err)
+	}
+	if before == nil {
+		// The point arrived late, the sensor has already moved on
+		return []*GeofenceEvent{}, nil
+	}
+
+	events := []*GeofenceEvent{}
+	for _, geofence := range geofences {
+		if !slices.Contains(before.GeofenceIDs, geofence.ID) {
+			events = append(events, newGeofenceEvent(point, geofence, GeofenceEventEnter))
+		}
+	}
+	var exitedIDs []primitive.ObjectID
+	for _, id := range before.GeofenceIDs {
+		if !slices.Contains(geofenceIDs, id) {
+			exitedIDs = append(exitedIDs, id)
+		}
+	}
+	// Geofences deleted in the meantime are skipped
+	exited, err := geofencesRepository.GetGeofencesByIDs(ctx, exitedIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exited geofences: %w", err)
+	}
+	for _, geofence := range exited {
+		events = append(events, newGeofenceEvent(point, geofence, GeofenceEventExit))
+	}
+
+	if err := geofencesRepository.SaveEvents(ctx, events); err != nil {
+		return nil, fmt.Errorf("sensor moved but failed to save geofence events: %w", err)
+	}
+	return events, nil
+}
+
+func newGeofenceEvent(point *TrackPoint, geofence *Geofence, eventType string) *GeofenceEvent {
+	return &GeofenceEvent{
+		SensorID:     point.SensorID,
+		GeofenceID:   geofence.ID,
+		GeofenceName: geofence.Name,
+		Type:         eventType,
+		Timestamp:    point.Timestamp,
+		Location:     point.Location,
+	}
+}
+
+// GetTrack returns the points of the sensor within the time range, oldest first.
+func (t *MongoTracksRepository) GetTrack(ctx context.Context, sensorID primitive.ObjectID, start, end time.Time) ([]*TrackPoint, error) {
+	cursor, err := t.tracksColl.Find(ctx,
+		bson.M{"sensor_id": sensorID, "timestamp": bson.M{"$gte": start, "$lt": end}},
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	points := []*TrackPoint{}
+	if err := cursor.All(ctx, &points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
@@ -0,0 +1,142 @@
+package rollup
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+// Maximum number of windows rolled up by a single query, so catching up after a long pause
+// doesn't turn into one huge query
+const maxWindowsPerRun = 48
+
+// Roller periodically rolls the completed windows of the raw bucket up into the rollup bucket,
+// for every resolution, for the backends whose rollups aren't maintained by the database.
+type Roller struct {
+	rollupWriter                repository.RollupWriter
+	rollupCheckpointsRepository repository.RollupCheckpointsRepository
+	enabled                     bool
+	interval                    time.Duration
+	rawRetention                time.Duration
+	resolutions                 []time.Duration
+}
+
+// NewRoller returns a roller that is only enabled when the repository is a RollupWriter with its
+// rollups configured, the other backends maintaining their rollups on their own.
+func NewRoller(envVars *config.EnvVars, measurementRepository repository.MeasurementRepository, rollupCheckpointsRepository repository.RollupCheckpointsRepository) *Roller {
+	rollupWriter, ok := measurementRepository.(repository.RollupWriter)
+	return &Roller{
+		rollupWriter:                rollupWriter,
+		rollupCheckpointsRepository: rollupCheckpointsRepository,
+		enabled:                     ok && rollupWriter.RollupsEnabled(),
+		interval:                    envVars.Rollup.Interval,
+		rawRetention:                envVars.Rollup.RawRetention,
+		resolutions:                 []time.Duration{repository.RollupHourly, repository.RollupDaily},
+	}
+}
+
+func (r *Roller) Enabled() bool {
+	return r.enabled
+}
+
+// Run rolls up at every interval until the context is cancelled.
+func (r *Roller) Run(ctx context.Context) error {
+	if err := r.rollupWriter.PrepareRollups(ctx); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.RunOnce(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to roll up measurements")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce rolls up every completed window since the last watermark of each resolution. On the
+// first run it starts from the oldest data still in the raw bucket. The spool replay, the imports
+// and the replication write measurements behind the watermark, so it is first moved back to the
+// window of the earliest measurement written since the previous run, to roll that window and the
+// ones after it up again.
+func (r *Roller) RunOnce(ctx context.Context) error {
+	now := time.Now()
+	if err := r.rewind(ctx, now, r.rollupWriter.TakeEarliestWrite()); err != nil {
+		return err
+	}
+
+	for _, resolution := range r.resolutions {
+		watermark, err := r.rollupCheckpointsRepository.GetWatermark(ctx, resolution)
+		if err != nil {
+			return err
+		}
+		if watermark.IsZero() {
+			watermark = now.Add(-r.rawRetention).Truncate(resolution)
+		}
+
+		target := now.Truncate(resolution)
+		for watermark.Before(target) {
+			end := watermark.Add(maxWindowsPerRun * resolution)
+			if end.After(target) {
+				end = target
+			}
+
+			if err := r.rollupWriter.RollupMeasurements(ctx, resolution, watermark, end); err != nil {
+				return err
+			}
+			if err := r.rollupCheckpointsRepository.SaveWatermark(ctx, resolution, end); err != nil {
+				return err
+			}
+
+			log.Debug().Stringer("resolution", resolution).Time("start", watermark).Time("end", end).Msg("rolled up measurements")
+			watermark = end
+		}
+	}
+
+	return nil
+}
+
+// rewind moves the watermarks past the earliest write back to its window, no further than the
+// raw retention. The watermarks are saved before rolling anything up, so the windows are still
+// rolled up again by the next run when this one fails.
+func (r *Roller) rewind(ctx context.Context, now, earliestWrite time.Time) error {
+	if earliestWrite.IsZero() {
+		return nil
+	}
+
+	for _, resolution := range r.resolutions {
+		watermark, err := r.rollupCheckpointsRepository.GetWatermark(ctx, resolution)
+		if err != nil {
+			return err
+		}
+		if watermark.IsZero() || !earliestWrite.Before(watermark) {
+			continue
+		}
+
+		rewound := earliestWrite.Truncate(resolution)
+		if oldest := now.Add(-r.rawRetention).Truncate(resolution); rewound.Before(oldest) {
+			rewound = oldest
+		}
+		if !rewound.Before(watermark) {
+			continue
+		}
+
+		if err := r.rollupCheckpointsRepository.SaveWatermark(ctx, resolution, rewound); err != nil {
+			return err
+		}
+
+		log.Info().Stringer("resolution", resolution).Time("from", watermark).Time("to", rewound).Msg("moved the rollup watermark back for measurements written late")
+	}
+
+	return nil
+}
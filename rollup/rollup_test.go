@@ -0,0 +1,164 @@
+package rollup
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/repository"
+)
+
+type rollupCall struct {
+	resolution time.Duration
+	start      time.Time
+	end        time.Time
+}
+
+type fakeRollupWriter struct {
+	mu            sync.Mutex
+	earliestWrite time.Time
+	calls         []rollupCall
+}
+
+func (f *fakeRollupWriter) RollupsEnabled() bool {
+	return true
+}
+
+func (f *fakeRollupWriter) PrepareRollups(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeRollupWriter) RollupMeasurements(ctx context.Context, resolution time.Duration, start, end time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, rollupCall{resolution: resolution, start: start, end: end})
+	return nil
+}
+
+func (f *fakeRollupWriter) TakeEarliestWrite() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	earliest := f.earliestWrite
+	f.earliestWrite = time.Time{}
+	return earliest
+}
+
+func (f *fakeRollupWriter) write(timestamp time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.earliestWrite.IsZero() || timestamp.Before(f.earliestWrite) {
+		f.earliestWrite = timestamp
+	}
+}
+
+// takeCalls returns the rollups of the resolution since the previous call.
+func (f *fakeRollupWriter) takeCalls(resolution time.Duration) []rollupCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []rollupCall
+	for _, call := range f.calls {
+		if call.resolution == resolution {
+			calls = append(calls, call)
+		}
+	}
+	f.calls = nil
+	return calls
+}
+
+type fakeCheckpoints struct {
+	mu         sync.Mutex
+	watermarks map[time.Duration]time.Time
+}
+
+func (f *fakeCheckpoints) GetWatermark(ctx context.Context, resolution time.Duration) (time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.watermarks[resolution], nil
+}
+
+func (f *fakeCheckpoints) SaveWatermark(ctx context.Context, resolution time.Duration, watermark time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.watermarks[resolution] = watermark
+	return nil
+}
+
+func newTestRoller(rawRetention time.Duration) (*Roller, *fakeRollupWriter, *fakeCheckpoints) {
+	writer := &fakeRollupWriter{}
+	checkpoints := &fakeCheckpoints{watermarks: map[time.Duration]time.Time{}}
+	return &Roller{
+		rollupWriter:                writer,
+		rollupCheckpointsRepository: checkpoints,
+		enabled:                     true,
+		interval:                    time.Minute,
+		rawRetention:                rawRetention,
+		resolutions:                 []time.Duration{repository.RollupHourly, repository.RollupDaily},
+	}, writer, checkpoints
+}
+
+func TestRunOnce(t *testing.T) {
+	t.Run("when it runs for the first time, it should roll up the windows since the raw retention", func(t *testing.T) {
+		is := require.New(t)
+		roller, writer, checkpoints := newTestRoller(6 * time.Hour)
+
+		is.NoError(roller.RunOnce(context.Background()))
+
+		now := time.Now()
+		calls := writer.takeCalls(repository.RollupHourly)
+		is.Len(calls, 1)
+		is.Equal(now.Add(-6*time.Hour).Truncate(time.Hour), calls[0].start)
+		is.Equal(now.Truncate(time.Hour), calls[0].end)
+		is.Equal(now.Truncate(time.Hour), checkpoints.watermarks[repository.RollupHourly])
+	})
+
+	t.Run("when nothing was written behind the watermark, it should not roll up the past windows again", func(t *testing.T) {
+		is := require.New(t)
+		roller, writer, _ := newTestRoller(6 * time.Hour)
+		is.NoError(roller.RunOnce(context.Background()))
+		writer.takeCalls(repository.RollupHourly)
+
+		writer.write(time.Now())
+		is.NoError(roller.RunOnce(context.Background()))
+
+		is.Empty(writer.takeCalls(repository.RollupHourly))
+	})
+
+	t.Run("when measurements are written behind the watermark, it should roll up their windows again", func(t *testing.T) {
+		is := require.New(t)
+		roller, writer, checkpoints := newTestRoller(6 * time.Hour)
+		is.NoError(roller.RunOnce(context.Background()))
+		writer.takeCalls(repository.RollupHourly)
+
+		late := time.Now().Add(-3 * time.Hour)
+		writer.write(time.Now().Add(-time.Hour))
+		writer.write(late)
+		is.NoError(roller.RunOnce(context.Background()))
+
+		now := time.Now()
+		calls := writer.takeCalls(repository.RollupHourly)
+		is.Len(calls, 1)
+		is.Equal(late.Truncate(time.Hour), calls[0].start)
+		is.Equal(now.Truncate(time.Hour), calls[0].end)
+		is.Equal(now.Truncate(time.Hour), checkpoints.watermarks[repository.RollupHourly])
+
+		// the earliest write is taken, so the next run doesn't roll the windows up again
+		is.NoError(roller.RunOnce(context.Background()))
+		is.Empty(writer.takeCalls(repository.RollupHourly))
+	})
+
+	t.Run("when measurements older than the raw retention are written, it should roll up again from the raw retention only", func(t *testing.T) {
+		is := require.New(t)
+		roller, writer, _ := newTestRoller(6 * time.Hour)
+		is.NoError(roller.RunOnce(context.Background()))
+		writer.takeCalls(repository.RollupHourly)
+
+		writer.write(time.Now().Add(-48 * time.Hour))
+		is.NoError(roller.RunOnce(context.Background()))
+
+		calls := writer.takeCalls(repository.RollupHourly)
+		is.Len(calls, 1)
+		is.Equal(time.Now().Add(-6*time.Hour).Truncate(time.Hour), calls[0].start)
+	})
+}
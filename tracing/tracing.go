@@ -0,0 +1,112 @@
+// Package tracing sets up OpenTelemetry tracing, exporting the spans to an OTLP collector or to a
+// file, and propagating the W3C trace context.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+const (
+	serverServiceName   = "pingthings-api"
+	instrumentationName = "github.com/zignd/pingthings-collaborative-technical-interview"
+)
+
+// Provider owns the tracer provider and the file its spans are exported to, if any.
+type Provider struct {
+	tracerProvider *sdktrace.TracerProvider
+	file           io.Closer
+}
+
+// NewProvider sets up the tracing of the API server.
+func NewProvider(envVars *config.EnvVars) (*Provider, error) {
+	return Setup(serverServiceName, envVars.Tracing)
+}
+
+// Setup makes the spans of the service go to the configured exporter and the trace context be
+// propagated in the traceparent and tracestate headers. Without an exporter, the trace context is
+// still propagated but no span is recorded.
+func Setup(serviceName string, cfg config.Tracing) (*Provider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	p := &Provider{}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return p, nil
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+		if cfg.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		var file *os.File
+		file, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open traces file: %w", err)
+		}
+		p.file = file
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter: %s", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build tracing resource: %w", err)
+	}
+
+	// Requests coming with a sampled trace context are always traced, so the traces of the clients
+	// aren't left with holes
+	p.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(p.tracerProvider)
+	return p, nil
+}
+
+// Shutdown exports the spans still buffered.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	var errs []error
+	if p.tracerProvider != nil {
+		errs = append(errs, p.tracerProvider.Shutdown(ctx))
+	}
+	if p.file != nil {
+		errs = append(errs, p.file.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Tracer returns the tracer of the service, spans started before Setup are dropped.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zignd/pingthings-collaborative-technical-interview/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetup(t *testing.T) {
+	t.Run("when the file exporter is set, it should write the spans to the file on shutdown", func(t *testing.T) {
+		is := require.New(t)
+
+		file := filepath.Join(t.TempDir(), "traces.jsonl")
+		provider, err := Setup("test", config.Tracing{Exporter: ExporterFile, File: file, SampleRatio: 1})
+		is.Nil(err)
+
+		_, span := Tracer().Start(context.Background(), "test span")
+		span.End()
+		is.Nil(provider.Shutdown(context.Background()))
+
+		content, err := os.ReadFile(file)
+		is.Nil(err)
+		is.Contains(string(content), `"Name":"test span"`)
+		is.Contains(string(content), `"Value":"test"`)
+	})
+
+	t.Run("when a request has a traceparent header, it should continue its trace", func(t *testing.T) {
+		is := require.New(t)
+
+		provider, err := Setup("test", config.Tracing{Exporter: ExporterFile, File: filepath.Join(t.TempDir(), "traces.jsonl"), SampleRatio: 0})
+		is.Nil(err)
+		defer provider.Shutdown(context.Background())
+
+		header := http.Header{}
+		header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(header))
+		_, span := Tracer().Start(ctx, "test span")
+		defer span.End()
+
+		// Sampled by the client, so it's recorded even though the sample ratio is 0
+		is.Equal("4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+		is.True(span.SpanContext().IsSampled())
+	})
+
+	t.Run("when there's no exporter, it should still propagate the trace context", func(t *testing.T) {
+		is := require.New(t)
+
+		provider, err := Setup("test", config.Tracing{Exporter: ExporterNone})
+		is.Nil(err)
+		is.Nil(provider.Shutdown(context.Background()))
+
+		spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{1},
+			TraceFlags: trace.FlagsSampled,
+		})
+		header := http.Header{}
+		otel.GetTextMapPropagator().Inject(trace.ContextWithSpanContext(context.Background(), spanContext), propagation.HeaderCarrier(header))
+		is.Equal("00-01000000000000000000000000000000-0100000000000000-01", header.Get("traceparent"))
+	})
+
+	t.Run("when the exporter is unknown, it should return an error", func(t *testing.T) {
+		is := require.New(t)
+
+		_, err := Setup("test", config.Tracing{Exporter: "zipkin"})
+		is.ErrorContains(err, "unsupported tracing exporter")
+	})
+}